@@ -11,7 +11,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 const (
@@ -21,6 +23,10 @@ const (
 	SecretEnvAccessKey  = "AWS_SECRET_ACCESS_KEY"
 	SecurityTokenEnvKey = "AWS_SECURITY_TOKEN"
 
+	WebIdentityTokenFileEnvKey = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	RoleARNEnvKey              = "AWS_ROLE_ARN"
+	RoleSessionNameEnvKey      = "AWS_ROLE_SESSION_NAME"
+
 	AWSMetadataServer = "169.254.169.254"
 	AWSIAMCredsPath   = "/latest/meta-data/iam/security-credentials"
 	AWSIAMCredsURL    = "http://" + AWSMetadataServer + "/" + AWSIAMCredsPath
@@ -216,6 +222,39 @@ func NewAWSDefaultAuth() *AuthAWS {
 	}
 }
 
+// NewAuthFromProfile creates an Auth using the credentials of the named profile in the shared
+// credentials file, ~/.aws/credentials unless the AWS_SHARED_CREDENTIALS_FILE env variable says
+// otherwise, so that tools can switch between profiles without juggling env variables. An empty
+// profile means the one named by the AWS_PROFILE env variable, or else "default". The file isn’t
+// read until the credentials are first needed, so a missing file or profile is reported then.
+func NewAuthFromProfile(profile string) *AuthAWS {
+	return &AuthAWS{
+		creds: credentials.NewSharedCredentials("", profile),
+	}
+}
+
+// NewAuthFromWebIdentity creates an Auth that assumes the role named by the AWS_ROLE_ARN env
+// variable using the web identity token in the file named by AWS_WEB_IDENTITY_TOKEN_FILE, as set
+// up for pods on EKS by IAM Roles for Service Accounts. AWS_ROLE_SESSION_NAME is optional. The
+// token file is re-read whenever the credentials expire, so rotated tokens are picked up by the
+// client’s usual renewal.
+func NewAuthFromWebIdentity() (*AuthAWS, error) {
+	tokenFile := os.Getenv(WebIdentityTokenFileEnvKey)
+	roleARN := os.Getenv(RoleARNEnvKey)
+	if tokenFile == "" || roleARN == "" {
+		return nil, fmt.Errorf("Both the %s and %s env variables must be set", WebIdentityTokenFileEnvKey, RoleARNEnvKey)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthAWS{
+		creds: stscreds.NewWebIdentityCredentials(sess, roleARN, os.Getenv(RoleSessionNameEnvKey), tokenFile),
+	}, nil
+}
+
 func (a *AuthAWS) GetToken() (string, error) {
 	value, err := a.creds.Get()
 	if err != nil {
@@ -1,7 +1,9 @@
 package kinesis
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -120,3 +122,61 @@ func TestNewAuthFromEnvWithFallbackVars(t *testing.T) {
 		t.Error("Expected SecretKey to be inferred as \"asdf2\"")
 	}
 }
+
+func TestNewAuthFromWebIdentityWithoutVars(t *testing.T) {
+	os.Unsetenv(WebIdentityTokenFileEnvKey)
+	os.Setenv(RoleARNEnvKey, "arn:aws:iam::123456789012:role/foo")
+	defer os.Unsetenv(RoleARNEnvKey)
+
+	auth, err := NewAuthFromWebIdentity()
+
+	if auth != nil {
+		t.Error("Expected auth instance to be nil but was non-nil")
+	}
+
+	if err == nil {
+		t.Error("Expected error to be non-nil but was nil")
+	}
+}
+
+func TestNewAuthFromProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "credentials")
+	contents := `[default]
+aws_access_key_id = default_key
+aws_secret_access_key = default_secret
+
+[dev]
+aws_access_key_id = dev_key
+aws_secret_access_key = dev_secret
+aws_session_token = dev_token
+`
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", file)
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	auth := NewAuthFromProfile("dev")
+
+	if swallowErr(auth.GetAccessKey()) != "dev_key" {
+		t.Error("Expected AccessKey to be read from the dev profile as \"dev_key\"")
+	}
+
+	if swallowErr(auth.GetSecretKey()) != "dev_secret" {
+		t.Error("Expected SecretKey to be read from the dev profile as \"dev_secret\"")
+	}
+
+	if swallowErr(auth.GetToken()) != "dev_token" {
+		t.Error("Expected SecurityToken to be read from the dev profile as \"dev_token\"")
+	}
+
+	if _, err := NewAuthFromProfile("missing").GetAccessKey(); err == nil {
+		t.Error("Expected error to be non-nil for a missing profile but was nil")
+	}
+}
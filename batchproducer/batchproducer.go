@@ -1,12 +1,17 @@
 package batchproducer
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"go.uber.org/zap"
 )
@@ -14,24 +19,124 @@ import (
 // MaxKinesisBatchSize is the maximum number of records that Kinesis accepts in a request
 const MaxKinesisBatchSize = 500
 
+// MaxRecordSize is the most Kinesis accepts for the data and partition key of a record combined.
+const MaxRecordSize = 1024 * 1024
+
+// MaxKinesisBatchBytes is the most Kinesis accepts for the data and partition keys of all the
+// records in a request combined.
+const MaxKinesisBatchBytes = 5 * 1024 * 1024
+
+// adaptiveBatchSizeFloor is the default of Config.MinBatchSize.
+const adaptiveBatchSizeFloor = 10
+
+// maxBufferedRecordsWithBufferBytes limits the number of records in the buffer when it is
+// measured in bytes, since the ring that holds them is allocated up front.
+const maxBufferedRecordsWithBufferBytes = 100000
+
+// createStreamPollInterval is how often Start checks whether a stream that it created, because of
+// Config.CreateStreamIfMissing, has become active.
+const createStreamPollInterval = 1 * time.Second
+
+// idleWarningFlushes is the number of flushes in a row that find the buffer empty, without
+// anything having been sent in between, after which an IdleWarningEvent is sent.
+const idleWarningFlushes = 100
+
+// statQueueSize is the number of StatsBatches that can be queued for the StatReceiver before the
+// oldest are dropped.
+const statQueueSize = 10
+
 // Producer collects records individually and then sends them to Kinesis in
 // batches in the background using PutRecords, with retries.
 // A Producer will do nothing until Start is called.
 type Producer interface {
-	// Start starts the main goroutine. No need to call it using `go`.
+	// Start starts the main goroutine. No need to call it using `go`. If Config.VerifyOnStart is
+	// true it first checks that the stream can be reached, and returns an error if not. If
+	// Config.CreateStreamIfMissing is true it first creates the stream if need be.
 	Start() error
 
+	// StartContext is like Start except that it gives up and returns ctx.Err() if the main
+	// goroutine hasn’t started by the time ctx is done, leaving the Producer stopped, rather than
+	// potentially waiting forever. It also returns an error if the main goroutine panics while
+	// setting up.
+	StartContext(ctx context.Context) error
+
 	// Stop signals the main goroutine to finish. Once this is called, Add will immediately start
-	// returning errors (unless and until Start is called again).
+	// returning errors (unless and until Start is called again). If Config.DrainOnStop is true it
+	// then sends the buffered records, as Flush does, and returns an *UnsentRecordsError if any
+	// are left.
 	Stop() error
 
+	// StopContext is like Stop except that it gives up waiting for the main goroutine to finish,
+	// e.g. because it is waiting for batches that are being sent, once ctx is done, and returns
+	// ctx.Err(). The Producer is stopped regardless, and the main goroutine finishes in the
+	// background; Done is closed once it has, and Start waits for that. If Config.DrainOnStop is
+	// true it also gives up sending the buffered records once ctx is done.
+	StopContext(ctx context.Context) error
+
 	// Add might block if the BatchProducer has a buffer and the buffer is full.
+	// It returns ErrRecordTooLarge if the data and partition key together exceed MaxRecordSize,
+	// unless Config.RecordSplitter can split the data into chunks that don’t.
 	// In order to prevent filling the buffer and eventually blocking indefinitely,
-	// Add will fail and return an error if the BatchProducer is stopped or stopping. Note
+	// Add will fail and return ErrNotRunning if the BatchProducer is stopped or stopping. Note
 	// that it’s critical to check the return value because the BatchProducer could have
 	// died in the background due to a panic (or something).
 	Add(data []byte, partitionKey string) error
 
+	// TryAdd is a fast path for hot loops: it is like Add except that it never blocks, even if
+	// AddBlocksWhenBufferFull is true, and rather than returning an error it returns false if the
+	// record was not added for any reason, e.g. because the buffer is full or the Producer is not
+	// running. Unlike Add it doesn’t allocate when it rejects a record, unless Config.WALDir or
+	// Config.SpillDir is set, in which case it logs or spills records just as Add does.
+	TryAdd(data []byte, partitionKey string) bool
+
+	// AddData is like Add except that the partition key is derived from data by
+	// Config.PartitionKeyFunc. It returns an error if PartitionKeyFunc is not set, or if it
+	// returns an error.
+	AddData(data []byte) error
+
+	// AddWithTTL is like Add except that if the record hasn’t been sent within ttl it is
+	// discarded rather than sent, and counted in StatsBatch.RecordsExpiredSinceLastStat. This is
+	// useful for time-sensitive data that would be useless if sent late, e.g. after recovering
+	// from a long outage. A ttl of 0 means the record never expires.
+	AddWithTTL(data []byte, partitionKey string, ttl time.Duration) error
+
+	// AddWithCallback is like Add except that cb will be called once the fate of the record is
+	// known. Once it has been written to Kinesis successfully, the result has the sequence number
+	// and shard ID Kinesis assigned it; if it was dropped, its Err says why. Either way Attempts
+	// says how many times it was sent, so retried records can be told apart. cb is not called if
+	// Add itself fails, nor for records that are still in the buffer when the Producer is stopped
+	// (unless and until they are sent later), nor for records returned by StopAndDrain.
+	// cb is called from one of the Producer’s own goroutines, possibly the main one, so it must be
+	// fast, must not block, and must not call any methods of the Producer.
+	AddWithCallback(data []byte, partitionKey string, cb func(result RecordResult)) error
+
+	// AddExplicit is like Add except that the record is sent to the shard whose hash key range
+	// contains explicitHashKey, a decimal integer between 0 and 2^128-1, rather than the one
+	// determined by hashing partitionKey. See ExplicitHashPartitioner.
+	AddExplicit(data []byte, partitionKey, explicitHashKey string) error
+
+	// AddWithAttributes is like Add except that attrs are sent along with data, wrapped in an
+	// envelope that consumers can unwrap with DecodeRecord. It returns ErrRecordTooLarge if the
+	// enveloped data and the partition key together exceed the Kinesis limit of 1 MiB.
+	AddWithAttributes(data []byte, partitionKey string, attrs map[string]string) error
+
+	// AddWithTimeout is like Add except that if the buffer is full it waits up to timeout for
+	// room, whatever Config.AddBlocksWhenBufferFull says, and then returns ErrAddTimeout. A timeout
+	// of 0 or less means not to wait at all.
+	AddWithTimeout(data []byte, partitionKey string, timeout time.Duration) error
+
+	// AddContext is like AddWithTimeout except that it waits for room in the buffer until ctx is
+	// done, and then returns ctx.Err(), so that a blocked Add can be cancelled.
+	AddContext(ctx context.Context, data []byte, partitionKey string) error
+
+	// AddAll adds the records received from ch, as AddExplicit would (so like Add for those
+	// without an ExplicitHashKey), until ch is closed, when it returns nil, or ctx is done, when it
+	// returns ctx.Err(). If adding a record fails it stops and returns the error, leaving the rest
+	// of ch unread. Whether it blocks when the buffer is full depends on
+	// Config.AddBlocksWhenBufferFull as for Add, and ctx being done doesn’t interrupt an Add that
+	// is blocked.
+	AddAll(ctx context.Context, ch <-chan Record) error
+
 	// Flush stops the Producer using Stop and attempts to send all buffered records to Kinesis as
 	// fast as possible with batches of size 500 (the maximum). It blocks until either all records
 	// are sent or the timeout expires. It returns the number of records still remaining in the
@@ -39,16 +144,130 @@ type Producer interface {
 	// signature for future-proofing.) A timeout value of 0 means no timeout.
 	// If Flush finishes sending all records without timing out, and sendStats is true, it will
 	// cause a single final StatsBatch to be sent to the StatsReceiver in Config, if set.
+	// Just before returning it sends a FlushCompleteEvent with the same results on Events, if
+	// there’s room for it.
+	// Flush is intended for shutdown; use Drain to empty the buffer while continuing to run.
 	Flush(timeout time.Duration, sendStats bool) (sent int, remaining int, err error)
 
-	// Events returns a channel for receiving Events such as errors from the Producer
+	// FlushContext is like Flush except that it gives up once ctx is done, rather than after a
+	// timeout, and then returns ctx.Err(). The PutRecords requests it sends are also cancelled
+	// when ctx is done, if the client is a ContextBatchingKinesisClient.
+	FlushContext(ctx context.Context, sendStats bool) (sent int, remaining int, err error)
+
+	// Drain is like Flush except that it does not stop the Producer: it attempts to send all
+	// buffered records to Kinesis as fast as possible with batches of size 500, blocking until
+	// either the buffer is empty or the timeout expires, and then the Producer carries on as
+	// before. This is useful for checkpointing. Records added while Drain is running may or may
+	// not be sent by it. A timeout value of 0 means no timeout.
+	Drain(timeout time.Duration) (sent int, remaining int, err error)
+
+	// FlushOrdered is like Flush except that it waits for the Producer to stop however long that
+	// takes, and it doesn’t send stats or a FlushCompleteEvent. It sends the buffered records in
+	// the order in which they were added and retries failed records immediately, in place, but so
+	// does Flush now, since failed records are always put back at the front of the buffer. Within
+	// a single batch Kinesis may write some records and not others, so a record can still be
+	// written after records that were added after it if it needed to be retried.
+	FlushOrdered(timeout time.Duration) (sent int, remaining int, err error)
+
+	// SendBatch sends records, at most MaxKinesisBatchSize of them, straight to Kinesis and waits
+	// for the outcome, bypassing the buffer and the main loop, for callers that want to know that
+	// one chunk of records has landed before moving on to the next. Failed records are retried
+	// much as buffered ones would be, according to MaxAttemptsPerRecord, ErrorClassifier and
+	// RetryBudget, with the same backoff after a failed request. PartitionKeyFunc and
+	// Encrypter are applied as by Add, but records too large to send are dropped rather than
+	// split. If the records add up to more than MaxKinesisBatchBytes they are sent in as many
+	// requests as it takes. It returns the fate of each record, and an error if any of them
+	// weren’t written, or ErrTooManyRecords. It can be called whether or not the Producer is
+	// running, and concurrently with it, but it doesn’t send Events or count towards stats, nor
+	// call the BeforeSend, AfterSend and OnPutRecords hooks.
+	SendBatch(records []Record) (BatchResult, error)
+
+	// Pause stops the Producer from sending batches to Kinesis, e.g. during a controlled failover
+	// or a maintenance window, until Resume is called, without stopping it: records can still be
+	// added, and accumulate in the buffer, subject to its limits as usual. A batch that is already
+	// being sent when Pause is called is sent anyway. Flush, Drain and FlushOrdered still send,
+	// since they are asked for explicitly. Pausing a paused Producer does nothing; otherwise a
+	// PausedEvent is sent on Events. The Producer stays paused across Stop and Start. It is safe
+	// to call at any time.
+	Pause()
+
+	// Resume undoes Pause, so that batches are sent again, and sends a ResumedEvent on Events.
+	// Resuming a Producer that isn’t paused does nothing. It is safe to call at any time.
+	Resume()
+
+	// StopAndDrain stops the Producer using Stop and, rather than trying to send the buffered
+	// records, removes them from the buffer and returns them in the order they would have been
+	// sent, so that the caller can persist them or forward them elsewhere, e.g. when Kinesis is
+	// unavailable at shutdown. Records whose TTL has expired are discarded as usual. The
+	// callbacks of the returned records are never called. It can be called whether or not the
+	// Producer is running. (It doesn’t currently return errors but that is in the signature for
+	// future-proofing.)
+	StopAndDrain() ([]Record, error)
+
+	// Events returns a channel for receiving Events such as errors from the Producer. It must be
+	// read from or the Producer will eventually block, unless Subscribe has been called: from
+	// then on Events that don’t fit in its buffer are discarded.
 	Events() <-chan Event
+
+	// Subscribe returns a channel that receives only the Events of the given types, until ctx is
+	// done, when the channel is closed. Like Events, it must be read from or the Producer will
+	// eventually block, until ctx is done. Events are sent to all the subscribed channels that
+	// want them as well as to Events.
+	Subscribe(ctx context.Context, types ...EventType) <-chan Event
+
+	// InFlight returns the number of records that have been taken from the buffer to be sent and
+	// are awaiting a PutRecords response. Failed records are put back at the front of the buffer as
+	// soon as the response is dealt with, and are counted there from then on. Together with the
+	// size of the buffer it tells how many records haven’t been dealt with yet, e.g. for
+	// accounting at shutdown. It is safe to call at any time.
+	InFlight() int
+
+	// State returns the current state of the Producer, e.g. for use by a health check. It is safe
+	// to call at any time.
+	State() ProducerState
+
+	// ShouldThrottle reports whether the buffer is filled beyond Config.HighWaterMark, as a hint
+	// that callers of Add should slow down before the buffer fills up entirely and Add starts to
+	// block or fail. It is purely advisory, and always false if HighWaterMark is 0.
+	ShouldThrottle() bool
+
+	// SetStreamName changes the stream that subsequent batches are sent to, without stopping the
+	// Producer or discarding any buffered records. It is safe to call while the Producer is
+	// running. Note that a batch that is already in flight when SetStreamName is called will
+	// still be sent to the old stream; records from that batch that fail and are retried will be
+	// sent to the new one. It returns an error if Config.StreamARN is set.
+	SetStreamName(name string) error
+
+	// StreamName returns the name of the stream that batches are currently sent to.
+	StreamName() string
+
+	// Reconfigure changes Config.BatchSize and Config.FlushInterval, e.g. to send smaller
+	// batches while shards are hot, without stopping the Producer or discarding any buffered
+	// records. The new values must satisfy the same rules as in New; if they don’t, an error is
+	// returned and nothing is changed. If the Producer is running the changes take effect
+	// straight away, with the flush interval starting afresh. It resets the effective batch size
+	// of Config.AdaptiveBatchSize to the new BatchSize.
+	Reconfigure(batchSize int, flushInterval time.Duration) error
+
+	// Done returns a channel that is closed once the main goroutine of the current or most recent
+	// run of the Producer has exited and cleaned up after itself, whether because of Stop (or a
+	// method that calls it, such as Flush) or because it panicked and Config.RestartOnPanic is
+	// false. This lets goroutines other than the one calling Stop wait for the Producer to stop,
+	// e.g. in a select. Each Start creates a new channel, so Done should be called after Start;
+	// before the first Start it returns a channel that is already closed.
+	Done() <-chan struct{}
+
+	// Config returns a copy of the Producer’s Config, with defaults applied, e.g. a nil Logger
+	// replaced with a no-op one. Changing it has no effect on the Producer.
+	Config() Config
 }
 
 // StatReceiver defines an object that can accept stats.
 type StatReceiver interface {
-	// Receive will be called by the main Producer goroutine so it will block all batches from being
-	// sent, so make sure it is either very fast or never blocks at all!
+	// Receive is called from a goroutine of its own while the Producer is running, so a slow
+	// receiver doesn’t hold up sending batches; StatsBatches are queued for it, in order, and if
+	// it falls far enough behind the oldest are dropped (see StatsDroppedSinceLastStat). It is
+	// never called concurrently. Stop waits for the queued StatsBatches to be received.
 	Receive(StatsBatch)
 }
 
@@ -56,79 +275,611 @@ type StatReceiver interface {
 // "moment-in-time" values e.g. BufferSize is the size of the buffer at the moment the StatsBatch
 // is sent. Other fields are cumulative since the last StatsBatch, i.e. ErrorsSinceLastStat.
 type StatsBatch struct {
+	// StreamName is the name of the stream the Producer was sending to when the StatsBatch was
+	// sent, so that a StatReceiver shared by several Producers, e.g. those of a MultiProducer, can
+	// tell their stats apart.
+	StreamName string
+
 	// Moment-in-time stats
 	BufferSize int
 
+	// BufferedBytes is the total size of the records in the buffer (their data plus partition
+	// keys), which is what Config.BufferBytes limits.
+	BufferedBytes int
+
+	// BatchesInFlight is the number of batches that had been sent in the background, because of
+	// Config.MaxConcurrentBatches, and whose outcomes hadn’t been dealt with yet.
+	BatchesInFlight int
+
+	// EffectiveBatchSize is the maximum size of the batches currently being sent, which differs
+	// from Config.BatchSize only if Config.AdaptiveBatchSize is true.
+	EffectiveBatchSize int
+
+	// EffectiveFlushInterval is the current flush interval, which differs from
+	// Config.FlushInterval only if Config.MinFlushInterval is set.
+	EffectiveFlushInterval time.Duration
+
 	// Cumulative stats
 	KinesisErrorsSinceLastStat           int
 	RecordsSentSuccessfullySinceLastStat int
-	RecordsDroppedSinceLastStat          int
+
+	// RecordsExpiredSinceLastStat counts records added with AddWithTTL that were discarded
+	// because their TTL expired before they were sent.
+	RecordsExpiredSinceLastStat int
+
+	// RecordsRetriedSinceLastStat counts records returned to the buffer to be sent again, either
+	// because their whole batch failed or because they failed individually. A rising value is an
+	// early warning that the Producer is churning, before records start to be dropped.
+	RecordsRetriedSinceLastStat int
+
+	// RecordsDroppedSinceLastStat is the total number of records dropped for any reason; the
+	// following fields break it down by cause.
+	RecordsDroppedSinceLastStat int
+
+	// RecordsDroppedBufferFullSinceLastStat counts records dropped because the buffer was full or
+	// nearly full while Kinesis was returning errors.
+	RecordsDroppedBufferFullSinceLastStat int
+
+	// RecordsDroppedMaxAttemptsSinceLastStat counts records dropped because they failed
+	// MaxAttemptsPerRecord times.
+	RecordsDroppedMaxAttemptsSinceLastStat int
+
+	// RecordsDroppedNonRetryableSinceLastStat counts records dropped because they failed with an
+	// error code that Config.ErrorClassifier classes as ErrorPermanent, by default one in
+	// Config.NonRetryableErrorCodes.
+	RecordsDroppedNonRetryableSinceLastStat int
+
+	// RecordsDroppedRetryBudgetSinceLastStat counts records dropped because Config.RetryBudget was
+	// used up when they failed.
+	RecordsDroppedRetryBudgetSinceLastStat int
+
+	// StatsDroppedSinceLastStat is 1 if the StatsBatch before this one was dropped, rather than
+	// passed to the StatReceiver, because the StatReceiver had fallen behind, and 0 otherwise.
+	StatsDroppedSinceLastStat int
 }
 
-// BatchingKinesisClient is a subset of KinesisClient to ease mocking.
+// BatchingKinesisClient is a subset of KinesisClient to ease mocking. PutRecords must not keep its
+// input after returning, since the Producer reuses it for later requests.
 type BatchingKinesisClient interface {
 	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
 }
 
+// StreamDescribingClient is a BatchingKinesisClient that can also describe streams, which is
+// needed for Config.VerifyOnStart.
+type StreamDescribingClient interface {
+	BatchingKinesisClient
+	DescribeStreamSummary(*kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error)
+}
+
+// StreamCreatingClient is a StreamDescribingClient that can also create streams, which is needed
+// for Config.CreateStreamIfMissing.
+type StreamCreatingClient interface {
+	StreamDescribingClient
+	CreateStream(*kinesis.CreateStreamInput) (*kinesis.CreateStreamOutput, error)
+}
+
+// ShardListingClient is a BatchingKinesisClient that can also list the shards of a stream, which
+// is needed for Config.ShardMapInterval. *kinesis.Kinesis implements it.
+type ShardListingClient interface {
+	BatchingKinesisClient
+	ListShards(*kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error)
+}
+
+// ContextBatchingKinesisClient is a BatchingKinesisClient that can also send records with a
+// context, which is needed for Config.PutRecordsTimeout. *kinesis.Kinesis implements it.
+type ContextBatchingKinesisClient interface {
+	BatchingKinesisClient
+	PutRecordsWithContext(aws.Context, *kinesis.PutRecordsInput, ...request.Option) (*kinesis.PutRecordsOutput, error)
+}
+
 // Config is a collection of config values for a Producer
 type Config struct {
+	// AdaptiveBatchSize enables adjusting the size of batches according to throttling by
+	// Kinesis. Batches start at BatchSize; whenever Kinesis throttles a batch the effective batch
+	// size is halved (but never goes below MinBatchSize), and each batch that is sent without
+	// being throttled grows it back by a tenth of BatchSize until it is back up to BatchSize.
+	AdaptiveBatchSize bool
+
 	// AddBlocksWhenBufferFull controls the behavior of Add when the buffer is full. If true, Add
-	// will block. If false, Add will return an error. This enables integrating applications to
+	// will block. If false, Add will return ErrBufferFull. This enables integrating applications to
 	// decide how they want to handle a full buffer e.g. so they can discard records if there’s
 	// a problem.
 	AddBlocksWhenBufferFull bool
 
 	// BatchSize controls the maximum size of the batches sent to Kinesis. If the number of records
 	// in the buffer hits this size, a batch of this size will be sent at that time, regardless of
-	// whether FlushInterval has a value or not.
+	// whether FlushInterval has a value or not. Batches are cut short, though, where they would
+	// exceed MaxKinesisBatchBytes, and the rest of the records are sent in the next one.
 	BatchSize int
 
+	// BeforeSend, if set, is called just before each PutRecords request with the number of records
+	// in it, e.g. to start a tracing span. The context it returns is passed to AfterSend.
+	BeforeSend func(recordCount int) context.Context
+
+	// AfterSend, if set, is called just after each PutRecords request with the context returned
+	// by BeforeSend (or context.Background() if BeforeSend is nil), the number of records in the
+	// request, and the error returned by the request, if any. Note that err is nil if the request
+	// succeeded but some of its records failed. Like BeforeSend it is called by the main
+	// goroutine, so it must be fast, unless MaxConcurrentBatches is more than 1, in which case it
+	// may be called concurrently by the goroutines sending batches.
+	AfterSend func(ctx context.Context, recordCount int, err error)
+
+	// CheckpointFunc, if set, is called with the shard ID and sequence number of each record that
+	// is written to Kinesis, e.g. to persist the highest sequence number written to each shard.
+	// It is called from the main goroutine, so like a StatReceiver it must be fast, and only once a
+	// batch’s outcome is known, so every sequence number it is given has been written, and each
+	// written record is reported exactly once. With MaxConcurrentBatches of 0 or 1 batches are sent
+	// one at a time, so within a shard it is called in increasing order of sequence number. With
+	// more, it is still called in increasing order within each batch, but batches are dealt with in
+	// the order in which they complete, which needn’t be the order in which Kinesis wrote them, so a
+	// later call for a shard can have a lower sequence number than an earlier one: keep the
+	// highest sequence number seen rather than the latest. In either case a sequence number says
+	// nothing about the records that aren’t written yet: retried records are written, and so
+	// reported, after records that were added after them, as are records in a batch that is still
+	// outstanding.
+	CheckpointFunc func(shardID, sequenceNumber string)
+
+	// CircuitBreakerThreshold is the number of consecutive errors from Kinesis after which the
+	// circuit breaker opens. While the circuit is open no batches are sent, and so no API calls
+	// are wasted during a sustained outage; records stay in the buffer. Once
+	// CircuitBreakerCooldown has elapsed a single probe batch is sent: if it succeeds the circuit
+	// closes and sending resumes as normal, and if it fails the circuit opens again. A
+	// CircuitOpenEvent is sent on the Events channel whenever the circuit opens. If zero, which
+	// is the default, the circuit breaker is disabled.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is how long the circuit breaker stays open before a probe batch is
+	// sent. See CircuitBreakerThreshold.
+	CircuitBreakerCooldown time.Duration
+
+	// CreateStreamIfMissing makes Start create the stream, with CreateStreamShardCount shards, if
+	// it doesn’t exist, and wait until it is active (or the context passed to StartContext is
+	// done) before starting. This is a convenience for ephemeral test and staging environments;
+	// in production streams are usually managed separately. If the stream is created concurrently
+	// by someone else, e.g. another instance of the same program, Start simply waits for it. It
+	// happens before VerifyOnStart’s check. The client must implement StreamCreatingClient, as
+	// *kinesis.Kinesis does.
+	CreateStreamIfMissing bool
+
+	// CreateStreamShardCount is the number of shards of a stream created because of
+	// CreateStreamIfMissing. If zero, the stream has one shard.
+	CreateStreamShardCount int
+
+	// BufferBytes, if nonzero, limits the buffer by the total size of the records in it (their data
+	// plus partition keys) rather than by their number, which gives predictable memory usage when
+	// record sizes vary widely. It is mutually exclusive with BufferSize, which must be 0 if
+	// BufferBytes is set. The buffer is considered full, as far as Add and
+	// AddBlocksWhenBufferFull are concerned, when either BufferBytes is reached or it holds
+	// BufferBytes or 100,000 records, whichever is fewer.
+	BufferBytes int
+
 	// BufferSize is the size of the buffer that stores records before they are sent to the Kinesis
 	// stream. If when Add is called the number of records in the buffer is >= bufferSize then
 	// Add will either block or return an error, depending on the value of AddBlocksWhenBufferFull.
 	BufferSize int
 
+	// DrainOnStop makes Stop and StopContext send everything in the buffer before returning, as
+	// Flush does, rather than leaving it there, so that records aren’t stranded at shutdown. If
+	// any can’t be sent, e.g. because StopContext’s context is done first, they are left in the
+	// buffer and an *UnsentRecordsError says how many. A FlushCompleteEvent is sent, as by
+	// Flush. Flush, FlushOrdered and StopAndDrain are unaffected.
+	DrainOnStop bool
+
+	// DropPolicy controls which records are shed when the buffer is full or nearly full and
+	// Kinesis has returned errors for several batches in a row, so that Add doesn’t block
+	// indefinitely during an outage. The default, DropOldest, drops the batches that fail, which
+	// are the oldest records; DropNewest keeps them and makes Add reject new records instead.
+	DropPolicy DropPolicy
+
+	// DroppedRecordHandler, if set, is called with each record that is dropped after being added,
+	// and the reason, so that it can be persisted or replayed rather than lost: records that hit
+	// MaxAttemptsPerRecord or the RetryBudget, fail with a non-retryable error, are shed under
+	// DropPolicy, or expire. The record is as sent, so its data is encrypted if Encrypter is set.
+	// It is called from whichever goroutine is sending records, which is the main goroutine or,
+	// while the Producer is stopped, the caller of Flush or one of its variants, so it must be
+	// fast. It isn’t called for records that Add and its variants reject, since the caller still
+	// has them, nor for records sent by SendBatch.
+	DroppedRecordHandler func(record Record, err error)
+
 	// FlushInterval controls how often the buffer is flushed to Kinesis. If nonzero, then every
 	// time this interval occurs, if there are any records in the buffer, they will be flushed,
 	// no matter how few there are. The size of the batch that’s flushed may be as small as 1 but
-	// will be no larger than BatchSize.
+	// will be no larger than BatchSize, unless FlushDrainsBuffer is set. If it is so short that
+	// the buffer is empty at 100 flushes in a row, an IdleWarningEvent is sent on Events.
 	FlushInterval time.Duration
 
-	// The logger used by the Producer.
+	// FlushDrainsBuffer makes each FlushInterval flush send everything that’s in the buffer, in as
+	// many batches of up to MaxKinesisBatchSize records as it takes, rather than a single batch of
+	// up to BatchSize records. This prevents records from waiting for several intervals when the
+	// buffer holds more than BatchSize. A flush stops early if a batch fails.
+	FlushDrainsBuffer bool
+
+	// EmitSuccessDetails controls whether a RecordsWrittenEvent is sent on the Events channel for
+	// each batch, describing the sequence number and shard of each record that was written
+	// successfully. It’s off by default because it adds overhead and a lot of events; if you turn
+	// it on, make sure you read from Events.
+	EmitSuccessDetails bool
+
+	// Encrypter, if set, encrypts the data of each record as it is added, so that it never leaves
+	// the process in plaintext, whatever server-side encryption the stream has. It must be safe to
+	// call from multiple goroutines. It is typically an envelope cipher such as AES-GCM with a data
+	// key from KMS, but the Producer doesn’t care: it just sends whatever Encrypter returns. Size
+	// limits, and Config.BufferBytes, apply to the ciphertext; if RecordSplitter is also set, it
+	// splits the plaintext and each chunk is encrypted separately. PartitionKeyFunc sees the
+	// plaintext. If Encrypter returns an error, so does Add, and the record isn’t added. Records
+	// returned by StopAndDrain are encrypted. consumer.Decrypter is the counterpart for reading.
+	Encrypter func(plaintext []byte) (ciphertext []byte, err error)
+
+	// ErrorClassifier, if set, decides how records that fail with each error code are treated;
+	// see ErrorClass. It is also used to tell whether an error from a whole PutRecords request is
+	// throttling, for AdaptiveBatchSize. It must be safe to call from multiple goroutines. If nil,
+	// the codes in NonRetryableErrorCodes are ErrorPermanent,
+	// ProvisionedThroughputExceededException and KMSThrottlingException are ErrorThrottled, and
+	// everything else, such as InternalFailure, is ErrorTransient. NonRetryableErrorCodes is
+	// ignored if ErrorClassifier is set.
+	ErrorClassifier func(errorCode string) ErrorClass
+
+	// HealthCheckInterval, if nonzero, makes the Producer check that the stream is accessible
+	// every HealthCheckInterval while it is running, by calling DescribeStreamSummary, so that
+	// problems such as expired credentials or a broken network are noticed even when no records
+	// are being sent. A HealthEvent is sent on the Events channel whenever the result of a check
+	// differs from that of the previous one; the stream is assumed to be healthy when the Producer
+	// starts. The checks happen in their own goroutine, so they don’t hold up sending. The client
+	// must implement StreamDescribingClient, as *kinesis.Kinesis does. It is off by default.
+	HealthCheckInterval time.Duration
+
+	// HighWaterMark is the fraction of BufferSize, between 0 and 1 (e.g. 0.8), above which
+	// ShouldThrottle returns true. 0 disables it.
+	HighWaterMark float32
+
+	// The logger used by the Producer. If nil, nothing is logged. Messages don’t vary; the details,
+	// such as "stream", "records", "batchSize", "consecutiveErrors" and "attempts", are attached as
+	// fields, so with a logger that writes JSON, such as zap.NewProduction’s, logs can be filtered
+	// on them.
 	Logger *zap.Logger
 
+	// MaxConcurrentBatches is the most batches that the Producer keeps in flight at once. With the
+	// default of 0, or 1, it sends one batch at a time and waits for the outcome before taking the
+	// next from the buffer, which caps throughput at one PutRecords request per round trip. With
+	// more it takes further batches while earlier ones are outstanding, though their outcomes are
+	// still dealt with one at a time by the main goroutine. While Kinesis is returning errors it
+	// goes back to one batch at a time, so that the backoff and the circuit breaker work as usual.
+	// Once the limit is reached no more batches are taken from the buffer until one of them
+	// completes, which bounds the memory used by records on their way to Kinesis and pushes back
+	// into the buffer instead. Flush, Drain and Stop wait for outstanding batches. Since
+	// concurrent batches can be written in any order it requires Ordering to be
+	// OrderingBestEffort.
+	MaxConcurrentBatches int
+
+	// MaxRecordsPerSecond limits the rate at which records are sent to Kinesis. Before each
+	// PutRecords request the Producer waits, if need be, until sending the batch would keep the
+	// rate within the limit, allowing bursts of up to a second’s worth. Kinesis accepts at most
+	// 1000 records per second per shard, so setting this a little below that times the number of
+	// shards avoids throttling rather than backing off after it happens. 0, the default, means no
+	// limit.
+	MaxRecordsPerSecond int
+
+	// MaxRecordsPerKeyPerInterval, if nonzero, is the number of records with the same partition
+	// key that may be sent within a StatInterval before a HotKeyEvent is sent on Events, as an
+	// early warning that the distribution of keys is skewed, before the shard that key maps to
+	// starts throttling. Only the first attempt to send a record counts, and a HotKeyEvent is sent
+	// at most once per key per StatInterval. StatInterval must be nonzero for it to be used.
+	MaxRecordsPerKeyPerInterval int
+
+	// MaxBytesPerSecond is like MaxRecordsPerSecond but limits the total size of the data and
+	// partition keys of the records sent. Kinesis accepts at most 1 MiB per second per shard. 0,
+	// the default, means no limit.
+	MaxBytesPerSecond int
+
+	// MinBatchSize is the smallest size that AdaptiveBatchSize shrinks batches to, and the size
+	// WarmupDuration starts them at. If 0, the default, it is 10, or BatchSize if that’s smaller.
+	// It must not be more than BatchSize.
+	MinBatchSize int
+
+	// MinFlushInterval, if nonzero, makes the flush interval adapt to the traffic between
+	// MinFlushInterval and FlushInterval, so that records wait less when traffic is light and
+	// batches are fuller when it is heavy. The interval starts at FlushInterval; a flush that
+	// finds fewer than half a batch in the buffer halves it, and one that finds more doubles it.
+	// Flushes that find the buffer empty leave it alone. The current interval is reported in
+	// StatsBatch.EffectiveFlushInterval. It must be at least 50ms and at most FlushInterval.
+	MinFlushInterval time.Duration
+
 	// MaxAttemptsPerRecord defines how many attempts should be made for each record before it is
 	// dropped. You probably want this higher than the init default of 0.
 	MaxAttemptsPerRecord int
 
+	// NonRetryableErrorCodes lists the error codes of failed records that should be dropped
+	// immediately, with a PermanentFailureEvent, rather than retried, because retrying them would
+	// be futile. If nil, DefaultNonRetryableErrorCodes is used; to retry all failed records,
+	// set it to an empty slice. It is only used if ErrorClassifier is nil.
+	NonRetryableErrorCodes []string
+
+	// OnPutRecords, if set, is called after every PutRecords request, whether or not it succeeded,
+	// with the request as sent (after RequestModifier) and the response or error, so that the raw
+	// payloads and failure entries can be logged, sampled or checked, e.g. when debugging partial
+	// failures. Unlike Events and stats, it gets the full AWS structures. It is called from the
+	// main goroutine (or, if MaxConcurrentBatches is more than 1, concurrently from the goroutines
+	// sending batches) before the response is processed, so it must be fast, and it must not keep or
+	// modify input, which is reused for later requests, or output. Note that having it set at all
+	// costs performance, since sending waits for it; sampling in it doesn’t avoid that.
+	OnPutRecords func(input *kinesis.PutRecordsInput, output *kinesis.PutRecordsOutput, err error)
+
+	// Ordering is the guarantee the Producer makes about the order in which records are written,
+	// relative to the order in which they were added. See the Ordering constants. Kinesis orders
+	// records by shard, so only the order of records that go to the same shard matters. Note that
+	// unlike PutRecord, PutRecords has no SequenceNumberForOrdering, so the Producer can only
+	// enforce ordering by what it sends when. The default is OrderingBestEffort.
+	Ordering Ordering
+
+	// PartitionKeyFunc, if set, is used to derive the partition key of records from their data
+	// when they are added with AddData, or with Add and an empty partition key. A partition key
+	// passed to Add explicitly always takes precedence.
+	PartitionKeyFunc func(data []byte) (string, error)
+
+	// PutRecordsTimeout, if nonzero, limits how long each PutRecords request may take, so that a
+	// hung request can’t stall the Producer indefinitely. A request that times out is treated like
+	// any other failed request: its records are returned to the buffer and retried after the
+	// usual backoff. The client must implement ContextBatchingKinesisClient, as *kinesis.Kinesis
+	// does. Note that records of a request that times out may have been written anyway, in which
+	// case they will be written twice.
+	PutRecordsTimeout time.Duration
+
+	// RecordSplitter, if set, is used by Add and the other Add methods, except TryAdd and
+	// AddWithAttributes, to split the data of records larger than MaxRecordSize into chunks that
+	// are added as records of their own, in order, with the same partition key and other options.
+	// It should return nil if the data can’t be split, e.g. newline-delimited JSON with a single
+	// huge line; then, or if any chunk is still too large, Add returns ErrRecordTooLarge and
+	// nothing is added. If Add fails part way, e.g. because the buffer is full, the chunks already
+	// added are still sent. A callback passed to AddWithCallback is called once the fates of all
+	// the chunks are known, with the result of the first one that failed if any did, or else of
+	// the last one.
+	RecordSplitter func(data []byte) [][]byte
+
+	// RequestModifier, if set, is called with each PutRecords request just before it is sent,
+	// including retries, and may change it, e.g. to set StreamARN rather than StreamName for
+	// cross-account or cross-region access, or fields that the Producer doesn’t know about. It is
+	// an advanced escape hatch: it must not add, remove or reorder records, since the response is
+	// matched to them by position, and it is called from the main goroutine, so it must be fast.
+	// It must not keep input, which is reused for later requests.
+	RequestModifier func(input *kinesis.PutRecordsInput)
+
+	// RestartOnPanic controls what happens if the Producer’s main goroutine panics, e.g. because
+	// of an unexpected response from Kinesis. Either way a PanicEvent is sent on the Events
+	// channel and any records in the batch being sent when the panic occurred are lost. If true,
+	// the main loop is restarted; if false, the Producer stops, and Add starts failing.
+	RestartOnPanic bool
+
+	// RetryBudget, if nonzero, is the fraction, between 0 and 1, of the records sent within each
+	// 10-second window that may be retries, e.g. 0.1 for 10%. Once it is used up, records that
+	// fail are dropped rather than retried until the next window, even if they haven’t reached
+	// MaxAttemptsPerRecord, and counted in StatsBatch.RecordsDroppedRetryBudgetSinceLastStat.
+	// This stops a high failure rate from turning into a retry storm that leaves no capacity for
+	// new records. Records that fail because of a non-retryable error code don’t count.
+	RetryBudget float64
+
+	// ShardMapInterval, if nonzero, makes the Producer keep a map of the stream’s open shards,
+	// listed with ListShards when it starts and every ShardMapInterval after that, and use it to
+	// work out which shard each record will go to, so that it can keep within the Kinesis limits
+	// of 1000 records and 1 MiB per second per shard rather than backing off once they are
+	// exceeded. Records for a shard that is at its limit are held back, at the front of the
+	// queue, while those for other shards are sent, so one hot shard doesn’t hold up the rest;
+	// if all the records are for shards at their limits, the Producer waits. Start fails if the
+	// shards can’t be listed; later failures are logged and the old map is kept. Records for
+	// shards that aren’t in the map, e.g. just after resharding or SetStreamName, aren’t limited.
+	// Since other producers may write to the same shards it complements, rather than replaces,
+	// backing off after throttling. The client must implement ShardListingClient, as
+	// *kinesis.Kinesis does. SendBatch isn’t limited.
+	ShardMapInterval time.Duration
+
+	// SpillDir, if set, is a directory in which records are kept on disk, rather than Add failing,
+	// blocking or shedding them, when the buffer is full, e.g. during a long Kinesis outage, so
+	// that bursts much larger than memory can be absorbed. Once any records have been spilled to
+	// disk all records added are spilled too, so that they stay in order, until the ones on disk
+	// have been moved back into the buffer, which happens whenever it is less than half full. The
+	// directory is created if need be, and must not be shared with another Producer. Records
+	// spilled by an earlier process that crashed are sent too. Records added with
+	// AddWithCallback, and records that are retried, are never spilled. It can’t be used with
+	// Ordering.
+	SpillDir string
+
+	// StatDeliveryInterval, if greater than StatInterval, makes the Producer pass stats to the
+	// StatReceiver only every StatDeliveryInterval (approximately, like StatInterval), rolling up
+	// the stats taken every StatInterval in between: the cumulative stats of a StatsBatch are then
+	// the sums over all of them, while the moment-in-time stats are those of the latest. This
+	// keeps a short StatInterval from swamping the StatReceiver. If zero, every StatsBatch is
+	// passed on as soon as it is taken. The stats sent when the Producer stops or is flushed are
+	// always passed on.
+	StatDeliveryInterval time.Duration
+
 	// StatInterval will be used to make a *best effort* attempt to send stats *approximately*
 	// when this interval elapses. There’s no guarantee, however, since the main goroutine is
-	// used to send the stats and therefore there may be some skew.
+	// used to collect the stats and therefore there may be some skew.
 	StatInterval time.Duration
 
 	// StatReceiver will have its Receive method called approximately every StatInterval.
 	StatReceiver StatReceiver
+
+	// StreamARN, if set, addresses the stream by its ARN rather than by the stream name passed to
+	// New, which may then be empty: PutRecords requests, and VerifyOnStart’s check, set StreamARN
+	// and not StreamName. This is needed e.g. for cross-account access through resource-based
+	// policies, which don’t resolve streams by name. SetStreamName fails while it is set, and it
+	// can’t be used with CreateStreamIfMissing, since streams are created by name.
+	StreamARN string
+
+	// VerifyOnStart makes Start check that the stream exists and is accessible, by calling
+	// DescribeStreamSummary, and fail if it isn’t, so that misconfiguration such as bad
+	// credentials or a misspelt stream name is caught straight away rather than surfacing later
+	// via Events while records pile up in the buffer. The client must implement
+	// StreamDescribingClient, as *kinesis.Kinesis does.
+	VerifyOnStart bool
+
+	// WALDir, if set, is a directory in which every record is logged as it is added, before it is
+	// buffered, and marked complete once it has been written to Kinesis or dropped (see
+	// DroppedRecordHandler) or handed back by StopAndDrain, so that records still in the buffer
+	// when the process crashes aren’t lost: the next Producer started with the same WALDir sends
+	// them before anything else. A record may be sent twice if the process crashes after it is
+	// written but before it is marked complete. The log is written to, but not synced, before Add
+	// returns, so it protects against the process crashing but not the machine. The directory is
+	// created if need be, and must not be shared with another Producer. Records replayed this way
+	// have lost any callback they were added with. It can’t be used with SpillDir.
+	WALDir string
+
+	// WarmupDuration, if nonzero, makes batches start small each time the Producer is started and
+	// grow linearly over WarmupDuration to BatchSize, so that a freshly started or scaled stream
+	// isn’t hit with full batches straight away. Batches start at MinBatchSize. The effective
+	// batch size is reported in StatsBatch.EffectiveBatchSize. If AdaptiveBatchSize is also true,
+	// batches are no larger than either would make them.
+	WarmupDuration time.Duration
+}
+
+// NewDefaultConfig is provided for convenience; if you have no specific preferences on how you’d
+// like to configure your Producer you can pass what it returns into New. It returns a new Config
+// each time, sharing nothing with any other, so it can be modified freely. The default Logger
+// discards everything.
+func NewDefaultConfig() Config {
+	return Config{
+		AddBlocksWhenBufferFull: false,
+		BufferSize:              10000,
+		FlushInterval:           1 * time.Second,
+		BatchSize:               10,
+		MaxAttemptsPerRecord:    10,
+		StatInterval:            1 * time.Second,
+		Logger:                  zap.NewNop(),
+	}
 }
 
-// DefaultConfig is provided for convenience; if you have no specific preferences on how you’d
-// like to configure your Producer you can pass this into New. The default value of Logger is
-// the same as the standard logger in "log" : `log.New(os.Stderr, "", log.LstdFlags)`.
-var DefaultConfig = Config{
-	AddBlocksWhenBufferFull: false,
-	BufferSize:              10000,
-	FlushInterval:           1 * time.Second,
-	BatchSize:               10,
-	MaxAttemptsPerRecord:    10,
-	StatInterval:            1 * time.Second,
-	Logger:                  zap.NewNop(),
+// DefaultConfig is the Config returned by NewDefaultConfig.
+//
+// Deprecated: use NewDefaultConfig. DefaultConfig is shared by everything that uses it, so
+// modifying it, or anything it refers to, affects them all. It will be removed in a future
+// release.
+var DefaultConfig = NewDefaultConfig()
+
+// DefaultNonRetryableErrorCodes is used when Config.NonRetryableErrorCodes is nil. It lists the
+// error codes that indicate a problem with permissions or configuration that retrying won’t fix.
+var DefaultNonRetryableErrorCodes = []string{
+	"AccessDeniedException",
+	"ValidationException",
+	kinesis.ErrCodeKMSAccessDeniedException,
+	kinesis.ErrCodeKMSDisabledException,
+	kinesis.ErrCodeKMSInvalidStateException,
+	kinesis.ErrCodeKMSNotFoundException,
+	kinesis.ErrCodeKMSOptInRequired,
 }
 
+// ErrorClass is what Config.ErrorClassifier returns.
+type ErrorClass int
+
+const (
+	// ErrorTransient is for errors that are likely to go away by themselves, such as
+	// InternalFailure: the record is retried without delay.
+	ErrorTransient ErrorClass = iota
+
+	// ErrorThrottled is for errors that mean the stream is over its limits, such as
+	// ProvisionedThroughputExceededException: the record is retried, but the Producer waits
+	// before sending the next batch, for 50ms after the first batch in a row with throttled
+	// records, doubling up to maxThrottleDelay.
+	ErrorThrottled
+
+	// ErrorPermanent is for errors that retrying won’t fix, such as ValidationException: the
+	// record is dropped at once, with a PermanentFailureEvent.
+	ErrorPermanent
+)
+
+// maxThrottleDelay is the longest that the Producer waits between batches because of
+// ErrorThrottled records.
+const maxThrottleDelay = 5 * time.Second
+
+// DropPolicy is the type of Config.DropPolicy.
+type DropPolicy int
+
+const (
+	// DropOldest drops the records of batches that fail while the buffer is full or nearly full.
+	DropOldest DropPolicy = iota
+
+	// DropNewest makes Add return ErrRecordShed, and TryAdd false, while the buffer is full or
+	// nearly full and Kinesis is returning errors, and keeps retrying the buffered records.
+	DropNewest
+)
+
+// Ordering is the type of Config.Ordering.
+type Ordering int
+
+const (
+	// OrderingBestEffort sends records in the order they were added, and records that fail are put
+	// back at the front of the buffer to be retried before anything else is sent, but a batch can
+	// contain several records with the same partition key, so one that fails can be written after
+	// later ones that were written the first time, and with MaxConcurrentBatches batches can be
+	// written in any order. It gives the best throughput.
+	OrderingBestEffort Ordering = iota
+
+	// OrderingPerPartitionKey preserves the order of records with the same partition key. Failed
+	// records are retried straight away, before anything else is sent, and a batch never contains
+	// two records with the same partition key, so that if one fails a later one can’t be written
+	// before it. Records whose partition key is already in a batch are held back, in order, for
+	// the next one, so many records with the same key make for small batches.
+	OrderingPerPartitionKey
+
+	// OrderingStrict preserves the order of all records: each record is sent in a request of its
+	// own, and is retried until it is written or dropped before the next one is sent. It requires
+	// BatchSize to be 1, and throughput is limited to one request at a time.
+	OrderingStrict
+)
+
 var (
 	// ErrAlreadyStarted is returned by Start if the Producer is already started.
 	ErrAlreadyStarted = errors.New("already started")
 
 	// ErrAlreadyStopped is returned by Stop if the Producer is already stopped.
 	ErrAlreadyStopped = errors.New("already stopped")
+
+	// ErrNotRunning is returned by the Add methods if the Producer isn’t started, or is stopped or
+	// stopping, to prevent the buffer filling up and Add blocking indefinitely.
+	ErrNotRunning = errors.New("Cannot call Add when BatchProducer is not running (to prevent the buffer filling up and Add blocking indefinitely).")
+
+	// ErrBufferFull is returned by the Add methods if the buffer is full and
+	// Config.AddBlocksWhenBufferFull is false.
+	ErrBufferFull = errors.New("Buffer is full")
+
+	// ErrRecordLargerThanBuffer is returned by the Add methods if a record is larger than
+	// Config.BufferBytes, so it could never fit in the buffer.
+	ErrRecordLargerThanBuffer = errors.New("Record is larger than BufferBytes")
+
+	// ErrRecordExpired is passed to the callback of a record that was discarded because its TTL
+	// expired.
+	ErrRecordExpired = errors.New("record expired before it could be sent")
+
+	// ErrAddTimeout is returned by AddWithTimeout if there was no room in the buffer within the
+	// timeout.
+	ErrAddTimeout = errors.New("timed out waiting for room in the buffer")
+
+	// ErrRecordTooLarge is returned by Add if a record is larger than MaxRecordSize and
+	// Config.RecordSplitter can’t split it, and by AddWithAttributes if the enveloped record would
+	// be.
+	ErrRecordTooLarge = errors.New("record is larger than the Kinesis limit of 1 MiB")
+
+	// ErrProducerClosed was returned by the Add methods if the Producer’s buffer, which was a
+	// channel, had been closed because of a bug.
+	//
+	// Deprecated: the buffer is no longer a channel and can’t be closed, so ErrProducerClosed is
+	// never returned. It will be removed in a future release.
+	ErrProducerClosed = errors.New("the Producer’s buffer has been closed")
+
+	// ErrRecordShed is returned by Add when Config.DropPolicy is DropNewest and the record was
+	// rejected to preserve the records that are already buffered.
+	ErrRecordShed = errors.New("record rejected because the buffer is nearly full and Kinesis is returning errors")
+
+	// ErrInvalidBatchSize is returned by New and Reconfigure if BatchSize isn’t between 1 and
+	// MaxKinesisBatchSize.
+	ErrInvalidBatchSize = errors.New("BatchSize must be between 1 and 500 inclusive")
+
+	// ErrBufferDeadlockRisk is returned by New and Reconfigure if the buffer is smaller than
+	// BatchSize and FlushInterval is 0, since then a full buffer would never be sent.
+	ErrBufferDeadlockRisk = errors.New("if BufferSize < BatchSize && FlushInterval <= 0 then the buffer will eventually fill up and Add will block forever")
+
+	// ErrFlushIntervalTooSmall is returned by New and Reconfigure if FlushInterval is nonzero but
+	// less than 50ms.
+	ErrFlushIntervalTooSmall = errors.New("FlushInterval must be 0 or at least 50ms")
 )
 
 // New creates and returns a BatchProducer that will do nothing until its Start method is called.
@@ -140,329 +891,2582 @@ func New(
 	streamName string,
 	config Config,
 ) (Producer, error) {
-	if config.BatchSize < 1 || config.BatchSize > MaxKinesisBatchSize {
-		return nil, errors.New("BatchSize must be between 1 and 500 inclusive")
+	if streamName == "" && config.StreamARN == "" {
+		return nil, errors.New("either streamName or Config.StreamARN must be set")
 	}
 
-	if config.BufferSize < config.BatchSize && config.FlushInterval <= 0 {
-		return nil, errors.New("if BufferSize < BatchSize && FlushInterval <= 0 then the buffer will eventually fill up and Add will block forever")
+	if config.BufferBytes < 0 {
+		return nil, errors.New("BufferBytes must not be negative")
 	}
 
-	if config.FlushInterval > 0 && config.FlushInterval < 50*time.Millisecond {
-		return nil, errors.New("are you crazy")
+	if config.BufferBytes > 0 && config.BufferSize > 0 {
+		return nil, errors.New("BufferSize and BufferBytes are mutually exclusive; set BufferSize to 0 to use BufferBytes")
 	}
 
-	batchProducer := batchProducer{
-		client:      client,
-		streamName:  streamName,
-		config:      config,
-		logger:      config.Logger,
-		currentStat: new(StatsBatch),
-		records:     make(chan batchRecord, config.BufferSize),
-		events:      make(chan Event, config.BufferSize),
-		start:       make(chan interface{}),
-		stop:        make(chan interface{}),
+	bufferSize := config.BufferSize
+	if config.BufferBytes > 0 {
+		// Every record is at least 1 byte since partition keys can’t be empty
+		bufferSize = config.BufferBytes
+		if bufferSize > maxBufferedRecordsWithBufferBytes {
+			bufferSize = maxBufferedRecordsWithBufferBytes
+		}
 	}
 
-	return &batchProducer, nil
-}
+	if err := validateBatching(config.BatchSize, config.FlushInterval, bufferSize); err != nil {
+		return nil, err
+	}
 
-type batchProducer struct {
-	client            BatchingKinesisClient
-	streamName        string
-	config            Config
-	logger            *zap.Logger
-	running           bool
-	runningMu         sync.RWMutex
-	consecutiveErrors int
-	currentDelay      time.Duration
-	currentStat       *StatsBatch
-	records           chan batchRecord
-	events            chan Event
+	if _, ok := client.(StreamDescribingClient); config.VerifyOnStart && !ok {
+		return nil, errors.New("VerifyOnStart requires a client that implements StreamDescribingClient")
+	}
 
-	// start and stop will be unbuffered and will be used to send signals to start/stop and
-	// response signals that indicate that the respective operations have completed.
-	start chan interface{}
-	stop  chan interface{}
-}
+	if _, ok := client.(StreamDescribingClient); config.HealthCheckInterval > 0 && !ok {
+		return nil, errors.New("HealthCheckInterval requires a client that implements StreamDescribingClient")
+	}
 
-type batchRecord struct {
-	data         []byte
-	partitionKey string
-	sendAttempts int
-}
+	if config.StatDeliveryInterval < 0 {
+		return nil, errors.New("StatDeliveryInterval must not be negative")
+	}
 
-// from/for interface Producer
-func (b *batchProducer) Add(data []byte, partitionKey string) error {
-	if !b.isRunning() {
-		return errors.New("Cannot call Add when BatchProducer is not running (to prevent the buffer filling up and Add blocking indefinitely).")
+	if config.SpillDir != "" && config.Ordering != OrderingBestEffort {
+		return nil, errors.New("SpillDir can’t be used with Ordering")
 	}
-	if b.isBufferFull() && !b.config.AddBlocksWhenBufferFull {
-		return errors.New("Buffer is full")
+	if config.WALDir != "" && config.SpillDir != "" {
+		return nil, errors.New("WALDir can’t be used with SpillDir")
 	}
-	b.records <- batchRecord{data: data, partitionKey: partitionKey}
-	return nil
-}
 
-// from/for interface Producer
-func (b *batchProducer) Start() error {
-	b.runningMu.Lock()
-	defer b.runningMu.Unlock()
+	if config.WarmupDuration < 0 {
+		return nil, errors.New("WarmupDuration must not be negative")
+	}
 
-	if b.running {
-		return ErrAlreadyStarted
+	if config.HealthCheckInterval < 0 {
+		return nil, errors.New("HealthCheckInterval must not be negative")
+	}
+	if config.ShardMapInterval < 0 {
+		return nil, errors.New("ShardMapInterval must not be negative")
+	}
+	if _, ok := client.(ShardListingClient); config.ShardMapInterval > 0 && !ok {
+		return nil, errors.New("ShardMapInterval requires a client that implements ShardListingClient")
 	}
 
-	go b.run()
+	if _, ok := client.(StreamCreatingClient); config.CreateStreamIfMissing && !ok {
+		return nil, errors.New("CreateStreamIfMissing requires a client that implements StreamCreatingClient")
+	}
 
-	// We want run to run in the background (in a goroutine) but we don’t want to return until that
-	// goroutine has actually entered its main loop. So we read from this non-buffered channel, which
-	// will block until run writes a value to it.
-	<-b.start
+	if config.CreateStreamIfMissing && config.StreamARN != "" {
+		return nil, errors.New("CreateStreamIfMissing can’t be used with StreamARN, since streams are created by name")
+	}
 
-	b.running = true
+	if config.CreateStreamShardCount < 0 {
+		return nil, errors.New("CreateStreamShardCount must not be negative")
+	}
 
-	return nil
-}
+	if _, ok := client.(ContextBatchingKinesisClient); config.PutRecordsTimeout > 0 && !ok {
+		return nil, errors.New("PutRecordsTimeout requires a client that implements ContextBatchingKinesisClient")
+	}
 
-func (b *batchProducer) run() {
-	flushTicker := &time.Ticker{}
-	if b.config.FlushInterval > 0 {
-		flushTicker = time.NewTicker(b.config.FlushInterval)
-		defer flushTicker.Stop()
+	if config.PutRecordsTimeout < 0 {
+		return nil, errors.New("PutRecordsTimeout must not be negative")
 	}
 
-	statTicker := &time.Ticker{}
-	if b.config.StatReceiver != nil && b.config.StatInterval > 0 {
-		statTicker = time.NewTicker(b.config.StatInterval)
-		defer statTicker.Stop()
+	if config.DropPolicy != DropOldest && config.DropPolicy != DropNewest {
+		return nil, errors.New("DropPolicy must be DropOldest or DropNewest")
 	}
 
-	// used to signal Start that we are now running (entering the main loop)
-	b.start <- true
+	if config.Ordering < OrderingBestEffort || config.Ordering > OrderingStrict {
+		return nil, errors.New("Ordering must be OrderingBestEffort, OrderingPerPartitionKey or OrderingStrict")
+	}
 
-	for {
-		select {
-		case <-flushTicker.C:
-			b.sendBatch(b.config.BatchSize)
-		case <-statTicker.C:
-			b.sendStats()
-		case <-b.stop:
-			b.sendStats()
-			b.stop <- true
-			return
-		default:
-			if len(b.records) >= b.config.BatchSize {
-				b.sendBatch(b.config.BatchSize)
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
+	if config.MinBatchSize < 0 || config.MinBatchSize > config.BatchSize {
+		return nil, errors.New("MinBatchSize must be between 0 and BatchSize inclusive")
 	}
-}
 
-// from/for interface Producer
-func (b *batchProducer) Stop() error {
-	b.runningMu.Lock()
-	defer b.runningMu.Unlock()
+	if config.MinFlushInterval != 0 &&
+		(config.MinFlushInterval < 50*time.Millisecond || config.MinFlushInterval > config.FlushInterval) {
+		return nil, errors.New("MinFlushInterval must be 0, or between 50ms and FlushInterval inclusive")
+	}
 
-	if !b.running {
-		return ErrAlreadyStopped
+	if config.Ordering == OrderingStrict && config.BatchSize != 1 {
+		return nil, errors.New("OrderingStrict requires BatchSize to be 1")
 	}
 
-	// request the main goroutine to stop
-	b.stop <- true
+	if config.MaxConcurrentBatches < 0 {
+		return nil, errors.New("MaxConcurrentBatches must not be negative")
+	}
+	if config.MaxConcurrentBatches > 1 && config.Ordering != OrderingBestEffort {
+		return nil, errors.New("MaxConcurrentBatches can’t be used with Ordering")
+	}
 
-	// block until the main goroutine returns a value indicating that it has stopped
-	<-b.stop
+	if config.MaxRecordsPerSecond < 0 || config.MaxBytesPerSecond < 0 {
+		return nil, errors.New("MaxRecordsPerSecond and MaxBytesPerSecond must not be negative")
+	}
 
-	b.running = false
+	if config.MaxRecordsPerKeyPerInterval < 0 {
+		return nil, errors.New("MaxRecordsPerKeyPerInterval must not be negative")
+	}
+	if config.MaxRecordsPerKeyPerInterval > 0 && config.StatInterval <= 0 {
+		return nil, errors.New("MaxRecordsPerKeyPerInterval requires StatInterval")
+	}
 
-	return nil
-}
+	if config.HighWaterMark < 0 || config.HighWaterMark > 1 {
+		return nil, errors.New("HighWaterMark must be between 0 and 1 inclusive")
+	}
 
-func (b *batchProducer) Events() <-chan Event {
-	return (<-chan Event)(b.events)
-}
+	if config.RetryBudget < 0 || config.RetryBudget > 1 {
+		return nil, errors.New("RetryBudget must be between 0 and 1 inclusive")
+	}
 
-// from/for interface Producer
-// TODO: send all batches in parallel, will require broader refactoring
-func (b *batchProducer) Flush(timeout time.Duration, sendStats bool) (int, int, error) {
-	b.Stop()
+	if config.NonRetryableErrorCodes == nil {
+		// Copied so that modifying the Config returned by Config can’t affect other Producers
+		config.NonRetryableErrorCodes = append([]string(nil), DefaultNonRetryableErrorCodes...)
+	}
 
-	timer := time.NewTimer(timeout)
-	if timeout == 0 {
-		timer.Stop()
+	// Otherwise the first log call would panic, deep in the send path
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
 	}
 
-	timedOut := false
-	sent := 0
+	batchProducer := batchProducer{
+		client:                 client,
+		clock:                  realClock{},
+		streamName:             streamName,
+		config:                 config,
+		logger:                 config.Logger,
+		effectiveBatchSize:     config.BatchSize,
+		nonRetryableErrorCodes: make(map[string]bool, len(config.NonRetryableErrorCodes)),
+		currentStat:            new(StatsBatch),
+		records:                newRecordQueue(bufferSize, config.BufferBytes),
+		events:                 make(chan Event, bufferSize),
+		drain:                  make(chan drainRequest),
+		reconfigure:            make(chan reconfigureRequest),
+		wake:                   make(chan struct{}, 1),
+		done:                   make(chan struct{}),
+	}
+	// The Producer hasn’t started, so as far as Done is concerned it has already stopped
+	close(batchProducer.done)
 
-loop:
-	for len(b.records) > 0 {
-		select {
-		case <-timer.C:
-			timedOut = true
-			break loop
-		default:
-			sent += b.sendBatch(MaxKinesisBatchSize)
-		}
+	if config.MaxConcurrentBatches > 1 {
+		// Big enough that sending a batch never waits for the main goroutine
+		batchProducer.sent = make(chan *sentBatch, config.MaxConcurrentBatches)
 	}
 
-	if !timedOut && sendStats {
-		b.sendStats()
+	if config.RetryBudget > 0 {
+		batchProducer.retryBudget = newRetryBudget(config.RetryBudget)
+	}
+	if config.MaxRecordsPerSecond > 0 {
+		batchProducer.recordsLimiter = newTokenBucket(config.MaxRecordsPerSecond)
+	}
+	if config.MaxBytesPerSecond > 0 {
+		batchProducer.bytesLimiter = newTokenBucket(config.MaxBytesPerSecond)
+	}
+	if config.ShardMapInterval > 0 {
+		batchProducer.shards = &shardMap{}
 	}
 
-	return sent, len(b.records), nil
-}
+	for _, code := range config.NonRetryableErrorCodes {
+		batchProducer.nonRetryableErrorCodes[code] = true
+	}
 
-func (b *batchProducer) isRunning() bool {
-	b.runningMu.RLock()
-	defer b.runningMu.RUnlock()
-	return b.running
+	if config.SpillDir != "" {
+		spill, err := openSpillQueue(config.SpillDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not open SpillDir: %v", err)
+		}
+		batchProducer.spill = spill
+	}
+
+	if config.WALDir != "" {
+		wal, err := openWriteAheadLog(config.WALDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not open WALDir: %v", err)
+		}
+		batchProducer.wal = wal
+	}
+
+	return &batchProducer, nil
 }
 
-// Sends batches of records to Kinesis, possibly re-enqueing them if there are any errors or failed
-// records. Returns the number of records successfully sent, if any.
-func (b *batchProducer) sendBatch(batchSize int) int {
-	if len(b.records) == 0 {
-		return 0
+// validateBatching returns an error if batchSize and flushInterval aren’t valid for a buffer of
+// bufferSize records.
+func validateBatching(batchSize int, flushInterval time.Duration, bufferSize int) error {
+	if batchSize < 1 || batchSize > MaxKinesisBatchSize {
+		return ErrInvalidBatchSize
 	}
 
-	// In the future, maybe this could be a RetryPolicy or something
-	if b.consecutiveErrors == 1 {
-		b.currentDelay = 50 * time.Millisecond
-	} else if b.consecutiveErrors > 1 {
-		b.currentDelay *= 2
+	if bufferSize < batchSize && flushInterval <= 0 {
+		return ErrBufferDeadlockRisk
 	}
 
-	if b.currentDelay > 0 {
-		b.logger.Debug(fmt.Sprintf("Delaying the batch by %v because of %v consecutive errors", b.currentDelay, b.consecutiveErrors))
-		time.Sleep(b.currentDelay)
+	if flushInterval > 0 && flushInterval < 50*time.Millisecond {
+		return ErrFlushIntervalTooSmall
 	}
 
-	records := b.takeRecordsFromBuffer(batchSize)
-	res, err := b.client.PutRecords(b.recordsToInput(records))
+	return nil
+}
 
-	if err != nil {
-		b.consecutiveErrors++
-		b.currentStat.KinesisErrorsSinceLastStat++
-		b.events <- newError(err.Error())
+type batchProducer struct {
+	// inFlightRecords is the number of records taken from the buffer by sendBatch whose fate isn’t
+	// yet settled. It is accessed atomically, and comes first so that it is 64-bit aligned on
+	// 32-bit platforms.
+	inFlightRecords int64
+
+	client       BatchingKinesisClient
+	clock        clock
+	streamName   string
+	streamNameMu sync.RWMutex
+	config       Config
+	// configMu guards the fields of config that Reconfigure changes, for Config. The main
+	// goroutine may read them without the lock since it is the only writer while it is running.
+	configMu        sync.RWMutex
+	logger          *zap.Logger
+	running         bool
+	runningMu       sync.RWMutex
+	currentDelay    time.Duration
+	circuitOpenedAt time.Time
+	// throttleDelay is how long to wait before the next batch because the last ones had
+	// ErrorThrottled records. It belongs to the main goroutine.
+	throttleDelay time.Duration
+	// lifecycle, consecutiveErrors and circuit are guarded by stateMu so that State can read them
+	// while the main goroutine is running. The main goroutine itself may read them without the
+	// lock since it is the only writer of consecutiveErrors and circuit.
+	lifecycle         ProducerState
+	consecutiveErrors int
+	circuit           circuitState
+	stateMu           sync.RWMutex
+	// effectiveBatchSize is the size used for batches sent by the main goroutine. It is always
+	// equal to config.BatchSize unless config.AdaptiveBatchSize is true.
+	effectiveBatchSize int
+	// effectiveFlushInterval is the interval of the flush ticker. It is always equal to
+	// config.FlushInterval unless config.MinFlushInterval is set. It is only used by the main
+	// goroutine.
+	effectiveFlushInterval time.Duration
+	nonRetryableErrorCodes map[string]bool
+	currentStat            *StatsBatch
+	// rolledUpStat holds the stats taken since the last StatsBatch was passed on, if
+	// config.StatDeliveryInterval is set, or is nil. lastStatDelivery is when that was. Both are
+	// only used by the main goroutine.
+	rolledUpStat     *StatsBatch
+	lastStatDelivery time.Time
+	// records is the buffer.
+	records    *recordQueue
+	events     chan Event
+	dispatcher dispatcher
+
+	// sent brings batches sent in the background, because of Config.MaxConcurrentBatches, back to
+	// the main goroutine once they are done; it is nil unless MaxConcurrentBatches is more than 1.
+	// outstandingBatches, which belongs to the main goroutine, is the number not yet dealt with.
+	sent               chan *sentBatch
+	outstandingBatches int
+
+	// sendCtx, if set, is the context of the requests sent by sendAll. It belongs to whichever
+	// goroutine may call sendBatch.
+	sendCtx context.Context
+	// stats queues StatsBatches for the StatReceiver while the Producer is running; it is nil
+	// otherwise. statsDone is closed once they have all been received after stats is closed.
+	stats     chan StatsBatch
+	statsDone chan struct{}
+	// recordsLimiter and bytesLimiter enforce Config.MaxRecordsPerSecond and
+	// Config.MaxBytesPerSecond. Each is nil if its limit is 0.
+	recordsLimiter *tokenBucket
+	bytesLimiter   *tokenBucket
+
+	// shards is the map of the stream’s shards used by Config.ShardMapInterval, or nil.
+	shards *shardMap
+	// retryBudget enforces Config.RetryBudget, or is nil if it is 0.
+	retryBudget *retryBudget
+
+	// paused is 1 while the Producer is paused; see Pause. It is accessed atomically.
+	paused int32
+
+	// spill is the disk queue used by Config.SpillDir, or nil.
+	spill *spillQueue
+
+	// wal is the log used by Config.WALDir, or nil.
+	wal *writeAheadLog
+
+	// warmingUp is true during Config.WarmupDuration, which started at warmUpStartedAt. Both are
+	// only used by the main goroutine.
+	warmingUp       bool
+	warmUpStartedAt time.Time
+
+	// keyCounts is the number of records sent with each partition key during the current
+	// StatInterval, for Config.MaxRecordsPerKeyPerInterval. It is only used by the main goroutine.
+	keyCounts map[string]int
+
+	// idleFlushes is the number of flushes in a row that have found the buffer empty, without
+	// anything having been sent in between. It is only used by the main goroutine.
+	idleFlushes int
+
+	// requeued collects the failed records to be retried while the function passed to
+	// returnToBuffer runs, for returnToBuffer to put back at the front of the buffer.
+	requeued []batchRecord
+
+	// stop and done are created afresh by each successful Start. Stop closes stop to ask the main
+	// goroutine to stop, and the main goroutine closes done once it has stopped and cleaned up
+	// after itself, so that it can’t interfere with a later run. done is also guarded by stateMu,
+	// for Done.
+	stop chan struct{}
+	done chan struct{}
+
+	// drain is unbuffered and is used to ask the main goroutine to drain the buffer, so that
+	// sendBatch is never called concurrently.
+	drain chan drainRequest
+	// stoppedMu is held by the methods that send or take records from the buffer themselves once
+	// the main goroutine has stopped, i.e. Drain, FlushContext, StopContext, StopAndDrain and
+	// FlushOrdered, so that they don’t do so concurrently with each other.
+	stoppedMu sync.Mutex
+
+	// wake is signalled by wakeUp whenever records are added to the buffer or the Producer is
+	// resumed, so that the main goroutine can wait for a full batch rather than polling for one.
+	wake chan struct{}
+
+	// reconfigure is unbuffered and is used to ask the main goroutine to apply Reconfigure.
+	reconfigure chan reconfigureRequest
+
+	// flushTicker and flushTick belong to the main goroutine. They are nil if FlushInterval is 0.
+	flushTicker ticker
+	flushTick   <-chan time.Time
+}
 
-		if b.consecutiveErrors >= 5 && b.isBufferFullOrNearlyFull() {
-			// In order to prevent Add from hanging indefinitely, we start dropping records
-			b.logger.Error(fmt.Sprintf("DROPPING %v records because buffer is full or nearly full and there have been %v consecutive errors from Kinesis", len(records), b.consecutiveErrors))
-		} else {
-			b.logger.Debug(fmt.Sprintf("Returning %v records to buffer (%v consecutive errors)", len(records), b.consecutiveErrors))
-			// returnRecordsToBuffer can block if the buffer (channel) if full so we’ll
-			// call it in a goroutine. This might be problematic WRT ordering. TODO: revisit this.
-			go b.returnRecordsToBuffer(records)
-		}
+type drainRequest struct {
+	timeout time.Duration
+	result  chan drainResult
+}
 
-		return 0
-	}
+// drainResult is the answer to a drainRequest.
+type drainResult struct {
+	sent      int
+	remaining int
+}
 
-	b.consecutiveErrors = 0
-	b.currentDelay = 0
-	var succeeded int
-	if res.FailedRecordCount == nil {
-		succeeded = len(records)
-		b.logger.Debug(fmt.Sprintf("PutRecords request succeeded: sent %v records to Kinesis stream %v", succeeded, b.streamName))
-	} else {
-		// note *int64 to int conversion - in practice we never expect 2 billion failed records
-		// in a single call since API only supports 500 records per call
-		succeeded = len(records) - int(*res.FailedRecordCount)
-		b.logger.Debug(fmt.Sprintf("Partial success when sending a PutRecords request to Kinesis stream %v: %v succeeded, %v failed. Re-enqueueing failed records.", b.streamName, succeeded, res.FailedRecordCount))
-		// returnSomeFailedRecordsToBuffer can block if the buffer (channel) if full so we’ll
-		// call it in a goroutine. This might be problematic WRT ordering. TODO: revisit this.
-		go b.returnSomeFailedRecordsToBuffer(res, records)
-	}
+type reconfigureRequest struct {
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+}
 
-	b.currentStat.RecordsSentSuccessfullySinceLastStat += succeeded
-	return succeeded
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// Record is a record as returned by StopAndDrain or passed to AddAll.
+type Record struct {
+	Data         []byte
+	PartitionKey string
+
+	// ExplicitHashKey is the explicit hash key the record was added with by AddExplicit, if any.
+	ExplicitHashKey string
 }
 
-func (b *batchProducer) isBufferFullOrNearlyFull() bool {
-	return float32(len(b.records))/float32(cap(b.records)) >= 0.95
+type batchRecord struct {
+	data         []byte
+	partitionKey string
+	sendAttempts int
+
+	// explicitHashKey, if set, determines the shard instead of partitionKey.
+	explicitHashKey string
+
+	// deadline is the time after which the record should be discarded rather than sent. The zero
+	// value means the record never expires.
+	deadline time.Time
+
+	// callback, if set, is called by done.
+	callback func(result RecordResult)
+
+	// addTimeout, if positive, is how long add waits for room in the buffer, whatever
+	// Config.AddBlocksWhenBufferFull says; if negative, add doesn’t wait at all.
+	addTimeout time.Duration
+
+	// addCtx, if set, is like addTimeout except that add waits until it is done.
+	addCtx context.Context
+
+	// walSegment and walID identify the record in the Config.WALDir log; walID is 0 if it wasn’t
+	// logged.
+	walSegment int
+	walID      uint64
 }
 
-func (b *batchProducer) isBufferFull() bool {
-	// Treating 99% as full because IIRC, len(chan) has a margin of error
-	return float32(len(b.records))/float32(cap(b.records)) >= 0.99
+// size is the size of the record as far as Config.BufferBytes is concerned.
+func (r batchRecord) size() int {
+	return len(r.data) + len(r.partitionKey)
 }
 
-func (b *batchProducer) takeRecordsFromBuffer(batchSize int) []batchRecord {
-	var size int
-	bufferLen := len(b.records)
-	if bufferLen >= batchSize {
-		size = batchSize
-	} else {
-		size = bufferLen
+// done reports to the record’s callback, if it has one, that it was dropped because of err.
+func (r batchRecord) done(err error) {
+	if r.callback != nil {
+		r.callback(RecordResult{Attempts: r.sendAttempts, Err: err})
 	}
+}
 
-	result := make([]batchRecord, size)
-	for i := 0; i < size; i++ {
-		result[i] = <-b.records
+// drop reports that record was dropped because of err, to its callback if it has one and to
+// Config.DroppedRecordHandler if that is set.
+func (b *batchProducer) drop(record batchRecord, err error) {
+	record.done(err)
+	b.completeInWAL(record)
+	if b.config.DroppedRecordHandler != nil {
+		b.config.DroppedRecordHandler(Record{
+			Data:            record.data,
+			PartitionKey:    record.partitionKey,
+			ExplicitHashKey: record.explicitHashKey,
+		}, err)
 	}
-	return result
 }
 
-func (b *batchProducer) recordsToInput(records []batchRecord) *kinesis.PutRecordsInput {
-	awsRecords := make([]*kinesis.PutRecordsRequestEntry, len(records))
-	for i, rec := range records {
-		awsRecords[i] = &kinesis.PutRecordsRequestEntry{PartitionKey: aws.String(rec.partitionKey), Data: rec.data}
+// wrote reports that record was written on its latest attempt, with the sequence number and shard
+// ID in entry if it isn’t nil.
+func (b *batchProducer) wrote(record batchRecord, entry *kinesis.PutRecordsResultEntry) {
+	record.written(entry)
+	b.completeInWAL(record)
+}
+
+// completeInWAL marks record as complete in the Config.WALDir log, if it was logged there.
+func (b *batchProducer) completeInWAL(record batchRecord) {
+	if b.wal == nil || record.walID == 0 {
+		return
 	}
-	return &kinesis.PutRecordsInput{
-		StreamName: aws.String(b.streamName),
-		Records:    awsRecords,
+	if err := b.wal.complete(record); err != nil {
+		b.logger.Error("Could not mark a record as complete in the write-ahead log", zap.Error(err))
 	}
 }
 
-// returnRecordsToBuffer can block if the buffer (channel) is full, so you might want to
-// call it in a goroutine.
-// TODO: we should probably use a deque internally as the buffer so we can return records to
-// the front of the queue, so as to preserve order, which is important.
-func (b *batchProducer) returnRecordsToBuffer(records []batchRecord) {
-	for _, record := range records {
-		// Not using b.Add because we want to preserve the value of record.sendAttempts.
-		b.records <- record
+// written reports to the record’s callback, if it has one, that it was written on its latest
+// attempt, with the sequence number and shard ID in entry if it isn’t nil.
+func (r batchRecord) written(entry *kinesis.PutRecordsResultEntry) {
+	if r.callback == nil {
+		return
 	}
+	result := RecordResult{Attempts: r.sendAttempts + 1}
+	if entry != nil {
+		result.SequenceNumber = aws.StringValue(entry.SequenceNumber)
+		result.ShardID = aws.StringValue(entry.ShardId)
+	}
+	r.callback(result)
 }
 
-// returnSomeFailedRecordsToBuffer can block if the buffer (channel) is full, so you might want to
-// call it in a goroutine.
-// TODO: we should probably use a deque internally as the buffer so we can return records to
-// the front of the queue, so as to preserve order, which is important.
-func (b *batchProducer) returnSomeFailedRecordsToBuffer(res *kinesis.PutRecordsOutput, records []batchRecord) {
-	for i, result := range res.Records {
-		record := records[i]
-		if result.ErrorMessage != nil {
-			record.sendAttempts++
-			b.events <- newError(*result.ErrorMessage)
-
-			if record.sendAttempts < b.config.MaxAttemptsPerRecord {
-				// Not using b.Add because we want to preserve the value of record.sendAttempts.
-				b.records <- record
-			} else {
-				b.currentStat.RecordsDroppedSinceLastStat++
-				msg := "Dropping failed record; it has hit %v attempts " +
-					"which is the maximum. Error code was: '%v' and message was '%v'."
-				b.logger.Error(fmt.Sprintf(msg, record.sendAttempts, *result.ErrorCode, *result.ErrorMessage))
-			}
-		}
+// from/for interface Producer
+func (b *batchProducer) Add(data []byte, partitionKey string) error {
+	return b.add(batchRecord{data: data, partitionKey: partitionKey})
+}
+
+// from/for interface Producer
+func (b *batchProducer) AddWithTTL(data []byte, partitionKey string, ttl time.Duration) error {
+	record := batchRecord{data: data, partitionKey: partitionKey}
+	if ttl > 0 {
+		record.deadline = b.clock.Now().Add(ttl)
 	}
+	return b.add(record)
 }
 
-func (b *batchProducer) sendStats() {
-	if b.config.StatReceiver == nil {
-		return
+// from/for interface Producer
+func (b *batchProducer) AddWithCallback(data []byte, partitionKey string, cb func(result RecordResult)) error {
+	return b.add(batchRecord{data: data, partitionKey: partitionKey, callback: cb})
+}
+
+// from/for interface Producer
+func (b *batchProducer) AddExplicit(data []byte, partitionKey, explicitHashKey string) error {
+	return b.add(batchRecord{data: data, partitionKey: partitionKey, explicitHashKey: explicitHashKey})
+}
+
+// from/for interface Producer
+func (b *batchProducer) AddWithTimeout(data []byte, partitionKey string, timeout time.Duration) error {
+	record := batchRecord{data: data, partitionKey: partitionKey, addTimeout: timeout}
+	if timeout <= 0 {
+		record.addTimeout = -1
 	}
+	return b.add(record)
+}
+
+// from/for interface Producer
+func (b *batchProducer) AddContext(ctx context.Context, data []byte, partitionKey string) error {
+	return b.add(batchRecord{data: data, partitionKey: partitionKey, addCtx: ctx})
+}
 
-	b.currentStat.BufferSize = len(b.records)
+// from/for interface Producer
+func (b *batchProducer) AddAll(ctx context.Context, ch <-chan Record) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := b.add(batchRecord{data: r.Data, partitionKey: r.PartitionKey, explicitHashKey: r.ExplicitHashKey}); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-	// I considered running this as a goroutine, but I’m concerned about leaks. So instead, for now,
-	// the provider of the BatchStatReceiver must ensure that it is either very fast or non-blocking.
-	b.config.StatReceiver.Receive(*b.currentStat)
+// from/for interface Producer
+func (b *batchProducer) AddWithAttributes(data []byte, partitionKey string, attrs map[string]string) error {
+	raw, err := EncodeRecord(data, attrs)
+	if err != nil {
+		return err
+	}
+	if len(raw)+len(partitionKey) > MaxRecordSize {
+		return ErrRecordTooLarge
+	}
+	return b.Add(raw, partitionKey)
+}
 
-	b.currentStat = new(StatsBatch)
+func (b *batchProducer) add(record batchRecord) error {
+	if record.partitionKey == "" && b.config.PartitionKeyFunc != nil {
+		var err error
+		record.partitionKey, err = b.config.PartitionKeyFunc(record.data)
+		if err != nil {
+			return err
+		}
+	}
+	if b.config.Encrypter != nil {
+		ciphertext, err := b.config.Encrypter(record.data)
+		if err != nil {
+			return err
+		}
+		if len(ciphertext)+len(record.partitionKey) > MaxRecordSize {
+			return b.addSplit(record)
+		}
+		record.data = ciphertext
+	} else if record.size() > MaxRecordSize {
+		return b.addSplit(record)
+	}
+	return b.addRecord(record)
+}
+
+// addRecord adds record, which is ready to be sent, to the buffer.
+func (b *batchProducer) addRecord(record batchRecord) (err error) {
+	if !b.isRunning() {
+		return ErrNotRunning
+	}
+	if b.config.BufferBytes > 0 && record.size() > b.config.BufferBytes {
+		return ErrRecordLargerThanBuffer
+	}
+	if b.wal != nil {
+		if err := b.wal.add(&record); err != nil {
+			return fmt.Errorf("could not log record to WALDir: %v", err)
+		}
+		// If it isn’t buffered after all, the caller still has it
+		defer func() {
+			if err != nil {
+				b.completeInWAL(record)
+			}
+		}()
+	}
+	if b.spill != nil && record.callback == nil && (b.spill.len() > 0 || b.isBufferFull()) {
+		if err := b.spill.push(record); err != nil {
+			return err
+		}
+		b.wakeUp()
+		return nil
+	}
+	if b.config.DropPolicy == DropNewest && b.shouldShed() {
+		return ErrRecordShed
+	}
+	if record.addCtx != nil {
+		return b.enqueueContext(record.addCtx, record)
+	}
+	if record.addTimeout != 0 {
+		return b.enqueueWithin(record, record.addTimeout)
+	}
+	if !b.config.AddBlocksWhenBufferFull {
+		if b.isBufferFull() || !b.tryEnqueue(record) {
+			return ErrBufferFull
+		}
+		return nil
+	}
+	return b.enqueue(record)
+}
+
+// addSplit adds the chunks that Config.RecordSplitter splits the data of record into, each as a
+// record of its own, encrypted separately if Config.Encrypter is set.
+func (b *batchProducer) addSplit(record batchRecord) error {
+	if b.config.RecordSplitter == nil {
+		return ErrRecordTooLarge
+	}
+	chunks := b.config.RecordSplitter(record.data)
+	if len(chunks) == 0 {
+		return ErrRecordTooLarge
+	}
+	for i, chunk := range chunks {
+		if b.config.Encrypter != nil {
+			var err error
+			chunks[i], err = b.config.Encrypter(chunk)
+			if err != nil {
+				return err
+			}
+		}
+		if len(chunks[i])+len(record.partitionKey) > MaxRecordSize {
+			return ErrRecordTooLarge
+		}
+	}
+
+	callback := splitCallback(record.callback, len(chunks))
+	for _, chunk := range chunks {
+		chunkRecord := record
+		chunkRecord.data = chunk
+		chunkRecord.callback = callback
+		if err := b.addRecord(chunkRecord); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitCallback returns a callback for the n chunks of a split record that calls cb once the fates
+// of all of them are known: with the result of the first one that failed, or else of the last one
+// to be written. It returns nil if cb is nil.
+func splitCallback(cb func(result RecordResult), n int) func(result RecordResult) {
+	if cb == nil {
+		return nil
+	}
+	var mu sync.Mutex
+	var failed *RecordResult
+	return func(result RecordResult) {
+		mu.Lock()
+		n--
+		if failed == nil && result.Err != nil {
+			failed = &result
+		}
+		if failed != nil {
+			result = *failed
+		}
+		last := n == 0
+		mu.Unlock()
+
+		if last {
+			cb(result)
+		}
+	}
+}
+
+// from/for interface Producer
+func (b *batchProducer) TryAdd(data []byte, partitionKey string) bool {
+	record := batchRecord{data: data, partitionKey: partitionKey}
+	if partitionKey == "" && b.config.PartitionKeyFunc != nil {
+		var err error
+		record.partitionKey, err = b.config.PartitionKeyFunc(data)
+		if err != nil {
+			return false
+		}
+	}
+	if b.config.Encrypter != nil {
+		var err error
+		record.data, err = b.config.Encrypter(data)
+		if err != nil {
+			return false
+		}
+	}
+	if !b.isRunning() || record.size() > MaxRecordSize {
+		return false
+	}
+	if b.wal != nil || b.spill != nil {
+		// The record must be logged, or spilled if the buffer is full, just as by Add, so it goes
+		// the same way, without waiting for room
+		record.addTimeout = -1
+		return b.addRecord(record) == nil
+	}
+	if b.isBufferFull() {
+		return false
+	}
+	if b.config.DropPolicy == DropNewest && b.shouldShed() {
+		return false
+	}
+	if b.config.BufferBytes > 0 && record.size() > b.config.BufferBytes {
+		return false
+	}
+	return b.tryEnqueue(record)
+}
+
+// from/for interface Producer
+func (b *batchProducer) AddData(data []byte) error {
+	if b.config.PartitionKeyFunc == nil {
+		return errors.New("AddData requires Config.PartitionKeyFunc to be set")
+	}
+	return b.Add(data, "")
+}
+
+// from/for interface Producer
+func (b *batchProducer) Start() error {
+	return b.StartContext(context.Background())
+}
+
+// from/for interface Producer
+func (b *batchProducer) StartContext(ctx context.Context) error {
+	b.runningMu.Lock()
+	defer b.runningMu.Unlock()
+
+	if b.running {
+		return ErrAlreadyStarted
+	}
+
+	// The main goroutine of the last run may still be finishing if StopContext gave up on it
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	b.setLifecycle(StateStarting)
+
+	if b.config.CreateStreamIfMissing {
+		if err := b.createStreamIfMissing(ctx); err != nil {
+			b.setLifecycle(StateStopped)
+			return err
+		}
+	}
+
+	if b.config.VerifyOnStart {
+		if err := b.verifyStream(); err != nil {
+			b.setLifecycle(StateStopped)
+			return err
+		}
+	}
+
+	if b.shards != nil {
+		if err := b.refreshShardMap(); err != nil {
+			b.setLifecycle(StateStopped)
+			return err
+		}
+	}
+
+	if b.wal != nil {
+		if replay := b.wal.takeReplay(); len(replay) > 0 {
+			b.logger.Info("Replaying records left in the write-ahead log", zap.Int("records", len(replay)))
+			b.records.pushFront(replay)
+		}
+	}
+
+	b.startStats()
+	ready := make(chan error)
+	abort := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go b.run(ready, abort, stop, done)
+
+	// We want run to run in the background (in a goroutine) but we don’t want to return until that
+	// goroutine has actually entered its main loop. So we read from this non-buffered channel, which
+	// will block until run writes a value to it. Because it’s unbuffered, if we give up waiting run
+	// can’t have entered the loop, and it won’t once abort is closed.
+	select {
+	case err := <-ready:
+		if err != nil {
+			b.stopStats()
+			b.setLifecycle(StateStopped)
+			return err
+		}
+	case <-ctx.Done():
+		close(abort)
+		b.stopStats()
+		b.setLifecycle(StateStopped)
+		return ctx.Err()
+	}
+
+	b.stop = stop
+	b.stateMu.Lock()
+	b.done = done
+	b.stateMu.Unlock()
+	b.running = true
+	b.setLifecycle(StateRunning)
+
+	return nil
+}
+
+// verifyStream returns an error if the stream can’t be described or can’t currently be written to.
+func (b *batchProducer) verifyStream() error {
+	streamName := b.StreamName()
+	input := &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(streamName)}
+	if b.config.StreamARN != "" {
+		streamName = b.config.StreamARN
+		input = &kinesis.DescribeStreamSummaryInput{StreamARN: aws.String(streamName)}
+	}
+	res, err := b.client.(StreamDescribingClient).DescribeStreamSummary(input)
+	if err != nil {
+		return fmt.Errorf("could not describe stream %v: %v", streamName, err)
+	}
+
+	status := aws.StringValue(res.StreamDescriptionSummary.StreamStatus)
+	if status != kinesis.StreamStatusActive && status != kinesis.StreamStatusUpdating {
+		return fmt.Errorf("stream %v is %v", streamName, status)
+	}
+	return nil
+}
+
+// createStreamIfMissing creates the stream if it doesn’t exist, and waits until it is active or ctx
+// is done.
+func (b *batchProducer) createStreamIfMissing(ctx context.Context) error {
+	client := b.client.(StreamCreatingClient)
+	streamName := b.StreamName()
+	created := false
+	for {
+		res, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+			StreamName: aws.String(streamName),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kinesis.ErrCodeResourceNotFoundException {
+			// Once we’ve created it the stream may not be visible straight away, so then we just
+			// keep waiting.
+			if !created {
+				if err := b.createStream(client, streamName); err != nil {
+					return err
+				}
+				created = true
+			}
+		} else if err != nil {
+			return fmt.Errorf("could not describe stream %v: %v", streamName, err)
+		} else {
+			switch status := aws.StringValue(res.StreamDescriptionSummary.StreamStatus); status {
+			case kinesis.StreamStatusActive, kinesis.StreamStatusUpdating:
+				return nil
+			case kinesis.StreamStatusCreating:
+				b.logger.Debug("Waiting for stream to be created", zap.String("stream", streamName))
+			default:
+				return fmt.Errorf("stream %v is %v", streamName, status)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.clock.After(createStreamPollInterval):
+		}
+	}
+}
+
+// createStream creates the stream for Config.CreateStreamIfMissing.
+func (b *batchProducer) createStream(client StreamCreatingClient, streamName string) error {
+	shardCount := b.config.CreateStreamShardCount
+	if shardCount == 0 {
+		shardCount = 1
+	}
+	_, err := client.CreateStream(&kinesis.CreateStreamInput{
+		StreamName: aws.String(streamName),
+		ShardCount: aws.Int64(int64(shardCount)),
+	})
+	// If someone else has created the stream since we described it, we can wait for theirs
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kinesis.ErrCodeResourceInUseException {
+		b.logger.Info("Stream is already being created", zap.String("stream", streamName))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not create stream %v: %v", streamName, err)
+	}
+	b.logger.Info("Created stream", zap.String("stream", streamName), zap.Int("shards", shardCount))
+	return nil
+}
+
+func (b *batchProducer) run(ready chan<- error, abort <-chan struct{}, stop <-chan struct{}, done chan<- struct{}) {
+	flushTicker, statTicker, err := b.newTickers()
+
+	// used to signal StartContext that we are now running (entering the main loop), unless it has
+	// given up waiting. Until then we mustn’t touch any state shared with other runs, since if we
+	// don’t enter the loop another run may already have started.
+	select {
+	case ready <- err:
+	case <-abort:
+		err = errors.New("aborted")
+	}
+	if err != nil {
+		for _, t := range []ticker{flushTicker, statTicker} {
+			if t != nil {
+				t.Stop()
+			}
+		}
+		return
+	}
+
+	// Deferred first so that it runs last, once we have cleaned up
+	defer close(done)
+
+	// A nil channel blocks forever, so if a ticker isn’t needed its case in the select below will
+	// never fire.
+	var statTick <-chan time.Time
+
+	b.flushTicker, b.flushTick = flushTicker, nil
+	if flushTicker != nil {
+		b.flushTick = flushTicker.Chan()
+	}
+	// Reconfigure may replace the flush ticker
+	defer func() {
+		if b.flushTicker != nil {
+			b.flushTicker.Stop()
+		}
+	}()
+
+	if statTicker != nil {
+		defer statTicker.Stop()
+		statTick = statTicker.Chan()
+		b.lastStatDelivery = b.clock.Now()
+	}
+
+	if b.config.HealthCheckInterval > 0 {
+		// Closed when we return, whether because of Stop or a panic
+		quit := make(chan struct{})
+		checked := make(chan struct{})
+		go b.checkHealth(quit, checked)
+		defer func() {
+			close(quit)
+			<-checked
+		}()
+	}
+
+	if b.shards != nil {
+		quit := make(chan struct{})
+		refreshed := make(chan struct{})
+		go b.refreshShardMapEvery(quit, refreshed)
+		defer func() {
+			close(quit)
+			<-refreshed
+		}()
+	}
+
+	b.effectiveFlushInterval = b.config.FlushInterval
+	b.startWarmUp()
+
+	for b.loop(statTick, stop) {
+		if !b.config.RestartOnPanic {
+			b.stopAfterPanic(stop)
+			return
+		}
+		b.logger.Warn("Restarting the main loop after a panic")
+	}
+}
+
+// checkHealth checks the stream every Config.HealthCheckInterval until quit is closed, sending a
+// HealthEvent whenever it becomes healthy or unhealthy. It closes done when it returns.
+func (b *batchProducer) checkHealth(quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	t := b.clock.NewTicker(b.config.HealthCheckInterval)
+	defer t.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.Chan():
+		}
+
+		err := b.verifyStream()
+		if (err == nil) == healthy {
+			continue
+		}
+		healthy = err == nil
+		if healthy {
+			b.logger.Info("Health check succeeded; the stream is healthy again", zap.String("stream", b.StreamName()))
+		} else {
+			b.logger.Warn("Health check failed", zap.String("stream", b.StreamName()), zap.Error(err))
+		}
+		b.emit(&HealthEvent{Healthy: healthy, Err: err})
+	}
+}
+
+// refreshShardMapEvery refreshes the shard map every Config.ShardMapInterval until quit is
+// closed, keeping the old map if that fails. It closes done when it returns.
+func (b *batchProducer) refreshShardMapEvery(quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	t := b.clock.NewTicker(b.config.ShardMapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.Chan():
+		}
+
+		if err := b.refreshShardMap(); err != nil {
+			b.logger.Warn("Could not refresh the shard map", zap.String("stream", b.StreamName()), zap.Error(err))
+		}
+	}
+}
+
+// refreshShardMap lists the stream’s shards and updates the shard map with them.
+func (b *batchProducer) refreshShardMap() error {
+	ranges, err := listShards(b.client.(ShardListingClient), b.StreamName(), b.config.StreamARN)
+	if err != nil {
+		return fmt.Errorf("could not list the shards of the stream: %v", err)
+	}
+	return b.shards.update(ranges)
+}
+
+// newTickers returns the tickers used by the main loop, or nil for those that aren’t needed. If it
+// panics, e.g. because of a bug, it recovers and returns an error instead so that StartContext can
+// report it.
+func (b *batchProducer) newTickers() (flushTicker, statTicker ticker, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if flushTicker != nil {
+				flushTicker.Stop()
+			}
+			flushTicker, statTicker = nil, nil
+			b.logger.Error("Recovered from panic while starting", zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+			err = fmt.Errorf("panic while starting: %v", r)
+		}
+	}()
+
+	if b.config.FlushInterval > 0 {
+		flushTicker = b.clock.NewTicker(b.config.FlushInterval)
+	}
+
+	if (b.config.StatReceiver != nil || b.config.MaxRecordsPerKeyPerInterval > 0) && b.config.StatInterval > 0 {
+		statTicker = b.clock.NewTicker(b.config.StatInterval)
+	}
+
+	return flushTicker, statTicker, nil
+}
+
+// loop is the main loop. It returns false when the Producer is stopped, or true if it panicked.
+func (b *batchProducer) loop(statTick <-chan time.Time, stop <-chan struct{}) (panicked bool) {
+	// If we panic while handling a drain request then Drain would wait forever for the result
+	var pendingDrain *drainRequest
+
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			stack := debug.Stack()
+			b.logger.Error("Recovered from panic in main loop", zap.Any("panic", r), zap.ByteString("stack", stack))
+			b.emit(&PanicEvent{Value: r, Stack: stack})
+			if pendingDrain != nil {
+				pendingDrain.result <- drainResult{remaining: b.bufferLen()}
+			}
+		}
+	}()
+
+	for {
+		// Rather than polling the buffer, wait for something that might make a full batch ready to
+		// be sent. Nothing can be sent while the circuit breaker is cooling down, so there’s no
+		// need to wake up for new records until it is over.
+		b.warmUp()
+		var ready <-chan struct{}
+		var cooledDown <-chan time.Time
+		wake := b.wake
+		if b.bufferLen() >= b.effectiveBatchSize && !b.isPaused() {
+			if remaining := b.circuitCooldownRemaining(); remaining > 0 {
+				cooledDown = b.clock.After(remaining)
+				wake = nil
+			} else {
+				ready = alwaysReady
+			}
+		}
+
+		select {
+		case <-b.flushTick:
+			b.checkIdle()
+			if !b.isPaused() {
+				queued := b.bufferLen()
+				b.flush()
+				b.adaptFlushInterval(queued)
+			}
+		case <-statTick:
+			b.keyCounts = nil
+			b.takeStats()
+		case batch := <-b.sent:
+			b.outstandingBatches--
+			b.handleSent(batch)
+		case req := <-b.drain:
+			pendingDrain = &req
+			b.awaitBatches()
+			ctx, cancel := timeoutContext(req.timeout)
+			sent, _ := b.sendAll(ctx)
+			cancel()
+			pendingDrain = nil
+			req.result <- drainResult{sent: sent, remaining: b.bufferLen()}
+		case req := <-b.reconfigure:
+			b.applyBatching(req.batchSize, req.flushInterval)
+			b.resetFlushTicker()
+			close(req.done)
+		case <-stop:
+			b.awaitBatches()
+			b.sendStats()
+			b.stopStats()
+			b.closeFiles()
+			return false
+		case <-ready:
+			b.sendNextBatch(b.effectiveBatchSize)
+		case <-wake:
+		case <-cooledDown:
+		}
+	}
+}
+
+// alwaysReady is a closed channel, for a select case that is always ready.
+var alwaysReady = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// wakeUp wakes the main goroutine, if it is waiting, to check whether there’s a full batch to send.
+// It never blocks.
+func (b *batchProducer) wakeUp() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// from/for interface Producer
+func (b *batchProducer) Pause() {
+	if atomic.CompareAndSwapInt32(&b.paused, 0, 1) {
+		b.logger.Info("Paused", zap.String("stream", b.StreamName()))
+		b.emit(&PausedEvent{})
+	}
+}
+
+// from/for interface Producer
+func (b *batchProducer) Resume() {
+	if atomic.CompareAndSwapInt32(&b.paused, 1, 0) {
+		b.logger.Info("Resumed", zap.String("stream", b.StreamName()))
+		b.emit(&ResumedEvent{})
+		b.wakeUp()
+	}
+}
+
+func (b *batchProducer) isPaused() bool {
+	return atomic.LoadInt32(&b.paused) == 1
+}
+
+// stopAfterPanic marks the Producer as stopped, so that Add starts failing, once the main loop has
+// panicked and isn’t going to be restarted.
+func (b *batchProducer) stopAfterPanic(stop <-chan struct{}) {
+	// Stop and Drain might be holding runningMu while they wait for the main goroutine, i.e. us, so
+	// we have to keep answering them while another goroutine waits for the lock.
+	locked := make(chan struct{})
+	go func() {
+		b.runningMu.Lock()
+		defer b.runningMu.Unlock()
+		select {
+		case <-stop:
+			// Stop has marked the Producer as stopped itself, and it may since have been restarted
+		default:
+			b.running = false
+			b.setLifecycle(StateStopped)
+		}
+		close(locked)
+	}()
+
+	b.stopStats()
+	// Batches still being sent in the background would otherwise leave their records in flight
+	b.awaitBatches()
+
+	for {
+		select {
+		case <-locked:
+			return
+		case <-stop:
+			return
+		case req := <-b.drain:
+			req.result <- drainResult{remaining: b.bufferLen()}
+		case req := <-b.reconfigure:
+			b.applyBatching(req.batchSize, req.flushInterval)
+			close(req.done)
+		}
+	}
+}
+
+// UnsentRecordsError is returned by Stop and StopContext when Config.DrainOnStop is true but not
+// every buffered record could be sent.
+type UnsentRecordsError struct {
+	// Remaining is the number of records left in the buffer.
+	Remaining int
+
+	// Err is the error of the context passed to StopContext if it was done before they could be
+	// sent, or else nil.
+	Err error
+}
+
+func (e *UnsentRecordsError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v records were not sent before stopping: %v", e.Remaining, e.Err)
+	}
+	return fmt.Sprintf("%v records were not sent before stopping", e.Remaining)
+}
+
+// from/for interface Producer
+func (b *batchProducer) Stop() error {
+	err := b.StopContext(context.Background())
+	// Even if the Producer was already stopped, by a StopContext that gave up waiting
+	<-b.Done()
+	return err
+}
+
+// from/for interface Producer
+func (b *batchProducer) StopContext(ctx context.Context) error {
+	if err := b.halt(ctx); err != nil || !b.config.DrainOnStop {
+		return err
+	}
+
+	b.stoppedMu.Lock()
+	defer b.stoppedMu.Unlock()
+	defer b.closeFiles()
+	sent, timedOut := b.sendAll(ctx)
+	remaining := b.bufferLen()
+	b.tryEmit(&FlushCompleteEvent{Sent: sent, Remaining: remaining, TimedOut: timedOut})
+	if remaining == 0 {
+		return nil
+	}
+	err := &UnsentRecordsError{Remaining: remaining}
+	if timedOut {
+		err.Err = ctx.Err()
+	}
+	return err
+}
+
+// stopWithoutDraining is like Stop except that it ignores Config.DrainOnStop.
+func (b *batchProducer) stopWithoutDraining() {
+	b.halt(context.Background())
+	<-b.Done()
+}
+
+// halt is StopContext without Config.DrainOnStop.
+func (b *batchProducer) halt(ctx context.Context) error {
+	b.runningMu.Lock()
+	defer b.runningMu.Unlock()
+
+	if !b.running {
+		return ErrAlreadyStopped
+	}
+
+	// request the main goroutine to stop
+	close(b.stop)
+
+	// block until the main goroutine has stopped, and stopped its tickers, so that it can’t
+	// interfere with a later run; if we give up, StartContext waits for it instead.
+	var err error
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	b.running = false
+	b.setLifecycle(StateStopped)
+
+	return err
+}
+
+func (b *batchProducer) Events() <-chan Event {
+	return (<-chan Event)(b.events)
+}
+
+// from/for interface Producer
+func (b *batchProducer) Done() <-chan struct{} {
+	b.stateMu.RLock()
+	defer b.stateMu.RUnlock()
+	return b.done
+}
+
+// from/for interface Producer
+func (b *batchProducer) Subscribe(ctx context.Context, types ...EventType) <-chan Event {
+	return b.dispatcher.subscribe(ctx, cap(b.events), types)
+}
+
+// emit sends event to the subscriptions that want it and to Events.
+func (b *batchProducer) emit(event Event) {
+	if !b.dispatcher.dispatch(event, true) {
+		b.events <- event
+		return
+	}
+
+	select {
+	case b.events <- event:
+	default:
+	}
+}
+
+// tryEmit is like emit except that it never blocks: event is discarded by Events and by any
+// subscriptions that have no room for it.
+func (b *batchProducer) tryEmit(event Event) {
+	b.dispatcher.dispatch(event, false)
+	select {
+	case b.events <- event:
+	default:
+	}
+}
+
+// from/for interface Producer
+func (b *batchProducer) SetStreamName(name string) error {
+	if name == "" {
+		return errors.New("stream name must not be empty")
+	}
+	if b.config.StreamARN != "" {
+		return errors.New("the stream is addressed by Config.StreamARN, not by name")
+	}
+
+	b.streamNameMu.Lock()
+	b.streamName = name
+	b.streamNameMu.Unlock()
+
+	// The shards of the old stream are no use until the map is next refreshed
+	if b.shards != nil {
+		b.shards.update(nil)
+	}
+
+	return nil
+}
+
+// from/for interface Producer
+func (b *batchProducer) StreamName() string {
+	b.streamNameMu.RLock()
+	defer b.streamNameMu.RUnlock()
+	return b.streamName
+}
+
+// from/for interface Producer
+func (b *batchProducer) Reconfigure(batchSize int, flushInterval time.Duration) error {
+	if err := validateBatching(batchSize, flushInterval, b.records.capacity()); err != nil {
+		return err
+	}
+	if b.config.Ordering == OrderingStrict && batchSize != 1 {
+		return errors.New("OrderingStrict requires BatchSize to be 1")
+	}
+
+	// Holding the read lock prevents the main goroutine from being stopped while we wait for it.
+	b.runningMu.RLock()
+	defer b.runningMu.RUnlock()
+
+	if b.running {
+		req := reconfigureRequest{batchSize: batchSize, flushInterval: flushInterval, done: make(chan struct{})}
+		b.reconfigure <- req
+		<-req.done
+	} else {
+		b.applyBatching(batchSize, flushInterval)
+	}
+
+	return nil
+}
+
+// applyBatching applies the new values of Reconfigure. It must only be called from the main
+// goroutine, or while it isn’t running.
+func (b *batchProducer) applyBatching(batchSize int, flushInterval time.Duration) {
+	b.configMu.Lock()
+	b.config.BatchSize = batchSize
+	b.config.FlushInterval = flushInterval
+	b.configMu.Unlock()
+	b.effectiveBatchSize = batchSize
+	b.effectiveFlushInterval = flushInterval
+	b.logger.Info("Reconfigured", zap.Int("batchSize", batchSize), zap.Duration("flushInterval", flushInterval))
+}
+
+// resetFlushTicker replaces the flush ticker with one for the effective flush interval. It must
+// only be called from the main goroutine.
+func (b *batchProducer) resetFlushTicker() {
+	if b.flushTicker != nil {
+		b.flushTicker.Stop()
+	}
+	b.flushTicker, b.flushTick = nil, nil
+	if b.effectiveFlushInterval > 0 {
+		b.flushTicker = b.clock.NewTicker(b.effectiveFlushInterval)
+		b.flushTick = b.flushTicker.Chan()
+	}
+}
+
+// from/for interface Producer
+func (b *batchProducer) Config() Config {
+	b.configMu.RLock()
+	config := b.config
+	b.configMu.RUnlock()
+	config.NonRetryableErrorCodes = append([]string(nil), config.NonRetryableErrorCodes...)
+	return config
+}
+
+// from/for interface Producer
+// TODO: once stopped, sendAll sends one batch at a time, even if Config.MaxConcurrentBatches is
+// more than 1
+func (b *batchProducer) Flush(timeout time.Duration, sendStats bool) (int, int, error) {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	sent, remaining, _ := b.FlushContext(ctx, sendStats)
+	return sent, remaining, nil
+}
+
+// from/for interface Producer
+func (b *batchProducer) FlushContext(ctx context.Context, sendStats bool) (int, int, error) {
+	b.halt(ctx)
+	select {
+	case <-b.Done():
+	case <-ctx.Done():
+		// The main goroutine is still finishing, so we can’t send anything
+		return 0, b.bufferLen() + b.InFlight(), ctx.Err()
+	}
+
+	b.stoppedMu.Lock()
+	defer b.stoppedMu.Unlock()
+	defer b.closeFiles()
+	sent, timedOut := b.sendAll(ctx)
+	if !timedOut && sendStats {
+		b.sendStats()
+	}
+
+	remaining := b.bufferLen()
+	b.tryEmit(&FlushCompleteEvent{Sent: sent, Remaining: remaining, TimedOut: timedOut})
+	if timedOut {
+		return sent, remaining, ctx.Err()
+	}
+	return sent, remaining, nil
+}
+
+// timeoutContext returns a context that is done after timeout, or never if timeout is 0.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// from/for interface Producer
+func (b *batchProducer) StopAndDrain() ([]Record, error) {
+	b.stopWithoutDraining()
+	b.stoppedMu.Lock()
+	defer b.stoppedMu.Unlock()
+	defer b.closeFiles()
+
+	var taken []batchRecord
+	for b.bufferLen() > 0 {
+		// Only some of the records spilled to disk, if any, are taken each time
+		more := b.takeRecordsFromBuffer(b.bufferLen())
+		if len(more) == 0 && b.memoryLen() == 0 {
+			break
+		}
+		taken = append(taken, more...)
+	}
+	records := make([]Record, len(taken))
+	for i, record := range taken {
+		records[i] = Record{Data: record.data, PartitionKey: record.partitionKey, ExplicitHashKey: record.explicitHashKey}
+		// They’re the caller’s responsibility now
+		b.completeInWAL(record)
+	}
+	if len(records) > 0 {
+		b.logger.Info("Removed records from the buffer to be handed back", zap.Int("records", len(records)))
+	}
+	return records, nil
+}
+
+// from/for interface Producer
+func (b *batchProducer) FlushOrdered(timeout time.Duration) (int, int, error) {
+	b.stopWithoutDraining()
+	b.stoppedMu.Lock()
+	defer b.stoppedMu.Unlock()
+	defer b.closeFiles()
+
+	ctx, cancel := timeoutContext(timeout)
+	sent, _ := b.sendAll(ctx)
+	cancel()
+	return sent, b.bufferLen(), nil
+}
+
+// from/for interface Producer
+func (b *batchProducer) Drain(timeout time.Duration) (int, int, error) {
+	// Holding the read lock prevents the main goroutine from being stopped while we wait for it.
+	b.runningMu.RLock()
+	defer b.runningMu.RUnlock()
+
+	var result drainResult
+	if b.running {
+		req := drainRequest{timeout: timeout, result: make(chan drainResult)}
+		b.drain <- req
+		result = <-req.result
+	} else {
+		b.stoppedMu.Lock()
+		ctx, cancel := timeoutContext(timeout)
+		result.sent, _ = b.sendAll(ctx)
+		cancel()
+		result.remaining = b.bufferLen()
+		b.closeFiles()
+		b.stoppedMu.Unlock()
+	}
+
+	// If the main goroutine is still stopping, the batches it’s waiting for haven’t been dealt with
+	return result.sent, result.remaining + b.InFlight(), nil
+}
+
+// from/for interface Producer
+func (b *batchProducer) InFlight() int {
+	return int(atomic.LoadInt64(&b.inFlightRecords))
+}
+
+// sendAll sends batches of the maximum size until either the buffer is empty or ctx is done, which
+// also cancels the requests. It must not be called concurrently with sendBatch.
+func (b *batchProducer) sendAll(ctx context.Context) (sent int, timedOut bool) {
+	b.sendCtx = ctx
+	defer func() {
+		b.sendCtx = nil
+	}()
+
+	// Failed records are put back in the buffer before sendBatch returns, so once it’s empty
+	// there’s nothing left to send.
+	for b.bufferLen() > 0 {
+		select {
+		case <-ctx.Done():
+			return sent, true
+		default:
+		}
+
+		// If the circuit is open then sendBatch won’t send anything until the cooldown is over,
+		// so rather than spinning we’ll wait for it.
+		if remaining := b.circuitCooldownRemaining(); remaining > 0 {
+			select {
+			case <-ctx.Done():
+				return sent, true
+			case <-b.clock.After(remaining):
+			}
+		}
+
+		sent += b.sendBatch(MaxKinesisBatchSize)
+	}
+	return sent, false
+}
+
+// countKeys adds the records being sent for the first time to keyCounts and sends a HotKeyEvent
+// for each key that goes over Config.MaxRecordsPerKeyPerInterval. It must only be called from the
+// main goroutine.
+func (b *batchProducer) countKeys(records []batchRecord) {
+	if b.config.MaxRecordsPerKeyPerInterval == 0 {
+		return
+	}
+	if b.keyCounts == nil {
+		b.keyCounts = make(map[string]int)
+	}
+	for _, record := range records {
+		if record.sendAttempts > 0 {
+			continue
+		}
+		b.keyCounts[record.partitionKey]++
+		if count := b.keyCounts[record.partitionKey]; count == b.config.MaxRecordsPerKeyPerInterval+1 {
+			b.logger.Warn("Hot partition key", zap.String("stream", b.StreamName()),
+				zap.String("partitionKey", record.partitionKey), zap.Int("records", count))
+			b.emit(&HotKeyEvent{PartitionKey: record.partitionKey, Count: count})
+		}
+	}
+}
+
+// checkIdle is called every FlushInterval, and sends an IdleWarningEvent once the buffer has been
+// empty at idleWarningFlushes flushes in a row. It must only be called from the main goroutine.
+func (b *batchProducer) checkIdle() {
+	if b.bufferLen() > 0 {
+		b.idleFlushes = 0
+		return
+	}
+	b.idleFlushes++
+	// Only once per idle streak
+	if b.idleFlushes == idleWarningFlushes {
+		b.logger.Info("The buffer has been empty at every flush for a while; FlushInterval could be longer",
+			zap.Int("flushes", b.idleFlushes), zap.Duration("flushInterval", b.config.FlushInterval))
+		b.emit(&IdleWarningEvent{EmptyFlushes: b.idleFlushes, FlushInterval: b.config.FlushInterval})
+	}
+}
+
+// flush is called every FlushInterval. It must only be called from the main goroutine.
+func (b *batchProducer) flush() {
+	if !b.config.FlushDrainsBuffer {
+		b.sendBatch(b.effectiveBatchSize)
+		return
+	}
+
+	// Only the records that were in the buffer when the flush began are sent, so that records
+	// which are added or re-enqueued meanwhile can’t keep us here indefinitely.
+	for remaining := b.bufferLen(); remaining > 0; remaining -= MaxKinesisBatchSize {
+		batchSize := MaxKinesisBatchSize
+		if remaining < batchSize {
+			batchSize = remaining
+		}
+		b.sendBatch(batchSize)
+
+		if b.consecutiveErrors > 0 {
+			return
+		}
+	}
+}
+
+func (b *batchProducer) isRunning() bool {
+	b.runningMu.RLock()
+	defer b.runningMu.RUnlock()
+	return b.running
+}
+
+// Sends batches of records to Kinesis, possibly re-enqueing them if there are any errors or failed
+// records. Returns the number of records successfully sent, if any.
+func (b *batchProducer) sendBatch(batchSize int) int {
+	batch := b.prepareBatch(batchSize)
+	if batch == nil {
+		return 0
+	}
+	b.send(batch)
+	return b.handleSent(batch)
+}
+
+// sendNextBatch sends a batch of up to batchSize records, in the background if
+// Config.MaxConcurrentBatches allows it. It must only be called from the main goroutine.
+func (b *batchProducer) sendNextBatch(batchSize int) {
+	if b.sent == nil {
+		b.sendBatch(batchSize)
+		return
+	}
+	if b.consecutiveErrors > 0 || b.throttleDelay > 0 || b.circuit != circuitClosed {
+		// One at a time, so that each batch knows how the one before it went
+		b.awaitBatches()
+		b.sendBatch(batchSize)
+		return
+	}
+	if b.outstandingBatches >= b.config.MaxConcurrentBatches {
+		b.outstandingBatches--
+		b.handleSent(<-b.sent)
+		return
+	}
+
+	batch := b.prepareBatch(batchSize)
+	if batch == nil {
+		return
+	}
+	b.outstandingBatches++
+	go func() {
+		b.send(batch)
+		b.sent <- batch
+	}()
+}
+
+// awaitBatches waits for the batches sent in the background, if any, and deals with their
+// outcomes. It must only be called from the main goroutine.
+func (b *batchProducer) awaitBatches() {
+	for ; b.outstandingBatches > 0; b.outstandingBatches-- {
+		b.handleSent(<-b.sent)
+	}
+}
+
+// sentBatch is a batch on its way to Kinesis, and then the outcome of sending it.
+type sentBatch struct {
+	records    []batchRecord
+	req        *putRecordsRequest
+	streamName string
+
+	// ctx is the one returned by Config.BeforeSend, for AfterSend, and reqCtx the one the request
+	// is sent with, which is the same unless sendAll is sending it.
+	ctx    context.Context
+	reqCtx context.Context
+
+	res *kinesis.PutRecordsOutput
+	err error
+}
+
+// prepareBatch takes up to batchSize records from the buffer to be sent, after backing off if
+// Kinesis has been returning errors. It returns nil if there is nothing to send. It must only be
+// called from the main goroutine, or while it isn’t running.
+func (b *batchProducer) prepareBatch(batchSize int) *sentBatch {
+	if b.bufferLen() == 0 {
+		return nil
+	}
+
+	if b.circuit == circuitOpen {
+		if b.circuitCooldownRemaining() > 0 {
+			return nil
+		}
+		b.setCircuit(circuitHalfOpen)
+		b.logger.Debug("Circuit breaker cooldown has elapsed; sending a probe batch")
+	}
+
+	// In the future, maybe this could be a RetryPolicy or something
+	if b.consecutiveErrors == 1 {
+		b.currentDelay = 50 * time.Millisecond
+	} else if b.consecutiveErrors > 1 {
+		b.currentDelay *= 2
+	}
+
+	// The cooldown of the circuit breaker takes the place of the delay for a probe batch.
+	if b.currentDelay > 0 && b.circuit != circuitHalfOpen {
+		b.logger.Debug("Delaying the batch because of consecutive errors", zap.Duration("delay", b.currentDelay), zap.Int("consecutiveErrors", b.consecutiveErrors))
+		b.clock.Sleep(b.currentDelay)
+	} else if b.throttleDelay > 0 {
+		b.logger.Debug("Delaying the batch because records were throttled", zap.Duration("delay", b.throttleDelay))
+		b.clock.Sleep(b.throttleDelay)
+	}
+
+	if b.config.Ordering == OrderingStrict {
+		// sendAll and FlushDrainsBuffer send batches of the maximum size regardless
+		batchSize = 1
+	}
+	records := b.takeRecordsFromBuffer(batchSize)
+	if b.config.Ordering == OrderingPerPartitionKey {
+		records = b.holdBackRepeatedKeys(records)
+	}
+	if b.shards != nil {
+		records = b.holdBackFullShards(records)
+	}
+	if n := fitInRequest(records); n < len(records) {
+		// Put the rest back at the front of the queue, in order, for the next batch
+		b.records.pushFront(records[n:])
+		records = records[:n]
+	}
+	if len(records) == 0 {
+		// They must all have expired
+		return nil
+	}
+	b.idleFlushes = 0
+	b.countKeys(records)
+	if b.retryBudget != nil {
+		b.retryBudget.sent(b.clock, len(records))
+	}
+	// handleSent takes them off again
+	atomic.AddInt64(&b.inFlightRecords, int64(len(records)))
+
+	b.waitForRateLimits(records)
+
+	batch := &sentBatch{records: records, streamName: b.StreamName(), ctx: context.Background()}
+	if b.config.BeforeSend != nil {
+		batch.ctx = b.config.BeforeSend(len(records))
+	}
+	batch.reqCtx = batch.ctx
+	if b.sendCtx != nil {
+		batch.reqCtx = b.sendCtx
+	}
+	batch.req = b.recordsToInput(batch.streamName, records)
+	return batch
+}
+
+// send sends a batch returned by prepareBatch. It is safe to call from any goroutine.
+func (b *batchProducer) send(batch *sentBatch) {
+	batch.res, batch.err = b.putRecords(batch.reqCtx, &batch.req.PutRecordsInput)
+	if b.config.OnPutRecords != nil {
+		b.config.OnPutRecords(&batch.req.PutRecordsInput, batch.res, batch.err)
+	}
+	batch.req.release()
+	batch.req = nil
+	if b.config.AfterSend != nil {
+		b.config.AfterSend(batch.ctx, len(batch.records), batch.err)
+	}
+}
+
+// handleSent deals with the outcome of sending a batch, and returns the number of records that
+// were written. It must only be called from the main goroutine, or while it isn’t running.
+func (b *batchProducer) handleSent(batch *sentBatch) int {
+	records, streamName, res, err := batch.records, batch.streamName, batch.res, batch.err
+
+	// Failed records that are returned to the buffer stay in flight until they are back in it, so
+	// whoever returns them takes them off pending.
+	pending := len(records)
+	defer func() {
+		atomic.AddInt64(&b.inFlightRecords, -int64(pending))
+	}()
+
+	if err != nil {
+		b.stateMu.Lock()
+		b.consecutiveErrors++
+		b.stateMu.Unlock()
+		b.currentStat.KinesisErrorsSinceLastStat++
+		b.emit(newError(err.Error()))
+
+		if aerr, ok := err.(awserr.Error); ok && b.classify(aerr.Code()) == ErrorThrottled {
+			b.adaptBatchSize(true)
+		}
+
+		if b.circuit == circuitHalfOpen ||
+			(b.config.CircuitBreakerThreshold > 0 && b.consecutiveErrors >= b.config.CircuitBreakerThreshold) {
+			b.openCircuit()
+		}
+
+		if b.config.DropPolicy == DropOldest && b.shouldShed() {
+			// In order to prevent Add from hanging indefinitely, we start dropping records
+			b.currentStat.RecordsDroppedSinceLastStat += len(records)
+			b.currentStat.RecordsDroppedBufferFullSinceLastStat += len(records)
+			b.logger.Error("DROPPING records because buffer is full or nearly full and there have been consecutive errors from Kinesis",
+				zap.String("stream", streamName), zap.Int("records", len(records)), zap.Int("consecutiveErrors", b.consecutiveErrors))
+			dropErr := fmt.Errorf("record dropped because the buffer is full or nearly full and Kinesis returned an error: %v", err)
+			for _, record := range records {
+				record.sendAttempts++
+				b.drop(record, dropErr)
+			}
+		} else {
+			b.logger.Debug("Returning records to buffer",
+				zap.String("stream", streamName), zap.Int("records", len(records)), zap.Int("consecutiveErrors", b.consecutiveErrors))
+			pending = 0
+			b.returnToBuffer(func() {
+				b.returnRecordsToBuffer(records, err)
+				atomic.AddInt64(&b.inFlightRecords, -int64(len(records)))
+			})
+		}
+
+		return 0
+	}
+
+	if b.circuit == circuitHalfOpen {
+		b.logger.Info("Probe batch succeeded; closing circuit breaker")
+	}
+	b.stateMu.Lock()
+	b.circuit = circuitClosed
+	b.consecutiveErrors = 0
+	b.stateMu.Unlock()
+	b.currentDelay = 0
+	throttled := b.isThrottled(res)
+	b.adaptBatchSize(throttled)
+	b.backOffIfThrottled(throttled)
+	// The entries decide which records were written, not FailedRecordCount, so that callbacks,
+	// stats, events and checkpoints all agree; Kinesis sometimes returns a FailedRecordCount of 0
+	// rather than omitting it anyway
+	var succeeded int
+	for i, record := range records {
+		if entry := resultEntry(res, i); !entryFailed(entry) {
+			b.wrote(record, entry)
+			succeeded++
+		}
+	}
+	if succeeded == len(records) {
+		b.logger.Debug("PutRecords request succeeded", zap.String("stream", streamName), zap.Int("records", succeeded))
+	} else {
+		failed := len(records) - succeeded
+		b.logger.Debug("Partial success when sending a PutRecords request; re-enqueueing failed records",
+			zap.String("stream", streamName), zap.Int("succeeded", succeeded), zap.Int("failed", failed))
+		// The records that were written are settled now, even if returning the others blocks
+		atomic.AddInt64(&b.inFlightRecords, -int64(succeeded))
+		pending = 0
+		b.returnToBuffer(func() {
+			b.returnSomeFailedRecordsToBuffer(res, records)
+			atomic.AddInt64(&b.inFlightRecords, -int64(failed))
+		})
+	}
+
+	if b.config.EmitSuccessDetails && succeeded > 0 {
+		b.emit(newRecordsWrittenEvent(res, records))
+	}
+
+	if b.config.CheckpointFunc != nil {
+		for i := range records {
+			if entry := resultEntry(res, i); !entryFailed(entry) {
+				b.config.CheckpointFunc(aws.StringValue(entry.ShardId), aws.StringValue(entry.SequenceNumber))
+			}
+		}
+	}
+
+	b.currentStat.RecordsSentSuccessfullySinceLastStat += succeeded
+	return succeeded
+}
+
+// putRecords sends input to Kinesis, within Config.PutRecordsTimeout if it’s set. The request is
+// cancelled if ctx is done, if the client supports that.
+func (b *batchProducer) putRecords(ctx context.Context, input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if b.config.PutRecordsTimeout == 0 {
+		if client, ok := b.client.(ContextBatchingKinesisClient); ok && ctx.Done() != nil {
+			return client.PutRecordsWithContext(ctx, input)
+		}
+		return b.client.PutRecords(input)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.config.PutRecordsTimeout)
+	defer cancel()
+	return b.client.(ContextBatchingKinesisClient).PutRecordsWithContext(ctx, input)
+}
+
+func newRecordsWrittenEvent(res *kinesis.PutRecordsOutput, records []batchRecord) *RecordsWrittenEvent {
+	written := make([]WrittenRecord, 0, len(records))
+	for i := range records {
+		result := resultEntry(res, i)
+		if entryFailed(result) {
+			continue
+		}
+		written = append(written, WrittenRecord{
+			PartitionKey:   records[i].partitionKey,
+			SequenceNumber: aws.StringValue(result.SequenceNumber),
+			ShardID:        aws.StringValue(result.ShardId),
+		})
+	}
+	return &RecordsWrittenEvent{Records: written}
+}
+
+// adaptBatchSize adjusts effectiveBatchSize after a batch has been sent, if
+// config.AdaptiveBatchSize is true. See the docs of that field for details.
+func (b *batchProducer) adaptBatchSize(throttled bool) {
+	if !b.config.AdaptiveBatchSize {
+		return
+	}
+
+	size := b.effectiveBatchSize
+	if throttled {
+		floor := b.minBatchSize()
+		size /= 2
+		if size < floor {
+			size = floor
+		}
+	} else {
+		step := b.config.BatchSize / 10
+		if step < 1 {
+			step = 1
+		}
+		size += step
+		if size > b.config.BatchSize {
+			size = b.config.BatchSize
+		}
+	}
+
+	if size != b.effectiveBatchSize {
+		b.logger.Debug("Changing effective batch size", zap.Int("previousBatchSize", b.effectiveBatchSize), zap.Int("batchSize", size))
+		b.effectiveBatchSize = size
+	}
+}
+
+// minBatchSize returns Config.MinBatchSize, or its default, but never more than BatchSize, which
+// Reconfigure may have lowered.
+func (b *batchProducer) minBatchSize() int {
+	floor := b.config.MinBatchSize
+	if floor == 0 {
+		floor = adaptiveBatchSizeFloor
+	}
+	if floor > b.config.BatchSize {
+		floor = b.config.BatchSize
+	}
+	return floor
+}
+
+// adaptFlushInterval adjusts effectiveFlushInterval after a flush that found queued records in the
+// buffer, if Config.MinFlushInterval is set. It must only be called from the main goroutine.
+func (b *batchProducer) adaptFlushInterval(queued int) {
+	if b.config.MinFlushInterval == 0 || b.config.FlushInterval == 0 || queued == 0 {
+		return
+	}
+
+	interval := b.effectiveFlushInterval
+	if queued < b.effectiveBatchSize/2 {
+		interval /= 2
+		if interval < b.config.MinFlushInterval {
+			interval = b.config.MinFlushInterval
+		}
+	} else {
+		interval *= 2
+	}
+	// Reconfigure may have lowered FlushInterval below MinFlushInterval
+	if interval > b.config.FlushInterval {
+		interval = b.config.FlushInterval
+	}
+
+	if interval != b.effectiveFlushInterval {
+		b.logger.Debug("Changing effective flush interval", zap.Duration("previousFlushInterval", b.effectiveFlushInterval), zap.Duration("flushInterval", interval))
+		b.effectiveFlushInterval = interval
+		b.resetFlushTicker()
+	}
+}
+
+// startWarmUp starts Config.WarmupDuration, if it is set. It must only be called from the main
+// goroutine.
+func (b *batchProducer) startWarmUp() {
+	if b.config.WarmupDuration <= 0 {
+		return
+	}
+	b.warmUpStartedAt = b.clock.Now()
+	b.warmingUp = true
+	b.warmUp()
+}
+
+// warmUp limits effectiveBatchSize during Config.WarmupDuration. See the docs of that field for
+// details. It must only be called from the main goroutine.
+func (b *batchProducer) warmUp() {
+	if !b.warmingUp {
+		return
+	}
+
+	batchSize := b.config.BatchSize
+	elapsed := b.clock.Now().Sub(b.warmUpStartedAt)
+	if elapsed >= b.config.WarmupDuration {
+		b.warmingUp = false
+		if !b.config.AdaptiveBatchSize {
+			b.effectiveBatchSize = batchSize
+		}
+		b.logger.Debug("Warm-up is over", zap.Int("batchSize", batchSize))
+		return
+	}
+
+	floor := b.minBatchSize()
+	limit := floor + int(int64(batchSize-floor)*int64(elapsed)/int64(b.config.WarmupDuration))
+	if !b.config.AdaptiveBatchSize || b.effectiveBatchSize > limit {
+		b.effectiveBatchSize = limit
+	}
+}
+
+// errNoResultEntry is the error of a record that a PutRecords response had no entry for, or a nil
+// one. Kinesis always returns an entry for each record, but mocks, proxies and adapters may not.
+var errNoResultEntry = errors.New("the PutRecords response had no result for the record")
+
+// resultEntry returns the entry for the ith record of a batch in res, its PutRecords response, or
+// nil if res has none.
+func resultEntry(res *kinesis.PutRecordsOutput, i int) *kinesis.PutRecordsResultEntry {
+	if i < len(res.Records) {
+		return res.Records[i]
+	}
+	return nil
+}
+
+// entryFailed reports whether the record of entry, from a PutRecords response, failed. Kinesis sets
+// both ErrorCode and ErrorMessage for a failed record, but one is enough to count it as failed, so
+// that a record is never taken to be both written and failed. A nil entry, for a record that the
+// response had no result for, counts as failed too.
+func entryFailed(entry *kinesis.PutRecordsResultEntry) bool {
+	return entry == nil || entry.ErrorCode != nil || entry.ErrorMessage != nil
+}
+
+// isThrottled returns true if any of the records in res were rejected because of throttling.
+func (b *batchProducer) isThrottled(res *kinesis.PutRecordsOutput) bool {
+	for _, result := range res.Records {
+		if result != nil && result.ErrorCode != nil && b.classify(*result.ErrorCode) == ErrorThrottled {
+			return true
+		}
+	}
+	return false
+}
+
+// backOffIfThrottled updates throttleDelay after a batch has been sent. It must only be called
+// from the main goroutine.
+func (b *batchProducer) backOffIfThrottled(throttled bool) {
+	switch {
+	case !throttled:
+		b.throttleDelay = 0
+	case b.throttleDelay == 0:
+		b.throttleDelay = 50 * time.Millisecond
+	case b.throttleDelay < maxThrottleDelay:
+		b.throttleDelay *= 2
+		if b.throttleDelay > maxThrottleDelay {
+			b.throttleDelay = maxThrottleDelay
+		}
+	}
+}
+
+// classify returns the ErrorClass of errorCode, according to Config.ErrorClassifier.
+func (b *batchProducer) classify(errorCode string) ErrorClass {
+	if b.config.ErrorClassifier != nil {
+		return b.config.ErrorClassifier(errorCode)
+	}
+	switch {
+	case b.nonRetryableErrorCodes[errorCode]:
+		return ErrorPermanent
+	case errorCode == kinesis.ErrCodeProvisionedThroughputExceededException || errorCode == kinesis.ErrCodeKMSThrottlingException:
+		return ErrorThrottled
+	}
+	return ErrorTransient
+}
+
+func (b *batchProducer) openCircuit() {
+	b.setCircuit(circuitOpen)
+	b.circuitOpenedAt = b.clock.Now()
+	b.logger.Warn("Opening circuit breaker because of consecutive errors from Kinesis",
+		zap.Duration("cooldown", b.config.CircuitBreakerCooldown), zap.Int("consecutiveErrors", b.consecutiveErrors))
+	b.emit(&CircuitOpenEvent{ConsecutiveErrors: b.consecutiveErrors, Cooldown: b.config.CircuitBreakerCooldown})
+}
+
+// circuitCooldownRemaining returns how much longer the circuit breaker will stay open, or 0 if it
+// isn’t open.
+func (b *batchProducer) circuitCooldownRemaining() time.Duration {
+	if b.circuit != circuitOpen {
+		return 0
+	}
+	return b.config.CircuitBreakerCooldown - b.clock.Now().Sub(b.circuitOpenedAt)
+}
+
+func (b *batchProducer) isBufferFullOrNearlyFull() bool {
+	return b.bufferFullness() >= 0.95
+}
+
+// shouldShed reports whether Kinesis has been returning errors for long enough, while the buffer is
+// full or nearly full, that records must be shed according to Config.DropPolicy.
+func (b *batchProducer) shouldShed() bool {
+	b.stateMu.RLock()
+	consecutiveErrors := b.consecutiveErrors
+	b.stateMu.RUnlock()
+	return consecutiveErrors >= 5 && b.isBufferFullOrNearlyFull()
+}
+
+// from/for interface Producer
+func (b *batchProducer) ShouldThrottle() bool {
+	if b.config.HighWaterMark == 0 {
+		return false
+	}
+	return b.bufferFullness() > b.config.HighWaterMark
+}
+
+func (b *batchProducer) isBufferFull() bool {
+	// Treating 99% as full, as when the buffer was a channel, whose len has a margin of error
+	return b.bufferFullness() >= 0.99
+}
+
+// bufferFullness returns how full the buffer is, from 0 to 1, by count of records or, if
+// BufferBytes is set, by whichever of count and bytes is fuller.
+func (b *batchProducer) bufferFullness() float32 {
+	fullness := float32(b.records.len()) / float32(b.records.capacity())
+	if b.config.BufferBytes > 0 {
+		bytesFullness := float32(b.records.bytes()) / float32(b.config.BufferBytes)
+		if bytesFullness > fullness {
+			fullness = bytesFullness
+		}
+	}
+	return fullness
+}
+
+// enqueue adds record to the buffer, blocking if it is full.
+func (b *batchProducer) enqueue(record batchRecord) error {
+	return b.enqueueContext(context.Background(), record)
+}
+
+// tryEnqueue is like enqueue except that it returns false rather than blocking if the buffer is
+// full.
+func (b *batchProducer) tryEnqueue(record batchRecord) bool {
+	if !b.records.tryPush(record) {
+		return false
+	}
+	b.wakeUp()
+	return true
+}
+
+// enqueueWithin is like enqueue except that it gives up and returns ErrAddTimeout if there isn’t
+// room in the buffer within timeout. A negative timeout means not to wait at all.
+func (b *batchProducer) enqueueWithin(record batchRecord, timeout time.Duration) error {
+	if timeout < 0 {
+		if b.isBufferFull() || !b.tryEnqueue(record) {
+			return ErrAddTimeout
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := b.enqueueContext(ctx, record); err != context.DeadlineExceeded {
+		return err
+	}
+	return ErrAddTimeout
+}
+
+// enqueueContext adds record to the buffer, waiting for room until ctx is done, when it returns
+// ctx.Err().
+func (b *batchProducer) enqueueContext(ctx context.Context, record batchRecord) error {
+	if err := b.records.push(ctx, record); err != nil {
+		return err
+	}
+	b.wakeUp()
+	return nil
+}
+
+// waitForRateLimits blocks until records may be sent without exceeding Config.MaxRecordsPerSecond
+// or Config.MaxBytesPerSecond.
+func (b *batchProducer) waitForRateLimits(records []batchRecord) {
+	if b.recordsLimiter != nil {
+		b.recordsLimiter.wait(b.clock, len(records))
+	}
+	if b.bytesLimiter != nil {
+		size := 0
+		for _, record := range records {
+			size += record.size()
+		}
+		b.bytesLimiter.wait(b.clock, size)
+	}
+}
+
+// returnToBuffer calls f, which returns failed records to the buffer, and puts the records it
+// requeues back at the front of the queue, in their original order, so that they are retried
+// before anything added after them. That never blocks, even if the buffer has filled up since they
+// were taken from it; see recordQueue. f runs right away, on the goroutine handling the batch, so
+// it counts its stats in currentStat like the rest of handleSent.
+func (b *batchProducer) returnToBuffer(f func()) {
+	f()
+	b.records.pushFront(b.requeued)
+	b.requeued = nil
+}
+
+// requeue keeps a failed record to be put back at the front of the queue by returnToBuffer.
+func (b *batchProducer) requeue(record batchRecord) {
+	b.requeued = append(b.requeued, record)
+}
+
+// closeFiles closes the files of Config.SpillDir and Config.WALDir, syncing the write-ahead log,
+// once the Producer has stopped, whether by Stop or by one of the methods that send or take
+// records themselves once it has. They are opened again as needed if it’s used again.
+func (b *batchProducer) closeFiles() {
+	if b.spill != nil {
+		if err := b.spill.close(); err != nil {
+			b.logger.Error("Could not close the spill queue", zap.Error(err))
+		}
+	}
+	if b.wal != nil {
+		if err := b.wal.close(); err != nil {
+			b.logger.Error("Could not close the write-ahead log", zap.Error(err))
+		}
+	}
+}
+
+// bufferLen returns the number of records waiting to be sent.
+func (b *batchProducer) bufferLen() int {
+	if b.spill != nil {
+		return b.memoryLen() + b.spill.len()
+	}
+	return b.memoryLen()
+}
+
+// memoryLen is like bufferLen except that it doesn’t count records spilled to disk.
+func (b *batchProducer) memoryLen() int {
+	return b.records.len()
+}
+
+// unspill moves records spilled to disk back into the buffer while it is less than half full. It
+// must only be called from the main goroutine, or while it isn’t running.
+func (b *batchProducer) unspill() {
+	if b.spill == nil {
+		return
+	}
+	for b.spill.len() > 0 && b.bufferFullness() < 0.5 {
+		record, ok, err := b.spill.pop()
+		if err != nil {
+			b.logger.Error("Could not read records spilled to disk", zap.Error(err))
+			return
+		}
+		if !ok {
+			return
+		}
+		if !b.tryEnqueue(record) {
+			// Something else has filled the buffer meanwhile, but this one has nowhere else to go
+			b.records.forcePush(record)
+			return
+		}
+	}
+}
+
+// takeRecordsFromBuffer takes up to batchSize records from the buffer, discarding any that have
+// expired. It never blocks, so it may return fewer than are in the buffer if they are taken
+// concurrently.
+func (b *batchProducer) takeRecordsFromBuffer(batchSize int) []batchRecord {
+	b.unspill()
+
+	var size int
+	bufferLen := b.memoryLen()
+	if bufferLen >= batchSize {
+		size = batchSize
+	} else {
+		size = bufferLen
+	}
+
+	now := b.clock.Now()
+	result := make([]batchRecord, 0, size)
+	for i := 0; i < size; i++ {
+		record, ok := b.records.pop()
+		if !ok {
+			size = i
+			break
+		}
+		if !record.deadline.IsZero() && now.After(record.deadline) {
+			b.currentStat.RecordsExpiredSinceLastStat++
+			b.drop(record, ErrRecordExpired)
+			continue
+		}
+		result = append(result, record)
+	}
+	if expired := size - len(result); expired > 0 {
+		b.logger.Debug("Discarded records whose TTL had expired", zap.Int("records", expired))
+	}
+	return result
+}
+
+// putRecordsRequest is a PutRecords request together with the storage that its entries, and the
+// strings they point to, live in. Allocating all of that afresh for every batch puts a lot of
+// pressure on the GC at high throughput, so requests are pooled and reused.
+type putRecordsRequest struct {
+	kinesis.PutRecordsInput
+
+	entries          []kinesis.PutRecordsRequestEntry
+	pointers         []*kinesis.PutRecordsRequestEntry
+	partitionKeys    []string
+	explicitHashKeys []string
+	streamName       string
+	streamARN        string
+}
+
+var putRecordsRequestPool = sync.Pool{
+	New: func() interface{} { return new(putRecordsRequest) },
+}
+
+// holdBackRepeatedKeys returns records without those whose partition key is the same as that of
+// an earlier one, which it puts back at the front of the queue, in order, for OrderingPerPartitionKey.
+func (b *batchProducer) holdBackRepeatedKeys(records []batchRecord) []batchRecord {
+	keys := make(map[string]bool, len(records))
+	batch := records[:0]
+	var heldBack []batchRecord
+	for _, record := range records {
+		if keys[record.partitionKey] {
+			heldBack = append(heldBack, record)
+			continue
+		}
+		keys[record.partitionKey] = true
+		batch = append(batch, record)
+	}
+	if len(heldBack) > 0 {
+		b.records.pushFront(heldBack)
+	}
+	return batch
+}
+
+// holdBackFullShards returns records without those whose shards are at their rate limits, which
+// are put back at the front of the queue for a later batch; see Config.ShardMapInterval.
+func (b *batchProducer) holdBackFullShards(records []batchRecord) []batchRecord {
+	batch, heldBack := b.shards.admit(b.clock, records)
+	if len(heldBack) > 0 {
+		b.logger.Debug("Holding back records for shards that are at their rate limits", zap.Int("records", len(heldBack)))
+		b.records.pushFront(heldBack)
+	}
+	return batch
+}
+
+// fitInRequest returns how many of records, from the first, fit in a single PutRecords request
+// without exceeding MaxKinesisBatchBytes. That’s always at least one if there are any, since no
+// record is larger than MaxRecordSize.
+func fitInRequest(records []batchRecord) int {
+	var bytes int
+	for i, record := range records {
+		bytes += record.size()
+		if bytes > MaxKinesisBatchBytes {
+			return i
+		}
+	}
+	return len(records)
+}
+
+// recordsToInput returns a request for sending records to the stream. Once it has been sent, the
+// caller should release it.
+func (b *batchProducer) recordsToInput(streamName string, records []batchRecord) *putRecordsRequest {
+	r := putRecordsRequestPool.Get().(*putRecordsRequest)
+	n := len(records)
+	if cap(r.entries) < n {
+		r.entries = make([]kinesis.PutRecordsRequestEntry, n)
+		r.pointers = make([]*kinesis.PutRecordsRequestEntry, n)
+		r.partitionKeys = make([]string, n)
+		r.explicitHashKeys = make([]string, n)
+	}
+	r.entries, r.pointers = r.entries[:n], r.pointers[:n]
+	r.partitionKeys, r.explicitHashKeys = r.partitionKeys[:n], r.explicitHashKeys[:n]
+
+	for i, rec := range records {
+		r.partitionKeys[i] = rec.partitionKey
+		r.entries[i] = kinesis.PutRecordsRequestEntry{PartitionKey: &r.partitionKeys[i], Data: rec.data}
+		if rec.explicitHashKey != "" {
+			r.explicitHashKeys[i] = rec.explicitHashKey
+			r.entries[i].ExplicitHashKey = &r.explicitHashKeys[i]
+		}
+		r.pointers[i] = &r.entries[i]
+	}
+
+	r.streamName, r.streamARN = streamName, b.config.StreamARN
+	r.PutRecordsInput = kinesis.PutRecordsInput{StreamName: &r.streamName, Records: r.pointers}
+	if r.streamARN != "" {
+		r.StreamName = nil
+		r.StreamARN = &r.streamARN
+	}
+	if b.config.RequestModifier != nil {
+		b.config.RequestModifier(&r.PutRecordsInput)
+	}
+	return r
+}
+
+// release returns r to the pool, so nothing may use it, or anything it points to, afterwards. The
+// entries are cleared so that the pool doesn’t keep the data of sent records alive.
+func (r *putRecordsRequest) release() {
+	for i := range r.entries {
+		r.entries[i] = kinesis.PutRecordsRequestEntry{}
+		r.pointers[i] = nil
+		r.partitionKeys[i] = ""
+		r.explicitHashKeys[i] = ""
+	}
+	r.PutRecordsInput = kinesis.PutRecordsInput{}
+	putRecordsRequestPool.Put(r)
+}
+
+// returnRecordsToBuffer requeues the records of a batch that failed as a whole, or drops those
+// that can’t be retried. It must be called through returnToBuffer.
+func (b *batchProducer) returnRecordsToBuffer(records []batchRecord, err error) {
+	var dropped, overBudget int
+	for _, record := range records {
+		record.sendAttempts++
+		if record.sendAttempts >= b.config.MaxAttemptsPerRecord {
+			dropped++
+			b.drop(record, fmt.Errorf("record dropped after %v attempts: %v", record.sendAttempts, err))
+		} else if !b.allowRetry() {
+			overBudget++
+			b.drop(record, fmt.Errorf("record dropped because the retry budget is used up: %v", err))
+		} else {
+			b.currentStat.RecordsRetriedSinceLastStat++
+			// Not using b.Add because we want to preserve the value of record.sendAttempts.
+			b.requeue(record)
+		}
+	}
+
+	if overBudget > 0 {
+		b.currentStat.RecordsDroppedSinceLastStat += overBudget
+		b.currentStat.RecordsDroppedRetryBudgetSinceLastStat += overBudget
+		b.logger.Error("Dropping records from a failed batch; the retry budget is used up",
+			zap.Int("records", overBudget), zap.Error(err))
+	}
+	if dropped > 0 {
+		b.currentStat.RecordsDroppedSinceLastStat += dropped
+		b.currentStat.RecordsDroppedMaxAttemptsSinceLastStat += dropped
+		b.logger.Error("Dropping records from a failed batch; they have hit the maximum number of attempts",
+			zap.Int("records", dropped), zap.Int("attempts", b.config.MaxAttemptsPerRecord), zap.Error(err))
+	}
+}
+
+// returnSomeFailedRecordsToBuffer requeues the records of a batch that Kinesis reports as failed,
+// or drops those that can’t be retried. It must be called through returnToBuffer. It goes by the
+// same entries as handleSent, so it takes care of exactly the records that handleSent didn’t count
+// as written, including any that res has no entry for.
+func (b *batchProducer) returnSomeFailedRecordsToBuffer(res *kinesis.PutRecordsOutput, records []batchRecord) {
+	for i, record := range records {
+		result := resultEntry(res, i)
+		if !entryFailed(result) {
+			continue
+		}
+		record.sendAttempts++
+		errorCode, errorMessage := "", errNoResultEntry.Error()
+		if result != nil {
+			errorCode = aws.StringValue(result.ErrorCode)
+			errorMessage = aws.StringValue(result.ErrorMessage)
+		}
+
+		if b.classify(errorCode) == ErrorPermanent {
+			b.currentStat.RecordsDroppedSinceLastStat++
+			b.currentStat.RecordsDroppedNonRetryableSinceLastStat++
+			b.emit(&PermanentFailureEvent{
+				PartitionKey: record.partitionKey,
+				ErrorCode:    errorCode,
+				ErrorMessage: errorMessage,
+			})
+			b.logger.Error("Dropping failed record because its error code is not retryable",
+				zap.String("errorCode", errorCode), zap.String("errorMessage", errorMessage))
+			b.drop(record, fmt.Errorf("record failed with non-retryable error: %v (%v)", errorMessage, errorCode))
+			continue
+		}
+
+		b.emit(newError(errorMessage))
+
+		if record.sendAttempts >= b.config.MaxAttemptsPerRecord {
+			b.currentStat.RecordsDroppedSinceLastStat++
+			b.currentStat.RecordsDroppedMaxAttemptsSinceLastStat++
+			b.logger.Error("Dropping failed record; it has hit the maximum number of attempts",
+				zap.Int("attempts", record.sendAttempts), zap.String("errorCode", errorCode), zap.String("errorMessage", errorMessage))
+			b.drop(record, fmt.Errorf("record dropped after %v attempts: %v (%v)", record.sendAttempts, errorMessage, errorCode))
+		} else if !b.allowRetry() {
+			b.currentStat.RecordsDroppedSinceLastStat++
+			b.currentStat.RecordsDroppedRetryBudgetSinceLastStat++
+			b.logger.Error("Dropping failed record; the retry budget is used up",
+				zap.String("errorCode", errorCode), zap.String("errorMessage", errorMessage))
+			b.drop(record, fmt.Errorf("record dropped because the retry budget is used up: %v (%v)", errorMessage, errorCode))
+		} else {
+			b.currentStat.RecordsRetriedSinceLastStat++
+			// Not using b.Add because we want to preserve the value of record.sendAttempts.
+			b.requeue(record)
+		}
+	}
+}
+
+// allowRetry reports whether Config.RetryBudget allows a failed record to be retried, and if so
+// counts the retry against it.
+func (b *batchProducer) allowRetry() bool {
+	return b.retryBudget == nil || b.retryBudget.allowRetry(b.clock)
+}
+
+func (b *batchProducer) sendStats() {
+	if b.config.StatReceiver == nil {
+		return
+	}
+
+	stat := b.snapshotStats()
+	if b.rolledUpStat != nil {
+		stat = rollUpStats(*b.rolledUpStat, stat)
+		b.rolledUpStat = nil
+	}
+	b.lastStatDelivery = b.clock.Now()
+
+	// Once the Producer has stopped, e.g. for the final stats sent by Flush, nothing else is
+	// waiting for this goroutine so there’s no need to queue.
+	if b.stats == nil {
+		b.config.StatReceiver.Receive(stat)
+		return
+	}
+
+	// We’re the only sender, so if there’s room after this the send below won’t block.
+	if len(b.stats) == cap(b.stats) {
+		select {
+		case <-b.stats:
+			stat.StatsDroppedSinceLastStat = 1
+			b.logger.Warn("Dropped a StatsBatch because the StatReceiver is falling behind")
+		default:
+		}
+	}
+	b.stats <- stat
+}
+
+// takeStats is called every Config.StatInterval. It passes the stats on to the StatReceiver, unless
+// Config.StatDeliveryInterval hasn’t elapsed since they were last passed on, in which case it rolls
+// them up into the next StatsBatch instead.
+func (b *batchProducer) takeStats() {
+	if b.config.StatReceiver == nil {
+		return
+	}
+	if b.clock.Now().Sub(b.lastStatDelivery) >= b.config.StatDeliveryInterval {
+		b.sendStats()
+		return
+	}
+
+	stat := b.snapshotStats()
+	if b.rolledUpStat != nil {
+		stat = rollUpStats(*b.rolledUpStat, stat)
+	}
+	b.rolledUpStat = &stat
+}
+
+// snapshotStats returns the current stats and starts counting afresh.
+func (b *batchProducer) snapshotStats() StatsBatch {
+	b.currentStat.StreamName = b.StreamName()
+	b.currentStat.BufferSize = b.bufferLen()
+	b.currentStat.BufferedBytes = b.records.bytes()
+	b.currentStat.BatchesInFlight = b.outstandingBatches
+	b.currentStat.EffectiveBatchSize = b.effectiveBatchSize
+	b.currentStat.EffectiveFlushInterval = b.effectiveFlushInterval
+	stat := *b.currentStat
+	b.currentStat = new(StatsBatch)
+	return stat
+}
+
+// rollUpStats combines two consecutive StatsBatches into one covering both: the cumulative stats
+// are summed and the moment-in-time stats are those of later.
+func rollUpStats(earlier, later StatsBatch) StatsBatch {
+	later.KinesisErrorsSinceLastStat += earlier.KinesisErrorsSinceLastStat
+	later.RecordsSentSuccessfullySinceLastStat += earlier.RecordsSentSuccessfullySinceLastStat
+	later.RecordsExpiredSinceLastStat += earlier.RecordsExpiredSinceLastStat
+	later.RecordsRetriedSinceLastStat += earlier.RecordsRetriedSinceLastStat
+	later.RecordsDroppedSinceLastStat += earlier.RecordsDroppedSinceLastStat
+	later.RecordsDroppedBufferFullSinceLastStat += earlier.RecordsDroppedBufferFullSinceLastStat
+	later.RecordsDroppedMaxAttemptsSinceLastStat += earlier.RecordsDroppedMaxAttemptsSinceLastStat
+	later.RecordsDroppedNonRetryableSinceLastStat += earlier.RecordsDroppedNonRetryableSinceLastStat
+	later.RecordsDroppedRetryBudgetSinceLastStat += earlier.RecordsDroppedRetryBudgetSinceLastStat
+	return later
+}
+
+// startStats starts the goroutine that passes queued StatsBatches to the StatReceiver.
+func (b *batchProducer) startStats() {
+	if b.config.StatReceiver == nil {
+		return
+	}
+
+	b.stats = make(chan StatsBatch, statQueueSize)
+	b.statsDone = make(chan struct{})
+	go func(stats <-chan StatsBatch, done chan<- struct{}) {
+		defer close(done)
+		for stat := range stats {
+			b.config.StatReceiver.Receive(stat)
+		}
+	}(b.stats, b.statsDone)
+}
+
+// stopStats waits for the StatReceiver to receive the queued StatsBatches and then stops the
+// goroutine started by startStats. It is called by the main goroutine when it stops.
+func (b *batchProducer) stopStats() {
+	if b.stats == nil {
+		return
+	}
+
+	close(b.stats)
+	<-b.statsDone
+	b.stats = nil
 }
@@ -2,13 +2,20 @@ package batchproducer
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -35,6 +42,80 @@ func TestNewBatchProducerWithGoodValues(t *testing.T) {
 	}
 }
 
+func TestNewBatchProducerWithNilLogger(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:    10,
+		FlushInterval: 0,
+		BatchSize:     10,
+	}
+	c := &mockBatchingClient{}
+	b, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatalf("%q != nil", err)
+	}
+
+	// This would panic if the nil Logger were used
+	b.Start()
+	b.Add([]byte("foo"), "bar")
+	b.Flush(time.Second, false)
+	if c.callCount() != 1 {
+		t.Errorf("%v != 1", c.callCount())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize: 10,
+		BatchSize:  10,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%q != nil", err)
+	}
+
+	if b.StreamName() != "foo" {
+		t.Errorf("%v != foo", b.StreamName())
+	}
+
+	c := b.Config()
+	if c.Logger == nil {
+		t.Error("Logger == nil")
+	}
+	if len(c.NonRetryableErrorCodes) != len(DefaultNonRetryableErrorCodes) {
+		t.Errorf("%v != %v", c.NonRetryableErrorCodes, DefaultNonRetryableErrorCodes)
+	}
+
+	// Changing the copy mustn’t change the Producer’s Config
+	c.BatchSize = 5
+	c.NonRetryableErrorCodes[0] = "foo"
+	if b.Config().BatchSize != 10 {
+		t.Errorf("%v != 10", b.Config().BatchSize)
+	}
+	if b.Config().NonRetryableErrorCodes[0] == "foo" {
+		t.Error("NonRetryableErrorCodes was changed")
+	}
+}
+
+func TestNewDefaultConfig(t *testing.T) {
+	t.Parallel()
+
+	// Each Config is independent of the others
+	c1, c2 := NewDefaultConfig(), NewDefaultConfig()
+	c1.BatchSize = 5
+	if c2.BatchSize != 10 {
+		t.Errorf("%v != 10", c2.BatchSize)
+	}
+	if c1.Logger == c2.Logger {
+		t.Error("The Configs share a Logger")
+	}
+
+	if _, err := New(&mockBatchingClient{}, "foo", NewDefaultConfig()); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+}
+
 func TestNewBatchProducerWithBadBatchSize(t *testing.T) {
 	t.Parallel()
 	config := Config{
@@ -52,6 +133,9 @@ func TestNewBatchProducerWithBadBatchSize(t *testing.T) {
 	if !strings.Contains(err.Error(), "between 1 and 500") {
 		t.Errorf("%q does not contain 'between 1 and 500'", err)
 	}
+	if err != ErrInvalidBatchSize {
+		t.Errorf("%v != %v", err, ErrInvalidBatchSize)
+	}
 }
 
 func TestNewBatchProducerWithBadValues(t *testing.T) {
@@ -71,6 +155,56 @@ func TestNewBatchProducerWithBadValues(t *testing.T) {
 	if !strings.Contains(err.Error(), "Add will block forever") {
 		t.Errorf("%q does not contain 'Add will block forever'", err)
 	}
+	if err != ErrBufferDeadlockRisk {
+		t.Errorf("%v != %v", err, ErrBufferDeadlockRisk)
+	}
+}
+
+func TestNewBatchProducerWithTooSmallFlushInterval(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:    10,
+		FlushInterval: 10 * time.Millisecond,
+		BatchSize:     10,
+	}
+	if _, err := New(&mockBatchingClient{}, "foo", config); err != ErrFlushIntervalTooSmall {
+		t.Errorf("%v != %v", err, ErrFlushIntervalTooSmall)
+	}
+}
+
+func TestNewBatchProducerWithBufferSizeAndBufferBytes(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:  10,
+		BufferBytes: 1000,
+		BatchSize:   10,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Fatalf("err == nil")
+	}
+	if !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("%q does not contain 'mutually exclusive'", err)
+	}
+}
+
+func TestNewBatchProducerWithBadHighWaterMark(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:    10,
+		BatchSize:     10,
+		HighWaterMark: 1.5,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
 }
 
 func TestStart(t *testing.T) {
@@ -179,6 +313,64 @@ func TestSuccessiveStartsAndStops(t *testing.T) {
 	}
 }
 
+func TestStartStopStress(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 1000, time.Millisecond, 10)
+
+	// Stop mustn’t hang or be lost while the main goroutine is busy sending batches, and each run
+	// must start with working channels and tickers, however quickly they follow each other.
+	for i := 0; i < 200; i++ {
+		if err := b.Start(); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+		for j := 0; j < i%25; j++ {
+			b.Add([]byte("foo"), "bar")
+		}
+		if err := b.Stop(); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+
+	// The flush ticker of the last run must still be working
+	b.Start()
+	defer b.Stop()
+	b.Add([]byte("foo"), "bar")
+	if !waitUntil(func() bool { return b.bufferLen() == 0 }) {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+}
+
+func TestDone(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	select {
+	case <-b.Done():
+	default:
+		t.Error("Done is not closed before the first Start")
+	}
+
+	for i := 0; i < 2; i++ {
+		b.Start()
+		done := b.Done()
+		select {
+		case <-done:
+			t.Fatal("Done is closed while running")
+		default:
+		}
+
+		go b.Stop()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Done was not closed by Stop")
+		}
+		if b.isRunning() {
+			t.Error("b should NOT be running")
+		}
+	}
+}
+
 func TestAddRecordWhenStarted(t *testing.T) {
 	t.Parallel()
 	config := Config{
@@ -213,11 +405,119 @@ func TestAddRecordWhenStopped(t *testing.T) {
 	}
 
 	err = b.Add([]byte("foo"), "bar")
+	if err != ErrNotRunning {
+		t.Errorf("%v != %v", err, ErrNotRunning)
+	}
+}
+
+func TestAddData(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.PartitionKeyFunc = func(data []byte) (string, error) {
+		if len(data) == 0 {
+			return "", errors.New("no data")
+		}
+		return string(data[:1]), nil
+	}
+	b.Start()
+	defer b.Stop()
+
+	err := b.AddData([]byte("foo"))
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	// An explicit partition key wins
+	err = b.Add([]byte("bar"), "baz")
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	err = b.AddData([]byte{})
+	if err == nil || err.Error() != "no data" {
+		t.Errorf("%v != no data", err)
+	}
+
+	first, _ := b.records.pop()
+	if first.partitionKey != "f" {
+		t.Errorf("%v != f", first.partitionKey)
+	}
+	second, _ := b.records.pop()
+	if second.partitionKey != "baz" {
+		t.Errorf("%v != baz", second.partitionKey)
+	}
+}
+
+func TestAddDataWithoutPartitionKeyFunc(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.Start()
+	defer b.Stop()
+
+	err := b.AddData([]byte("foo"))
 	if err == nil {
 		t.Errorf("%v == nil", err)
 	}
 }
 
+func TestAddWithTTL(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	clock := newFakeClock()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.clock = clock
+	b.config.StatReceiver = sr
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 5; i++ {
+		b.AddWithTTL([]byte("foo"), "expires", 1*time.Second)
+		b.AddWithTTL([]byte("foo"), "lasts", 1*time.Minute)
+		b.AddWithTTL([]byte("foo"), "forever", 0)
+	}
+	b.running = false
+
+	clock.Advance(2 * time.Second)
+
+	// We’re calling sendBatch directly (rather than calling Start) so the records don’t get sent
+	// before they expire.
+	sent := b.sendBatch(15)
+	if sent != 10 {
+		t.Errorf("%v != 10", sent)
+	}
+
+	b.sendStats()
+	if sr.received()[0].RecordsExpiredSinceLastStat != 5 {
+		t.Errorf("%v != 5", sr.received()[0].RecordsExpiredSinceLastStat)
+	}
+}
+
+func TestAddWithTTLAllExpired(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{}
+	clock := newFakeClock()
+	b := newProducer(c, 100, 0, 10)
+	b.clock = clock
+
+	b.running = true
+	b.AddWithTTL([]byte("foo"), "bar", 1*time.Second)
+	b.running = false
+
+	clock.Advance(2 * time.Second)
+
+	sent := b.sendBatch(10)
+	if sent != 0 {
+		t.Errorf("%v != 0", sent)
+	}
+	if c.calls != 0 {
+		t.Errorf("%v != 0", c.calls)
+	}
+}
+
 func TestFlushInterval(t *testing.T) {
 	t.Parallel()
 	c := &mockBatchingClient{}
@@ -226,16 +526,16 @@ func TestFlushInterval(t *testing.T) {
 	defer b.Stop()
 
 	b.addRecordsAndWait(10, 0)
-	if len(b.records) != 10 {
-		t.Errorf("%v != 10", len(b.records))
+	if b.records.len() != 10 {
+		t.Errorf("%v != 10", b.records.len())
 	}
 	if c.calls != 0 {
 		t.Errorf("%v != 0", c.calls)
 	}
 
 	time.Sleep(3 * time.Millisecond)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
 	}
 	if c.calls != 1 {
 		t.Errorf("%v != 1", c.calls)
@@ -243,14 +543,98 @@ func TestFlushInterval(t *testing.T) {
 
 	// 20 more records should result in two more batches being sent
 	b.addRecordsAndWait(20, 8)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
 	}
 	if c.calls != 3 {
 		t.Errorf("%v != 3", c.calls)
 	}
 }
 
+func TestShouldThrottle(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+	b.config.HighWaterMark = 0.5
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(5, 0)
+	if b.ShouldThrottle() {
+		t.Errorf("ShouldThrottle() is true with 5 of 10 records buffered")
+	}
+	b.addRecordsAndWait(1, 0)
+	if !b.ShouldThrottle() {
+		t.Errorf("ShouldThrottle() is false with 6 of 10 records buffered")
+	}
+}
+
+func TestShouldThrottleDisabledByDefault(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+
+	b.running = true
+	b.addRecordsAndWait(9, 0)
+	if b.ShouldThrottle() {
+		t.Errorf("ShouldThrottle() is true with HighWaterMark 0")
+	}
+}
+
+func TestFlushDrainsBuffer(t *testing.T) {
+	t.Parallel()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 2000, 0, 10)
+	b.config.FlushDrainsBuffer = true
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(1200, 0)
+	b.running = false
+
+	// We’re calling flush directly (rather than calling Start) because otherwise the records would
+	// be sent in batches of BatchSize as soon as they were added.
+	b.flush()
+	if c.callCount() != 3 {
+		t.Errorf("%v != 3", c.callCount())
+	}
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+}
+
+func TestFlushSendsOneBatchByDefault(t *testing.T) {
+	t.Parallel()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 2000, 0, 10)
+
+	b.running = true
+	b.addRecordsAndWait(25, 0)
+	b.running = false
+
+	b.flush()
+	if c.callCount() != 1 {
+		t.Errorf("%v != 1", c.callCount())
+	}
+	if b.records.len() != 15 {
+		t.Errorf("%v != 15", b.records.len())
+	}
+}
+
+func TestFlushDrainsBufferStopsOnError(t *testing.T) {
+	t.Parallel()
+	c := &mockBatchingClient{shouldErr: true}
+	b := newProducer(c, 2000, 0, 10)
+	b.config.FlushDrainsBuffer = true
+
+	b.running = true
+	b.addRecordsAndWait(1200, 0)
+	b.running = false
+
+	b.flush()
+	if c.callCount() != 1 {
+		t.Errorf("%v != 1", c.callCount())
+	}
+}
+
 func TestBatchSize(t *testing.T) {
 	t.Parallel()
 	c := &mockBatchingClient{}
@@ -259,32 +643,32 @@ func TestBatchSize(t *testing.T) {
 	defer b.Stop()
 
 	b.addRecordsAndWait(4, 2)
-	if len(b.records) != 4 {
-		t.Errorf("%v != 4", len(b.records))
+	if b.records.len() != 4 {
+		t.Errorf("%v != 4", b.records.len())
 	}
 	if c.calls != 0 {
 		t.Errorf("%v != 0", c.calls)
 	}
 
 	b.addRecordsAndWait(1, 2)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
 	}
 	if c.calls != 1 {
 		t.Errorf("%v != 1", c.calls)
 	}
 
 	b.addRecordsAndWait(6, 2)
-	if len(b.records) != 1 {
-		t.Errorf("%v != 1", len(b.records))
+	if b.records.len() != 1 {
+		t.Errorf("%v != 1", b.records.len())
 	}
 	if c.calls != 2 {
 		t.Errorf("%v != 2", c.calls)
 	}
 
 	b.addRecordsAndWait(19, 2)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
 	}
 	if c.calls != 6 {
 		t.Errorf("%v != 6", c.calls)
@@ -295,6 +679,8 @@ func TestBatchError(t *testing.T) {
 	t.Parallel()
 	c := &mockBatchingClient{shouldErr: true}
 	b := newProducer(c, 100, 0, 5)
+	// so that the records aren’t dropped after 2 failed batches
+	b.config.MaxAttemptsPerRecord = 10
 	b.Start()
 	defer b.Stop()
 
@@ -302,8 +688,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 1 {
 		t.Errorf("%v != 1", b.consecutiveErrors)
 	}
-	if len(b.records) != 5 {
-		t.Errorf("%v != 5", len(b.records))
+	if b.records.len() != 5 {
+		t.Errorf("%v != 5", b.records.len())
 	}
 
 	// Wait another 55 ms and another error should have occurred
@@ -311,8 +697,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 2 {
 		t.Errorf("%v != 2", b.consecutiveErrors)
 	}
-	if len(b.records) != 5 {
-		t.Errorf("%v != 5", len(b.records))
+	if b.records.len() != 5 {
+		t.Errorf("%v != 5", b.records.len())
 	}
 
 	b.Stop()
@@ -323,8 +709,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 0 {
 		t.Errorf("%v != 0", b.consecutiveErrors)
 	}
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
 	}
 
 	// This next batch should succeed immediately
@@ -332,76 +718,432 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 0 {
 		t.Errorf("%v != 0", b.consecutiveErrors)
 	}
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
 	}
 }
 
-func TestBatchPartialFailure(t *testing.T) {
+func TestCircuitBreaker(t *testing.T) {
 	t.Parallel()
-	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
-	b.config.MaxAttemptsPerRecord = 2
-	b.Start()
-	defer b.Stop()
 
-	b.addRecordsAndWait(19, 0)
+	c := &mockBatchingClient{shouldErr: true}
+	clock := newFakeClock()
+	b := newProducer(c, 100, 0, 5)
+	b.clock = clock
+	b.config.MaxAttemptsPerRecord = 10
+	b.config.CircuitBreakerThreshold = 2
+	b.config.CircuitBreakerCooldown = 20 * time.Millisecond
 
-	// Add a single record that will fail. partitionKey is (mis)used to specify that the record
-	// should fail.
-	b.Add([]byte("foo"), "fail")
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(5, 0)
+	b.running = false
 
-	// First attempt
-	time.Sleep(5 * time.Millisecond)
-	if len(b.records) != 1 {
-		t.Errorf("%v != 1", len(b.records))
+	// We’re calling sendBatch directly (rather than calling Start) so we can step through the
+	// states of the circuit breaker deterministically. Failed records are back in the buffer by
+	// the time sendBatch returns.
+	sendBatchAndWait := func() {
+		b.sendBatch(5)
+		if b.records.len() != 5 {
+			t.Fatalf("%v != 5", b.records.len())
+		}
 	}
 
-	// Second attempt
-	b.addRecordsAndWait(19, 1)
-	// The failing record should be thrown away at this point
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	sendBatchAndWait()
+	if b.circuit != circuitClosed {
+		t.Errorf("%v != circuitClosed", b.circuit)
 	}
-}
-
-func TestBufferSizeStat(t *testing.T) {
-	t.Parallel()
-
-	sr := &statReceiver{}
-
-	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
-	b.config.StatReceiver = sr
-	b.config.StatInterval = 1 * time.Millisecond
-	b.Start()
-	defer b.Stop()
-
-	// Adding 10 will not trigger a batch
-	b.addRecordsAndWait(10, 2)
 
-	if len(sr.stats) == 0 {
-		// More than one might have been sent, which is fine. We just need at least one.
-		t.Fatalf("%v == 0", len(sr.stats))
+	sendBatchAndWait()
+	if b.circuit != circuitOpen {
+		t.Fatalf("%v != circuitOpen", b.circuit)
 	}
-
-	lastStat := sr.stats[len(sr.stats)-1]
-	if lastStat.BufferSize != 10 {
-		t.Errorf("%v != 10", lastStat.BufferSize)
+	if c.calls != 2 {
+		t.Errorf("%v != 2", c.calls)
 	}
 
-	// Adding another 10 **will** trigger a batch
-	b.addRecordsAndWait(10, 2)
-
-	if len(sr.stats) < 2 {
-		t.Fatalf("%v < 2", len(sr.stats))
+	var opened *CircuitOpenEvent
+	for opened == nil && len(b.events) > 0 {
+		opened, _ = (<-b.events).(*CircuitOpenEvent)
 	}
-
-	lastStat = sr.stats[len(sr.stats)-1]
-	if lastStat.BufferSize != 0 {
-		t.Errorf("%v != 0", lastStat.BufferSize)
+	if opened == nil {
+		t.Fatal("no CircuitOpenEvent was sent")
+	}
+	if opened.ConsecutiveErrors != 2 {
+		t.Errorf("%v != 2", opened.ConsecutiveErrors)
 	}
-}
 
-func TestSuccessfulRecordsStat(t *testing.T) {
+	// While the circuit is open no calls should be made
+	b.sendBatch(5)
+	if c.calls != 2 {
+		t.Errorf("%v != 2", c.calls)
+	}
+
+	// Once the cooldown has elapsed a failing probe should reopen the circuit
+	clock.Advance(25 * time.Millisecond)
+	sendBatchAndWait()
+	if c.calls != 3 {
+		t.Errorf("%v != 3", c.calls)
+	}
+	if b.circuit != circuitOpen {
+		t.Errorf("%v != circuitOpen", b.circuit)
+	}
+
+	// And a successful probe should close it
+	c = &mockBatchingClient{}
+	b.client = c
+	clock.Advance(25 * time.Millisecond)
+	sent := b.sendBatch(5)
+	if sent != 5 {
+		t.Errorf("%v != 5", sent)
+	}
+	if b.circuit != circuitClosed {
+		t.Errorf("%v != circuitClosed", b.circuit)
+	}
+	if b.consecutiveErrors != 0 {
+		t.Errorf("%v != 0", b.consecutiveErrors)
+	}
+}
+
+func TestAdaptiveBatchSize(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	b := newProducer(&mockBatchingClient{}, 1000, 0, 40)
+	b.config.AdaptiveBatchSize = true
+	b.config.MaxAttemptsPerRecord = 100
+	b.config.StatReceiver = sr
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+
+	// partitionKey is (mis)used to specify that the records should be throttled.
+	for i := 0; i < 40; i++ {
+		b.Add([]byte("foo"), "throttle")
+	}
+
+	// We’re calling sendBatch directly (rather than calling Start) so we can control exactly
+	// which batches are throttled.
+	expected := []int{20, 10, 10}
+	for _, size := range expected {
+		// Throttled records are returned to the buffer
+		if b.records.len() != 40 {
+			t.Fatalf("%v != 40", b.records.len())
+		}
+		b.sendBatch(b.effectiveBatchSize)
+		if b.effectiveBatchSize != size {
+			t.Errorf("%v != %v", b.effectiveBatchSize, size)
+		}
+	}
+
+	// Get rid of the throttled records
+	for b.records.len() > 0 {
+		b.records.pop()
+	}
+
+	b.addRecordsAndWait(200, 0)
+	expected = []int{14, 18, 22, 26, 30, 34, 38, 40, 40}
+	for _, size := range expected {
+		b.sendBatch(b.effectiveBatchSize)
+		if b.effectiveBatchSize != size {
+			t.Errorf("%v != %v", b.effectiveBatchSize, size)
+		}
+	}
+
+	b.sendStats()
+	if sr.received()[0].EffectiveBatchSize != 40 {
+		t.Errorf("%v != 40", sr.received()[0].EffectiveBatchSize)
+	}
+}
+
+func TestAdaptiveBatchSizeDisabled(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 1000, 0, 40)
+	b.running = true
+	defer func() { b.running = false }()
+
+	for i := 0; i < 40; i++ {
+		b.Add([]byte("foo"), "throttle")
+	}
+
+	b.sendBatch(b.effectiveBatchSize)
+	if b.effectiveBatchSize != 40 {
+		t.Errorf("%v != 40", b.effectiveBatchSize)
+	}
+}
+
+func TestMinBatchSize(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 1000, 0, 40)
+	b.config.AdaptiveBatchSize = true
+	b.config.MaxAttemptsPerRecord = 100
+	b.config.MinBatchSize = 15
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+
+	// partitionKey is (mis)used to specify that the records should be throttled.
+	for i := 0; i < 40; i++ {
+		b.Add([]byte("foo"), "throttle")
+	}
+
+	for _, size := range []int{20, 15, 15} {
+		// Throttled records are returned to the buffer
+		if b.records.len() != 40 {
+			t.Fatalf("%v != 40", b.records.len())
+		}
+		b.sendBatch(b.effectiveBatchSize)
+		if b.effectiveBatchSize != size {
+			t.Errorf("%v != %v", b.effectiveBatchSize, size)
+		}
+	}
+}
+
+func TestMinFlushInterval(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 1000, time.Second, 40)
+	b.clock = newFakeClock()
+	b.config.MinFlushInterval = 100 * time.Millisecond
+	b.effectiveFlushInterval = time.Second
+
+	// Light traffic shortens the interval, down to MinFlushInterval, heavy traffic lengthens it,
+	// up to FlushInterval, and an empty buffer leaves it alone
+	for _, step := range []struct {
+		queued   int
+		expected time.Duration
+	}{
+		{5, 500 * time.Millisecond},
+		{19, 250 * time.Millisecond},
+		{1, 125 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{0, 100 * time.Millisecond},
+		{20, 200 * time.Millisecond},
+		{40, 400 * time.Millisecond},
+		{40, 800 * time.Millisecond},
+		{40, time.Second},
+	} {
+		b.adaptFlushInterval(step.queued)
+		if b.effectiveFlushInterval != step.expected {
+			t.Errorf("%v: %v != %v", step.queued, b.effectiveFlushInterval, step.expected)
+		}
+		if ticker := b.flushTicker.(*fakeTicker); ticker.period != step.expected {
+			t.Errorf("%v: %v != %v", step.queued, ticker.period, step.expected)
+		}
+	}
+}
+
+func TestNewBatchProducerWithBadMinimums(t *testing.T) {
+	t.Parallel()
+	for _, config := range []Config{
+		{BufferSize: 100, BatchSize: 10, MinBatchSize: -1},
+		{BufferSize: 100, BatchSize: 10, MinBatchSize: 11},
+		{BufferSize: 100, BatchSize: 10, FlushInterval: time.Second, MinFlushInterval: 10 * time.Millisecond},
+		{BufferSize: 100, BatchSize: 10, FlushInterval: time.Second, MinFlushInterval: 2 * time.Second},
+		{BufferSize: 100, BatchSize: 10, MinFlushInterval: time.Second},
+	} {
+		if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+			t.Errorf("%+v: err == nil", config)
+		}
+	}
+}
+
+func TestWarmupDuration(t *testing.T) {
+	t.Parallel()
+
+	c := &failOnceClient{}
+	sr := &statReceiver{}
+	config := Config{
+		BufferSize:     2000,
+		BatchSize:      100,
+		Logger:         discardLogger,
+		StatReceiver:   sr,
+		WarmupDuration: 10 * time.Second,
+	}
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+	clock := newFakeClock()
+	b.clock = clock
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 1200; i++ {
+		b.Add([]byte("foo"), "bar")
+	}
+	b.running = false
+
+	// We’re calling the main goroutine’s methods directly (rather than calling Start) so that we
+	// can control exactly when each batch is sent.
+	b.startWarmUp()
+	for i := 0; i <= 12; i++ {
+		b.warmUp()
+		b.sendBatch(b.effectiveBatchSize)
+		if i == 5 {
+			b.sendStats()
+		}
+		clock.Advance(1 * time.Second)
+	}
+
+	expected := []int{10, 19, 28, 37, 46, 55, 64, 73, 82, 91, 100, 100, 100}
+	if len(c.requests) != len(expected) {
+		t.Fatalf("%v != %v", len(c.requests), len(expected))
+	}
+	for i, request := range c.requests {
+		if len(request) != expected[i] {
+			t.Errorf("batch %v: %v != %v", i, len(request), expected[i])
+		}
+	}
+	if sr.received()[0].EffectiveBatchSize != 55 {
+		t.Errorf("%v != 55", sr.received()[0].EffectiveBatchSize)
+	}
+
+	// Warm-up starts again when the Producer is restarted
+	b.startWarmUp()
+	if b.effectiveBatchSize != 10 {
+		t.Errorf("%v != 10", b.effectiveBatchSize)
+	}
+}
+
+func TestBatchPartialFailure(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.config.MaxAttemptsPerRecord = 2
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(19, 0)
+
+	// Add a single record that will fail. partitionKey is (mis)used to specify that the record
+	// should fail.
+	b.Add([]byte("foo"), "fail")
+
+	// First attempt
+	time.Sleep(5 * time.Millisecond)
+	if b.records.len() != 1 {
+		t.Errorf("%v != 1", b.records.len())
+	}
+
+	// Second attempt
+	b.addRecordsAndWait(19, 1)
+	// The failing record should be thrown away at this point
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+}
+
+func TestStreamNameStat(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.config.StatReceiver = sr
+
+	b.sendStats()
+	b.SetStreamName("bar")
+	b.sendStats()
+	if len(sr.received()) != 2 {
+		t.Fatalf("%v != 2", len(sr.received()))
+	}
+	if sr.received()[0].StreamName != "foo" {
+		t.Errorf("%v != foo", sr.received()[0].StreamName)
+	}
+	if sr.received()[1].StreamName != "bar" {
+		t.Errorf("%v != bar", sr.received()[1].StreamName)
+	}
+}
+
+func TestStatDeliveryInterval(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	clock := newFakeClock()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.clock = clock
+	b.config.StatReceiver = sr
+	b.config.StatDeliveryInterval = 3 * time.Second
+	b.lastStatDelivery = clock.Now()
+
+	// Take stats every second, as if StatInterval were 1s
+	for i := 1; i <= 6; i++ {
+		b.currentStat.RecordsSentSuccessfullySinceLastStat += i
+		b.currentStat.KinesisErrorsSinceLastStat++
+		b.currentStat.RecordsDroppedSinceLastStat += 2
+		b.effectiveBatchSize = i
+		clock.Advance(1 * time.Second)
+		b.takeStats()
+	}
+
+	if len(sr.received()) != 2 {
+		t.Fatalf("%v != 2", len(sr.received()))
+	}
+	for i, expected := range []StatsBatch{
+		{StreamName: "foo", EffectiveBatchSize: 3, RecordsSentSuccessfullySinceLastStat: 6, KinesisErrorsSinceLastStat: 3, RecordsDroppedSinceLastStat: 6},
+		{StreamName: "foo", EffectiveBatchSize: 6, RecordsSentSuccessfullySinceLastStat: 15, KinesisErrorsSinceLastStat: 3, RecordsDroppedSinceLastStat: 6},
+	} {
+		if sr.received()[i] != expected {
+			t.Errorf("%+v != %+v", sr.received()[i], expected)
+		}
+	}
+
+	// Stats that have been rolled up but not yet passed on aren’t lost when the Producer stops
+	b.currentStat.RecordsSentSuccessfullySinceLastStat = 1
+	clock.Advance(1 * time.Second)
+	b.takeStats()
+	b.currentStat.RecordsSentSuccessfullySinceLastStat = 2
+	b.sendStats()
+	if len(sr.received()) != 3 {
+		t.Fatalf("%v != 3", len(sr.received()))
+	}
+	if sr.received()[2].RecordsSentSuccessfullySinceLastStat != 3 {
+		t.Errorf("%v != 3", sr.received()[2].RecordsSentSuccessfullySinceLastStat)
+	}
+}
+
+func TestBufferSizeStat(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.config.StatReceiver = sr
+	b.config.StatInterval = 1 * time.Millisecond
+	b.Start()
+	defer b.Stop()
+
+	// Adding 10 will not trigger a batch
+	b.addRecordsAndWait(10, 2)
+
+	if len(sr.received()) == 0 {
+		// More than one might have been sent, which is fine. We just need at least one.
+		t.Fatalf("%v == 0", len(sr.received()))
+	}
+
+	lastStat := sr.last()
+	if lastStat.BufferSize != 10 {
+		t.Errorf("%v != 10", lastStat.BufferSize)
+	}
+
+	// Adding another 10 **will** trigger a batch
+	b.addRecordsAndWait(10, 2)
+
+	if len(sr.received()) < 2 {
+		t.Fatalf("%v < 2", len(sr.received()))
+	}
+
+	lastStat = sr.last()
+	if lastStat.BufferSize != 0 {
+		t.Errorf("%v != 0", lastStat.BufferSize)
+	}
+}
+
+func TestSuccessfulRecordsStat(t *testing.T) {
 	t.Parallel()
 
 	sr := &statReceiver{}
@@ -414,12 +1156,12 @@ func TestSuccessfulRecordsStat(t *testing.T) {
 	// Adding 10 will not trigger a batch
 	b.addRecordsAndWait(10, 2)
 
-	if len(sr.stats) == 0 {
+	if len(sr.received()) == 0 {
 		// More than one might have been sent, which is fine. We just need at least one.
-		t.Fatalf("%v == 0", len(sr.stats))
+		t.Fatalf("%v == 0", len(sr.received()))
 	}
 
-	lastStat := sr.stats[len(sr.stats)-1]
+	lastStat := sr.last()
 	if lastStat.RecordsSentSuccessfullySinceLastStat != 0 {
 		t.Errorf("%v != 0", lastStat.RecordsSentSuccessfullySinceLastStat)
 	}
@@ -427,12 +1169,12 @@ func TestSuccessfulRecordsStat(t *testing.T) {
 	// Adding another 10 **will** trigger a batch
 	b.addRecordsAndWait(10, 2)
 
-	if len(sr.stats) < 2 {
-		t.Fatalf("%v < 2", len(sr.stats))
+	if len(sr.received()) < 2 {
+		t.Fatalf("%v < 2", len(sr.received()))
 	}
 
-	if sr.totalRecordsSentSuccessfully != 20 {
-		t.Errorf("%v != 20", sr.totalRecordsSentSuccessfully)
+	if sr.totals().recordsSentSuccessfully != 20 {
+		t.Errorf("%v != 20", sr.totals().recordsSentSuccessfully)
 	}
 }
 
@@ -457,8 +1199,8 @@ func TestSuccessfulRecordsStatWhenSomeRecordsFail(t *testing.T) {
 	time.Sleep(3 * time.Millisecond)
 
 	// Should be 10 because one record failed
-	if sr.totalRecordsSentSuccessfully != 19 {
-		t.Errorf("%v != 19", sr.totalRecordsSentSuccessfully)
+	if sr.totals().recordsSentSuccessfully != 19 {
+		t.Errorf("%v != 19", sr.totals().recordsSentSuccessfully)
 	}
 }
 
@@ -483,100 +1225,289 @@ func TestRecordsDroppedStatWhenSomeRecordsFail(t *testing.T) {
 	// Sleep long enough for an attempt to be tried and the stat to be recieved
 	time.Sleep(5 * time.Millisecond)
 
-	if sr.totalRecordsDroppedSinceLastStat != 2 {
-		t.Errorf("%v != 2", sr.totalRecordsDroppedSinceLastStat)
+	if sr.totals().recordsDropped != 2 {
+		t.Errorf("%v != 2", sr.totals().recordsDropped)
+	}
+	if sr.totals().recordsDroppedMaxAttempts != 2 {
+		t.Errorf("%v != 2", sr.totals().recordsDroppedMaxAttempts)
+	}
+	if sr.totals().recordsDroppedBufferFull != 0 {
+		t.Errorf("%v != 0", sr.totals().recordsDroppedBufferFull)
 	}
 }
 
-func TestSuccessfulRecordsStatWhenKinesisReturnsError(t *testing.T) {
+func TestRecordsDroppedStatWhenBufferFull(t *testing.T) {
 	t.Parallel()
 
 	sr := &statReceiver{}
-	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 5)
+	b.clock = newFakeClock()
 	b.config.StatReceiver = sr
-	b.config.StatInterval = 1 * time.Millisecond
-	b.Start()
-	defer b.Stop()
+	b.config.AddBlocksWhenBufferFull = true
+	// So that the failed records, which go back to the front of the buffer, aren’t dropped first
+	b.config.MaxAttemptsPerRecord = 10
 
-	// Adding 20 **will** trigger a batch
-	b.addRecordsAndWait(20, 50)
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(100, 0)
+	b.running = false
 
-	if len(sr.stats) < 1 {
-		t.Fatalf("%v < 1", len(sr.stats))
+	// After 5 consecutive errors with a nearly full buffer the batch should be dropped. We’re
+	// calling sendBatch directly with a fake clock so the backoff delays don’t slow the test down.
+	for i := 0; i < 5; i++ {
+		waitUntil(func() bool { return b.records.len() == 100 })
+		b.sendBatch(5)
 	}
+	b.sendStats()
 
-	// Should be 0 because Kinesis is just returning errors
-	if sr.totalRecordsSentSuccessfully != 0 {
-		t.Errorf("%v != 0", sr.totalRecordsSentSuccessfully)
+	if sr.totals().recordsDropped != 5 {
+		t.Errorf("%v != 5", sr.totals().recordsDropped)
+	}
+	if sr.totals().recordsDroppedBufferFull != 5 {
+		t.Errorf("%v != 5", sr.totals().recordsDroppedBufferFull)
+	}
+	if sr.totals().recordsDroppedMaxAttempts != 0 {
+		t.Errorf("%v != 0", sr.totals().recordsDroppedMaxAttempts)
 	}
 }
 
-func TestKinesisErrorsStatWhenKinesisSucceeds(t *testing.T) {
+func TestNonRetryableRecordsAreDroppedImmediately(t *testing.T) {
 	t.Parallel()
 
 	sr := &statReceiver{}
-	b := newProducer(&mockBatchingClient{shouldErr: false}, 100, 0, 20)
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
 	b.config.StatReceiver = sr
-	b.config.StatInterval = 1 * time.Millisecond
-	b.Start()
-	defer b.Stop()
+	b.config.MaxAttemptsPerRecord = 10
 
-	// Adding 20 **will** trigger a batch
-	b.addRecordsAndWait(20, 2)
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(8, 0)
+	// partitionKey is (mis)used to specify that the records should fail with a non-retryable
+	// error code.
+	b.Add([]byte("foo"), "denied")
+	b.Add([]byte("foo"), "denied")
+	b.running = false
 
-	if len(sr.stats) < 1 {
-		t.Fatalf("%v < 1", len(sr.stats))
+	sent := b.sendBatch(10)
+	if sent != 8 {
+		t.Errorf("%v != 8", sent)
 	}
 
-	// Should be 0 because Kinesis is succeeding
-	if sr.totalKinesisErrorsSinceLastStat != 0 {
-		t.Errorf("%v != 0", sr.totalKinesisErrorsSinceLastStat)
+	var failures int
+	waitUntil(func() bool {
+		for len(b.events) > 0 {
+			if _, ok := (<-b.events).(*PermanentFailureEvent); ok {
+				failures++
+			}
+		}
+		return failures == 2
+	})
+	if failures != 2 {
+		t.Errorf("%v != 2", failures)
+	}
+
+	// Nothing should have been returned to the buffer for a retry
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+
+	b.sendStats()
+	if sr.totals().recordsDroppedNonRetryable != 2 {
+		t.Errorf("%v != 2", sr.totals().recordsDroppedNonRetryable)
+	}
+	if sr.totals().recordsDropped != 2 {
+		t.Errorf("%v != 2", sr.totals().recordsDropped)
 	}
 }
 
-func TestKinesisErrorsStatWhenKinesisReturnsError(t *testing.T) {
+func TestNonRetryableErrorCodesCanBeEmpty(t *testing.T) {
 	t.Parallel()
 
-	sr := &statReceiver{}
-	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
-	b.config.StatReceiver = sr
-	b.config.StatInterval = 1 * time.Millisecond
-	b.Start()
-	defer b.Stop()
+	config := Config{
+		BufferSize:             100,
+		BatchSize:              10,
+		Logger:                 discardLogger,
+		MaxAttemptsPerRecord:   10,
+		NonRetryableErrorCodes: []string{},
+	}
+	p, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
 
-	b.addRecordsAndWait(20, 5)
-	b.Stop()
+	b.running = true
+	b.Add([]byte("foo"), "denied")
+	b.running = false
 
-	if sr.totalKinesisErrorsSinceLastStat != 2 {
-		t.Errorf("%v != 2", sr.totalKinesisErrorsSinceLastStat)
+	b.sendBatch(10)
+
+	// The record should be retried
+	if !waitUntil(func() bool { return b.records.len() == 1 }) {
+		t.Errorf("%v != 1", b.records.len())
 	}
 }
 
-func TestLogMessageWhenKinesisSucceeds(t *testing.T) {
+func TestErrorClassifier(t *testing.T) {
 	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.MaxAttemptsPerRecord = 10
+	b.config.ErrorClassifier = func(errorCode string) ErrorClass {
+		if errorCode == "foo" {
+			return ErrorPermanent
+		}
+		return ErrorTransient
+	}
 
-	b := newProducer(&mockBatchingClient{shouldErr: false}, 100, 0, 20)
-	logRecorder, logger := newRecordedLogger()
-	b.logger = logger
-	b.Start()
-	defer b.Stop()
+	// set running to true so Add will succeed
+	b.running = true
+	// partitionKey is (mis)used to specify the error code the record fails with: "foo", and a KMS
+	// one that is permanent by default but not according to the classifier.
+	b.Add([]byte("foo"), "fail")
+	b.Add([]byte("foo"), "denied")
+	b.running = false
 
-	// Adding 20 **will** trigger a batch
-	b.addRecordsAndWait(20, 2)
+	b.sendBatch(10)
 
-	loggerString := logRecorder.All()[0].Message
-	requiredString := "PutRecords request succeeded: sent 20 records to Kinesis stream"
-	if !strings.Contains(loggerString, requiredString) {
-		t.Errorf("%s does not contain %s", loggerString, requiredString)
+	var failures []string
+	for len(b.events) > 0 {
+		if e, ok := (<-b.events).(*PermanentFailureEvent); ok {
+			failures = append(failures, e.PartitionKey)
+		}
+	}
+	if len(failures) != 1 || failures[0] != "fail" {
+		t.Errorf("%v != [fail]", failures)
+	}
+	if records := b.takeRecordsFromBuffer(10); len(records) != 1 || records[0].partitionKey != "denied" {
+		t.Errorf("%v records != [denied]", len(records))
 	}
 }
 
-func TestReturnEventWhenKinesisReturnsError(t *testing.T) {
+func TestThrottledRecordsBackOff(t *testing.T) {
 	t.Parallel()
+	clock := newFakeClock()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.clock = clock
+	b.config.MaxAttemptsPerRecord = 10
 
-	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
-	b.Start()
-	defer b.Stop()
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+	// partitionKey is (mis)used to specify that the record should be throttled
+	b.Add([]byte("foo"), "throttle")
+	for i := 0; i < 2; i++ {
+		b.sendBatch(10)
+	}
+	if b.throttleDelay != 100*time.Millisecond {
+		t.Errorf("%v != 100ms", b.throttleDelay)
+	}
+
+	// Once a batch goes through without throttling there’s no more delay
+	b.takeRecordsFromBuffer(10)
+	for i := 0; i < 2; i++ {
+		b.Add([]byte("foo"), "bar")
+		b.sendBatch(10)
+	}
+	sleeps := clock.Sleeps()
+	if len(sleeps) != 2 || sleeps[0] != 50*time.Millisecond || sleeps[1] != 100*time.Millisecond {
+		t.Errorf("%v != [50ms 100ms]", sleeps)
+	}
+}
+
+func TestSuccessfulRecordsStatWhenKinesisReturnsError(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
+	b.config.StatReceiver = sr
+	b.config.StatInterval = 1 * time.Millisecond
+	b.Start()
+	defer b.Stop()
+
+	// Adding 20 **will** trigger a batch
+	b.addRecordsAndWait(20, 50)
+
+	if len(sr.received()) < 1 {
+		t.Fatalf("%v < 1", len(sr.received()))
+	}
+
+	// Should be 0 because Kinesis is just returning errors
+	if sr.totals().recordsSentSuccessfully != 0 {
+		t.Errorf("%v != 0", sr.totals().recordsSentSuccessfully)
+	}
+}
+
+func TestKinesisErrorsStatWhenKinesisSucceeds(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	b := newProducer(&mockBatchingClient{shouldErr: false}, 100, 0, 20)
+	b.config.StatReceiver = sr
+	b.config.StatInterval = 1 * time.Millisecond
+	b.Start()
+	defer b.Stop()
+
+	// Adding 20 **will** trigger a batch
+	b.addRecordsAndWait(20, 2)
+
+	if len(sr.received()) < 1 {
+		t.Fatalf("%v < 1", len(sr.received()))
+	}
+
+	// Should be 0 because Kinesis is succeeding
+	if sr.totals().kinesisErrors != 0 {
+		t.Errorf("%v != 0", sr.totals().kinesisErrors)
+	}
+}
+
+func TestKinesisErrorsStatWhenKinesisReturnsError(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
+	b.config.StatReceiver = sr
+	b.config.StatInterval = 1 * time.Millisecond
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(20, 5)
+	b.Stop()
+
+	if sr.totals().kinesisErrors != 2 {
+		t.Errorf("%v != 2", sr.totals().kinesisErrors)
+	}
+}
+
+func TestLogMessageWhenKinesisSucceeds(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{shouldErr: false}, 100, 0, 20)
+	logRecorder, logger := newRecordedLogger()
+	b.logger = logger
+	b.Start()
+	defer b.Stop()
+
+	// Adding 20 **will** trigger a batch
+	b.addRecordsAndWait(20, 2)
+
+	entry := logRecorder.All()[0]
+	requiredString := "PutRecords request succeeded"
+	if entry.Message != requiredString {
+		t.Errorf("%s != %s", entry.Message, requiredString)
+	}
+	fields := entry.ContextMap()
+	if fields["stream"] != "foo" || fields["records"] != int64(20) {
+		t.Errorf("%v, %v != foo, 20", fields["stream"], fields["records"])
+	}
+}
+
+func TestReturnEventWhenKinesisReturnsError(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
+	b.Start()
+	defer b.Stop()
 
 	// Adding 20 **will** trigger a batch
 	b.addRecordsAndWait(20, 2)
@@ -588,225 +1519,3018 @@ func TestReturnEventWhenKinesisReturnsError(t *testing.T) {
 	}
 }
 
-func TestLogMessageWhenSomeRecordsFail(t *testing.T) {
+func TestLogMessageWhenSomeRecordsFail(t *testing.T) {
+	t.Parallel()
+
+	sr := &statReceiver{}
+	b := newProducer(&mockBatchingClient{}, 100, 2*time.Millisecond, 20)
+	b.config.StatReceiver = sr
+	b.config.StatInterval = 1 * time.Millisecond
+	b.config.MaxAttemptsPerRecord = 2
+	logRecorder, logger := newRecordedLogger()
+	b.logger = logger
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(18, 0)
+
+	// Add two records that will fail. partitionKey is (mis)used to specify that the record
+	// should fail.
+	b.Add([]byte("foo"), "fail")
+	b.Add([]byte("foo"), "fail")
+
+	// Sleep long enough for a few attempts to be tried and the failing records to be re-enqueued
+	// and then dropped
+	time.Sleep(5 * time.Millisecond)
+
+	buf := new(bytes.Buffer)
+	for _, log := range logRecorder.All() {
+		buf.WriteString(log.Message)
+	}
+	loggerString := buf.String()
+
+	requiredString := "Partial success when sending a PutRecords request"
+	if !strings.Contains(loggerString, requiredString) {
+		t.Errorf("%s does not contain %s", loggerString, requiredString)
+	}
+
+	requiredString = "this record failed"
+	if len(b.Events()) == 0 {
+		t.Errorf("Expected at least one error, 0 seen")
+	}
+	e := <-b.Events()
+	if e.String() != requiredString {
+		t.Errorf("Expected event: %s; received: %s", requiredString, e.String())
+	}
+
+	requiredString = "Dropping failed record; it has hit the maximum number of attempts"
+	dropped := logRecorder.FilterMessage(requiredString).All()
+	if len(dropped) == 0 {
+		t.Fatalf("%s does not contain %s", loggerString, requiredString)
+	}
+	if attempts := dropped[0].ContextMap()["attempts"]; attempts != int64(2) {
+		t.Errorf("%v != 2", attempts)
+	}
+}
+
+func TestRecordsWrittenEvent(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.config.EmitSuccessDetails = true
+	b.config.MaxAttemptsPerRecord = 1
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(19, 0)
+
+	// Add a single record that will fail. partitionKey is (mis)used to specify that the record
+	// should fail.
+	b.Add([]byte("foo"), "fail")
+
+	var written *RecordsWrittenEvent
+	for written == nil {
+		select {
+		case e := <-b.Events():
+			written, _ = e.(*RecordsWrittenEvent)
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for RecordsWrittenEvent")
+		}
+	}
+
+	if len(written.Records) != 19 {
+		t.Fatalf("%v != 19", len(written.Records))
+	}
+	for _, r := range written.Records {
+		if r.PartitionKey != "foo" || r.SequenceNumber != "001" || r.ShardID != "001" {
+			t.Errorf("unexpected WrittenRecord %+v", r)
+		}
+	}
+}
+
+func TestNoRecordsWrittenEventByDefault(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(20, 2)
+
+	if len(b.Events()) != 0 {
+		t.Errorf("%v != 0", len(b.Events()))
+	}
+}
+
+func TestCheckpointFunc(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	var checkpoints []string
+	b.config.CheckpointFunc = func(shardID, sequenceNumber string) {
+		checkpoints = append(checkpoints, shardID+"/"+sequenceNumber)
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(4, 0)
+	// partitionKey is (mis)used to specify that the record should fail
+	b.Add([]byte("foo"), "fail")
+	b.running = false
+
+	b.sendBatch(20)
+
+	if len(checkpoints) != 4 {
+		t.Fatalf("%v != 4", len(checkpoints))
+	}
+	for _, c := range checkpoints {
+		if c != "001/001" {
+			t.Errorf("%v != 001/001", c)
+		}
+	}
+}
+
+func TestFailedRecordWithoutErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	var checkpoints int
+	b.config.CheckpointFunc = func(shardID, sequenceNumber string) {
+		checkpoints++
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(4, 0)
+	b.Add([]byte("foo"), "nomessage")
+	b.running = false
+
+	// It failed, even though only its ErrorCode is set, so it’s retried rather than written
+	if sent := b.sendBatch(20); sent != 4 {
+		t.Errorf("%v != 4", sent)
+	}
+	if checkpoints != 4 {
+		t.Errorf("%v != 4", checkpoints)
+	}
+	if b.bufferLen() != 1 {
+		t.Errorf("%v != 1", b.bufferLen())
+	}
+}
+
+func TestFailedRecordWithZeroFailedRecordCount(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{zeroFailedRecordCount: true}, 100, 0, 20)
+	var checkpoints int
+	b.config.CheckpointFunc = func(shardID, sequenceNumber string) {
+		checkpoints++
+	}
+	var results []RecordResult
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(4, 0)
+	b.AddWithCallback([]byte("foo"), "fail", func(result RecordResult) {
+		results = append(results, result)
+	})
+	b.running = false
+
+	// Its entry says it failed, so it’s retried rather than written, whatever FailedRecordCount says
+	if sent := b.sendBatch(20); sent != 4 {
+		t.Errorf("%v != 4", sent)
+	}
+	if b.currentStat.RecordsSentSuccessfullySinceLastStat != 4 {
+		t.Errorf("%v != 4", b.currentStat.RecordsSentSuccessfullySinceLastStat)
+	}
+	if checkpoints != 4 {
+		t.Errorf("%v != 4", checkpoints)
+	}
+	if len(results) != 0 {
+		t.Errorf("%v != []", results)
+	}
+	if b.bufferLen() != 1 {
+		t.Errorf("%v != 1", b.bufferLen())
+	}
+}
+
+// miscountingClient fails the first record of each request and leaves out the entry for the last,
+// but always returns a FailedRecordCount of 1.
+type miscountingClient struct{}
+
+func (c *miscountingClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	res := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(1)}
+	for i := range args.Records[:len(args.Records)-1] {
+		if i == 0 {
+			res.Records = append(res.Records, &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("foo"), ErrorMessage: aws.String("this record failed")})
+		} else {
+			res.Records = append(res.Records, &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("001"), ShardId: aws.String("001")})
+		}
+	}
+	return res, nil
+}
+
+func TestPartialFailureCountsFromEntries(t *testing.T) {
+	t.Parallel()
+	p, err := New(&miscountingClient{}, "foo", Config{BufferSize: 100, BatchSize: 20, Logger: discardLogger, MaxAttemptsPerRecord: 2})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(5, 0)
+	b.running = false
+
+	// Both the failed record and the one without an entry are retried, and neither counts as sent
+	if sent := b.sendBatch(20); sent != 3 {
+		t.Errorf("%v != 3", sent)
+	}
+	if b.currentStat.RecordsSentSuccessfullySinceLastStat != 3 {
+		t.Errorf("%v != 3", b.currentStat.RecordsSentSuccessfullySinceLastStat)
+	}
+	if b.bufferLen() != 2 {
+		t.Errorf("%v != 2", b.bufferLen())
+	}
+	if n := atomic.LoadInt64(&b.inFlightRecords); n != 0 {
+		t.Errorf("%v != 0", n)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 2, 0, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	circuitEvents := b.Subscribe(ctx, EventTypeCircuitOpen, EventTypePanic)
+
+	// Nobody is reading from Events, which only has room for 2, but once there are subscriptions
+	// that no longer blocks
+	for i := 0; i < 3; i++ {
+		b.emit(newError("oops"))
+	}
+	b.emit(&CircuitOpenEvent{ConsecutiveErrors: 5})
+
+	select {
+	case e := <-circuitEvents:
+		if _, ok := e.(*CircuitOpenEvent); !ok {
+			t.Errorf("%T is not a *CircuitOpenEvent", e)
+		}
+	default:
+		t.Error("No event was received")
+	}
+	if len(circuitEvents) != 0 {
+		t.Errorf("%v != 0", len(circuitEvents))
+	}
+	if len(b.Events()) != 2 {
+		t.Errorf("%v != 2", len(b.Events()))
+	}
+
+	cancel()
+	select {
+	case _, ok := <-circuitEvents:
+		if ok {
+			t.Error("received an event after unsubscribing")
+		}
+	case <-time.After(time.Second):
+		t.Error("the channel wasn’t closed")
+	}
+}
+
+func TestAddBlocksFalse(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
+	b.Start()
+	defer b.Stop()
+
+	// Adding 10 will fill up the buffer and not trigger a batch
+	b.addRecordsAndWait(10, 2)
+
+	data := []byte("The cheese is old and moldy, where is the bathroom?")
+	partitionKey := "foo"
+	err := b.Add(data, partitionKey)
+
+	if err != ErrBufferFull {
+		t.Errorf("%v != %v", err, ErrBufferFull)
+	}
+}
+
+func TestAddBlocksTrue(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
+	b.config.AddBlocksWhenBufferFull = true
+	b.Start()
+	defer b.Stop()
+
+	// Adding 10 will fill up the buffer and not trigger a batch
+	b.addRecordsAndWait(10, 2)
+
+	// This should block so we need to run this in a goroutine
+	go func() {
+		data := []byte("The cheese is old and moldy, where is the bathroom?")
+		partitionKey := "foo"
+		b.Add(data, partitionKey)
+		t.Fatal("We should never have gotten here.")
+	}()
+
+	time.Sleep(1 * time.Millisecond)
+
+	if b.records.len() != 10 {
+		t.Errorf("%v != 10", b.records.len())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 20, 0, 20)
+	b.Start()
+	defer b.Stop()
+
+	// Adding 10 will not trigger a batch
+	b.addRecordsAndWait(10, 2)
+
+	timeout := 20 * time.Second
+	sent, remaining, err := b.Flush(timeout, false)
+	if err != nil {
+		t.Errorf("%s != nil", err)
+	}
+
+	if sent != 10 {
+		t.Errorf("%v != 10", sent)
+	}
+	if remaining > 0 {
+		t.Errorf("%v > 0", remaining)
+	}
+	if b.records.len() > 0 {
+		t.Errorf("%v > 0", b.records.len())
+	}
+	if b.isRunning() {
+		t.Errorf("b.running != false")
+	}
+}
+
+func TestFlushWithTimeout(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{
+		sleepFor: 6 * time.Millisecond,
+	}
+	b := newProducer(c, 1000, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+
+	// Adding 600 will enqueue 2 batches
+	b.addRecordsAndWait(600, 0)
+
+	// back to normal
+	b.running = false
+
+	// This should lead to only 1 batch of 500 being sent by Flush
+	timeout := 5 * time.Millisecond
+
+	start := time.Now()
+	sent, remaining, err := b.Flush(timeout, false)
+	duration := time.Since(start)
+	if err != nil {
+		t.Errorf("%s != nil", err)
+	}
+
+	if sent != 500 {
+		t.Errorf("%v != 500", sent)
+	}
+	if remaining != 100 {
+		t.Errorf("%v != 100", remaining)
+	}
+	if b.records.len() != 100 {
+		t.Errorf("%v != 100", b.records.len())
+	}
+	if duration < 6*time.Millisecond || duration > 8*time.Millisecond {
+		t.Errorf("%v seems off", duration)
+	}
+}
+
+func TestFlushCompleteEvent(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(15, 0)
+	b.running = false
+
+	sent, remaining, _ := b.Flush(0, false)
+	select {
+	case e := <-b.Events():
+		expected := FlushCompleteEvent{Sent: sent, Remaining: remaining}
+		if e, ok := e.(*FlushCompleteEvent); !ok || *e != expected {
+			t.Errorf("%v != %v", e, expected)
+		}
+	default:
+		t.Fatal("No FlushCompleteEvent was sent")
+	}
+
+	// Flush doesn’t block if there’s no room for the Event
+	for len(b.events) < cap(b.events) {
+		b.events <- &Error{}
+	}
+	done := make(chan struct{})
+	go func() {
+		b.Flush(0, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Error("Flush blocked")
+	}
+}
+
+func TestFlushWithoutTimeout(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{
+		sleepFor: 6 * time.Millisecond,
+	}
+	b := newProducer(c, 1000, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+
+	// Adding 600 will enqueue 2 batches
+	b.addRecordsAndWait(600, 0)
+
+	// back to normal
+	b.running = false
+
+	// This should lead to batches of 500 and 100 being sent by Flush
+	timeout := 0 * time.Millisecond
+
+	start := time.Now()
+	sent, remaining, err := b.Flush(timeout, false)
+	duration := time.Since(start)
+	if err != nil {
+		t.Errorf("%s != nil", err)
+	}
+
+	if sent != 600 {
+		t.Errorf("%v != 600", sent)
+	}
+	if remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+	if duration < 12*time.Millisecond || duration > 16*time.Millisecond {
+		t.Errorf("%v seems off", duration)
+	}
+}
+
+func TestAddTooLarge(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add would succeed
+	b.running = true
+	data := make([]byte, MaxRecordSize)
+	err := b.Add(data, "foo")
+	ok := b.TryAdd(data, "foo")
+	b.running = false
+	if err != ErrRecordTooLarge {
+		t.Errorf("%v != %v", err, ErrRecordTooLarge)
+	}
+	if ok {
+		t.Error("TryAdd added a record that is too large")
+	}
+	if b.bufferLen() != 0 {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+}
+
+func TestTakeRecordsFromBufferWhileDraining(t *testing.T) {
+	t.Parallel()
+	for attempt := 0; attempt < 20; attempt++ {
+		b := newProducer(&mockBatchingClient{}, 100, 0, 100)
+		for i := 0; i < 100; i++ {
+			b.records.forcePush(batchRecord{data: []byte("foo"), partitionKey: "bar"})
+		}
+
+		drained := make(chan int)
+		go func() {
+			var n int
+			for i := 0; i < 50; i++ {
+				if _, ok := b.records.pop(); ok {
+					n++
+				}
+			}
+			drained <- n
+		}()
+
+		taken := make(chan int)
+		go func() {
+			taken <- len(b.takeRecordsFromBuffer(100))
+		}()
+
+		select {
+		case n := <-taken:
+			if n += <-drained; n != 100 {
+				t.Errorf("%v != 100", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("takeRecordsFromBuffer blocked")
+		}
+	}
+}
+
+func TestBatchesStayUnderMaxKinesisBatchBytes(t *testing.T) {
+	t.Parallel()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+
+	// Each record is 1 MiB with its partition key, so only 5 fit in a request
+	data := make([]byte, MaxRecordSize-3)
+	for i := 0; i < 8; i++ {
+		b.records.forcePush(batchRecord{data: data, partitionKey: strconv.Itoa(100 + i)})
+	}
+
+	if sent := b.sendBatch(10); sent != 5 {
+		t.Errorf("%v != 5", sent)
+	}
+	if b.bufferLen() != 3 {
+		t.Errorf("%v != 3", b.bufferLen())
+	}
+	// The records that didn’t fit are sent next, in order
+	records := b.takeRecordsFromBuffer(10)
+	if len(records) != 3 || records[0].partitionKey != "105" {
+		t.Errorf("%v, %v != 3, 105", len(records), records[0].partitionKey)
+	}
+	if c.callCount() != 1 {
+		t.Errorf("%v != 1", c.callCount())
+	}
+}
+
+func TestFitInRequest(t *testing.T) {
+	t.Parallel()
+	small := batchRecord{data: []byte("foo"), partitionKey: "bar"}
+	large := batchRecord{data: make([]byte, MaxRecordSize-3), partitionKey: "bar"}
+	cases := []struct {
+		records  []batchRecord
+		expected int
+	}{
+		{nil, 0},
+		{[]batchRecord{small, small}, 2},
+		{[]batchRecord{large, large, large, large, large}, 5},
+		{[]batchRecord{large, large, large, large, large, small}, 5},
+		{[]batchRecord{small, large, large, large, large, large}, 5},
+	}
+	for _, c := range cases {
+		if n := fitInRequest(c.records); n != c.expected {
+			t.Errorf("%v != %v", n, c.expected)
+		}
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 3, 0, 10)
+
+	ch := make(chan Record, 4)
+	ch <- Record{Data: []byte("foo"), PartitionKey: "a"}
+	ch <- Record{Data: []byte("bar"), PartitionKey: "b", ExplicitHashKey: "42"}
+	close(ch)
+
+	// set running to true so Add will succeed
+	b.running = true
+	if err := b.AddAll(context.Background(), ch); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	// The buffer only has room for one more, so the second of these fails
+	ch = make(chan Record, 3)
+	for i := 0; i < 3; i++ {
+		ch <- Record{Data: []byte("baz"), PartitionKey: "c"}
+	}
+	if err := b.AddAll(context.Background(), ch); err == nil {
+		t.Error("err == nil")
+	}
+	b.running = false
+	if len(ch) != 1 {
+		t.Errorf("%v != 1", len(ch))
+	}
+
+	records := b.takeRecordsFromBuffer(10)
+	if len(records) != 3 {
+		t.Fatalf("%v != 3", len(records))
+	}
+	if string(records[1].data) != "bar" || records[1].explicitHashKey != "42" {
+		t.Errorf("%q, %v != bar, 42", records[1].data, records[1].explicitHashKey)
+	}
+
+	// Cancelling the context stops AddAll even though ch is still open
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.AddAll(ctx, make(chan Record)); err != context.Canceled {
+		t.Errorf("%v != %v", err, context.Canceled)
+	}
+}
+
+func TestAddWithTimeout(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+	b.addRecordsAndWait(10, 0)
+
+	start := time.Now()
+	if err := b.AddWithTimeout([]byte("foo"), "bar", 10*time.Millisecond); err != ErrAddTimeout {
+		t.Errorf("%v != %v", err, ErrAddTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("%v < %v", elapsed, 10*time.Millisecond)
+	}
+	if err := b.AddWithTimeout([]byte("foo"), "bar", 0); err != ErrAddTimeout {
+		t.Errorf("%v != %v", err, ErrAddTimeout)
+	}
+
+	// Once there’s room the record is added
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		b.records.pop()
+	}()
+	if err := b.AddWithTimeout([]byte("foo"), "bar", time.Second); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if b.bufferLen() != 10 {
+		t.Errorf("%v != 10", b.bufferLen())
+	}
+}
+
+func TestAddContext(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+	if err := b.AddContext(context.Background(), []byte("foo"), "bar"); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	b.addRecordsAndWait(9, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.AddContext(ctx, []byte("foo"), "bar"); err != context.DeadlineExceeded {
+		t.Errorf("%v != %v", err, context.DeadlineExceeded)
+	}
+
+	// Cancelling the context unblocks it
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	if err := b.AddContext(ctx, []byte("foo"), "bar"); err != context.Canceled {
+		t.Errorf("%v != %v", err, context.Canceled)
+	}
+	if b.bufferLen() != 10 {
+		t.Errorf("%v != 10", b.bufferLen())
+	}
+}
+
+// splitLines is a Config.RecordSplitter for newline-delimited data.
+func splitLines(data []byte) [][]byte {
+	return bytes.Split(data, []byte("\n"))
+}
+
+func TestRecordSplitter(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.RecordSplitter = splitLines
+
+	line := strings.Repeat("x", MaxRecordSize/2)
+	data := []byte(line + "\n" + line + "\n" + "short")
+	var cbCalls int
+	var cbErr error
+
+	// set running to true so Add will succeed
+	b.running = true
+	err := b.AddWithCallback(data, "foo", func(result RecordResult) {
+		cbCalls++
+		cbErr = result.Err
+	})
+	b.running = false
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if b.bufferLen() != 3 {
+		t.Fatalf("%v != 3", b.bufferLen())
+	}
+
+	records := b.takeRecordsFromBuffer(10)
+	if string(records[2].data) != "short" || records[2].partitionKey != "foo" {
+		t.Errorf("%q, %v != short, foo", records[2].data, records[2].partitionKey)
+	}
+
+	// The callback is called once all the chunks are done, with the first error
+	oops := errors.New("oops")
+	records[0].done(nil)
+	records[1].done(oops)
+	if cbCalls != 0 {
+		t.Errorf("%v != 0", cbCalls)
+	}
+	records[2].done(nil)
+	if cbCalls != 1 || cbErr != oops {
+		t.Errorf("%v, %v != 1, %v", cbCalls, cbErr, oops)
+	}
+}
+
+func TestRecordSplitterChunkTooLarge(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.RecordSplitter = splitLines
+
+	// The first chunk would fit but the second wouldn’t, so neither is added
+	data := []byte("short\n" + strings.Repeat("x", MaxRecordSize))
+
+	// set running to true so Add would succeed
+	b.running = true
+	err := b.Add(data, "foo")
+	b.running = false
+	if err != ErrRecordTooLarge {
+		t.Errorf("%v != %v", err, ErrRecordTooLarge)
+	}
+	if b.bufferLen() != 0 {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+}
+
+// encryptWithTag "encrypts" data by reversing it and appending a 16 byte tag, so that the
+// ciphertext is larger than the plaintext as with a real AEAD cipher.
+func encryptWithTag(plaintext []byte) ([]byte, error) {
+	if string(plaintext) == "fail" {
+		return nil, errors.New("oops")
+	}
+	ciphertext := make([]byte, 0, len(plaintext)+16)
+	for i := len(plaintext) - 1; i >= 0; i-- {
+		ciphertext = append(ciphertext, plaintext[i])
+	}
+	return append(ciphertext, bytes.Repeat([]byte("t"), 16)...), nil
+}
+
+func TestEncrypter(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.Encrypter = encryptWithTag
+	b.config.PartitionKeyFunc = func(data []byte) (string, error) { return string(data[:1]), nil }
+
+	// set running to true so Add will succeed
+	b.running = true
+	if err := b.AddData([]byte("abc")); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if err := b.Add([]byte("fail"), "foo"); err == nil {
+		t.Error("err == nil")
+	}
+	if b.TryAdd([]byte("fail"), "foo") {
+		t.Error("TryAdd succeeded although the record couldn’t be encrypted")
+	}
+	// The plaintext fits but the ciphertext doesn’t
+	if err := b.Add(make([]byte, MaxRecordSize-10), "foo"); err != ErrRecordTooLarge {
+		t.Errorf("%v != %v", err, ErrRecordTooLarge)
+	}
+	b.running = false
+
+	records := b.takeRecordsFromBuffer(10)
+	if len(records) != 1 {
+		t.Fatalf("%v != 1", len(records))
+	}
+	if string(records[0].data) != "cbatttttttttttttttt" {
+		t.Errorf("%q != cbatttttttttttttttt", records[0].data)
+	}
+	// The partition key is derived from the plaintext
+	if records[0].partitionKey != "a" {
+		t.Errorf("%v != a", records[0].partitionKey)
+	}
+}
+
+func TestEncrypterWithRecordSplitter(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.Encrypter = encryptWithTag
+	b.config.RecordSplitter = splitLines
+
+	line := strings.Repeat("x", MaxRecordSize/2)
+	data := []byte(line + "\n" + line + "\n" + "ab")
+
+	// set running to true so Add will succeed
+	b.running = true
+	err := b.Add(data, "foo")
+	b.running = false
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// Each chunk is encrypted separately
+	records := b.takeRecordsFromBuffer(10)
+	if len(records) != 3 {
+		t.Fatalf("%v != 3", len(records))
+	}
+	if len(records[0].data) != len(line)+16 {
+		t.Errorf("%v != %v", len(records[0].data), len(line)+16)
+	}
+	if string(records[2].data) != "batttttttttttttttt" {
+		t.Errorf("%q != batttttttttttttttt", records[2].data)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 20)
+	b.Start()
+	defer b.Stop()
+
+	// Adding 10 will not trigger a batch
+	b.addRecordsAndWait(10, 2)
+
+	sent, remaining, err := b.Drain(20 * time.Second)
+	if err != nil {
+		t.Errorf("%s != nil", err)
+	}
+	if sent != 10 {
+		t.Errorf("%v != 10", sent)
+	}
+	if remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+	if !b.isRunning() {
+		t.Errorf("b.running != true")
+	}
+
+	// The producer should carry on as normal
+	b.addRecordsAndWait(20, 0)
+	if !waitUntil(func() bool { return c.callCount() == 2 }) {
+		t.Errorf("%v != 2", c.callCount())
+	}
+}
+
+func TestDrainWhenStopped(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 1000, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(600, 0)
+	b.running = false
+
+	sent, remaining, err := b.Drain(0)
+	if err != nil {
+		t.Errorf("%s != nil", err)
+	}
+	if sent != 600 {
+		t.Errorf("%v != 600", sent)
+	}
+	if remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+}
+
+func TestConcurrentDrainsWhenStopped(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 1000, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(600, 0)
+	b.running = false
+
+	// Each sends what the others haven’t, and between them they send everything once
+	var sent int64
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, remaining, _ := b.Drain(0)
+			if remaining != 0 {
+				t.Errorf("%v != 0", remaining)
+			}
+			atomic.AddInt64(&sent, int64(n))
+		}()
+	}
+	wg.Wait()
+	if sent != 600 {
+		t.Errorf("%v != 600", sent)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{sleepFor: 50 * time.Millisecond}
+	b := newProducer(c, 100, 0, 10)
+	b.config.MaxAttemptsPerRecord = 1
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(10, 0)
+	if !waitUntil(func() bool { return b.InFlight() == 10 }) {
+		t.Errorf("%v != 10", b.InFlight())
+	}
+	if !waitUntil(func() bool { return b.InFlight() == 0 }) {
+		t.Errorf("%v != 0", b.InFlight())
+	}
+
+	// Failed records are in flight until they are back in the buffer, or dropped
+	b.Add([]byte("foo"), "fail")
+	b.addRecordsAndWait(9, 0)
+	if !waitUntil(func() bool { return c.callCount() == 2 && b.InFlight() == 0 }) {
+		t.Errorf("%v != 0", b.InFlight())
+	}
+}
+
+func TestStopAndDrain(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 20)
+	b.Start()
+
+	// Adding fewer than a batch will not trigger one
+	called := false
+	b.Add([]byte("one"), "foo")
+	b.AddExplicit([]byte("two"), "bar", "42")
+	b.AddWithCallback([]byte("three"), "baz", func(RecordResult) { called = true })
+
+	records, err := b.StopAndDrain()
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if b.isRunning() {
+		t.Error("b should NOT be running")
+	}
+	if len(records) != 3 {
+		t.Fatalf("%v != 3", len(records))
+	}
+	if string(records[0].Data) != "one" || records[0].PartitionKey != "foo" {
+		t.Errorf("%q, %v != one, foo", records[0].Data, records[0].PartitionKey)
+	}
+	if records[1].ExplicitHashKey != "42" {
+		t.Errorf("%v != 42", records[1].ExplicitHashKey)
+	}
+	if b.bufferLen() != 0 {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+	if c.callCount() != 0 {
+		t.Errorf("%v != 0", c.callCount())
+	}
+	if called {
+		t.Error("the callback was called")
+	}
+
+	// Once stopped there is nothing left to hand back
+	records, err = b.StopAndDrain()
+	if len(records) != 0 || err != nil {
+		t.Errorf("%v, %v != 0, nil", len(records), err)
+	}
+}
+
+func TestSetStreamName(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(10, 0)
+	if !waitUntil(func() bool { return c.callCount() == 1 }) {
+		t.Fatalf("%v != 1", c.callCount())
+	}
+	if c.lastStreamName != "foo" {
+		t.Errorf("%v != foo", c.lastStreamName)
+	}
+
+	err := b.SetStreamName("bar")
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	b.addRecordsAndWait(10, 0)
+	if !waitUntil(func() bool { return c.callCount() == 2 }) {
+		t.Fatalf("%v != 2", c.callCount())
+	}
+	if c.lastStreamName != "bar" {
+		t.Errorf("%v != bar", c.lastStreamName)
+	}
+}
+
+func TestSetStreamNameEmpty(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	err := b.SetStreamName("")
+	if err == nil {
+		t.Errorf("%v == nil", err)
+	}
+	if b.StreamName() != "foo" {
+		t.Errorf("%v != foo", b.StreamName())
+	}
+}
+
+func TestAddWithCallback(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	results := map[string]RecordResult{}
+	callback := func(key string) func(RecordResult) {
+		return func(result RecordResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			results[key] = result
+		}
+	}
+
+	clock := newFakeClock()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.clock = clock
+	resultCount := func() int {
+		// drain the events channel so that returnSomeFailedRecordsToBuffer can’t block
+		for len(b.events) > 0 {
+			<-b.events
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results)
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.AddWithCallback([]byte("foo"), "ok", callback("ok"))
+	// partitionKey is (mis)used to specify that the record should fail with a non-retryable
+	// error code, or with a retryable one.
+	b.AddWithCallback([]byte("foo"), "denied", callback("denied"))
+	b.AddWithCallback([]byte("foo"), "fail", callback("fail"))
+	b.records.forcePush(batchRecord{data: []byte("foo"), partitionKey: "expired", deadline: clock.Now().Add(time.Second), callback: callback("expired")})
+	b.running = false
+
+	clock.Advance(2 * time.Second)
+	b.sendBatch(10)
+	waitUntil(func() bool { return resultCount() == 3 })
+
+	// The record that failed with a retryable error is retried, and dropped after
+	// MaxAttemptsPerRecord attempts.
+	b.sendBatch(10)
+	waitUntil(func() bool { return resultCount() == 4 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if r, ok := results["ok"]; !ok || r.Err != nil || r.SequenceNumber != "001" || r.ShardID != "001" || r.Attempts != 1 {
+		t.Errorf("%+v, %v != {SequenceNumber:001 ShardID:001 Attempts:1 Err:<nil>}, true", r, ok)
+	}
+	if r := results["denied"]; r.Err == nil || r.Attempts != 1 {
+		t.Errorf("%v, %v == nil, 1", r.Err, r.Attempts)
+	}
+	if r := results["fail"]; r.Err == nil || r.Attempts != 2 {
+		t.Errorf("%v, %v == nil, 2", r.Err, r.Attempts)
+	}
+	if r := results["expired"]; r.Err != ErrRecordExpired || r.Attempts != 0 {
+		t.Errorf("%v, %v != %v, 0", r.Err, r.Attempts, ErrRecordExpired)
+	}
+}
+
+func TestDroppedRecordHandler(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	dropped := map[string]error{}
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.DroppedRecordHandler = func(record Record, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if string(record.Data) != "foo" {
+			t.Errorf("%q != foo", record.Data)
+		}
+		dropped[record.PartitionKey] = err
+	}
+	droppedCount := func() int {
+		// drain the events channel so that returnSomeFailedRecordsToBuffer can’t block
+		for len(b.events) > 0 {
+			<-b.events
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return len(dropped)
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	// partitionKey is (mis)used to specify that the record should fail with a non-retryable
+	// error code, or with a retryable one.
+	b.Add([]byte("foo"), "ok")
+	b.Add([]byte("foo"), "denied")
+	b.Add([]byte("foo"), "fail")
+	b.running = false
+
+	b.sendBatch(10)
+	waitUntil(func() bool { return droppedCount() == 1 })
+	b.sendBatch(10)
+	waitUntil(func() bool { return droppedCount() == 2 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := dropped["ok"]; ok {
+		t.Error("A record that was written was dropped")
+	}
+	if err := dropped["denied"]; err == nil {
+		t.Error("err == nil")
+	}
+	if err := dropped["fail"]; err == nil || !strings.Contains(err.Error(), "2 attempts") {
+		t.Errorf("%v doesn’t mention 2 attempts", err)
+	}
+}
+
+func TestRecordsRetriedStat(t *testing.T) {
+	t.Parallel()
+	sr := &statReceiver{}
+	c := &mockBatchingClient{shouldErr: true}
+	b := newProducer(c, 100, 0, 10)
+	b.config.StatReceiver = sr
+	b.config.MaxAttemptsPerRecord = 10
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(8, 0)
+	// partitionKey is (mis)used to specify that the records should fail
+	b.Add([]byte("foo"), "fail")
+	b.Add([]byte("foo"), "fail")
+	b.running = false
+
+	// The whole batch fails, so all 10 records are retried
+	b.sendBatch(10)
+	waitUntil(func() bool { return b.records.len() == 10 })
+
+	// Then just the 2 failed records are retried
+	c.shouldErr = false
+	b.sendBatch(10)
+	waitUntil(func() bool {
+		// drain the events channel so that returnSomeFailedRecordsToBuffer can’t block
+		for len(b.events) > 0 {
+			<-b.events
+		}
+		return b.records.len() == 2
+	})
+
+	b.sendStats()
+	if sr.received()[0].RecordsRetriedSinceLastStat != 12 {
+		t.Errorf("%v != 12", sr.received()[0].RecordsRetriedSinceLastStat)
+	}
+}
+
+// Not parallel, so that other tests don’t start or stop goroutines while it counts them
+func TestReturningFailedRecordsToFullBuffer(t *testing.T) {
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+	b.config.MaxAttemptsPerRecord = 1000
+	// Once subscribed, Events that don’t fit are discarded rather than blocking
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.Subscribe(ctx, EventTypePanic)
+
+	before := runtime.NumGoroutine()
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 10; i++ {
+		// partitionKey is (mis)used to specify that the records should fail
+		b.Add([]byte("foo"), "fail")
+	}
+	// Every batch fails, and its record is put straight back, so the buffer stays full
+	for i := 0; i < 200; i++ {
+		b.sendBatch(1)
+		if b.TryAdd([]byte("foo"), "fail") {
+			t.Fatal("TryAdd succeeded")
+		}
+	}
+	b.running = false
+
+	if n := runtime.NumGoroutine() - before; n > 5 {
+		t.Errorf("%v more goroutines are running", n)
+	}
+	if b.bufferLen() != 10 {
+		t.Errorf("%v != 10", b.bufferLen())
+	}
+}
+
+func TestFlushWaitsForFailedRecordsToBeReturned(t *testing.T) {
+	t.Parallel()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+	// An unbuffered events channel makes returnSomeFailedRecordsToBuffer block until we read
+	// from it, so that the main goroutine is still returning the failed records to the buffer
+	// when Flush is called.
+	b.events = make(chan Event)
+	b.Start()
+
+	b.addRecordsAndWait(8, 0)
+	// partitionKey is (mis)used to specify that the records should fail
+	b.Add([]byte("foo"), "fail")
+	b.Add([]byte("foo"), "fail")
+	waitUntil(func() bool { return c.callCount() == 1 })
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		for {
+			select {
+			case <-b.events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	_, remaining, _ := b.Flush(0, false)
+
+	// The failed records should have been retried by Flush, and then dropped because they’d
+	// reached MaxAttemptsPerRecord.
+	if c.callCount() != 2 {
+		t.Errorf("%v != 2", c.callCount())
+	}
+	if remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+}
+
+func TestFlushWithTimeoutCountsRecordsBeingReturned(t *testing.T) {
+	t.Parallel()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+	b.events = make(chan Event)
+	b.config.MaxAttemptsPerRecord = 10
+	b.Start()
+
+	b.addRecordsAndWait(8, 0)
+	b.Add([]byte("foo"), "fail")
+	b.Add([]byte("foo"), "fail")
+	waitUntil(func() bool { return c.callCount() == 1 })
+
+	// Let the failed records back into the buffer, but only once Flush has timed out
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for {
+			select {
+			case <-b.events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	_, remaining, _ := b.Flush(10*time.Millisecond, false)
+	if remaining != 2 {
+		t.Errorf("%v != 2", remaining)
+	}
+}
+
+func TestBufferBytes(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferBytes: 1000,
+		BatchSize:   10,
+		Logger:      discardLogger,
+	}
+	p, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%q != nil", err)
+	}
+	b := p.(*batchProducer)
+
+	// 97 bytes of data plus a 3-byte partition key makes each record 100 bytes
+	data := bytes.Repeat([]byte("a"), 97)
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 10; i++ {
+		if err := b.Add(data, "foo"); err != nil {
+			t.Fatalf("%q != nil", err)
+		}
+	}
+	if err := b.Add(data, "foo"); err != ErrBufferFull {
+		t.Errorf("%v != %v", err, ErrBufferFull)
+	}
+
+	b.takeRecordsFromBuffer(5)
+	if stat := b.snapshotStats(); stat.BufferedBytes != 500 {
+		t.Errorf("%v != 500", stat.BufferedBytes)
+	}
+	if err := b.Add(data, "foo"); err != nil {
+		t.Errorf("%q != nil", err)
+	}
+}
+
+func TestBufferBytesConcurrentAdds(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferBytes:             1000,
+		BatchSize:               10,
+		Logger:                  discardLogger,
+		AddBlocksWhenBufferFull: true,
+	}
+	p, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%q != nil", err)
+	}
+	b := p.(*batchProducer)
+
+	// 97 bytes of data plus a 3-byte partition key makes each record 100 bytes
+	data := bytes.Repeat([]byte("a"), 97)
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+
+	// Many more than fit, so most of them block until room is made
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.Add(data, "foo"); err != nil {
+				t.Errorf("%q != nil", err)
+			}
+		}()
+	}
+
+	var taken int
+	if !waitUntil(func() bool {
+		if bytes := b.records.bytes(); bytes > 1000 {
+			t.Fatalf("%v > 1000", bytes)
+		}
+		taken += len(b.takeRecordsFromBuffer(3))
+		return taken == 30
+	}) {
+		t.Errorf("%v != 30", taken)
+	}
+	wg.Wait()
+}
+
+func TestBufferBytesRecordTooLarge(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferBytes: 100,
+		BatchSize:   10,
+		Logger:      discardLogger,
+	}
+	p, _ := New(&mockBatchingClient{}, "foo", config)
+	b := p.(*batchProducer)
+
+	b.running = true
+	if err := b.Add(bytes.Repeat([]byte("a"), 101), "foo"); err != ErrRecordLargerThanBuffer {
+		t.Errorf("%v != %v", err, ErrRecordLargerThanBuffer)
+	}
+}
+
+func TestTryAdd(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+	b.config.AddBlocksWhenBufferFull = true
+
+	if b.TryAdd([]byte("foo"), "bar") {
+		t.Error("TryAdd succeeded while the Producer was stopped")
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 10; i++ {
+		if !b.TryAdd([]byte("foo"), "bar") {
+			t.Fatalf("TryAdd failed with %v records buffered", b.records.len())
+		}
+	}
+	// TryAdd mustn’t block even though AddBlocksWhenBufferFull is true
+	if b.TryAdd([]byte("foo"), "bar") {
+		t.Error("TryAdd succeeded while the buffer was full")
+	}
+	if b.records.len() != 10 {
+		t.Errorf("%v != 10", b.records.len())
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []DropPolicy{DropOldest, DropNewest} {
+		b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 10)
+		b.config.DropPolicy = policy
+
+		// set running to true so Add will succeed
+		b.running = true
+		b.addRecordsAndWait(96, 0)
+		b.consecutiveErrors = 5
+
+		err := b.Add([]byte("foo"), "bar")
+		if policy == DropNewest && err != ErrRecordShed {
+			t.Errorf("%v: %v != %v", policy, err, ErrRecordShed)
+		}
+		if policy == DropOldest && err != nil {
+			t.Errorf("%v: %v != nil", policy, err)
+		}
+		b.running = false
+
+		// The remaining records fill 95% of the buffer, so the failed record is shed
+		expected := b.records.len()
+		b.sendBatch(1)
+		if policy == DropOldest {
+			expected--
+			if b.currentStat.RecordsDroppedBufferFullSinceLastStat != 1 {
+				t.Errorf("%v: %v != 1", policy, b.currentStat.RecordsDroppedBufferFullSinceLastStat)
+			}
+		} else if b.currentStat.RecordsDroppedSinceLastStat != 0 {
+			t.Errorf("%v: %v != 0", policy, b.currentStat.RecordsDroppedSinceLastStat)
+		}
+		if b.records.len() != expected {
+			t.Errorf("%v: %v != %v", policy, b.records.len(), expected)
+		}
+	}
+}
+
+func TestNewBatchProducerWithBadDropPolicy(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize: 10,
+		BatchSize:  10,
+		DropPolicy: DropNewest + 1,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
+
+func BenchmarkAddWhenBufferFull(bm *testing.B) {
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+	b.running = true
+	b.addRecordsAndWait(10, 0)
+	data := []byte("foo")
+
+	bm.ReportAllocs()
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		b.Add(data, "bar")
+	}
+}
+
+func BenchmarkTryAddWhenBufferFull(bm *testing.B) {
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+	b.running = true
+	b.addRecordsAndWait(10, 0)
+	data := []byte("foo")
+
+	bm.ReportAllocs()
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		b.TryAdd(data, "bar")
+	}
+}
+
+// signallingClient sends on sent after every call to PutRecords.
+type signallingClient struct {
+	mockBatchingClient
+	sent chan struct{}
+}
+
+func (c *signallingClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	res, err := c.mockBatchingClient.PutRecords(args)
+	c.sent <- struct{}{}
+	return res, err
+}
+
+// BenchmarkFullBatchLatency measures how long it takes for a full batch to be sent once its last
+// record has been added.
+func BenchmarkFullBatchLatency(bm *testing.B) {
+	client := &signallingClient{sent: make(chan struct{})}
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.client = client
+	b.Start()
+	defer b.Stop()
+	data := []byte("foo")
+
+	bm.ReportAllocs()
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		for j := 0; j < 10; j++ {
+			b.Add(data, "bar")
+		}
+		<-client.sent
+	}
+}
+
+func BenchmarkRecordsToInput(bm *testing.B) {
+	b := newProducer(&mockBatchingClient{}, 10, 0, 10)
+	records := make([]batchRecord, MaxKinesisBatchSize)
+	for i := range records {
+		records[i] = batchRecord{data: []byte("foo"), partitionKey: strconv.Itoa(i)}
+	}
+
+	bm.ReportAllocs()
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		b.recordsToInput("foo", records).release()
+	}
+}
+
+func TestRecordsAreDroppedAfterMaxAttemptsOfFailedBatches(t *testing.T) {
+	t.Parallel()
+	sr := &statReceiver{}
+	c := &mockBatchingClient{shouldErr: true}
+	b := newProducer(c, 100, 0, 5)
+	b.config.StatReceiver = sr
+	b.config.MaxAttemptsPerRecord = 3
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(5, 0)
+	b.running = false
+
+	for i := 0; i < 3; i++ {
+		// Records are returned to the buffer after a failure
+		if b.records.len() != 5 {
+			t.Fatalf("%v != 5", b.records.len())
+		}
+		b.sendBatch(5)
+	}
+
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+	if c.callCount() != 3 {
+		t.Errorf("%v != 3", c.callCount())
+	}
+
+	b.sendStats()
+	if sr.totals().recordsDroppedMaxAttempts != 5 {
+		t.Errorf("%v != 5", sr.totals().recordsDroppedMaxAttempts)
+	}
+}
+
+// zeroFailedRecordCountClient returns a FailedRecordCount of 0 rather than nil on success.
+type zeroFailedRecordCountClient struct {
+	mockBatchingClient
+}
+
+func (c *zeroFailedRecordCountClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	res, err := c.mockBatchingClient.PutRecords(args)
+	if err == nil && res.FailedRecordCount == nil {
+		res.FailedRecordCount = aws.Int64(0)
+	}
+	return res, err
+}
+
+func TestZeroFailedRecordCountIsSuccess(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.client = &zeroFailedRecordCountClient{}
+	logRecorder, logger := newRecordedLogger()
+	b.logger = logger
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(10, 0)
+	b.running = false
+
+	sent := b.sendBatch(10)
+	if sent != 10 {
+		t.Errorf("%v != 10", sent)
+	}
+
+	messages := logRecorder.FilterMessageSnippet("Partial success").All()
+	if len(messages) != 0 {
+		t.Errorf("%v != 0", len(messages))
+	}
+}
+
+// panickingClient panics on its first numPanics calls to PutRecords.
+type panickingClient struct {
+	mockBatchingClient
+	numPanics int
+}
+
+func (c *panickingClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if c.callCount() < c.numPanics {
+		c.callsMu.Lock()
+		c.calls++
+		c.callsMu.Unlock()
+		panic("oh no")
+	}
+	return c.mockBatchingClient.PutRecords(args)
+}
+
+func waitForPanicEvent(b *batchProducer) *PanicEvent {
+	for {
+		select {
+		case event := <-b.events:
+			if e, ok := event.(*PanicEvent); ok {
+				return e
+			}
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+}
+
+func TestPanicStopsProducer(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.client = &panickingClient{numPanics: 1}
+	b.Start()
+
+	b.addRecordsAndWait(10, 0)
+
+	e := waitForPanicEvent(b)
+	if e == nil {
+		t.Fatal("No PanicEvent was received")
+	}
+	if !strings.Contains(string(e.Stack), "PutRecords") {
+		t.Errorf("%s does not contain PutRecords", e.Stack)
+	}
+
+	waitUntil(func() bool { return !b.isRunning() })
+	if err := b.Add([]byte("foo"), "bar"); err == nil {
+		t.Error("err == nil")
+	}
+	if b.State() != StateStopped {
+		t.Errorf("%v != %v", b.State(), StateStopped)
+	}
+	if err := b.Stop(); err != ErrAlreadyStopped {
+		t.Errorf("%v != %v", err, ErrAlreadyStopped)
+	}
+}
+
+func TestPanicRestartsProducer(t *testing.T) {
+	t.Parallel()
+	c := &panickingClient{numPanics: 1}
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.client = c
+	b.config.RestartOnPanic = true
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(10, 0)
+	if waitForPanicEvent(b) == nil {
+		t.Fatal("No PanicEvent was received")
+	}
+
+	b.addRecordsAndWait(10, 0)
+	if !waitUntil(func() bool { return c.callCount() == 2 }) {
+		t.Errorf("%v != 2", c.callCount())
+	}
+	if !b.isRunning() {
+		t.Error("Producer is not running")
+	}
+}
+
+func TestStopDuringPanic(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.client = &panickingClient{numPanics: 1}
+	b.Start()
+
+	b.addRecordsAndWait(10, 0)
+
+	// Stop mustn’t hang, whichever of it and the main goroutine gets the lock first
+	go func() {
+		time.Sleep(1 * time.Millisecond)
+		waitForPanicEvent(b)
+	}()
+	b.Stop()
+	if b.isRunning() {
+		t.Error("Producer is running")
+	}
+}
+
+func TestDoneAfterPanic(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.client = &panickingClient{numPanics: 1}
+	b.Start()
+	done := b.Done()
+
+	b.addRecordsAndWait(10, 0)
+	if waitForPanicEvent(b) == nil {
+		t.Fatal("No PanicEvent was received")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Done was not closed after the panic")
+	}
+}
+
+func TestSendHooks(t *testing.T) {
+	t.Parallel()
+	type key struct{}
+	var counts []int
+	var errs []error
+	var values []interface{}
+
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+	b.config.MaxAttemptsPerRecord = 10
+	b.config.BeforeSend = func(recordCount int) context.Context {
+		counts = append(counts, recordCount)
+		return context.WithValue(context.Background(), key{}, recordCount)
+	}
+	b.config.AfterSend = func(ctx context.Context, recordCount int, err error) {
+		values = append(values, ctx.Value(key{}))
+		errs = append(errs, err)
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(7, 0)
+	b.running = false
+
+	b.sendBatch(10)
+	c.shouldErr = true
+	b.running = true
+	b.addRecordsAndWait(3, 0)
+	b.running = false
+	b.sendBatch(10)
+
+	if len(counts) != 2 || counts[0] != 7 || counts[1] != 3 {
+		t.Errorf("%v != [7 3]", counts)
+	}
+	if len(values) != 2 || values[0] != 7 || values[1] != 3 {
+		t.Errorf("%v != [7 3]", values)
+	}
+	if len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+		t.Errorf("%v != [<nil> error]", errs)
+	}
+}
+
+// failOnceClient fails each record whose data is in failOnce the first time it is sent, and
+// records the data of every record it is sent, request by request.
+type failOnceClient struct {
+	failOnce map[string]bool
+	requests [][]string
+}
+
+func (c *failOnceClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	var request []string
+	res := kinesis.PutRecordsOutput{Records: make([]*kinesis.PutRecordsResultEntry, len(args.Records))}
+	var failedRecordCount int64
+	for i, record := range args.Records {
+		data := string(record.Data)
+		request = append(request, data)
+		if c.failOnce[data] {
+			delete(c.failOnce, data)
+			failedRecordCount++
+			res.Records[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("foo"), ErrorMessage: aws.String("this record failed")}
+		} else {
+			res.Records[i] = &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("001"), ShardId: aws.String("001")}
+		}
+	}
+	if failedRecordCount > 0 {
+		res.FailedRecordCount = &failedRecordCount
+	}
+	c.requests = append(c.requests, request)
+	return &res, nil
+}
+
+func TestFlushOrdered(t *testing.T) {
+	t.Parallel()
+	c := &failOnceClient{failOnce: map[string]bool{"100": true, "600": true}}
+	b := newProducer(&mockBatchingClient{}, 2000, 0, 10)
+	b.client = c
+	b.config.MaxAttemptsPerRecord = 10
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 1200; i++ {
+		b.Add([]byte(strconv.Itoa(i)), "foo")
+	}
+	b.running = false
+
+	// drain the events channel so that returnSomeFailedRecordsToBuffer can’t block
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-b.events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sent, remaining, _ := b.FlushOrdered(0)
+	if sent != 1200 {
+		t.Errorf("%v != 1200", sent)
+	}
+	if remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+
+	// Each failed record should be retried at the start of the next request, and otherwise the
+	// records should be sent in the order they were added.
+	if len(c.requests) != 3 {
+		t.Fatalf("%v != 3", len(c.requests))
+	}
+	next := 0
+	for i, request := range c.requests {
+		for j, data := range request {
+			if i == 1 && j == 0 {
+				if data != "100" {
+					t.Errorf("%v != 100", data)
+				}
+				continue
+			}
+			if i == 2 && j == 0 {
+				if data != "600" {
+					t.Errorf("%v != 600", data)
+				}
+				continue
+			}
+			if data != strconv.Itoa(next) {
+				t.Fatalf("%v != %v", data, next)
+			}
+			next++
+		}
+	}
+}
+
+// newOrderedProducer returns a Producer with the given Ordering whose client is c, with records
+// added whose data is "0", "1" and so on and whose partition keys are keys.
+func newOrderedProducer(t *testing.T, c *failOnceClient, ordering Ordering, batchSize int, keys ...string) *batchProducer {
+	config := Config{
+		BufferSize:           100,
+		BatchSize:            batchSize,
+		MaxAttemptsPerRecord: 10,
+		Logger:               discardLogger,
+		Ordering:             ordering,
+	}
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i, key := range keys {
+		b.Add([]byte(strconv.Itoa(i)), key)
+	}
+	b.running = false
+	return b
+}
+
+func TestOrderingBestEffort(t *testing.T) {
+	t.Parallel()
+	c := &failOnceClient{failOnce: map[string]bool{"1": true}}
+	b := newOrderedProducer(t, c, OrderingBestEffort, 10, "a", "a", "a", "a", "a")
+
+	// The failed record goes back to the front of the buffer
+	b.sendBatch(3)
+	b.sendBatch(10)
+	if fmt.Sprint(c.requests) != "[[0 1 2] [1 3 4]]" {
+		t.Errorf("%v != [[0 1 2] [1 3 4]]", c.requests)
+	}
+}
+
+func TestOrderingPerPartitionKey(t *testing.T) {
+	t.Parallel()
+	c := &failOnceClient{failOnce: map[string]bool{"1": true}}
+	b := newOrderedProducer(t, c, OrderingPerPartitionKey, 10, "a", "b", "b", "c")
+
+	// "2" is held back because it has the same key as "1", and so can’t overtake it when "1" fails
+	for b.bufferLen() > 0 {
+		b.sendBatch(10)
+	}
+	if fmt.Sprint(c.requests) != "[[0 1 3] [1] [2]]" {
+		t.Errorf("%v != [[0 1 3] [1] [2]]", c.requests)
+	}
+}
+
+func TestOrderingStrict(t *testing.T) {
+	t.Parallel()
+	c := &failOnceClient{failOnce: map[string]bool{"1": true}}
+	b := newOrderedProducer(t, c, OrderingStrict, 1, "a", "b", "c")
+
+	// Even draining, which otherwise sends batches of the maximum size, sends one record at a time
+	sent, remaining, _ := b.Drain(0)
+	if sent != 3 || remaining != 0 {
+		t.Errorf("%v, %v != 3, 0", sent, remaining)
+	}
+	if fmt.Sprint(c.requests) != "[[0] [1] [1] [2]]" {
+		t.Errorf("%v != [[0] [1] [1] [2]]", c.requests)
+	}
+
+	if err := b.Reconfigure(10, 0); err == nil {
+		t.Error("err == nil")
+	}
+}
+
+func TestNewBatchProducerWithStrictOrderingAndBatchSize(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize: 10,
+		BatchSize:  10,
+		Ordering:   OrderingStrict,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
+
+// describingClient is a mockBatchingClient that can also describe streams.
+type describingClient struct {
+	mockBatchingClient
+	status string
+	err    error
+}
+
+func (c *describingClient) DescribeStreamSummary(args *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamName:   args.StreamName,
+			StreamStatus: aws.String(c.status),
+		},
+	}, nil
+}
+
+func TestVerifyOnStart(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:    10,
+		BatchSize:     10,
+		VerifyOnStart: true,
+	}
+
+	cases := []struct {
+		client *describingClient
+		ok     bool
+	}{
+		{&describingClient{status: kinesis.StreamStatusActive}, true},
+		{&describingClient{status: kinesis.StreamStatusUpdating}, true},
+		{&describingClient{status: kinesis.StreamStatusCreating}, false},
+		{&describingClient{err: errors.New("Stream foo not found")}, false},
+	}
+	for _, c := range cases {
+		b, err := New(c.client, "foo", config)
+		if err != nil {
+			t.Fatalf("%q != nil", err)
+		}
+
+		err = b.Start()
+		if c.ok && err != nil {
+			t.Errorf("%q != nil", err)
+		}
+		if !c.ok {
+			if err == nil {
+				t.Errorf("err == nil for status %v", c.client.status)
+			}
+			if b.State() != StateStopped {
+				t.Errorf("%v != %v", b.State(), StateStopped)
+			}
+		}
+		b.Stop()
+	}
+}
+
+func TestVerifyOnStartRequiresDescribingClient(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:    10,
+		BatchSize:     10,
+		VerifyOnStart: true,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
+
+// healthClient is a mockBatchingClient whose stream can be described, except that describing it
+// fails with err if err is set.
+type healthClient struct {
+	mockBatchingClient
+	mu        sync.Mutex
+	err       error
+	describes int
+}
+
+func (c *healthClient) DescribeStreamSummary(args *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.describes++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamName:   args.StreamName,
+			StreamStatus: aws.String(kinesis.StreamStatusActive),
+		},
+	}, nil
+}
+
+func (c *healthClient) setErr(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *healthClient) describeCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.describes
+}
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+	c := &healthClient{}
+	config := Config{
+		BufferSize:          10,
+		BatchSize:           10,
+		HealthCheckInterval: time.Minute,
+		Logger:              discardLogger,
+	}
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+	clock := newFakeClock()
+	b.clock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := b.Subscribe(ctx, EventTypeHealth)
+	b.Start()
+	defer b.Stop()
+
+	// check waits until the stream has been checked at least once more
+	check := func() {
+		n := c.describeCount()
+		if !waitUntil(func() bool {
+			clock.Advance(time.Minute)
+			return c.describeCount() > n
+		}) {
+			t.Fatal("The stream wasn’t checked")
+		}
+	}
+
+	check()
+	c.setErr(errors.New("ExpiredTokenException"))
+	check()
+	select {
+	case e := <-events:
+		if e, ok := e.(*HealthEvent); !ok || e.Healthy || e.Err == nil {
+			t.Errorf("%v is not an unhealthy HealthEvent", e)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("No HealthEvent was received")
+	}
+
+	// Only changes are reported
+	check()
+	c.setErr(nil)
+	check()
+	select {
+	case e := <-events:
+		if e, ok := e.(*HealthEvent); !ok || !e.Healthy {
+			t.Errorf("%v is not a healthy HealthEvent", e)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("No HealthEvent was received")
+	}
+	if len(events) != 0 {
+		t.Errorf("%v != 0", len(events))
+	}
+}
+
+func TestHealthCheckRequiresDescribingClient(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:          10,
+		BatchSize:           10,
+		HealthCheckInterval: time.Minute,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
+
+// creatingClient is a mockBatchingClient that can also describe and create a stream. A stream it
+// creates is CREATING for the first describe after it is created. If raced is true, CreateStream
+// fails as if someone else had just created the stream.
+type creatingClient struct {
+	mockBatchingClient
+	mu         sync.Mutex
+	exists     bool
+	creating   bool
+	raced      bool
+	shardCount int64
+	creates    int
+}
+
+func (c *creatingClient) DescribeStreamSummary(args *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.exists {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream not found", nil)
+	}
+	status := kinesis.StreamStatusActive
+	if c.creating {
+		status = kinesis.StreamStatusCreating
+		c.creating = false
+	}
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamName:   args.StreamName,
+			StreamStatus: aws.String(status),
+		},
+	}, nil
+}
+
+func (c *creatingClient) CreateStream(args *kinesis.CreateStreamInput) (*kinesis.CreateStreamOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.creates++
+	c.exists, c.creating = true, true
+	if c.raced {
+		return nil, awserr.New(kinesis.ErrCodeResourceInUseException, "Stream already exists", nil)
+	}
+	c.shardCount = aws.Int64Value(args.ShardCount)
+	return &kinesis.CreateStreamOutput{}, nil
+}
+
+// startWithFakeClock starts b, advancing clock until it has.
+func startWithFakeClock(b *batchProducer, clock *fakeClock) error {
+	result := make(chan error, 1)
+	go func() { result <- b.Start() }()
+	for {
+		select {
+		case err := <-result:
+			return err
+		default:
+			clock.Advance(createStreamPollInterval)
+			time.Sleep(1 * time.Millisecond)
+		}
+	}
+}
+
+func TestCreateStreamIfMissing(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name            string
+		client          *creatingClient
+		expectedCreates int
+		expectedShards  int64
+	}{
+		{"missing", &creatingClient{}, 1, 3},
+		{"exists", &creatingClient{exists: true}, 0, 0},
+		{"raced", &creatingClient{raced: true}, 1, 0},
+	} {
+		config := Config{
+			BufferSize:             10,
+			BatchSize:              10,
+			Logger:                 discardLogger,
+			CreateStreamIfMissing:  true,
+			CreateStreamShardCount: 3,
+		}
+		p, err := New(test.client, "foo", config)
+		if err != nil {
+			t.Fatalf("%v: %v != nil", test.name, err)
+		}
+		b := p.(*batchProducer)
+		clock := newFakeClock()
+		b.clock = clock
+
+		if err := startWithFakeClock(b, clock); err != nil {
+			t.Errorf("%v: %v != nil", test.name, err)
+		}
+		if test.client.creates != test.expectedCreates {
+			t.Errorf("%v: %v != %v", test.name, test.client.creates, test.expectedCreates)
+		}
+		if test.client.shardCount != test.expectedShards {
+			t.Errorf("%v: %v != %v", test.name, test.client.shardCount, test.expectedShards)
+		}
+		if test.client.creating {
+			t.Errorf("%v: Start didn’t wait for the stream to be created", test.name)
+		}
+		b.Stop()
+	}
+}
+
+func TestCreateStreamIfMissingRequiresCreatingClient(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:            10,
+		BatchSize:             10,
+		CreateStreamIfMissing: true,
+	}
+	b, err := New(&describingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
+
+// concurrencyClient records the largest number of PutRecords calls it has seen at once.
+type concurrencyClient struct {
+	inFlight    int32
+	maxInFlight int32
+	sleepFor    time.Duration
+	written     int64
+}
+
+func (c *concurrencyClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	n := atomic.AddInt32(&c.inFlight, 1)
+	defer atomic.AddInt32(&c.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxInFlight, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(c.sleepFor)
+	res := &kinesis.PutRecordsOutput{Records: make([]*kinesis.PutRecordsResultEntry, len(args.Records))}
+	for i := range res.Records {
+		res.Records[i] = &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("001"), ShardId: aws.String("001")}
+	}
+	atomic.AddInt64(&c.written, int64(len(args.Records)))
+	return res, nil
+}
+
+func TestMaxConcurrentBatches(t *testing.T) {
+	t.Parallel()
+	c := &concurrencyClient{sleepFor: 20 * time.Millisecond}
+	config := Config{
+		BufferSize:           100,
+		BatchSize:            10,
+		Logger:               discardLogger,
+		MaxConcurrentBatches: 3,
+	}
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+
+	// Fill the buffer before starting, so that batches are ready to go at once
+	b.running = true
+	for i := 0; i < 60; i++ {
+		b.Add([]byte("foo"), "bar")
+	}
+	b.running = false
+
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	waitUntil(func() bool { return atomic.LoadInt64(&c.written) == 60 })
+	b.Stop()
+
+	if max := atomic.LoadInt32(&c.maxInFlight); max < 2 || max > 3 {
+		t.Errorf("%v is not 2 or 3", max)
+	}
+	// Stop waits for the outcomes of all the batches
+	if b.outstandingBatches != 0 || b.InFlight() != 0 {
+		t.Errorf("%v, %v != 0, 0", b.outstandingBatches, b.InFlight())
+	}
+}
+
+func TestMaxConcurrentBatchesHoldsBackTheBuffer(t *testing.T) {
+	t.Parallel()
+	c := &concurrencyClient{sleepFor: 200 * time.Millisecond}
+	config := Config{
+		BufferSize:           100,
+		BatchSize:            10,
+		Logger:               discardLogger,
+		MaxConcurrentBatches: 3,
+	}
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+
+	b.running = true
+	for i := 0; i < 60; i++ {
+		b.Add([]byte("foo"), "bar")
+	}
+	b.running = false
+
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	defer b.Stop()
+
+	// Once the limit is reached the rest stay in the buffer until a batch completes
+	if !waitUntil(func() bool { return atomic.LoadInt32(&c.inFlight) == 3 }) {
+		t.Fatalf("%v != 3", atomic.LoadInt32(&c.inFlight))
+	}
+	if b.records.len() != 30 {
+		t.Errorf("%v != 30", b.records.len())
+	}
+	waitUntil(func() bool { return atomic.LoadInt64(&c.written) == 60 })
+	if max := atomic.LoadInt32(&c.maxInFlight); max != 3 {
+		t.Errorf("%v != 3", max)
+	}
+}
+
+func TestNewBatchProducerWithBadMaxConcurrentBatches(t *testing.T) {
+	t.Parallel()
+	for _, config := range []Config{
+		{BufferSize: 10, BatchSize: 10, MaxConcurrentBatches: -1},
+		{BufferSize: 10, BatchSize: 10, MaxConcurrentBatches: 2, Ordering: OrderingPerPartitionKey},
+	} {
+		if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+			t.Error("err == nil")
+		}
+	}
+}
+
+// blockingStatReceiver blocks in Receive until gate is closed.
+type blockingStatReceiver struct {
+	gate  chan struct{}
+	stats []StatsBatch
+	mu    sync.Mutex
+}
+
+func (s *blockingStatReceiver) Receive(stat StatsBatch) {
+	<-s.gate
+	s.mu.Lock()
+	s.stats = append(s.stats, stat)
+	s.mu.Unlock()
+}
+
+func TestSlowStatReceiverDoesNotBlockBatches(t *testing.T) {
+	t.Parallel()
+
+	sr := &blockingStatReceiver{gate: make(chan struct{})}
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+	b.config.StatReceiver = sr
+	b.config.StatInterval = 1 * time.Millisecond
+	b.Start()
+
+	// Give the stats time to pile up behind the blocked receiver
+	time.Sleep(50 * time.Millisecond)
+
+	b.addRecordsAndWait(20, 0)
+	if !waitUntil(func() bool { return c.callCount() == 2 }) {
+		t.Errorf("%v != 2", c.callCount())
+	}
+
+	// Stop waits for the queued stats to be received
+	close(sr.gate)
+	b.Stop()
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	dropped := 0
+	for _, stat := range sr.stats {
+		dropped += stat.StatsDroppedSinceLastStat
+	}
+	if dropped == 0 {
+		t.Error("dropped == 0")
+	}
+}
+
+// panickingTickerClock is a clock whose tickers can’t be created.
+type panickingTickerClock struct {
+	*fakeClock
+}
+
+func (panickingTickerClock) NewTicker(d time.Duration) ticker {
+	panic("no tickers today")
+}
+
+// slowTickerClock is a clock whose tickers take until release is closed to be created.
+type slowTickerClock struct {
+	*fakeClock
+	release chan struct{}
+}
+
+func (c slowTickerClock) NewTicker(d time.Duration) ticker {
+	<-c.release
+	return c.fakeClock.NewTicker(d)
+}
+
+func TestStartContext(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 10*time.Millisecond, 10)
+	b.clock = newFakeClock()
+	if err := b.StartContext(context.Background()); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if err := b.Add([]byte("foo"), "bar"); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if err := b.Stop(); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+}
+
+func TestStartContextWhenSetupIsSlow(t *testing.T) {
+	t.Parallel()
+
+	clock := slowTickerClock{fakeClock: newFakeClock(), release: make(chan struct{})}
+	defer close(clock.release)
+	b := newProducer(&mockBatchingClient{}, 100, 10*time.Millisecond, 10)
+	b.clock = clock
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.StartContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("%v != %v", err, context.DeadlineExceeded)
+	}
+	if b.State() != StateStopped {
+		t.Errorf("%v != %v", b.State(), StateStopped)
+	}
+	if err := b.Add([]byte("foo"), "bar"); err == nil {
+		t.Error("err == nil")
+	}
+}
+
+func TestStartContextWhenSetupPanics(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 10*time.Millisecond, 10)
+	b.clock = panickingTickerClock{newFakeClock()}
+
+	err := b.StartContext(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no tickers today") {
+		t.Errorf("%v does not mention the panic", err)
+	}
+	if b.State() != StateStopped {
+		t.Errorf("%v != %v", b.State(), StateStopped)
+	}
+	if err := b.Stop(); err != ErrAlreadyStopped {
+		t.Errorf("%v != %v", err, ErrAlreadyStopped)
+	}
+}
+
+func TestRequestModifier(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.config.RequestModifier = func(input *kinesis.PutRecordsInput) {
+		input.StreamARN = aws.String("arn:aws:kinesis:us-east-1:123456789012:stream/" + *input.StreamName)
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(2, 0)
+	b.running = false
+
+	input := b.recordsToInput("foo", b.takeRecordsFromBuffer(2))
+	if arn := aws.StringValue(input.StreamARN); arn != "arn:aws:kinesis:us-east-1:123456789012:stream/foo" {
+		t.Errorf("%v != arn:aws:kinesis:us-east-1:123456789012:stream/foo", arn)
+	}
+	if len(input.Records) != 2 {
+		t.Errorf("%v != 2", len(input.Records))
+	}
+}
+
+func TestOnPutRecords(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	var calls []string
+	b.config.OnPutRecords = func(input *kinesis.PutRecordsInput, output *kinesis.PutRecordsOutput, err error) {
+		failed := -1
+		if output != nil {
+			failed = int(aws.Int64Value(output.FailedRecordCount))
+		}
+		calls = append(calls, fmt.Sprintf("%v %v %v %v", aws.StringValue(input.StreamName), len(input.Records), failed, err))
+	}
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(2, 0)
+	b.Add([]byte("foo"), "fail")
+	b.running = false
+	b.sendBatch(10)
+
+	b.client = &mockBatchingClient{shouldErr: true}
+	b.sendBatch(10)
+
+	expected := []string{"foo 3 1 <nil>", "foo 1 -1 Oh Noes!"}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("%v != %v", calls, expected)
+	}
+}
+
+func TestPause(t *testing.T) {
+	t.Parallel()
+	client := &mockBatchingClient{}
+	b := newProducer(client, 100, 5*time.Millisecond, 10)
+	b.Start()
+	defer b.Stop()
+
+	b.Pause()
+	b.Pause()
+	if e := <-b.Events(); TypeOf(e) != EventTypePaused {
+		t.Errorf("%v != paused", e)
+	}
+	if b.State() != StatePaused {
+		t.Errorf("%v != %v", b.State(), StatePaused)
+	}
+
+	// Neither full batches nor the flush interval send anything while paused
+	b.addRecordsAndWait(35, 30)
+	if client.callCount() != 0 {
+		t.Errorf("%v != 0", client.callCount())
+	}
+	if b.bufferLen() != 35 {
+		t.Errorf("%v != 35", b.bufferLen())
+	}
+
+	b.Resume()
+	b.Resume()
+	if e := <-b.Events(); TypeOf(e) != EventTypeResumed {
+		t.Errorf("%v != resumed", e)
+	}
+	if !waitUntil(func() bool { return b.bufferLen() == 0 && b.InFlight() == 0 }) {
+		t.Errorf("%v records were not sent", b.bufferLen()+b.InFlight())
+	}
+	if b.State() != StateRunning {
+		t.Errorf("%v != %v", b.State(), StateRunning)
+	}
+	if len(b.Events()) != 0 {
+		t.Errorf("%v != 0", len(b.Events()))
+	}
+}
+
+func TestIdleWarningEvent(t *testing.T) {
 	t.Parallel()
-
-	sr := &statReceiver{}
-	b := newProducer(&mockBatchingClient{}, 100, 2*time.Millisecond, 20)
-	b.config.StatReceiver = sr
-	b.config.StatInterval = 1 * time.Millisecond
-	b.config.MaxAttemptsPerRecord = 2
-	logRecorder, logger := newRecordedLogger()
-	b.logger = logger
+	b := newProducer(&mockBatchingClient{}, 100, 1*time.Millisecond, 10)
 	b.Start()
 	defer b.Stop()
 
-	b.addRecordsAndWait(18, 0)
+	waitForIdleWarning := func() {
+		select {
+		case e := <-b.Events():
+			if warning, ok := e.(*IdleWarningEvent); !ok || warning.EmptyFlushes != idleWarningFlushes {
+				t.Errorf("%v is not an IdleWarningEvent for %v flushes", e, idleWarningFlushes)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no IdleWarningEvent")
+		}
+	}
+	waitForIdleWarning()
 
-	// Add two records that will fail. partitionKey is (mis)used to specify that the record
-	// should fail.
-	b.Add([]byte("foo"), "fail")
-	b.Add([]byte("foo"), "fail")
+	// Only one is sent per idle streak
+	time.Sleep(3 * idleWarningFlushes * time.Millisecond / 2)
+	if len(b.Events()) != 0 {
+		t.Errorf("%v != 0", len(b.Events()))
+	}
 
-	// Sleep long enough for a few attempts to be tried and the failing records to be re-enqueued
-	// and then dropped
-	time.Sleep(5 * time.Millisecond)
+	// Sending records starts a new streak
+	b.addRecordsAndWait(1, 0)
+	waitForIdleWarning()
+}
 
-	buf := new(bytes.Buffer)
-	for _, log := range logRecorder.All() {
-		buf.WriteString(log.Message)
+func TestHotKeyEvent(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.config.StatInterval = 1 * time.Minute
+	b.config.MaxRecordsPerKeyPerInterval = 5
+
+	addAndSend := func() {
+		// set running to true so Add will succeed
+		b.running = true
+		for i := 0; i < 8; i++ {
+			b.Add([]byte("foo"), "hot")
+		}
+		for i := 0; i < 2; i++ {
+			b.Add([]byte("foo"), "cold")
+		}
+		b.running = false
+		b.sendBatch(20)
 	}
-	loggerString := buf.String()
 
-	requiredString := "Partial success when sending a PutRecords request"
-	if !strings.Contains(loggerString, requiredString) {
-		t.Errorf("%s does not contain %s", loggerString, requiredString)
+	addAndSend()
+	if len(b.Events()) != 1 {
+		t.Fatalf("%v != 1", len(b.Events()))
 	}
-
-	requiredString = "this record failed"
-	if len(b.Events()) == 0 {
-		t.Errorf("Expected at least one error, 0 seen")
+	if e, ok := (<-b.Events()).(*HotKeyEvent); !ok || e.PartitionKey != "hot" || e.Count != 6 {
+		t.Errorf("%v is not a HotKeyEvent for hot with 6 records", e)
 	}
-	e := <-b.Events()
-	if e.String() != requiredString {
-		t.Errorf("Expected event: %s; received: %s", requiredString, e.String())
+
+	// The key is already known to be hot in this interval
+	addAndSend()
+	if len(b.Events()) != 0 {
+		t.Errorf("%v != 0", len(b.Events()))
 	}
 
-	requiredString = "Dropping failed record; it has hit 2 attempts which is the maximum"
-	if !strings.Contains(loggerString, requiredString) {
-		t.Errorf("%s does not contain %s", loggerString, requiredString)
+	// Counting starts afresh each StatInterval
+	b.keyCounts = nil
+	addAndSend()
+	if len(b.Events()) != 1 {
+		t.Errorf("%v != 1", len(b.Events()))
 	}
 }
 
-func TestAddBlocksFalse(t *testing.T) {
+func TestNewBatchProducerWithMaxRecordsPerKeyPerIntervalAndNoStatInterval(t *testing.T) {
 	t.Parallel()
+	config := NewDefaultConfig()
+	config.StatInterval = 0
+	config.MaxRecordsPerKeyPerInterval = 5
+	if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+		t.Error("err == nil")
+	}
+}
 
-	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
-	b.Start()
-	defer b.Stop()
-
-	// Adding 10 will fill up the buffer and not trigger a batch
-	b.addRecordsAndWait(10, 2)
+func TestRetryBudgetWithHighFailureRate(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 1000, 0, 100)
+	clock := newFakeClock()
+	b.clock = clock
+	b.config.MaxAttemptsPerRecord = 10
+	b.retryBudget = newRetryBudget(0.1)
+
+	send := func(n int, partitionKey string) {
+		// set running to true so Add will succeed
+		b.running = true
+		for i := 0; i < n; i++ {
+			b.Add([]byte("foo"), partitionKey)
+		}
+		b.running = false
+		// Keep sending until every record has been written or dropped
+		for b.bufferLen() > 0 {
+			b.sendBatch(500)
+		}
+	}
 
-	data := []byte("The cheese is old and moldy, where is the bathroom?")
-	partitionKey := "foo"
-	err := b.Add(data, partitionKey)
+	send(100, "fail")
+	// 100 records were sent, so 10 of them could be retried, and then 110 had been sent in all,
+	// so 1 of the retries could be retried
+	stat := b.snapshotStats()
+	if stat.RecordsRetriedSinceLastStat != 11 {
+		t.Errorf("%v != 11", stat.RecordsRetriedSinceLastStat)
+	}
+	if stat.RecordsDroppedRetryBudgetSinceLastStat != 100 || stat.RecordsDroppedSinceLastStat != 100 {
+		t.Errorf("%v, %v != 100, 100", stat.RecordsDroppedRetryBudgetSinceLastStat, stat.RecordsDroppedSinceLastStat)
+	}
+	if stat.RecordsDroppedMaxAttemptsSinceLastStat != 0 {
+		t.Errorf("%v != 0", stat.RecordsDroppedMaxAttemptsSinceLastStat)
+	}
 
-	if err == nil {
-		t.Errorf("%s == nil", err)
+	// Budget built up by successful records in one window can’t be spent in the next
+	send(1000, "foo")
+	clock.Advance(retryBudgetWindow)
+	b.snapshotStats()
+	send(100, "fail")
+	if stat := b.snapshotStats(); stat.RecordsRetriedSinceLastStat != 11 {
+		t.Errorf("%v != 11", stat.RecordsRetriedSinceLastStat)
 	}
 }
 
-func TestAddBlocksTrue(t *testing.T) {
+func TestRecordsToInputReusesRequests(t *testing.T) {
 	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	first := b.recordsToInput("foo", []batchRecord{
+		{data: []byte("1"), partitionKey: "a", explicitHashKey: "42"},
+		{data: []byte("2"), partitionKey: "b"},
+	})
+	// A request that hasn’t been released isn’t affected by later ones
+	second := b.recordsToInput("bar", []batchRecord{{data: []byte("3"), partitionKey: "c"}})
+	if aws.StringValue(first.Records[0].PartitionKey) != "a" || aws.StringValue(first.StreamName) != "foo" {
+		t.Errorf("%v, %v != a, foo", aws.StringValue(first.Records[0].PartitionKey), aws.StringValue(first.StreamName))
+	}
+	first.release()
+	second.release()
 
-	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
-	b.config.AddBlocksWhenBufferFull = true
-	b.Start()
-	defer b.Stop()
-
-	// Adding 10 will fill up the buffer and not trigger a batch
-	b.addRecordsAndWait(10, 2)
+	// Nothing from a released request leaks into the next one to reuse it
+	for i := 0; i < 10; i++ {
+		r := b.recordsToInput("baz", []batchRecord{{data: []byte("4"), partitionKey: "d"}})
+		if len(r.Records) != 1 {
+			t.Fatalf("%v != 1", len(r.Records))
+		}
+		entry := r.Records[0]
+		if string(entry.Data) != "4" || aws.StringValue(entry.PartitionKey) != "d" || entry.ExplicitHashKey != nil {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		if aws.StringValue(r.StreamName) != "baz" {
+			t.Errorf("%v != baz", aws.StringValue(r.StreamName))
+		}
+		r.release()
+	}
+}
 
-	// This should block so we need to run this in a goroutine
-	go func() {
-		data := []byte("The cheese is old and moldy, where is the bathroom?")
-		partitionKey := "foo"
-		b.Add(data, partitionKey)
-		t.Fatal("We should never have gotten here.")
-	}()
+func TestStreamARN(t *testing.T) {
+	t.Parallel()
+	arn := "arn:aws:kinesis:us-east-1:123456789012:stream/foo"
+	p, err := New(&mockBatchingClient{}, "", Config{BufferSize: 10, BatchSize: 10, StreamARN: arn})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
 
-	time.Sleep(1 * time.Millisecond)
+	input := b.recordsToInput(b.StreamName(), nil)
+	if aws.StringValue(input.StreamARN) != arn {
+		t.Errorf("%v != %v", aws.StringValue(input.StreamARN), arn)
+	}
+	if input.StreamName != nil {
+		t.Errorf("%v != nil", *input.StreamName)
+	}
+	if err := b.SetStreamName("bar"); err == nil {
+		t.Error("err == nil")
+	}
 
-	if len(b.records) != 10 {
-		t.Errorf("%v != 10", len(b.records))
+	// Without an ARN the stream is addressed by name
+	b = newProducer(&mockBatchingClient{}, 10, 0, 10)
+	input = b.recordsToInput(b.StreamName(), nil)
+	if aws.StringValue(input.StreamName) != "foo" {
+		t.Errorf("%v != foo", aws.StringValue(input.StreamName))
+	}
+	if input.StreamARN != nil {
+		t.Errorf("%v != nil", *input.StreamARN)
 	}
 }
 
-func TestFlush(t *testing.T) {
+func TestNewBatchProducerWithoutStream(t *testing.T) {
 	t.Parallel()
+	b, err := New(&mockBatchingClient{}, "", Config{BufferSize: 10, BatchSize: 10})
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
 
-	b := newProducer(&mockBatchingClient{}, 20, 0, 20)
-	b.Start()
-	defer b.Stop()
+// contextClient is a mockBatchingClient that can also send records with a context. It waits for
+// delay before sending, or until the context is done.
+type contextClient struct {
+	mockBatchingClient
+	delay time.Duration
+}
 
-	// Adding 10 will not trigger a batch
-	b.addRecordsAndWait(10, 2)
+func (c *contextClient) PutRecordsWithContext(ctx aws.Context, args *kinesis.PutRecordsInput, opts ...request.Option) (*kinesis.PutRecordsOutput, error) {
+	select {
+	case <-time.After(c.delay):
+		return c.PutRecords(args)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	timeout := 20 * time.Second
-	sent, remaining, err := b.Flush(timeout, false)
+func TestPutRecordsTimeout(t *testing.T) {
+	t.Parallel()
+	c := &contextClient{delay: time.Second}
+	config := Config{
+		BufferSize:           100,
+		BatchSize:            10,
+		Logger:               discardLogger,
+		MaxAttemptsPerRecord: 2,
+		PutRecordsTimeout:    10 * time.Millisecond,
+	}
+	p, err := New(c, "foo", config)
 	if err != nil {
-		t.Errorf("%s != nil", err)
+		t.Fatalf("%v != nil", err)
 	}
+	b := p.(*batchProducer)
 
-	if sent != 10 {
-		t.Errorf("%v != 10", sent)
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(10, 0)
+	b.running = false
+
+	start := time.Now()
+	if sent := b.sendBatch(10); sent != 0 {
+		t.Errorf("%v != 0", sent)
 	}
-	if remaining > 0 {
-		t.Errorf("%v > 0", remaining)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("sendBatch took %v despite the timeout", elapsed)
 	}
-	if len(b.records) > 0 {
-		t.Errorf("%v > 0", len(b.records))
+	if b.consecutiveErrors != 1 {
+		t.Errorf("%v != 1", b.consecutiveErrors)
 	}
-	if b.isRunning() {
-		t.Errorf("b.running != false")
+
+	// The records are returned to the buffer to be retried
+	if b.bufferLen() != 10 {
+		t.Errorf("%v != 10", b.bufferLen())
 	}
 }
 
-func TestFlushWithTimeout(t *testing.T) {
+func TestFlushContext(t *testing.T) {
 	t.Parallel()
-
-	c := &mockBatchingClient{
-		sleepFor: 6 * time.Millisecond,
+	c := &contextClient{delay: time.Second}
+	p, err := New(c, "foo", Config{BufferSize: 100, BatchSize: 10, Logger: discardLogger, MaxAttemptsPerRecord: 2})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
 	}
-	b := newProducer(c, 1000, 0, 10)
+	b := p.(*batchProducer)
 
 	// set running to true so Add will succeed
 	b.running = true
-
-	// Adding 600 will enqueue 2 batches
-	b.addRecordsAndWait(600, 0)
-
-	// back to normal
+	b.addRecordsAndWait(5, 0)
 	b.running = false
 
-	// This should lead to only 1 batch of 500 being sent by Flush
-	timeout := 5 * time.Millisecond
-
+	// The request is cancelled along with the flush
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
 	start := time.Now()
-	sent, remaining, err := b.Flush(timeout, false)
-	duration := time.Since(start)
-	if err != nil {
-		t.Errorf("%s != nil", err)
+	sent, remaining, err := b.FlushContext(ctx, false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("%v != %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("FlushContext took %v despite the deadline", elapsed)
 	}
+	if sent != 0 || remaining != 5 {
+		t.Errorf("%v, %v != 0, 5", sent, remaining)
+	}
+}
 
-	if sent != 500 {
-		t.Errorf("%v != 500", sent)
+func TestFlushContextWhileStillSending(t *testing.T) {
+	t.Parallel()
+	c := &concurrencyClient{sleepFor: 200 * time.Millisecond}
+	p, err := New(c, "foo", Config{BufferSize: 100, BatchSize: 10, Logger: discardLogger})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
 	}
-	if remaining != 100 {
-		t.Errorf("%v != 100", remaining)
+	b := p.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
 	}
-	if len(b.records) != 100 {
-		t.Errorf("%v != 100", len(b.records))
+	b.addRecordsAndWait(15, 0)
+	waitUntil(func() bool { return atomic.LoadInt32(&c.inFlight) == 1 })
+
+	// The main goroutine is still waiting for the batch, so nothing can be sent, but the records
+	// in the buffer and in the batch are counted
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	sent, remaining, err := b.FlushContext(ctx, false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("%v != %v", err, context.DeadlineExceeded)
 	}
-	if duration < 6*time.Millisecond || duration > 8*time.Millisecond {
-		t.Errorf("%v seems off", duration)
+	if sent != 0 || remaining != 15 {
+		t.Errorf("%v, %v != 0, 15", sent, remaining)
 	}
+	<-b.Done()
 }
 
-func TestFlushWithoutTimeout(t *testing.T) {
+func TestStopContext(t *testing.T) {
 	t.Parallel()
-
-	c := &mockBatchingClient{
-		sleepFor: 6 * time.Millisecond,
+	c := &concurrencyClient{sleepFor: 200 * time.Millisecond}
+	p, err := New(c, "foo", Config{BufferSize: 100, BatchSize: 10, Logger: discardLogger, MaxConcurrentBatches: 2})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
 	}
-	b := newProducer(c, 1000, 0, 10)
+	b := p.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b.addRecordsAndWait(10, 0)
+	waitUntil(func() bool { return atomic.LoadInt32(&c.inFlight) == 1 })
 
-	// set running to true so Add will succeed
-	b.running = true
+	// Stopping waits for the batch being sent, but StopContext gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.StopContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("%v != %v", err, context.DeadlineExceeded)
+	}
+	if err := b.Add([]byte("foo"), "bar"); err == nil {
+		t.Error("err == nil")
+	}
+	select {
+	case <-b.Done():
+		t.Error("Done is closed before the main goroutine has finished")
+	default:
+	}
 
-	// Adding 600 will enqueue 2 batches
-	b.addRecordsAndWait(600, 0)
+	// Starting again waits for the main goroutine to finish
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if n := atomic.LoadInt64(&c.written); n != 10 {
+		t.Errorf("%v != 10", n)
+	}
+	b.Stop()
+}
 
-	// back to normal
-	b.running = false
+func TestDrainOnStop(t *testing.T) {
+	t.Parallel()
+	c := &concurrencyClient{}
+	p, err := New(c, "foo", Config{BufferSize: 100, BatchSize: 10, Logger: discardLogger, DrainOnStop: true})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	// Paused, so that nothing is sent until Stop
+	b.Pause()
+	b.addRecordsAndWait(15, 0)
 
-	// This should lead to batches of 500 and 100 being sent by Flush
-	timeout := 0 * time.Millisecond
+	if err := b.Stop(); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if n := atomic.LoadInt64(&c.written); n != 15 {
+		t.Errorf("%v != 15", n)
+	}
+	if b.bufferLen() != 0 {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+}
 
-	start := time.Now()
-	sent, remaining, err := b.Flush(timeout, false)
-	duration := time.Since(start)
+func TestDrainOnStopGivesUp(t *testing.T) {
+	t.Parallel()
+	c := &concurrencyClient{sleepFor: 30 * time.Millisecond}
+	p, err := New(c, "foo", Config{BufferSize: 1000, BatchSize: 10, Logger: discardLogger, DrainOnStop: true})
 	if err != nil {
-		t.Errorf("%s != nil", err)
+		t.Fatalf("%v != nil", err)
 	}
+	b := p.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b.Pause()
+	// 2 batches of 500 and 100, the second of which won’t be sent
+	b.addRecordsAndWait(600, 0)
 
-	if sent != 600 {
-		t.Errorf("%v != 600", sent)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = b.StopContext(ctx)
+	if err, ok := err.(*UnsentRecordsError); !ok || err.Remaining != 100 || err.Err != context.DeadlineExceeded {
+		t.Errorf("%v != 100 records were not sent before stopping: %v", err, context.DeadlineExceeded)
 	}
-	if remaining != 0 {
-		t.Errorf("%v != 0", remaining)
+	if b.bufferLen() != 100 {
+		t.Errorf("%v != 100", b.bufferLen())
+	}
+}
+
+func TestPutRecordsTimeoutRequiresContextClient(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:        10,
+		BatchSize:         10,
+		PutRecordsTimeout: time.Second,
 	}
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
 	}
-	if duration < 12*time.Millisecond || duration > 16*time.Millisecond {
-		t.Errorf("%v seems off", duration)
+	if err == nil {
+		t.Error("err == nil")
 	}
 }
 
 type mockBatchingClient struct {
-	calls     int
-	callsMu   sync.Mutex
-	shouldErr bool
-	numToFail int
-	sleepFor  time.Duration
+	calls          int
+	callsMu        sync.Mutex
+	shouldErr      bool
+	numToFail      int
+	sleepFor       time.Duration
+	lastStreamName string
+	// zeroFailedRecordCount makes it return a FailedRecordCount of 0 even if records failed
+	zeroFailedRecordCount bool
 }
 
 func (s *mockBatchingClient) PutRecords(args *kinesis.PutRecordsInput) (resp *kinesis.PutRecordsOutput, err error) {
 	s.callsMu.Lock()
 	defer s.callsMu.Unlock()
 	s.calls++
+	s.lastStreamName = *args.StreamName
 
 	if s.shouldErr {
 		return nil, errors.New("Oh Noes!")
@@ -819,16 +4543,33 @@ func (s *mockBatchingClient) PutRecords(args *kinesis.PutRecordsInput) (resp *ki
 		if *record.PartitionKey == "fail" {
 			failedRecordCount++
 			res.Records[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("foo"), ErrorMessage: aws.String("this record failed")}
+		} else if *record.PartitionKey == "denied" {
+			failedRecordCount++
+			res.Records[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String(kinesis.ErrCodeKMSAccessDeniedException), ErrorMessage: aws.String("access denied")}
+		} else if *record.PartitionKey == "nomessage" {
+			failedRecordCount++
+			res.Records[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("InternalFailure")}
+		} else if *record.PartitionKey == "throttle" {
+			failedRecordCount++
+			res.Records[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException), ErrorMessage: aws.String("Rate exceeded")}
 		} else {
 			res.Records[i] = &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("001"), ShardId: aws.String("001")}
 		}
 	}
-	if failedRecordCount > 0 {
+	if s.zeroFailedRecordCount {
+		res.FailedRecordCount = aws.Int64(0)
+	} else if failedRecordCount > 0 {
 		res.FailedRecordCount = &failedRecordCount
 	}
 	return &res, nil
 }
 
+func (s *mockBatchingClient) callCount() int {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	return s.calls
+}
+
 func newProducer(client *mockBatchingClient, bufferSize int, flushInterval time.Duration, batchSize int) *batchProducer {
 	config := Config{
 		BufferSize: bufferSize,
@@ -875,18 +4616,71 @@ func (b *batchProducer) addRecordsAndWait(numRecords int, millisToWait int) {
 	}
 }
 
+// waitUntil polls cond until it returns true or a second has passed, and returns the final result
+// of cond. It’s for tests that would otherwise have to guess how long to sleep for.
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(1 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	return true
+}
+
+// statReceiver records the StatsBatches it receives. Receive is called on the Producer’s own
+// goroutine, so tests read what it has received through received, last and totals.
 type statReceiver struct {
-	stats                            []StatsBatch
-	totalKinesisErrorsSinceLastStat  int
-	totalRecordsSentSuccessfully     int
-	totalRecordsDroppedSinceLastStat int
+	stats []StatsBatch
+	sums  statTotals
+	mu    sync.Mutex
+}
+
+// statTotals sums some of the stats received by a statReceiver.
+type statTotals struct {
+	kinesisErrors              int
+	recordsSentSuccessfully    int
+	recordsDropped             int
+	recordsDroppedBufferFull   int
+	recordsDroppedMaxAttempts  int
+	recordsDroppedNonRetryable int
 }
 
 func (s *statReceiver) Receive(sf StatsBatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.stats = append(s.stats, sf)
-	s.totalKinesisErrorsSinceLastStat += sf.KinesisErrorsSinceLastStat
-	s.totalRecordsSentSuccessfully += sf.RecordsSentSuccessfullySinceLastStat
-	s.totalRecordsDroppedSinceLastStat += sf.RecordsDroppedSinceLastStat
+	s.sums.kinesisErrors += sf.KinesisErrorsSinceLastStat
+	s.sums.recordsSentSuccessfully += sf.RecordsSentSuccessfullySinceLastStat
+	s.sums.recordsDropped += sf.RecordsDroppedSinceLastStat
+	s.sums.recordsDroppedBufferFull += sf.RecordsDroppedBufferFullSinceLastStat
+	s.sums.recordsDroppedMaxAttempts += sf.RecordsDroppedMaxAttemptsSinceLastStat
+	s.sums.recordsDroppedNonRetryable += sf.RecordsDroppedNonRetryableSinceLastStat
+}
+
+// received returns a copy of the StatsBatches received so far.
+func (s *statReceiver) received() []StatsBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StatsBatch(nil), s.stats...)
+}
+
+// last returns the most recently received StatsBatch, or the zero StatsBatch if none has been
+// received.
+func (s *statReceiver) last() StatsBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stats) == 0 {
+		return StatsBatch{}
+	}
+	return s.stats[len(s.stats)-1]
+}
+
+func (s *statReceiver) totals() statTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sums
 }
 
 func newRecordedLogger() (*observer.ObservedLogs, *zap.Logger) {
@@ -0,0 +1,451 @@
+// Package batchproducertest provides a fake batchproducer.Producer for the unit tests of code that
+// uses one, so that they don’t need a Kinesis client, mock or otherwise.
+package batchproducertest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/JoshKCarroll/go-kinesis/batchproducer"
+)
+
+// Record is a record added to a FakeProducer, with whichever options it was added with.
+type Record struct {
+	Data            []byte
+	PartitionKey    string
+	ExplicitHashKey string
+	TTL             time.Duration
+	Attributes      map[string]string
+}
+
+// FakeProducer is an in-memory batchproducer.Producer. Rather than sending records anywhere it
+// keeps them, in the order they were added, for AddedRecords to return. It behaves like a real
+// Producer in that records can only be added while it is started, but records are considered sent
+// as soon as they are added: callbacks are called with nil straight away, and Flush and Drain
+// report as sent the records added since the last of them was called. It is safe to use from
+// multiple goroutines.
+type FakeProducer struct {
+	mu             sync.Mutex
+	config         batchproducer.Config
+	streamName     string
+	running        bool
+	started        bool
+	stopped        bool
+	flushed        bool
+	paused         bool
+	shouldThrottle bool
+	records        []Record
+	unflushed      int
+	done           chan struct{}
+	addErrs        []error
+	events         chan batchproducer.Event
+	subscriptions  []*subscription
+	// subscriptionsMu is held for reading while sending to subscriptions, so that a subscription’s
+	// channel isn’t closed while an Event is being sent on it.
+	subscriptionsMu sync.RWMutex
+}
+
+type subscription struct {
+	c     chan batchproducer.Event
+	types []batchproducer.EventType
+	done  <-chan struct{}
+}
+
+var _ batchproducer.Producer = (*FakeProducer)(nil)
+
+// ErrNotRunning is returned by the Add methods of a FakeProducer that isn’t started. It is
+// batchproducer.ErrNotRunning, as returned by a real Producer.
+var ErrNotRunning = batchproducer.ErrNotRunning
+
+// NewFakeProducer returns a stopped FakeProducer for streamName. config is only used by AddData,
+// for its PartitionKeyFunc, and returned by Config.
+func NewFakeProducer(streamName string, config batchproducer.Config) *FakeProducer {
+	p := &FakeProducer{
+		config:     config,
+		streamName: streamName,
+		events:     make(chan batchproducer.Event, 100),
+		done:       make(chan struct{}),
+	}
+	close(p.done)
+	return p
+}
+
+// AddedRecords returns a copy of the records that have been added so far.
+func (p *FakeProducer) AddedRecords() []Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Record(nil), p.records...)
+}
+
+// SetAddErrors scripts the results of the next calls to the Add methods: each one returns the next
+// of errs, without adding its record unless the error is nil. Once errs are used up records are
+// added as usual.
+func (p *FakeProducer) SetAddErrors(errs ...error) {
+	p.mu.Lock()
+	p.addErrs = append([]error(nil), errs...)
+	p.mu.Unlock()
+}
+
+// SetShouldThrottle sets the value returned by ShouldThrottle.
+func (p *FakeProducer) SetShouldThrottle(shouldThrottle bool) {
+	p.mu.Lock()
+	p.shouldThrottle = shouldThrottle
+	p.mu.Unlock()
+}
+
+// SendEvent sends event to the subscriptions that want it and on the channel returned by Events.
+// It blocks if 100 events are already waiting to be received on either.
+func (p *FakeProducer) SendEvent(event batchproducer.Event) {
+	p.subscriptionsMu.RLock()
+	for _, s := range p.subscriptions {
+		for _, t := range s.types {
+			if t == batchproducer.TypeOf(event) {
+				select {
+				case s.c <- event:
+				case <-s.done:
+				}
+				break
+			}
+		}
+	}
+	p.subscriptionsMu.RUnlock()
+
+	p.events <- event
+}
+
+// Started reports whether Start or StartContext has been called successfully.
+func (p *FakeProducer) Started() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.started
+}
+
+// Stopped reports whether Stop, or one of the methods that calls it, has been called successfully.
+func (p *FakeProducer) Stopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+// Flushed reports whether Flush or FlushOrdered has been called.
+func (p *FakeProducer) Flushed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushed
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		return batchproducer.ErrAlreadyStarted
+	}
+	p.running = true
+	p.started = true
+	p.done = make(chan struct{})
+	return nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.Start()
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stop()
+}
+
+// from/for interface Producer
+func (p *FakeProducer) StopContext(ctx context.Context) error {
+	return p.Stop()
+}
+
+func (p *FakeProducer) stop() error {
+	if !p.running {
+		return batchproducer.ErrAlreadyStopped
+	}
+	p.running = false
+	p.stopped = true
+	close(p.done)
+	return nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Add(data []byte, partitionKey string) error {
+	return p.add(Record{Data: data, PartitionKey: partitionKey}, nil)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) TryAdd(data []byte, partitionKey string) bool {
+	return p.Add(data, partitionKey) == nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddData(data []byte) error {
+	if p.config.PartitionKeyFunc == nil {
+		return errors.New("AddData requires Config.PartitionKeyFunc to be set")
+	}
+	partitionKey, err := p.config.PartitionKeyFunc(data)
+	if err != nil {
+		return err
+	}
+	return p.Add(data, partitionKey)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddWithTTL(data []byte, partitionKey string, ttl time.Duration) error {
+	return p.add(Record{Data: data, PartitionKey: partitionKey, TTL: ttl}, nil)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddWithCallback(data []byte, partitionKey string, cb func(result batchproducer.RecordResult)) error {
+	return p.add(Record{Data: data, PartitionKey: partitionKey}, cb)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddExplicit(data []byte, partitionKey, explicitHashKey string) error {
+	return p.add(Record{Data: data, PartitionKey: partitionKey, ExplicitHashKey: explicitHashKey}, nil)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddWithAttributes(data []byte, partitionKey string, attrs map[string]string) error {
+	return p.add(Record{Data: data, PartitionKey: partitionKey, Attributes: attrs}, nil)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddWithTimeout(data []byte, partitionKey string, timeout time.Duration) error {
+	return p.Add(data, partitionKey)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddContext(ctx context.Context, data []byte, partitionKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.Add(data, partitionKey)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) AddAll(ctx context.Context, ch <-chan batchproducer.Record) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := p.AddExplicit(r.Data, r.PartitionKey, r.ExplicitHashKey); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *FakeProducer) add(record Record, cb func(result batchproducer.RecordResult)) error {
+	p.mu.Lock()
+	if len(p.addErrs) > 0 {
+		err := p.addErrs[0]
+		p.addErrs = p.addErrs[1:]
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+	if !p.running {
+		p.mu.Unlock()
+		return ErrNotRunning
+	}
+	p.records = append(p.records, record)
+	p.unflushed++
+	p.mu.Unlock()
+
+	// Like a real Producer, don’t hold the lock while calling the callback
+	if cb != nil {
+		cb(batchproducer.RecordResult{Attempts: 1})
+	}
+	return nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Flush(timeout time.Duration, sendStats bool) (sent int, remaining int, err error) {
+	return p.FlushOrdered(timeout)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) FlushContext(ctx context.Context, sendStats bool) (sent int, remaining int, err error) {
+	return p.FlushOrdered(0)
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Drain(timeout time.Duration) (sent int, remaining int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent, p.unflushed = p.unflushed, 0
+	return sent, 0, nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) FlushOrdered(timeout time.Duration) (sent int, remaining int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop()
+	p.flushed = true
+	sent, p.unflushed = p.unflushed, 0
+	return sent, 0, nil
+}
+
+// SendBatch adds records as Add would, except that it doesn’t need the FakeProducer to be started,
+// and reports them all as written.
+func (p *FakeProducer) SendBatch(records []batchproducer.Record) (batchproducer.BatchResult, error) {
+	if len(records) > batchproducer.MaxKinesisBatchSize {
+		return batchproducer.BatchResult{}, batchproducer.ErrTooManyRecords
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := batchproducer.BatchResult{Records: make([]batchproducer.RecordResult, len(records))}
+	for i, r := range records {
+		p.records = append(p.records, Record{Data: r.Data, PartitionKey: r.PartitionKey, ExplicitHashKey: r.ExplicitHashKey})
+		result.Records[i].Attempts = 1
+	}
+	result.Written = len(records)
+	return result, nil
+}
+
+// Pause only affects State, and sends a PausedEvent if the FakeProducer wasn’t paused already;
+// records are still considered sent as soon as they are added.
+func (p *FakeProducer) Pause() {
+	p.mu.Lock()
+	wasPaused := p.paused
+	p.paused = true
+	p.mu.Unlock()
+	if !wasPaused {
+		p.SendEvent(&batchproducer.PausedEvent{})
+	}
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Resume() {
+	p.mu.Lock()
+	wasPaused := p.paused
+	p.paused = false
+	p.mu.Unlock()
+	if wasPaused {
+		p.SendEvent(&batchproducer.ResumedEvent{})
+	}
+}
+
+// from/for interface Producer
+func (p *FakeProducer) StopAndDrain() ([]batchproducer.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop()
+	// Records are considered sent as soon as they are added, so there are none to hand back
+	p.unflushed = 0
+	return nil, nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Events() <-chan batchproducer.Event {
+	return p.events
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Subscribe(ctx context.Context, types ...batchproducer.EventType) <-chan batchproducer.Event {
+	s := &subscription{c: make(chan batchproducer.Event, 100), types: types, done: ctx.Done()}
+	p.subscriptionsMu.Lock()
+	p.subscriptions = append(p.subscriptions, s)
+	p.subscriptionsMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		p.subscriptionsMu.Lock()
+		for i, other := range p.subscriptions {
+			if other == s {
+				p.subscriptions = append(p.subscriptions[:i], p.subscriptions[i+1:]...)
+				break
+			}
+		}
+		close(s.c)
+		p.subscriptionsMu.Unlock()
+	}()
+
+	return s.c
+}
+
+// from/for interface Producer
+func (p *FakeProducer) InFlight() int {
+	// Records are considered sent as soon as they are added
+	return 0
+}
+
+// from/for interface Producer
+func (p *FakeProducer) State() batchproducer.ProducerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case !p.running:
+		return batchproducer.StateStopped
+	case p.paused:
+		return batchproducer.StatePaused
+	default:
+		return batchproducer.StateRunning
+	}
+}
+
+// from/for interface Producer
+func (p *FakeProducer) ShouldThrottle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.shouldThrottle
+}
+
+// from/for interface Producer
+func (p *FakeProducer) SetStreamName(name string) error {
+	if name == "" {
+		return errors.New("stream name must not be empty")
+	}
+	p.mu.Lock()
+	p.streamName = name
+	p.mu.Unlock()
+	return nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) StreamName() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.streamName
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Reconfigure(batchSize int, flushInterval time.Duration) error {
+	p.mu.Lock()
+	p.config.BatchSize = batchSize
+	p.config.FlushInterval = flushInterval
+	p.mu.Unlock()
+	return nil
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+// from/for interface Producer
+func (p *FakeProducer) Config() batchproducer.Config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
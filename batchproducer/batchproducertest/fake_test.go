@@ -0,0 +1,103 @@
+package batchproducertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/JoshKCarroll/go-kinesis/batchproducer"
+)
+
+func TestFakeProducer(t *testing.T) {
+	t.Parallel()
+
+	p := NewFakeProducer("foo", batchproducer.Config{})
+	if err := p.Add([]byte("early"), "key"); err != ErrNotRunning {
+		t.Errorf("%v != %v", err, ErrNotRunning)
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	p.Add([]byte("one"), "key")
+	p.AddExplicit([]byte("two"), "key", "42")
+	cbErr := errors.New("not called")
+	p.AddWithCallback([]byte("three"), "key", func(result batchproducer.RecordResult) { cbErr = result.Err })
+
+	records := p.AddedRecords()
+	if len(records) != 3 {
+		t.Fatalf("%v != 3", len(records))
+	}
+	if string(records[0].Data) != "one" {
+		t.Errorf("%q != one", records[0].Data)
+	}
+	if records[1].ExplicitHashKey != "42" {
+		t.Errorf("%v != 42", records[1].ExplicitHashKey)
+	}
+	if cbErr != nil {
+		t.Errorf("%v != nil", cbErr)
+	}
+
+	if p.Flushed() || p.Stopped() {
+		t.Error("the FakeProducer was flushed or stopped too soon")
+	}
+	sent, remaining, err := p.Flush(0, false)
+	if sent != 3 || remaining != 0 || err != nil {
+		t.Errorf("%v, %v, %v != 3, 0, nil", sent, remaining, err)
+	}
+	if !p.Started() || !p.Flushed() || !p.Stopped() {
+		t.Errorf("%v, %v, %v != true, true, true", p.Started(), p.Flushed(), p.Stopped())
+	}
+	if p.State() != batchproducer.StateStopped {
+		t.Errorf("%v != %v", p.State(), batchproducer.StateStopped)
+	}
+}
+
+func TestFakeProducerAddErrors(t *testing.T) {
+	t.Parallel()
+
+	p := NewFakeProducer("foo", batchproducer.Config{})
+	p.Start()
+
+	oops := errors.New("oops")
+	p.SetAddErrors(nil, oops)
+	if err := p.Add([]byte("one"), "key"); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if err := p.Add([]byte("two"), "key"); err != oops {
+		t.Errorf("%v != %v", err, oops)
+	}
+	if !p.TryAdd([]byte("three"), "key") {
+		t.Error("TryAdd failed after the scripted errors were used up")
+	}
+
+	records := p.AddedRecords()
+	if len(records) != 2 {
+		t.Fatalf("%v != 2", len(records))
+	}
+	if string(records[1].Data) != "three" {
+		t.Errorf("%q != three", records[1].Data)
+	}
+}
+
+func TestFakeProducerSubscribe(t *testing.T) {
+	t.Parallel()
+
+	p := NewFakeProducer("foo", batchproducer.Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	panics := p.Subscribe(ctx, batchproducer.EventTypePanic)
+
+	p.SendEvent(&batchproducer.CircuitOpenEvent{})
+	p.SendEvent(&batchproducer.PanicEvent{Value: "oops"})
+
+	if len(panics) != 1 {
+		t.Fatalf("%v != 1", len(panics))
+	}
+	if e, ok := (<-panics).(*batchproducer.PanicEvent); !ok || e.Value != "oops" {
+		t.Errorf("%v is not the PanicEvent", e)
+	}
+	if len(p.Events()) != 2 {
+		t.Errorf("%v != 2", len(p.Events()))
+	}
+}
@@ -0,0 +1,176 @@
+package batchproducer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// recordQueue is the Producer’s buffer: a double-ended queue of records, kept in a ring, that
+// records are added to at the back and sent from the front. Records taken from it can be put back
+// at the front, in their original order, so that records that fail, or that are held back from a
+// batch, are sent before anything added after them. It holds at most maxRecords records and, if
+// maxBytes isn’t 0, maxBytes bytes, and push waits for room. Putting records back never waits,
+// though, since they were in the queue before, so it can be over its limits for a while; then
+// nothing more can be pushed until enough records have been popped. It is safe to use from any
+// goroutine.
+type recordQueue struct {
+	// n is the number of records in the queue and nBytes is their total size. They are only
+	// modified while mu is held, but can be read atomically at any time. They come first so that
+	// they are 64-bit aligned on 32-bit platforms.
+	n      int64
+	nBytes int64
+
+	maxRecords int
+	maxBytes   int64
+
+	// ring holds the records, starting at head and wrapping around. It grows if records are put
+	// back while it is full.
+	ring []batchRecord
+	head int
+	// room, if not nil, is closed, and set to nil, when records are popped, to wake anything
+	// waiting in push.
+	room chan struct{}
+	mu   sync.Mutex
+}
+
+// newRecordQueue returns an empty recordQueue with the given limits. Its ring is allocated up
+// front, like the channel it replaced.
+func newRecordQueue(maxRecords, maxBytes int) *recordQueue {
+	return &recordQueue{
+		maxRecords: maxRecords,
+		maxBytes:   int64(maxBytes),
+		ring:       make([]batchRecord, maxRecords),
+	}
+}
+
+// len returns the number of records in the queue.
+func (q *recordQueue) len() int {
+	return int(atomic.LoadInt64(&q.n))
+}
+
+// bytes returns the total size of the records in the queue.
+func (q *recordQueue) bytes() int {
+	return int(atomic.LoadInt64(&q.nBytes))
+}
+
+// capacity returns the most records that can be pushed onto the queue.
+func (q *recordQueue) capacity() int {
+	return q.maxRecords
+}
+
+// push adds record at the back of the queue, waiting until there’s room for it. It gives up and
+// returns ctx.Err() if ctx is done first.
+func (q *recordQueue) push(ctx context.Context, record batchRecord) error {
+	for {
+		q.mu.Lock()
+		if q.fits(record) {
+			q.pushBack(record)
+			q.mu.Unlock()
+			return nil
+		}
+		if q.room == nil {
+			q.room = make(chan struct{})
+		}
+		room := q.room
+		q.mu.Unlock()
+
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryPush is like push except that it returns false rather than waiting if there isn’t room for
+// record.
+func (q *recordQueue) tryPush(record batchRecord) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.fits(record) {
+		return false
+	}
+	q.pushBack(record)
+	return true
+}
+
+// forcePush adds record at the back of the queue even if there isn’t room for it.
+func (q *recordQueue) forcePush(record batchRecord) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pushBack(record)
+}
+
+// pushFront puts records back at the front of the queue, in order, whether or not there’s room
+// for them.
+func (q *recordQueue) pushFront(records []batchRecord) {
+	if len(records) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.grow(len(records))
+	var size int64
+	for i := len(records) - 1; i >= 0; i-- {
+		q.head = (q.head - 1 + len(q.ring)) % len(q.ring)
+		q.ring[q.head] = records[i]
+		size += int64(records[i].size())
+	}
+	atomic.AddInt64(&q.n, int64(len(records)))
+	atomic.AddInt64(&q.nBytes, size)
+}
+
+// pop takes the record at the front of the queue. It returns false if the queue is empty.
+func (q *recordQueue) pop() (batchRecord, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return batchRecord{}, false
+	}
+	record := q.ring[q.head]
+	// So that the garbage collector can have the record’s data once it has been sent
+	q.ring[q.head] = batchRecord{}
+	q.head = (q.head + 1) % len(q.ring)
+	atomic.AddInt64(&q.n, -1)
+	atomic.AddInt64(&q.nBytes, -int64(record.size()))
+	if q.room != nil {
+		close(q.room)
+		q.room = nil
+	}
+	return record, true
+}
+
+// fits reports whether there’s room for record. q.mu must be held.
+func (q *recordQueue) fits(record batchRecord) bool {
+	if int(q.n) >= q.maxRecords {
+		return false
+	}
+	return q.maxBytes == 0 || q.nBytes+int64(record.size()) <= q.maxBytes
+}
+
+// pushBack adds record at the back of the ring, growing it if need be. q.mu must be held.
+func (q *recordQueue) pushBack(record batchRecord) {
+	q.grow(1)
+	q.ring[(q.head+int(q.n))%len(q.ring)] = record
+	atomic.AddInt64(&q.n, 1)
+	atomic.AddInt64(&q.nBytes, int64(record.size()))
+}
+
+// grow makes sure that the ring has room for extra more records. q.mu must be held.
+func (q *recordQueue) grow(extra int) {
+	n := int(q.n)
+	if n+extra <= len(q.ring) {
+		return
+	}
+	size := 2 * len(q.ring)
+	if size < n+extra {
+		size = n + extra
+	}
+	ring := make([]batchRecord, size)
+	for i := 0; i < n; i++ {
+		ring[i] = q.ring[(q.head+i)%len(q.ring)]
+	}
+	q.ring = ring
+	q.head = 0
+}
@@ -0,0 +1,100 @@
+package batchproducer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func popAll(q *recordQueue) string {
+	var keys []string
+	for {
+		record, ok := q.pop()
+		if !ok {
+			return fmt.Sprint(keys)
+		}
+		keys = append(keys, record.partitionKey)
+	}
+}
+
+func TestRecordQueue(t *testing.T) {
+	t.Parallel()
+	q := newRecordQueue(5, 0)
+	for i := 0; i < 5; i++ {
+		if !q.tryPush(batchRecord{data: []byte("foo"), partitionKey: strconv.Itoa(i)}) {
+			t.Fatalf("tryPush failed with %v records", q.len())
+		}
+	}
+	if q.tryPush(batchRecord{data: []byte("foo"), partitionKey: "5"}) {
+		t.Error("tryPush succeeded with the queue full")
+	}
+	if q.len() != 5 || q.bytes() != 20 {
+		t.Errorf("%v, %v != 5, 20", q.len(), q.bytes())
+	}
+
+	// Records taken from the queue are put back in front of the rest, in order
+	first, _ := q.pop()
+	second, _ := q.pop()
+	q.tryPush(batchRecord{data: []byte("foo"), partitionKey: "5"})
+	q.pushFront([]batchRecord{first, second})
+	if q.len() != 6 {
+		t.Errorf("%v != 6", q.len())
+	}
+	if keys := popAll(q); keys != "[0 1 2 3 4 5]" {
+		t.Errorf("%v != [0 1 2 3 4 5]", keys)
+	}
+	if q.len() != 0 || q.bytes() != 0 {
+		t.Errorf("%v, %v != 0, 0", q.len(), q.bytes())
+	}
+}
+
+func TestRecordQueueGrowsWhenRecordsArePutBack(t *testing.T) {
+	t.Parallel()
+	q := newRecordQueue(3, 0)
+	// Wrap around the end of the ring
+	q.tryPush(batchRecord{partitionKey: "x"})
+	q.pop()
+	for _, key := range []string{"c", "d", "e"} {
+		q.tryPush(batchRecord{partitionKey: key})
+	}
+	q.pushFront([]batchRecord{{partitionKey: "a"}, {partitionKey: "b"}})
+	q.forcePush(batchRecord{partitionKey: "f"})
+	if keys := popAll(q); keys != "[a b c d e f]" {
+		t.Errorf("%v != [a b c d e f]", keys)
+	}
+}
+
+func TestRecordQueuePushWaitsForRoom(t *testing.T) {
+	t.Parallel()
+	q := newRecordQueue(100, 10)
+	if !q.tryPush(batchRecord{data: []byte("123456789"), partitionKey: "a"}) {
+		t.Fatal("tryPush failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.push(ctx, batchRecord{data: []byte("1"), partitionKey: "b"}); err != context.DeadlineExceeded {
+		t.Errorf("%v != %v", err, context.DeadlineExceeded)
+	}
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.push(context.Background(), batchRecord{data: []byte("1"), partitionKey: "b"})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push didn’t wait for room")
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.pop()
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Errorf("%v != nil", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("push is still waiting")
+	}
+}
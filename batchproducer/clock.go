@@ -0,0 +1,45 @@
+package batchproducer
+
+import "time"
+
+// clock is the source of time for a Producer. It exists so that tests can control time rather than
+// having to sleep for real.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker is the subset of *time.Ticker used by a Producer.
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock used by default; it simply delegates to the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
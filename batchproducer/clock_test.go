@@ -0,0 +1,232 @@
+package batchproducer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to. Sleep doesn’t block; it just advances the
+// clock and records the duration, so that tests can assert on delays without waiting for them.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	sleeps  []time.Duration
+	tickers []*fakeTicker
+	waiters []fakeWaiter
+}
+
+type fakeTicker struct {
+	clock  *fakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+	done   bool
+}
+
+type fakeWaiter struct {
+	c    chan time.Time
+	when time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.sleeps = append(c.sleeps, d)
+	c.mu.Unlock()
+	c.Advance(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{c: ch, when: c.now.Add(d)})
+	}
+	return ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any tickers and waiters that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	for _, t := range c.tickers {
+		for !t.done && !t.next.After(c.now) {
+			// Like a real ticker, drop ticks if the receiver isn’t keeping up
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+
+	var waiters []fakeWaiter
+	for _, w := range c.waiters {
+		if w.when.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.done = true
+}
+
+func TestBackoffDelays(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 5)
+	b.clock = clock
+	b.config.MaxAttemptsPerRecord = 10
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(5, 0)
+	b.running = false
+
+	for i := 0; i < 4; i++ {
+		// Records are returned to the buffer after a failure
+		if b.records.len() != 5 {
+			t.Fatalf("%v != 5", b.records.len())
+		}
+		b.sendBatch(5)
+	}
+
+	expected := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+	sleeps := clock.Sleeps()
+	if len(sleeps) != len(expected) {
+		t.Fatalf("%v != %v", sleeps, expected)
+	}
+	for i := range expected {
+		if sleeps[i] != expected[i] {
+			t.Errorf("%v != %v", sleeps[i], expected[i])
+		}
+	}
+
+	// A success should reset the delay
+	b.client = &mockBatchingClient{}
+	b.sendBatch(5)
+	b.running = true
+	b.addRecordsAndWait(5, 0)
+	b.running = false
+	b.sendBatch(5)
+	if len(clock.Sleeps()) != 4 {
+		t.Errorf("%v != 4", len(clock.Sleeps()))
+	}
+}
+
+func TestFlushIntervalWithFakeClock(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 100*time.Millisecond, 10)
+	b.clock = clock
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(5, 0)
+	time.Sleep(5 * time.Millisecond)
+	if c.callCount() != 0 {
+		t.Errorf("%v != 0", c.callCount())
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if !waitUntil(func() bool { return c.callCount() == 1 }) {
+		t.Errorf("%v != 1", c.callCount())
+	}
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 100*time.Millisecond, 10)
+	b.clock = clock
+	b.Start()
+	defer b.Stop()
+
+	if err := b.Reconfigure(20, 500*time.Millisecond); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	config := b.Config()
+	if config.BatchSize != 20 || config.FlushInterval != 500*time.Millisecond {
+		t.Errorf("%v, %v != 20, 500ms", config.BatchSize, config.FlushInterval)
+	}
+
+	// 10 records no longer make a full batch
+	b.addRecordsAndWait(10, 0)
+	time.Sleep(5 * time.Millisecond)
+	clock.Advance(100 * time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if c.callCount() != 0 {
+		t.Errorf("%v != 0", c.callCount())
+	}
+
+	clock.Advance(400 * time.Millisecond)
+	if !waitUntil(func() bool { return c.callCount() == 1 }) {
+		t.Errorf("%v != 1", c.callCount())
+	}
+}
+
+func TestReconfigureWithInvalidValues(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 100*time.Millisecond, 10)
+	b.Start()
+	defer b.Stop()
+
+	if err := b.Reconfigure(501, time.Second); err != ErrInvalidBatchSize {
+		t.Errorf("%v != %v", err, ErrInvalidBatchSize)
+	}
+	if err := b.Reconfigure(10, time.Millisecond); err != ErrFlushIntervalTooSmall {
+		t.Errorf("%v != %v", err, ErrFlushIntervalTooSmall)
+	}
+	config := b.Config()
+	if config.BatchSize != 10 || config.FlushInterval != 100*time.Millisecond {
+		t.Errorf("%v, %v != 10, 100ms", config.BatchSize, config.FlushInterval)
+	}
+}
@@ -0,0 +1,64 @@
+package batchproducer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Kinesis records have no headers, so AddWithAttributes wraps the data of a record in an envelope
+// that carries attributes alongside it, for consumers that route records on metadata that
+// shouldn’t be part of the payload. DecodeRecord unwraps it again. The envelope is:
+//
+//	1 byte     the envelope version, currently 1
+//	4 bytes    n, the length of the attributes, as a big-endian unsigned integer
+//	n bytes    the attributes, as a JSON object whose values are all strings
+//	remainder  the data
+//
+// Consumers must know which records are enveloped; nothing in the format marks a record as such
+// beyond the version byte.
+
+const envelopeVersion = 1
+
+// envelopeHeaderSize is the size of the version byte and the length of the attributes.
+const envelopeHeaderSize = 1 + 4
+
+// EncodeRecord wraps data and attrs in the envelope that AddWithAttributes uses; see DecodeRecord.
+// It is useful for sending enveloped records some other way, and for tests.
+func EncodeRecord(data []byte, attrs map[string]string) ([]byte, error) {
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	header, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(header)+len(data))
+	raw[0] = envelopeVersion
+	binary.BigEndian.PutUint32(raw[1:envelopeHeaderSize], uint32(len(header)))
+	raw = append(raw, header...)
+	return append(raw, data...), nil
+}
+
+// DecodeRecord unwraps the data of a record added with AddWithAttributes, returning the original
+// data and attributes. It returns an error if raw isn’t a valid envelope. data shares its memory
+// with raw.
+func DecodeRecord(raw []byte) (data []byte, attrs map[string]string, err error) {
+	if len(raw) < envelopeHeaderSize {
+		return nil, nil, errors.New("Record is too short to be enveloped")
+	}
+	if raw[0] != envelopeVersion {
+		return nil, nil, fmt.Errorf("Unknown envelope version %v", raw[0])
+	}
+	n := binary.BigEndian.Uint32(raw[1:envelopeHeaderSize])
+	if uint64(n) > uint64(len(raw)-envelopeHeaderSize) {
+		return nil, nil, fmt.Errorf("Attributes length %v is longer than the record", n)
+	}
+	header := raw[envelopeHeaderSize : envelopeHeaderSize+int(n)]
+	if err := json.Unmarshal(header, &attrs); err != nil {
+		return nil, nil, fmt.Errorf("Invalid attributes: %v", err)
+	}
+	return raw[envelopeHeaderSize+int(n):], attrs, nil
+}
@@ -0,0 +1,109 @@
+package batchproducer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeAndDecodeRecord(t *testing.T) {
+	t.Parallel()
+
+	attrs := map[string]string{"tenant": "acme", "type": "click"}
+	raw, err := EncodeRecord([]byte("payload"), attrs)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	expectedHeader := []byte{1, 0, 0, 0, 32}
+	if !bytes.HasPrefix(raw, expectedHeader) {
+		t.Errorf("%v does not start with %v", raw, expectedHeader)
+	}
+
+	data, decoded, err := DecodeRecord(raw)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if string(data) != "payload" {
+		t.Errorf("%q != payload", data)
+	}
+	if len(decoded) != 2 || decoded["tenant"] != "acme" || decoded["type"] != "click" {
+		t.Errorf("%v != %v", decoded, attrs)
+	}
+}
+
+func TestEncodeRecordWithoutAttributes(t *testing.T) {
+	t.Parallel()
+
+	raw, _ := EncodeRecord([]byte("payload"), nil)
+	data, attrs, err := DecodeRecord(raw)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if string(data) != "payload" {
+		t.Errorf("%q != payload", data)
+	}
+	if len(attrs) != 0 {
+		t.Errorf("%v != 0", len(attrs))
+	}
+}
+
+func TestDecodeRecordErrors(t *testing.T) {
+	t.Parallel()
+
+	invalid := map[string][]byte{
+		"too short":       {1, 0, 0},
+		"unknown version": {2, 0, 0, 0, 2, '{', '}'},
+		"too long":        {1, 0, 0, 0, 3, '{', '}'},
+		"not json":        {1, 0, 0, 0, 2, 'n', 'o'},
+	}
+	for name, raw := range invalid {
+		if _, _, err := DecodeRecord(raw); err == nil {
+			t.Errorf("%v: err == nil", name)
+		}
+	}
+}
+
+func TestAddWithAttributes(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	err := b.AddWithAttributes([]byte("foo"), "bar", map[string]string{"route": "a"})
+	b.running = false
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	records := b.takeRecordsFromBuffer(1)
+	data, attrs, err := DecodeRecord(records[0].data)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if string(data) != "foo" {
+		t.Errorf("%q != foo", data)
+	}
+	if attrs["route"] != "a" {
+		t.Errorf("%v != a", attrs["route"])
+	}
+}
+
+func TestAddWithAttributesTooLarge(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add would succeed
+	b.running = true
+	data := []byte(strings.Repeat("x", MaxRecordSize-20))
+	err := b.AddWithAttributes(data, "bar", map[string]string{"route": "a"})
+	b.running = false
+	if err != ErrRecordTooLarge {
+		t.Errorf("%v != %v", err, ErrRecordTooLarge)
+	}
+	if b.bufferLen() != 0 {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+}
@@ -1,5 +1,12 @@
 package batchproducer
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
 type Event interface {
 	String() string
 }
@@ -7,6 +14,17 @@ type Event interface {
 var (
 	_ Event = (*Error)(nil)
 	_ error = (*Error)(nil)
+	_ Event = (*RecordsWrittenEvent)(nil)
+	_ Event = (*CircuitOpenEvent)(nil)
+	_ Event = (*PermanentFailureEvent)(nil)
+	_ Event = (*PanicEvent)(nil)
+	_ Event = (*HealthEvent)(nil)
+	_ Event = (*ClosedEvent)(nil)
+	_ Event = (*FlushCompleteEvent)(nil)
+	_ Event = (*PausedEvent)(nil)
+	_ Event = (*ResumedEvent)(nil)
+	_ Event = (*IdleWarningEvent)(nil)
+	_ Event = (*HotKeyEvent)(nil)
 )
 
 type Error struct {
@@ -26,3 +44,265 @@ func (e *Error) String() string {
 func (e *Error) Error() string {
 	return e.String()
 }
+
+// RecordsWrittenEvent is sent for each batch in which at least one record was written
+// successfully, but only if Config.EmitSuccessDetails is true.
+type RecordsWrittenEvent struct {
+	Records []WrittenRecord
+}
+
+// WrittenRecord describes where a record that was written successfully landed.
+type WrittenRecord struct {
+	PartitionKey   string
+	SequenceNumber string
+	ShardID        string
+}
+
+func (e *RecordsWrittenEvent) String() string {
+	return fmt.Sprintf("%v records written", len(e.Records))
+}
+
+// CircuitOpenEvent is sent when the circuit breaker opens. See Config.CircuitBreakerThreshold.
+type CircuitOpenEvent struct {
+	ConsecutiveErrors int
+	Cooldown          time.Duration
+}
+
+func (e *CircuitOpenEvent) String() string {
+	return fmt.Sprintf("circuit breaker opened for %v after %v consecutive errors", e.Cooldown, e.ConsecutiveErrors)
+}
+
+// PermanentFailureEvent is sent when a record is dropped without being retried because it failed
+// with an error code that Config.ErrorClassifier classes as ErrorPermanent, by default one of those
+// in Config.NonRetryableErrorCodes.
+type PermanentFailureEvent struct {
+	PartitionKey string
+	ErrorCode    string
+	ErrorMessage string
+}
+
+func (e *PermanentFailureEvent) String() string {
+	return fmt.Sprintf("record with partition key %v failed permanently: %v (%v)", e.PartitionKey, e.ErrorMessage, e.ErrorCode)
+}
+
+// PanicEvent is sent when the Producer’s main goroutine recovers from a panic. See
+// Config.RestartOnPanic.
+type PanicEvent struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicEvent) String() string {
+	return fmt.Sprintf("recovered from panic in main goroutine: %v", e.Value)
+}
+
+// HealthEvent is sent when a health check finds that the stream has become healthy or unhealthy.
+// See Config.HealthCheckInterval.
+type HealthEvent struct {
+	Healthy bool
+
+	// Err is why the check failed, if Healthy is false.
+	Err error
+}
+
+func (e *HealthEvent) String() string {
+	if e.Healthy {
+		return "stream is healthy"
+	}
+	return fmt.Sprintf("stream is unhealthy: %v", e.Err)
+}
+
+// ClosedEvent was sent when the Producer found that its buffer, which was a channel, had been
+// closed because of a bug.
+//
+// Deprecated: the buffer is no longer a channel and can’t be closed, so ClosedEvent is never
+// sent. It will be removed in a future release.
+type ClosedEvent struct{}
+
+func (e *ClosedEvent) String() string {
+	return "the Producer’s buffer has been closed"
+}
+
+// FlushCompleteEvent is sent by Flush just before it returns, with the same results, for the
+// benefit of code that handles everything from Events in one loop. Unlike other Events it is
+// discarded, rather than blocking Flush, if there’s no room for it.
+type FlushCompleteEvent struct {
+	Sent      int
+	Remaining int
+	TimedOut  bool
+}
+
+func (e *FlushCompleteEvent) String() string {
+	if e.TimedOut {
+		return fmt.Sprintf("flush timed out after sending %v records, with %v remaining", e.Sent, e.Remaining)
+	}
+	return fmt.Sprintf("flush complete after sending %v records, with %v remaining", e.Sent, e.Remaining)
+}
+
+// PausedEvent is sent when the Producer is paused; see Producer.Pause.
+type PausedEvent struct{}
+
+func (e *PausedEvent) String() string {
+	return "paused"
+}
+
+// ResumedEvent is sent when the Producer is resumed; see Producer.Resume.
+type ResumedEvent struct{}
+
+func (e *ResumedEvent) String() string {
+	return "resumed"
+}
+
+// IdleWarningEvent is sent when the buffer has been empty at EmptyFlushes flushes in a row, without
+// anything being sent in between, as a hint that FlushInterval could be longer. It is only sent
+// once until records are sent again.
+type IdleWarningEvent struct {
+	EmptyFlushes  int
+	FlushInterval time.Duration
+}
+
+func (e *IdleWarningEvent) String() string {
+	return fmt.Sprintf("the buffer was empty at %v flushes in a row; FlushInterval %v could be longer", e.EmptyFlushes, e.FlushInterval)
+}
+
+// HotKeyEvent is sent when more than Config.MaxRecordsPerKeyPerInterval records with the same
+// partition key have been sent within a StatInterval. Count is the number sent so far, which is
+// one more than the limit; more may follow in the same StatInterval without another HotKeyEvent.
+type HotKeyEvent struct {
+	PartitionKey string
+	Count        int
+}
+
+func (e *HotKeyEvent) String() string {
+	return fmt.Sprintf("hot partition key %q: %v records in one StatInterval", e.PartitionKey, e.Count)
+}
+
+// EventType identifies a kind of Event, for Subscribe.
+type EventType int
+
+const (
+	EventTypeError EventType = iota
+	EventTypeRecordsWritten
+	EventTypeCircuitOpen
+	EventTypePermanentFailure
+	EventTypePanic
+	EventTypeHealth
+	EventTypeClosed
+	EventTypeFlushComplete
+	EventTypePaused
+	EventTypeResumed
+	EventTypeIdleWarning
+	EventTypeHotKey
+)
+
+// TypeOf returns the EventType of event. It returns -1 if event isn’t one of the Events sent by a
+// Producer.
+func TypeOf(event Event) EventType {
+	switch event.(type) {
+	case *Error:
+		return EventTypeError
+	case *RecordsWrittenEvent:
+		return EventTypeRecordsWritten
+	case *CircuitOpenEvent:
+		return EventTypeCircuitOpen
+	case *PermanentFailureEvent:
+		return EventTypePermanentFailure
+	case *PanicEvent:
+		return EventTypePanic
+	case *HealthEvent:
+		return EventTypeHealth
+	case *ClosedEvent:
+		return EventTypeClosed
+	case *FlushCompleteEvent:
+		return EventTypeFlushComplete
+	case *PausedEvent:
+		return EventTypePaused
+	case *ResumedEvent:
+		return EventTypeResumed
+	case *IdleWarningEvent:
+		return EventTypeIdleWarning
+	case *HotKeyEvent:
+		return EventTypeHotKey
+	default:
+		return -1
+	}
+}
+
+// subscription is a channel returned by Subscribe and the types of Event it receives.
+type subscription struct {
+	c     chan Event
+	types map[EventType]bool
+	done  <-chan struct{}
+}
+
+// dispatcher sends Events to subscriptions.
+type dispatcher struct {
+	subscriptions []*subscription
+	// subscribed is true once Subscribe has been called.
+	subscribed bool
+	// mu is held for reading while sending to subscriptions, so that a subscription’s channel
+	// isn’t closed while an Event is being sent on it.
+	mu sync.RWMutex
+}
+
+// subscribe returns a channel that receives the Events of the given types until ctx is done,
+// when it is closed. size is the size of its buffer.
+func (d *dispatcher) subscribe(ctx context.Context, size int, types []EventType) <-chan Event {
+	s := &subscription{
+		c:     make(chan Event, size),
+		types: make(map[EventType]bool, len(types)),
+		done:  ctx.Done(),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	d.mu.Lock()
+	d.subscriptions = append(d.subscriptions, s)
+	d.subscribed = true
+	d.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		for i, other := range d.subscriptions {
+			if other == s {
+				d.subscriptions = append(d.subscriptions[:i], d.subscriptions[i+1:]...)
+				break
+			}
+		}
+		close(s.c)
+		d.mu.Unlock()
+	}()
+
+	return s.c
+}
+
+// dispatch sends event to the subscriptions that want it, blocking until each has room for it or
+// is cancelled, unless wait is false, in which case it is discarded by those that have no room. It
+// returns true if Subscribe has ever been called.
+func (d *dispatcher) dispatch(event Event, wait bool) (subscribed bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	t := TypeOf(event)
+	for _, s := range d.subscriptions {
+		if s.types[t] {
+			if !wait {
+				select {
+				case s.c <- event:
+				default:
+				}
+				continue
+			}
+			select {
+			case s.c <- event:
+			case <-s.done:
+			}
+		}
+	}
+	return d.subscribed
+}
@@ -0,0 +1,140 @@
+// Package firehoseproducer lets a batchproducer.Producer send records to a Kinesis Data Firehose
+// delivery stream instead of a Kinesis stream, reusing its buffering, batching and retries.
+// Firehose’s PutRecordBatch is much like PutRecords, but records have no partition key and the
+// limits are different: at most 500 records and 4 MiB per request and 1000 KiB per record.
+package firehoseproducer
+
+import (
+	"github.com/JoshKCarroll/go-kinesis/batchproducer"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// MaxBatchSize is the most records Firehose accepts in one PutRecordBatch request.
+	MaxBatchSize = 500
+
+	// MaxBatchBytes is the most data Firehose accepts in one PutRecordBatch request.
+	MaxBatchBytes = 4 * 1024 * 1024
+
+	// MaxRecordBytes is the most data Firehose accepts in one record.
+	MaxRecordBytes = 1000 * 1024
+)
+
+// ErrCodeRecordTooLarge is the error code given to records larger than MaxRecordBytes, which are
+// failed without being sent. New makes it non-retryable.
+const ErrCodeRecordTooLarge = "RecordTooLarge"
+
+// FirehoseClient is the subset of *firehose.Firehose used by this package, to ease mocking.
+type FirehoseClient interface {
+	PutRecordBatch(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
+// New returns a Producer that sends records to the Firehose delivery stream deliveryStreamName
+// using client. The partition keys of the records are ignored, but since Add requires one any
+// non-empty string will do. config is used as for batchproducer.New except that
+// ErrCodeRecordTooLarge is added to its NonRetryableErrorCodes.
+func New(client FirehoseClient, deliveryStreamName string, config batchproducer.Config) (batchproducer.Producer, error) {
+	codes := config.NonRetryableErrorCodes
+	if codes == nil {
+		codes = batchproducer.DefaultNonRetryableErrorCodes
+	}
+	config.NonRetryableErrorCodes = append(append([]string(nil), codes...), ErrCodeRecordTooLarge)
+	return batchproducer.New(NewClient(client), deliveryStreamName, config)
+}
+
+// NewClient adapts client to batchproducer.BatchingKinesisClient, treating the stream name of each
+// PutRecords request as the name of a delivery stream. A request that is larger than MaxBatchBytes
+// is split into several PutRecordBatch requests, and records larger than MaxRecordBytes are failed
+// with ErrCodeRecordTooLarge. Records that Firehose fails with ServiceUnavailableException, its
+// equivalent of throttling, are reported with the Kinesis code
+// ProvisionedThroughputExceededException so that the Producer treats them as throttled.
+func NewClient(client FirehoseClient) batchproducer.BatchingKinesisClient {
+	return &firehoseClient{client: client}
+}
+
+type firehoseClient struct {
+	client FirehoseClient
+}
+
+func (c *firehoseClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	results := make([]*kinesis.PutRecordsResultEntry, len(input.Records))
+	var failed int64
+
+	// indexes are the indexes in input.Records of the records in the current request
+	var indexes []int
+	var records []*firehose.Record
+	var size int
+	sent := false
+	send := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		output, err := c.client.PutRecordBatch(&firehose.PutRecordBatchInput{
+			DeliveryStreamName: input.StreamName,
+			Records:            records,
+		})
+		if err != nil {
+			if !sent {
+				return err
+			}
+			// Some records have already been written, so returning the error would cause them to
+			// be retried too; fail just the records of this request instead.
+			code := "InternalFailure"
+			if awsErr, ok := err.(awserr.Error); ok {
+				code = awsErr.Code()
+			}
+			for _, i := range indexes {
+				failed++
+				results[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String(code), ErrorMessage: aws.String(err.Error())}
+			}
+			indexes, records, size = nil, nil, 0
+			return nil
+		}
+		sent = true
+		for i, response := range output.RequestResponses {
+			result := &kinesis.PutRecordsResultEntry{SequenceNumber: response.RecordId}
+			if response.ErrorCode != nil {
+				failed++
+				result.ErrorCode = response.ErrorCode
+				result.ErrorMessage = response.ErrorMessage
+				if *response.ErrorCode == firehose.ErrCodeServiceUnavailableException {
+					result.ErrorCode = aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)
+				}
+			}
+			results[indexes[i]] = result
+		}
+		indexes, records, size = nil, nil, 0
+		return nil
+	}
+
+	for i, record := range input.Records {
+		if len(record.Data) > MaxRecordBytes {
+			failed++
+			results[i] = &kinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String(ErrCodeRecordTooLarge),
+				ErrorMessage: aws.String("Record is larger than the Firehose limit of 1000 KiB"),
+			}
+			continue
+		}
+		if size+len(record.Data) > MaxBatchBytes || len(records) == MaxBatchSize {
+			if err := send(); err != nil {
+				return nil, err
+			}
+		}
+		indexes = append(indexes, i)
+		records = append(records, &firehose.Record{Data: record.Data})
+		size += len(record.Data)
+	}
+	if err := send(); err != nil {
+		return nil, err
+	}
+
+	output := &kinesis.PutRecordsOutput{Records: results}
+	if failed > 0 {
+		output.FailedRecordCount = aws.Int64(failed)
+	}
+	return output, nil
+}
@@ -0,0 +1,163 @@
+package firehoseproducer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/JoshKCarroll/go-kinesis/batchproducer"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// mockFirehoseClient fails records whose data is "fail" and, if errOnCall is set, the request with
+// that (1-based) number.
+type mockFirehoseClient struct {
+	inputs    []*firehose.PutRecordBatchInput
+	errOnCall int
+}
+
+func (c *mockFirehoseClient) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	c.inputs = append(c.inputs, input)
+	if len(c.inputs) == c.errOnCall {
+		return nil, errors.New("Oh Noes!")
+	}
+
+	output := &firehose.PutRecordBatchOutput{}
+	var failed int64
+	for _, record := range input.Records {
+		if string(record.Data) == "fail" {
+			failed++
+			output.RequestResponses = append(output.RequestResponses, &firehose.PutRecordBatchResponseEntry{
+				ErrorCode:    aws.String(firehose.ErrCodeServiceUnavailableException),
+				ErrorMessage: aws.String("Slow down."),
+			})
+		} else {
+			output.RequestResponses = append(output.RequestResponses, &firehose.PutRecordBatchResponseEntry{
+				RecordId: aws.String("id"),
+			})
+		}
+	}
+	output.FailedPutCount = aws.Int64(failed)
+	return output, nil
+}
+
+func putRecordsInput(data ...[]byte) *kinesis.PutRecordsInput {
+	input := &kinesis.PutRecordsInput{StreamName: aws.String("deliveries")}
+	for _, d := range data {
+		input.Records = append(input.Records, &kinesis.PutRecordsRequestEntry{Data: d, PartitionKey: aws.String("key")})
+	}
+	return input
+}
+
+func TestPutRecords(t *testing.T) {
+	t.Parallel()
+
+	c := &mockFirehoseClient{}
+	output, err := NewClient(c).PutRecords(putRecordsInput([]byte("foo"), []byte("fail"), []byte("bar")))
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	if len(c.inputs) != 1 {
+		t.Fatalf("%v != 1", len(c.inputs))
+	}
+	if aws.StringValue(c.inputs[0].DeliveryStreamName) != "deliveries" {
+		t.Errorf("%v != deliveries", aws.StringValue(c.inputs[0].DeliveryStreamName))
+	}
+	if aws.Int64Value(output.FailedRecordCount) != 1 {
+		t.Errorf("%v != 1", aws.Int64Value(output.FailedRecordCount))
+	}
+	if output.Records[0].ErrorCode != nil {
+		t.Errorf("%v != nil", *output.Records[0].ErrorCode)
+	}
+	if code := aws.StringValue(output.Records[1].ErrorCode); code != kinesis.ErrCodeProvisionedThroughputExceededException {
+		t.Errorf("%v != %v", code, kinesis.ErrCodeProvisionedThroughputExceededException)
+	}
+}
+
+func TestPutRecordsSplitsLargeRequests(t *testing.T) {
+	t.Parallel()
+
+	c := &mockFirehoseClient{}
+	record := make([]byte, MaxRecordBytes)
+	// Four records of 1000 KiB fit in 4 MiB but five don’t
+	output, err := NewClient(c).PutRecords(putRecordsInput(record, record, record, record, record))
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if len(c.inputs) != 2 {
+		t.Fatalf("%v != 2", len(c.inputs))
+	}
+	if len(c.inputs[0].Records) != 4 {
+		t.Errorf("%v != 4", len(c.inputs[0].Records))
+	}
+	if output.FailedRecordCount != nil {
+		t.Errorf("%v != nil", *output.FailedRecordCount)
+	}
+	for i, result := range output.Records {
+		if result == nil {
+			t.Errorf("result %v == nil", i)
+		}
+	}
+}
+
+func TestPutRecordsFailsRecordsThatAreTooLarge(t *testing.T) {
+	t.Parallel()
+
+	c := &mockFirehoseClient{}
+	output, err := NewClient(c).PutRecords(putRecordsInput(make([]byte, MaxRecordBytes+1), []byte("foo")))
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if len(c.inputs[0].Records) != 1 {
+		t.Errorf("%v != 1", len(c.inputs[0].Records))
+	}
+	if code := aws.StringValue(output.Records[0].ErrorCode); code != ErrCodeRecordTooLarge {
+		t.Errorf("%v != %v", code, ErrCodeRecordTooLarge)
+	}
+	if aws.Int64Value(output.FailedRecordCount) != 1 {
+		t.Errorf("%v != 1", aws.Int64Value(output.FailedRecordCount))
+	}
+}
+
+func TestPutRecordsErrors(t *testing.T) {
+	t.Parallel()
+
+	record := make([]byte, MaxRecordBytes)
+
+	// If nothing has been written the error is returned as is
+	c := &mockFirehoseClient{errOnCall: 1}
+	if _, err := NewClient(c).PutRecords(putRecordsInput(record, record, record, record, record)); err == nil {
+		t.Error("err == nil")
+	}
+
+	// Otherwise only the records of the failed request are failed
+	c = &mockFirehoseClient{errOnCall: 2}
+	output, err := NewClient(c).PutRecords(putRecordsInput(record, record, record, record, record))
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if aws.Int64Value(output.FailedRecordCount) != 1 {
+		t.Errorf("%v != 1", aws.Int64Value(output.FailedRecordCount))
+	}
+	if output.Records[4].ErrorCode == nil {
+		t.Error("ErrorCode == nil")
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	p, err := New(&mockFirehoseClient{}, "deliveries", batchproducer.Config{BufferSize: 10, BatchSize: 10})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	codes := p.Config().NonRetryableErrorCodes
+	if len(codes) != len(batchproducer.DefaultNonRetryableErrorCodes)+1 {
+		t.Errorf("%v != %v", len(codes), len(batchproducer.DefaultNonRetryableErrorCodes)+1)
+	}
+	if codes[len(codes)-1] != ErrCodeRecordTooLarge {
+		t.Errorf("%v != %v", codes[len(codes)-1], ErrCodeRecordTooLarge)
+	}
+}
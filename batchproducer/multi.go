@@ -0,0 +1,164 @@
+package batchproducer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrMultiProducerStopped is returned by the methods of a MultiProducer once it has been stopped.
+var ErrMultiProducerStopped = errors.New("MultiProducer is stopped")
+
+// MultiProducer sends records to several streams, routing each record to a Producer for its
+// stream. Each Producer is created, using the function passed to NewMultiProducer, and started
+// the first time a record is added for its stream. It is safe to use from multiple goroutines.
+type MultiProducer struct {
+	newProducer func(streamName string) (Producer, error)
+	producers   map[string]Producer
+	stopped     bool
+	mu          sync.Mutex
+
+	events chan Event
+	// done is closed when the MultiProducer is stopped, to stop the goroutines that forward events
+	done chan struct{}
+}
+
+// StreamEvent is sent on the Events channel of a MultiProducer for each Event sent by one of its
+// Producers.
+type StreamEvent struct {
+	StreamName string
+	Event      Event
+}
+
+var _ Event = (*StreamEvent)(nil)
+
+func (e *StreamEvent) String() string {
+	return fmt.Sprintf("%v: %v", e.StreamName, e.Event)
+}
+
+// NewMultiProducer returns a MultiProducer that uses newProducer to create the Producer for each
+// stream, e.g. by calling New with the stream name and a shared client and Config. newProducer
+// should not start the Producer. To tell the stats of each stream apart, give each Producer its
+// own StatReceiver that knows which stream it is for.
+func NewMultiProducer(newProducer func(streamName string) (Producer, error)) *MultiProducer {
+	return &MultiProducer{
+		newProducer: newProducer,
+		producers:   make(map[string]Producer),
+		events:      make(chan Event),
+		done:        make(chan struct{}),
+	}
+}
+
+// Add adds a record to the Producer for streamName, creating and starting it if need be. It
+// returns an error if that fails, or if Add on that Producer does.
+func (m *MultiProducer) Add(streamName string, data []byte, partitionKey string) error {
+	p, err := m.producer(streamName)
+	if err != nil {
+		return err
+	}
+	return p.Add(data, partitionKey)
+}
+
+func (m *MultiProducer) producer(streamName string) (Producer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return nil, ErrMultiProducerStopped
+	}
+
+	if p, ok := m.producers[streamName]; ok {
+		return p, nil
+	}
+
+	p, err := m.newProducer(streamName)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+	m.producers[streamName] = p
+	go m.forwardEvents(streamName, p)
+
+	return p, nil
+}
+
+func (m *MultiProducer) forwardEvents(streamName string, p Producer) {
+	for {
+		select {
+		case event := <-p.Events():
+			select {
+			case m.events <- &StreamEvent{StreamName: streamName, Event: event}:
+			case <-m.done:
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Events returns a channel for receiving the Events of all the Producers, each wrapped in a
+// StreamEvent. As with a single Producer, it must be read from or the Producers will eventually
+// block.
+func (m *MultiProducer) Events() <-chan Event {
+	return m.events
+}
+
+// Stop stops all the Producers. The MultiProducer can’t be used again afterwards. It returns
+// the first error returned by any of the Producers’ Stop methods.
+func (m *MultiProducer) Stop() error {
+	return m.each(func(p Producer) error {
+		return p.Stop()
+	})
+}
+
+// Flush calls Flush on all the Producers concurrently, so that they all share the timeout, and
+// returns the totals of their results along with the first error any of them returned. Like
+// Stop, it leaves the MultiProducer stopped.
+func (m *MultiProducer) Flush(timeout time.Duration, sendStats bool) (sent int, remaining int, err error) {
+	var resultsMu sync.Mutex
+	err = m.each(func(p Producer) error {
+		s, r, err := p.Flush(timeout, sendStats)
+		resultsMu.Lock()
+		sent += s
+		remaining += r
+		resultsMu.Unlock()
+		return err
+	})
+	return sent, remaining, err
+}
+
+// each marks the MultiProducer stopped and then calls f concurrently for each Producer, returning
+// the first error.
+func (m *MultiProducer) each(f func(p Producer) error) error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return ErrMultiProducerStopped
+	}
+	m.stopped = true
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(m.producers))
+	for _, p := range m.producers {
+		wg.Add(1)
+		go func(p Producer) {
+			defer wg.Done()
+			if err := f(p); err != nil {
+				errs <- err
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// The Producers are stopped so we can stop forwarding their events. Any events that haven’t
+	// been read by now are discarded.
+	close(m.done)
+
+	close(errs)
+	return <-errs
+}
@@ -0,0 +1,102 @@
+package batchproducer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type multiProducerTest struct {
+	clients   map[string]*mockBatchingClient
+	clientsMu sync.Mutex
+}
+
+func (m *multiProducerTest) newProducer(streamName string) (Producer, error) {
+	if streamName == "bad" {
+		return nil, errors.New("bad stream")
+	}
+
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+	c := &mockBatchingClient{}
+	m.clients[streamName] = c
+	return New(c, streamName, Config{BufferSize: 100, BatchSize: 10, Logger: discardLogger})
+}
+
+func TestMultiProducer(t *testing.T) {
+	t.Parallel()
+
+	m := &multiProducerTest{clients: make(map[string]*mockBatchingClient)}
+	mp := NewMultiProducer(m.newProducer)
+
+	for i := 0; i < 3; i++ {
+		mp.Add("foo", []byte("data"), "key")
+	}
+	mp.Add("bar", []byte("data"), "key")
+
+	if len(m.clients) != 2 {
+		t.Errorf("%v != 2", len(m.clients))
+	}
+
+	sent, remaining, err := mp.Flush(time.Second, false)
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if sent != 4 {
+		t.Errorf("%v != 4", sent)
+	}
+	if remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+	if m.clients["foo"].lastStreamName != "foo" {
+		t.Errorf("%v != foo", m.clients["foo"].lastStreamName)
+	}
+	if m.clients["bar"].lastStreamName != "bar" {
+		t.Errorf("%v != bar", m.clients["bar"].lastStreamName)
+	}
+
+	if err := mp.Add("foo", []byte("data"), "key"); err != ErrMultiProducerStopped {
+		t.Errorf("%v != %v", err, ErrMultiProducerStopped)
+	}
+	if err := mp.Stop(); err != ErrMultiProducerStopped {
+		t.Errorf("%v != %v", err, ErrMultiProducerStopped)
+	}
+}
+
+func TestMultiProducerNewProducerError(t *testing.T) {
+	t.Parallel()
+
+	m := &multiProducerTest{clients: make(map[string]*mockBatchingClient)}
+	mp := NewMultiProducer(m.newProducer)
+	defer mp.Stop()
+
+	if err := mp.Add("bad", []byte("data"), "key"); err == nil {
+		t.Error("err == nil")
+	}
+}
+
+func TestMultiProducerEvents(t *testing.T) {
+	t.Parallel()
+
+	m := &multiProducerTest{clients: make(map[string]*mockBatchingClient)}
+	mp := NewMultiProducer(m.newProducer)
+	defer mp.Stop()
+
+	mp.Add("foo", []byte("data"), "key")
+	p := mp.producers["foo"].(*batchProducer)
+	p.events <- newError("oops")
+
+	select {
+	case event := <-mp.Events():
+		streamEvent, ok := event.(*StreamEvent)
+		if !ok {
+			t.Fatalf("%T is not a *StreamEvent", event)
+		}
+		if streamEvent.StreamName != "foo" {
+			t.Errorf("%v != foo", streamEvent.StreamName)
+		}
+	case <-time.After(time.Second):
+		t.Error("No event was received")
+	}
+}
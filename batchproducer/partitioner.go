@@ -0,0 +1,142 @@
+package batchproducer
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+)
+
+// Kinesis maps each record to a shard by the MD5 hash of its partition key (or by its explicit hash
+// key, if it has one), interpreted as a 128-bit integer. Each shard owns a contiguous range of
+// these hash keys. The partitioners below assume the ranges were split evenly across shardCount
+// shards, which is the case for a newly created stream or one that has been resharded with
+// UpdateShardCount and uniform scaling.
+
+// maxHashKey is 2^128, one more than the largest hash key.
+var maxHashKey = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// RoundRobinPartitioner returns partition keys that cycle through the shards of a stream, so that
+// consecutive records are spread evenly across them. Use it with Add. It is safe to use from
+// multiple goroutines.
+type RoundRobinPartitioner struct {
+	keys    []string
+	counter uint64
+}
+
+// NewRoundRobinPartitioner returns a RoundRobinPartitioner for a stream with shardCount shards.
+// It panics if shardCount is less than 1.
+func NewRoundRobinPartitioner(shardCount int) *RoundRobinPartitioner {
+	checkShardCount(shardCount)
+
+	// Find a partition key that hashes into each shard by trying successive integers. Since MD5 is
+	// uniformly distributed this only takes about shardCount*ln(shardCount) attempts.
+	keys := make([]string, shardCount)
+	found := 0
+	for i := 0; found < shardCount; i++ {
+		key := strconv.Itoa(i)
+		shard := shardForHashKey(partitionKeyHash(key), shardCount)
+		if keys[shard] == "" {
+			keys[shard] = key
+			found++
+		}
+	}
+	return &RoundRobinPartitioner{keys: keys}
+}
+
+// Key returns the partition key for the next shard.
+func (p *RoundRobinPartitioner) Key() string {
+	n := atomic.AddUint64(&p.counter, 1) - 1
+	return p.keys[n%uint64(len(p.keys))]
+}
+
+// ExplicitHashPartitioner returns explicit hash keys that cycle through the shards of a stream, so
+// that consecutive records are spread evenly across them. Each key is the midpoint of its shard’s
+// hash key range, so it still lands in that shard if the range boundaries are slightly off. Use
+// it with AddExplicit. It is safe to use from multiple goroutines.
+type ExplicitHashPartitioner struct {
+	keys    []string
+	counter uint64
+}
+
+// NewExplicitHashPartitioner returns an ExplicitHashPartitioner for a stream with shardCount
+// shards. It panics if shardCount is less than 1.
+func NewExplicitHashPartitioner(shardCount int) *ExplicitHashPartitioner {
+	checkShardCount(shardCount)
+
+	keys := make([]string, shardCount)
+	for i := range keys {
+		start := shardRangeStart(i, shardCount)
+		end := shardRangeStart(i+1, shardCount)
+		mid := new(big.Int).Add(start, end)
+		keys[i] = mid.Rsh(mid, 1).String()
+	}
+	return &ExplicitHashPartitioner{keys: keys}
+}
+
+// Key returns the explicit hash key for the next shard.
+func (p *ExplicitHashPartitioner) Key() string {
+	n := atomic.AddUint64(&p.counter, 1) - 1
+	return p.keys[n%uint64(len(p.keys))]
+}
+
+// checkShardCount panics if shardCount isn’t a valid number of shards, since a partitioner for no
+// shards would otherwise only fail later, when Key is called.
+func checkShardCount(shardCount int) {
+	if shardCount < 1 {
+		panic(fmt.Sprintf("batchproducer: shardCount must be at least 1, not %v", shardCount))
+	}
+}
+
+// shardRangeStart returns the first hash key of shard i of shardCount evenly split shards.
+func shardRangeStart(i, shardCount int) *big.Int {
+	start := new(big.Int).Mul(maxHashKey, big.NewInt(int64(i)))
+	return start.Div(start, big.NewInt(int64(shardCount)))
+}
+
+// shardForHashKey returns the index of the shard, of shardCount evenly split shards, that owns
+// hashKey.
+func shardForHashKey(hashKey *big.Int, shardCount int) int {
+	shard := new(big.Int).Mul(hashKey, big.NewInt(int64(shardCount)))
+	shard.Div(shard, maxHashKey)
+	return int(shard.Int64())
+}
+
+// HashKeyRange is the range of hash keys owned by a shard, as returned for each shard by ListShards
+// or DescribeStream. The hash keys are decimal integers and both ends of the range are inclusive.
+type HashKeyRange struct {
+	ShardID         string
+	StartingHashKey string
+	EndingHashKey   string
+}
+
+// ShardForPartitionKey returns the ID of the shard in shards whose hash key range contains the
+// hash of partitionKey, i.e. the shard Kinesis would put a record with that partition key in. Unlike
+// the partitioners it works with any shard layout, including one left by splitting and merging
+// shards, as long as shards only includes the open shards. It returns an error if none of the
+// ranges contain the hash or one of them can’t be parsed.
+func ShardForPartitionKey(partitionKey string, shards []HashKeyRange) (shardID string, err error) {
+	hash := partitionKeyHash(partitionKey)
+	for _, shard := range shards {
+		start, ok := new(big.Int).SetString(shard.StartingHashKey, 10)
+		if !ok {
+			return "", fmt.Errorf("Invalid starting hash key %q for shard %v", shard.StartingHashKey, shard.ShardID)
+		}
+		end, ok := new(big.Int).SetString(shard.EndingHashKey, 10)
+		if !ok {
+			return "", fmt.Errorf("Invalid ending hash key %q for shard %v", shard.EndingHashKey, shard.ShardID)
+		}
+		if hash.Cmp(start) >= 0 && hash.Cmp(end) <= 0 {
+			return shard.ShardID, nil
+		}
+	}
+	return "", fmt.Errorf("No shard contains the hash key %v of partition key %q", hash, partitionKey)
+}
+
+// partitionKeyHash returns the hash key Kinesis uses for partitionKey: its MD5 hash interpreted as
+// a 128-bit unsigned integer.
+func partitionKeyHash(partitionKey string) *big.Int {
+	hash := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(hash[:])
+}
@@ -0,0 +1,158 @@
+package batchproducer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestRoundRobinPartitioner(t *testing.T) {
+	t.Parallel()
+
+	p := NewRoundRobinPartitioner(8)
+	counts := make([]int, 8)
+	for i := 0; i < 80; i++ {
+		counts[shardForHashKey(partitionKeyHash(p.Key()), 8)]++
+	}
+	for shard, count := range counts {
+		if count != 10 {
+			t.Errorf("shard %v: %v != 10", shard, count)
+		}
+	}
+}
+
+func TestExplicitHashPartitioner(t *testing.T) {
+	t.Parallel()
+
+	p := NewExplicitHashPartitioner(2)
+	quarter := new(big.Int).Lsh(big.NewInt(1), 126)
+	expected := []string{
+		quarter.String(),
+		new(big.Int).Mul(quarter, big.NewInt(3)).String(),
+		quarter.String(),
+	}
+	for _, e := range expected {
+		if key := p.Key(); key != e {
+			t.Errorf("%v != %v", key, e)
+		}
+	}
+}
+
+func TestExplicitHashPartitionerKeysAreInTheirShards(t *testing.T) {
+	t.Parallel()
+
+	p := NewExplicitHashPartitioner(7)
+	for i := 0; i < 7; i++ {
+		key, _ := new(big.Int).SetString(p.Key(), 10)
+		if shard := shardForHashKey(key, 7); shard != i {
+			t.Errorf("%v != %v", shard, i)
+		}
+	}
+}
+
+func TestPartitionersPanicWithoutShards(t *testing.T) {
+	t.Parallel()
+
+	for _, shardCount := range []int{0, -1} {
+		for _, newPartitioner := range []func(int){
+			func(n int) { NewRoundRobinPartitioner(n) },
+			func(n int) { NewExplicitHashPartitioner(n) },
+		} {
+			func() {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("no panic for %v shards", shardCount)
+					}
+				}()
+				newPartitioner(shardCount)
+			}()
+		}
+	}
+}
+
+func TestAddExplicit(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.AddExplicit([]byte("foo"), "bar", "42")
+	b.Add([]byte("foo"), "bar")
+	b.running = false
+
+	input := b.recordsToInput("foo", b.takeRecordsFromBuffer(2))
+	if aws.StringValue(input.Records[0].ExplicitHashKey) != "42" {
+		t.Errorf("%v != 42", aws.StringValue(input.Records[0].ExplicitHashKey))
+	}
+	if input.Records[1].ExplicitHashKey != nil {
+		t.Errorf("%v != nil", *input.Records[1].ExplicitHashKey)
+	}
+}
+
+// twoShards is the layout of a stream created with two shards.
+var twoShards = []HashKeyRange{
+	{
+		ShardID:         "shardId-000000000000",
+		StartingHashKey: "0",
+		EndingHashKey:   "170141183460469231731687303715884105727",
+	},
+	{
+		ShardID:         "shardId-000000000001",
+		StartingHashKey: "170141183460469231731687303715884105728",
+		EndingHashKey:   "340282366920938463463374607431768211455",
+	},
+}
+
+func TestShardForPartitionKey(t *testing.T) {
+	t.Parallel()
+
+	// The MD5 hash of "a" is 0cc175b9..., which is in the lower half of the hash key space, and the
+	// hash of "b" is 92eb5ffe..., which is in the upper half.
+	tests := map[string]string{
+		"a":   "shardId-000000000000",
+		"b":   "shardId-000000000001",
+		"foo": "shardId-000000000001",
+	}
+	for key, expected := range tests {
+		shardID, err := ShardForPartitionKey(key, twoShards)
+		if err != nil {
+			t.Errorf("%v: %v != nil", key, err)
+		}
+		if shardID != expected {
+			t.Errorf("%v: %v != %v", key, shardID, expected)
+		}
+	}
+}
+
+func TestShardForPartitionKeyRangesAreInclusive(t *testing.T) {
+	t.Parallel()
+
+	// 16955237001963240173058271559858726497 is the MD5 hash of "a"
+	shards := []HashKeyRange{
+		{ShardID: "before", StartingHashKey: "0", EndingHashKey: "16955237001963240173058271559858726496"},
+		{ShardID: "only", StartingHashKey: "16955237001963240173058271559858726497", EndingHashKey: "16955237001963240173058271559858726497"},
+		{ShardID: "after", StartingHashKey: "16955237001963240173058271559858726498", EndingHashKey: "340282366920938463463374607431768211455"},
+	}
+	shardID, err := ShardForPartitionKey("a", shards)
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if shardID != "only" {
+		t.Errorf("%v != only", shardID)
+	}
+}
+
+func TestShardForPartitionKeyErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := ShardForPartitionKey("b", twoShards[:1]); err == nil {
+		t.Error("err == nil")
+	}
+
+	invalid := []HashKeyRange{{ShardID: "shardId-000000000000", StartingHashKey: "zero", EndingHashKey: "1"}}
+	if _, err := ShardForPartitionKey("a", invalid); err == nil {
+		t.Error("err == nil")
+	}
+}
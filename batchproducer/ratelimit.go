@@ -0,0 +1,110 @@
+package batchproducer
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudgetWindow is the length of the windows within which Config.RetryBudget applies.
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudget enforces Config.RetryBudget: within each retryBudgetWindow, failed records may only
+// be retried while the retries are at most fraction of the records sent, including the retries
+// themselves.
+type retryBudget struct {
+	fraction    float64
+	windowStart time.Time
+	attempts    int
+	retries     int
+	mu          sync.Mutex
+}
+
+func newRetryBudget(fraction float64) *retryBudget {
+	return &retryBudget{fraction: fraction}
+}
+
+// sent counts n records being sent, whether for the first time or not.
+func (r *retryBudget) sent(c clock, n int) {
+	r.mu.Lock()
+	r.startWindow(c.Now())
+	r.attempts += n
+	r.mu.Unlock()
+}
+
+// allowRetry reports whether there is room in the budget for another retry, and if so counts it.
+func (r *retryBudget) allowRetry(c clock) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.startWindow(c.Now())
+	if float64(r.retries+1) > r.fraction*float64(r.attempts) {
+		return false
+	}
+	r.retries++
+	return true
+}
+
+// startWindow starts a new window, with nothing counted, if the current one is over. It must be
+// called with mu held.
+func (r *retryBudget) startWindow(now time.Time) {
+	if r.windowStart.IsZero() || now.Sub(r.windowStart) >= retryBudgetWindow {
+		r.windowStart = now
+		r.attempts, r.retries = 0, 0
+	}
+}
+
+// tokenBucket limits the rate of something, e.g. records sent, to rate per second. It holds up to
+// one second’s worth of tokens, so it allows bursts of up to rate, and starts full. A request for
+// more tokens than are available still succeeds but goes into debt, and the caller waits until
+// the debt would have been paid off; so requests larger than the bucket, such as a batch of 500
+// records with a limit of 100 per second, are allowed but wait accordingly.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate)}
+}
+
+// wait takes n tokens from the bucket, sleeping on clock first if there aren’t enough.
+func (t *tokenBucket) wait(c clock, n int) {
+	if d := t.take(c, n); d > 0 {
+		c.Sleep(d)
+	}
+}
+
+// take takes n tokens from the bucket, going into debt if there aren’t enough, and returns how
+// long the caller must wait before using them, which is 0 unless it went into debt. It doesn’t
+// sleep itself, so that callers can wait without holding their own locks.
+func (t *tokenBucket) take(c clock, n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refill(c.Now())
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+// canTake reports whether the bucket has n tokens, so that wait would take them without sleeping.
+func (t *tokenBucket) canTake(c clock, n int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refill(c.Now())
+	return t.tokens >= float64(n)
+}
+
+// refill adds the tokens that have accrued since it was last called. It must be called with mu
+// held.
+func (t *tokenBucket) refill(now time.Time) {
+	if !t.last.IsZero() {
+		t.tokens += now.Sub(t.last).Seconds() * t.rate
+		if t.tokens > t.rate {
+			t.tokens = t.rate
+		}
+	}
+	t.last = now
+}
@@ -0,0 +1,155 @@
+package batchproducer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	bucket := newTokenBucket(10)
+
+	// The bucket starts full
+	bucket.wait(clock, 10)
+	if len(clock.sleeps) != 0 {
+		t.Fatalf("%v != 0", len(clock.sleeps))
+	}
+
+	bucket.wait(clock, 5)
+	if clock.sleeps[0] != 500*time.Millisecond {
+		t.Errorf("%v != %v", clock.sleeps[0], 500*time.Millisecond)
+	}
+
+	// Tokens don’t accumulate beyond a second’s worth
+	clock.Advance(time.Minute)
+	bucket.wait(clock, 20)
+	if clock.sleeps[1] != time.Second {
+		t.Errorf("%v != %v", clock.sleeps[1], time.Second)
+	}
+}
+
+func newRateLimitedProducer(t *testing.T, config Config) (*batchProducer, *fakeClock) {
+	config.BufferSize = 1000
+	config.BatchSize = 50
+	config.Logger = discardLogger
+	p, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+	clock := newFakeClock()
+	b.clock = clock
+	return b, clock
+}
+
+func TestMaxRecordsPerSecond(t *testing.T) {
+	t.Parallel()
+
+	b, clock := newRateLimitedProducer(t, Config{MaxRecordsPerSecond: 100})
+	start := clock.Now()
+
+	// set running to true so Add will succeed
+	b.running = true
+	b.addRecordsAndWait(500, 0)
+	b.running = false
+
+	sent := 0
+	for b.bufferLen() > 0 {
+		sent += b.sendBatch(50)
+	}
+	if sent != 500 {
+		t.Errorf("%v != 500", sent)
+	}
+
+	// The first 100 records are a burst; after that the rate must not exceed the limit
+	elapsed := clock.Now().Sub(start)
+	if rate := float64(sent-100) / elapsed.Seconds(); rate > 100 {
+		t.Errorf("%v > 100", rate)
+	}
+	if elapsed != 4*time.Second {
+		t.Errorf("%v != %v", elapsed, 4*time.Second)
+	}
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	t.Parallel()
+
+	b, clock := newRateLimitedProducer(t, Config{MaxBytesPerSecond: 1000})
+	start := clock.Now()
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 100; i++ {
+		// 100 bytes of data and partition key
+		b.Add(make([]byte, 97), "key")
+	}
+	b.running = false
+
+	for b.bufferLen() > 0 {
+		b.sendBatch(10)
+	}
+
+	// 10,000 bytes, of which the first 1000 are a burst
+	if elapsed := clock.Now().Sub(start); elapsed != 9*time.Second {
+		t.Errorf("%v != %v", elapsed, 9*time.Second)
+	}
+}
+
+func TestNewBatchProducerWithNegativeRateLimit(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		BufferSize:          10,
+		BatchSize:           10,
+		MaxRecordsPerSecond: -1,
+	}
+	b, err := New(&mockBatchingClient{}, "foo", config)
+	if b != nil {
+		t.Errorf("%q != nil", b)
+	}
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	budget := newRetryBudget(0.1)
+
+	// Nothing has been sent yet, so there’s no room for retries
+	if budget.allowRetry(clock) {
+		t.Error("retry allowed before anything was sent")
+	}
+
+	budget.sent(clock, 100)
+	var retries int
+	for budget.allowRetry(clock) {
+		retries++
+	}
+	if retries != 10 {
+		t.Errorf("%v != 10", retries)
+	}
+
+	// Sending the retries makes room for one more
+	budget.sent(clock, 10)
+	if !budget.allowRetry(clock) {
+		t.Error("retry not allowed")
+	}
+	if budget.allowRetry(clock) {
+		t.Error("retry allowed")
+	}
+
+	// A new window starts afresh
+	clock.Advance(retryBudgetWindow)
+	budget.sent(clock, 20)
+	retries = 0
+	for budget.allowRetry(clock) {
+		retries++
+	}
+	if retries != 2 {
+		t.Errorf("%v != 2", retries)
+	}
+}
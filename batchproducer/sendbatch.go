@@ -0,0 +1,174 @@
+package batchproducer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// ErrTooManyRecords is returned by SendBatch if it is passed more than MaxKinesisBatchSize records.
+var ErrTooManyRecords = errors.New("SendBatch can send at most 500 records")
+
+// BatchResult is the result of SendBatch.
+type BatchResult struct {
+	// Records has the result of each record passed to SendBatch, in the same order.
+	Records []RecordResult
+
+	// Written is the number of records that were written; the rest were dropped.
+	Written int
+}
+
+// RecordResult is the fate of a single record, as returned by SendBatch or passed to the callback
+// of AddWithCallback.
+type RecordResult struct {
+	// SequenceNumber and ShardID say where the record landed, if it was written.
+	SequenceNumber string
+	ShardID        string
+
+	// Attempts is the number of times the record was sent.
+	Attempts int
+
+	// Err is nil if the record was written, or why it was dropped otherwise.
+	Err error
+}
+
+// from/for interface Producer
+func (b *batchProducer) SendBatch(records []Record) (BatchResult, error) {
+	if len(records) > MaxKinesisBatchSize {
+		return BatchResult{}, ErrTooManyRecords
+	}
+
+	result := BatchResult{Records: make([]RecordResult, len(records))}
+	// pending are the indexes of the records still to be sent, and batch the records themselves.
+	var pending []int
+	var batch []batchRecord
+	for i, r := range records {
+		record, err := b.prepareForSendBatch(r)
+		if err != nil {
+			result.Records[i].Err = err
+			continue
+		}
+		pending = append(pending, i)
+		batch = append(batch, record)
+	}
+
+	maxAttempts := b.config.MaxAttemptsPerRecord
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var delay time.Duration
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if delay > 0 {
+			b.clock.Sleep(delay)
+		}
+
+		if b.retryBudget != nil {
+			b.retryBudget.sent(b.clock, len(batch))
+		}
+		// The batch is sent in as many requests as it takes to stay under MaxKinesisBatchBytes.
+		// Each record gets either an entry from the response or the error of its request.
+		entries := make([]*kinesis.PutRecordsResultEntry, len(batch))
+		errs := make([]error, len(batch))
+		var requestFailed bool
+		for start := 0; start < len(batch); {
+			chunk := batch[start : start+fitInRequest(batch[start:])]
+			b.waitForRateLimits(chunk)
+			req := b.recordsToInput(b.StreamName(), chunk)
+			res, err := b.putRecords(context.Background(), &req.PutRecordsInput)
+			req.release()
+			for j := range chunk {
+				if err != nil {
+					errs[start+j] = err
+				} else if res != nil && j < len(res.Records) {
+					// A short response leaves the entries of the rest nil
+					entries[start+j] = res.Records[j]
+				}
+			}
+			requestFailed = requestFailed || err != nil
+			start += len(chunk)
+		}
+
+		var retry []int
+		var retryBatch []batchRecord
+		for j, i := range pending {
+			result.Records[i].Attempts = attempt
+
+			var recordErr error
+			retryable := true
+			if errs[j] != nil {
+				recordErr = errs[j]
+			} else if entries[j] == nil {
+				// It may or may not have been written, so it’s retried
+				recordErr = errNoResultEntry
+			} else if entry := entries[j]; !entryFailed(entry) {
+				result.Records[i].SequenceNumber = aws.StringValue(entry.SequenceNumber)
+				result.Records[i].ShardID = aws.StringValue(entry.ShardId)
+				result.Written++
+				continue
+			} else {
+				errorCode := aws.StringValue(entry.ErrorCode)
+				recordErr = fmt.Errorf("%v (%v)", aws.StringValue(entry.ErrorMessage), errorCode)
+				retryable = b.classify(errorCode) != ErrorPermanent
+			}
+
+			switch {
+			case !retryable:
+				result.Records[i].Err = fmt.Errorf("record failed with non-retryable error: %v", recordErr)
+			case attempt >= maxAttempts:
+				result.Records[i].Err = fmt.Errorf("record dropped after %v attempts: %v", attempt, recordErr)
+			case !b.allowRetry():
+				result.Records[i].Err = fmt.Errorf("record dropped because the retry budget is used up: %v", recordErr)
+			default:
+				retry = append(retry, i)
+				retryBatch = append(retryBatch, batch[j])
+			}
+		}
+		pending, batch = retry, retryBatch
+
+		// The same backoff as the main loop uses between failed requests
+		if requestFailed {
+			if delay == 0 {
+				delay = 50 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+		} else {
+			delay = 0
+		}
+	}
+
+	if failed := len(records) - result.Written; failed > 0 {
+		for _, r := range result.Records {
+			if r.Err != nil {
+				return result, fmt.Errorf("%v of %v records were not written; the first error was: %v", failed, len(records), r.Err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// prepareForSendBatch turns r into a record ready to be sent, as Add would.
+func (b *batchProducer) prepareForSendBatch(r Record) (batchRecord, error) {
+	record := batchRecord{data: r.Data, partitionKey: r.PartitionKey, explicitHashKey: r.ExplicitHashKey}
+	if record.partitionKey == "" && b.config.PartitionKeyFunc != nil {
+		var err error
+		if record.partitionKey, err = b.config.PartitionKeyFunc(record.data); err != nil {
+			return batchRecord{}, err
+		}
+	}
+	if b.config.Encrypter != nil {
+		ciphertext, err := b.config.Encrypter(record.data)
+		if err != nil {
+			return batchRecord{}, err
+		}
+		record.data = ciphertext
+	}
+	if record.size() > MaxRecordSize {
+		return batchRecord{}, ErrRecordTooLarge
+	}
+	return record, nil
+}
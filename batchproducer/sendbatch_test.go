@@ -0,0 +1,177 @@
+package batchproducer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestSendBatch(t *testing.T) {
+	t.Parallel()
+	client := &mockBatchingClient{}
+	b := newProducer(client, 100, 0, 10)
+	b.clock = newFakeClock()
+	b.config.MaxAttemptsPerRecord = 3
+
+	result, err := b.SendBatch([]Record{
+		{Data: []byte("foo"), PartitionKey: "a"},
+		{Data: []byte("foo"), PartitionKey: "fail"},
+		{Data: []byte("foo"), PartitionKey: "denied"},
+		{Data: []byte("foo"), PartitionKey: "b", ExplicitHashKey: "42"},
+	})
+	if err == nil {
+		t.Error("err == nil")
+	}
+	if result.Written != 2 {
+		t.Errorf("%v != 2", result.Written)
+	}
+	if len(result.Records) != 4 {
+		t.Fatalf("%v != 4", len(result.Records))
+	}
+
+	for _, i := range []int{0, 3} {
+		r := result.Records[i]
+		if r.Err != nil || r.SequenceNumber != "001" || r.ShardID != "001" || r.Attempts != 1 {
+			t.Errorf("%v: %+v is not written at the first attempt", i, r)
+		}
+	}
+	// The failing record is retried until it hits MaxAttemptsPerRecord
+	if r := result.Records[1]; r.Err == nil || r.Attempts != 3 {
+		t.Errorf("%+v is not dropped after 3 attempts", r)
+	}
+	// but one with a non-retryable error isn’t retried
+	if r := result.Records[2]; r.Err == nil || r.Attempts != 1 {
+		t.Errorf("%+v is not dropped after 1 attempt", r)
+	}
+	if client.callCount() != 3 {
+		t.Errorf("%v != 3", client.callCount())
+	}
+
+	// Nothing went through the buffer
+	if b.bufferLen() != 0 {
+		t.Errorf("%v != 0", b.bufferLen())
+	}
+}
+
+func TestSendBatchWhenKinesisReturnsError(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 10)
+	clock := newFakeClock()
+	b.clock = clock
+	b.config.MaxAttemptsPerRecord = 3
+
+	result, err := b.SendBatch([]Record{{Data: []byte("foo"), PartitionKey: "a"}})
+	if err == nil {
+		t.Error("err == nil")
+	}
+	if r := result.Records[0]; r.Err == nil || r.Attempts != 3 {
+		t.Errorf("%+v is not dropped after 3 attempts", r)
+	}
+	// It backs off between failed requests
+	expected := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}
+	if sleeps := clock.Sleeps(); len(sleeps) != 2 || sleeps[0] != expected[0] || sleeps[1] != expected[1] {
+		t.Errorf("%v != %v", sleeps, expected)
+	}
+}
+
+func TestSendBatchSplitsRequestsByBytes(t *testing.T) {
+	t.Parallel()
+	client := &mockBatchingClient{}
+	b := newProducer(client, 100, 0, 10)
+
+	records := make([]Record, 7)
+	for i := range records {
+		records[i] = Record{Data: make([]byte, MaxRecordSize-3), PartitionKey: "foo"}
+	}
+	result, err := b.SendBatch(records)
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if result.Written != 7 {
+		t.Errorf("%v != 7", result.Written)
+	}
+	if client.callCount() != 2 {
+		t.Errorf("%v != 2", client.callCount())
+	}
+}
+
+func TestSendBatchWithTooManyRecords(t *testing.T) {
+	t.Parallel()
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	if _, err := b.SendBatch(make([]Record, MaxKinesisBatchSize+1)); err != ErrTooManyRecords {
+		t.Errorf("%v != %v", err, ErrTooManyRecords)
+	}
+}
+
+func TestSendBatchWithRecordTooLarge(t *testing.T) {
+	t.Parallel()
+	client := &mockBatchingClient{}
+	b := newProducer(client, 100, 0, 10)
+
+	result, err := b.SendBatch([]Record{
+		{Data: make([]byte, MaxRecordSize), PartitionKey: "a"},
+		{Data: []byte("foo"), PartitionKey: "b"},
+	})
+	if err == nil {
+		t.Error("err == nil")
+	}
+	if result.Records[0].Err != ErrRecordTooLarge || result.Records[0].Attempts != 0 {
+		t.Errorf("%+v is not dropped without being sent", result.Records[0])
+	}
+	if result.Written != 1 {
+		t.Errorf("%v != 1", result.Written)
+	}
+}
+
+// shortResponseClient answers its first request with an entry for the first record only, and a nil
+// one for the second, and every later request in full.
+type shortResponseClient struct {
+	calls int
+	mu    sync.Mutex
+}
+
+func (c *shortResponseClient) PutRecords(args *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	res := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for range args.Records {
+		res.Records = append(res.Records, &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("001"), ShardId: aws.String("001")})
+	}
+	if c.calls == 1 && len(res.Records) > 2 {
+		res.Records = []*kinesis.PutRecordsResultEntry{res.Records[0], nil}
+	}
+	return res, nil
+}
+
+func TestSendBatchWithShortResponse(t *testing.T) {
+	t.Parallel()
+	c := &shortResponseClient{}
+	p, err := New(c, "foo", Config{BufferSize: 100, BatchSize: 10, Logger: discardLogger, MaxAttemptsPerRecord: 2})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+	b.clock = newFakeClock()
+
+	// The records without an entry, or with a nil one, are retried rather than crashing
+	result, err := b.SendBatch([]Record{
+		{Data: []byte("foo"), PartitionKey: "a"},
+		{Data: []byte("foo"), PartitionKey: "b"},
+		{Data: []byte("foo"), PartitionKey: "c"},
+	})
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if result.Written != 3 {
+		t.Errorf("%v != 3", result.Written)
+	}
+	for i, expected := range []int{1, 2, 2} {
+		if r := result.Records[i]; r.Err != nil || r.Attempts != expected {
+			t.Errorf("%v: %+v is not written at attempt %v", i, r, expected)
+		}
+	}
+}
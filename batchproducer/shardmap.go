@@ -0,0 +1,182 @@
+package batchproducer
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// The rates at which Kinesis accepts records into each shard.
+const (
+	shardRecordsPerSecond = 1000
+	shardBytesPerSecond   = 1024 * 1024
+)
+
+// shardMap is the map of the stream’s open shards used by Config.ShardMapInterval, with the rate
+// limits of each. It is updated by the goroutine that lists the shards and used by the main
+// goroutine, so it is safe to use from any goroutine.
+type shardMap struct {
+	// shards are sorted by their starting hash keys.
+	shards []*mappedShard
+	mu     sync.Mutex
+}
+
+type mappedShard struct {
+	id         string
+	start, end *big.Int
+	records    *tokenBucket
+	bytes      *tokenBucket
+
+	// full is set while choosing a batch once the shard has no room for a record, so that later
+	// records for it are held back too, and stay in order.
+	full bool
+}
+
+// update replaces the shards, keeping the rate limits of the ones that are already known so that
+// refreshing the map doesn’t reset them. With no shards, nothing is limited.
+func (m *shardMap) update(ranges []HashKeyRange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	known := make(map[string]*mappedShard, len(m.shards))
+	for _, shard := range m.shards {
+		known[shard.id] = shard
+	}
+	shards := make([]*mappedShard, len(ranges))
+	for i, r := range ranges {
+		start, ok := new(big.Int).SetString(r.StartingHashKey, 10)
+		if !ok {
+			return fmt.Errorf("Invalid starting hash key %q for shard %v", r.StartingHashKey, r.ShardID)
+		}
+		end, ok := new(big.Int).SetString(r.EndingHashKey, 10)
+		if !ok {
+			return fmt.Errorf("Invalid ending hash key %q for shard %v", r.EndingHashKey, r.ShardID)
+		}
+		shard := &mappedShard{id: r.ShardID, start: start, end: end}
+		if old, ok := known[r.ShardID]; ok {
+			shard.records, shard.bytes = old.records, old.bytes
+		} else {
+			shard.records = newTokenBucket(shardRecordsPerSecond)
+			shard.bytes = newTokenBucket(shardBytesPerSecond)
+		}
+		shards[i] = shard
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].start.Cmp(shards[j].start) < 0 })
+	m.shards = shards
+	return nil
+}
+
+// find returns the shard that record will be put in, or nil if that isn’t known. It must be called
+// with mu held.
+func (m *shardMap) find(record batchRecord) *mappedShard {
+	var hash *big.Int
+	if record.explicitHashKey != "" {
+		var ok bool
+		if hash, ok = new(big.Int).SetString(record.explicitHashKey, 10); !ok {
+			return nil
+		}
+	} else {
+		hash = partitionKeyHash(record.partitionKey)
+	}
+	i := sort.Search(len(m.shards), func(i int) bool { return m.shards[i].start.Cmp(hash) > 0 }) - 1
+	if i < 0 || hash.Cmp(m.shards[i].end) > 0 {
+		return nil
+	}
+	return m.shards[i]
+}
+
+// admit splits records into those whose shards are within their rate limits, which can be sent
+// now, and those whose shards aren’t, which are held back, keeping the order of each. Once a
+// record for a shard has been held back so are all the later ones for it. If every record would
+// be held back, admit waits on c until the shard of the first has room for it, and admits that
+// one, so that the caller always makes progress. It doesn’t hold mu while it waits, so that the
+// map can be updated meanwhile. Records whose shard isn’t known are admitted.
+func (m *shardMap) admit(c clock, records []batchRecord) (admitted, heldBack []batchRecord) {
+	m.mu.Lock()
+	if len(m.shards) == 0 || len(records) == 0 {
+		m.mu.Unlock()
+		return records, nil
+	}
+
+	shards := make([]*mappedShard, len(records))
+	admitted = make([]batchRecord, 0, len(records))
+	for i, record := range records {
+		shard := m.find(record)
+		shards[i] = shard
+		if shard == nil {
+			admitted = append(admitted, record)
+			continue
+		}
+		if shard.full || !shard.records.canTake(c, 1) || !shard.bytes.canTake(c, record.size()) {
+			shard.full = true
+			heldBack = append(heldBack, record)
+			continue
+		}
+		// Never waits, since there’s room
+		shard.records.take(c, 1)
+		shard.bytes.take(c, record.size())
+		admitted = append(admitted, record)
+	}
+	for _, shard := range shards {
+		if shard != nil {
+			shard.full = false
+		}
+	}
+
+	if len(admitted) == 0 {
+		// Go into debt for the first record, which waits until its shard has room for it
+		shard := shards[0]
+		wait := shard.records.take(c, 1)
+		if d := shard.bytes.take(c, records[0].size()); d > wait {
+			wait = d
+		}
+		m.mu.Unlock()
+		if wait > 0 {
+			c.Sleep(wait)
+		}
+		return records[:1], records[1:]
+	}
+	m.mu.Unlock()
+	return admitted, heldBack
+}
+
+// listShards returns the hash key ranges of the open shards of the stream, which is addressed by
+// streamARN if that is set, or else by streamName.
+func listShards(client ShardListingClient, streamName, streamARN string) ([]HashKeyRange, error) {
+	input := &kinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	if streamARN != "" {
+		input = &kinesis.ListShardsInput{StreamARN: aws.String(streamARN)}
+	}
+
+	var ranges []HashKeyRange
+	for {
+		res, err := client.ListShards(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range res.Shards {
+			// Closed shards, left by resharding, have an ending sequence number and can’t be
+			// written to.
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+				continue
+			}
+			if shard.HashKeyRange == nil {
+				continue
+			}
+			ranges = append(ranges, HashKeyRange{
+				ShardID:         aws.StringValue(shard.ShardId),
+				StartingHashKey: aws.StringValue(shard.HashKeyRange.StartingHashKey),
+				EndingHashKey:   aws.StringValue(shard.HashKeyRange.EndingHashKey),
+			})
+		}
+		if res.NextToken == nil {
+			return ranges, nil
+		}
+		// The stream mustn’t be given along with a NextToken
+		input = &kinesis.ListShardsInput{NextToken: res.NextToken}
+	}
+}
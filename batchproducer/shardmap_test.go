@@ -0,0 +1,242 @@
+package batchproducer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// recordFor returns a record with partitionKey, which is "a" for the first shard of twoShards or
+// "b" for the second.
+func recordFor(partitionKey string) batchRecord {
+	return batchRecord{data: []byte("foo"), partitionKey: partitionKey}
+}
+
+func TestShardMapAdmit(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	m := &shardMap{}
+	if err := m.update(twoShards); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// Use up all of the first shard’s allowance, then some more for each
+	var records []batchRecord
+	for i := 0; i < shardRecordsPerSecond; i++ {
+		records = append(records, recordFor("a"))
+	}
+	for i := 0; i < 5; i++ {
+		records = append(records, recordFor("a"), recordFor("b"))
+	}
+	admitted, heldBack := m.admit(clock, records)
+	if len(admitted) != shardRecordsPerSecond+5 {
+		t.Errorf("%v != %v", len(admitted), shardRecordsPerSecond+5)
+	}
+	if len(heldBack) != 5 {
+		t.Fatalf("%v != 5", len(heldBack))
+	}
+	for _, record := range heldBack {
+		if record.partitionKey != "a" {
+			t.Errorf("%v != a", record.partitionKey)
+		}
+	}
+	if len(clock.sleeps) != 0 {
+		t.Errorf("%v != 0", len(clock.sleeps))
+	}
+
+	// Refreshing the map doesn’t reset the allowances
+	if err := m.update(twoShards); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// When every record would be held back, the first is sent once its shard has room
+	admitted, heldBack = m.admit(clock, heldBack)
+	if len(admitted) != 1 || len(heldBack) != 4 {
+		t.Errorf("%v, %v != 1, 4", len(admitted), len(heldBack))
+	}
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != time.Millisecond {
+		t.Errorf("%v != [%v]", clock.sleeps, time.Millisecond)
+	}
+
+	// Without a map nothing is held back
+	if err := m.update(nil); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if admitted, heldBack := m.admit(clock, records); len(admitted) != len(records) || len(heldBack) != 0 {
+		t.Errorf("%v, %v != %v, 0", len(admitted), len(heldBack), len(records))
+	}
+}
+
+func TestShardMapAdmitBytes(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	m := &shardMap{}
+	if err := m.update(twoShards); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// Two of these, with their partition keys, are exactly a second’s worth
+	big := recordFor("a")
+	big.data = make([]byte, shardBytesPerSecond/2-1)
+	admitted, heldBack := m.admit(clock, []batchRecord{big, big, big, recordFor("b")})
+	if len(admitted) != 3 || len(heldBack) != 1 {
+		t.Errorf("%v, %v != 3, 1", len(admitted), len(heldBack))
+	}
+}
+
+// sleepBlockingClock is a clock whose Sleep reports on sleeping and then blocks until release is
+// closed.
+type sleepBlockingClock struct {
+	*fakeClock
+	sleeping chan struct{}
+	release  chan struct{}
+}
+
+func (c sleepBlockingClock) Sleep(d time.Duration) {
+	c.sleeping <- struct{}{}
+	<-c.release
+}
+
+func TestShardMapAdmitWaitsWithoutTheLock(t *testing.T) {
+	t.Parallel()
+	clock := sleepBlockingClock{newFakeClock(), make(chan struct{}), make(chan struct{})}
+	m := &shardMap{}
+	if err := m.update(twoShards); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// Use up all of the first shard’s allowance
+	var records []batchRecord
+	for i := 0; i < shardRecordsPerSecond; i++ {
+		records = append(records, recordFor("a"))
+	}
+	m.admit(clock, records)
+
+	admitted := make(chan int)
+	go func() {
+		batch, _ := m.admit(clock, []batchRecord{recordFor("a")})
+		admitted <- len(batch)
+	}()
+	<-clock.sleeping
+
+	// The map can be refreshed while admit waits for the shard to have room
+	updated := make(chan error)
+	go func() {
+		updated <- m.update(twoShards)
+	}()
+	select {
+	case err := <-updated:
+		if err != nil {
+			t.Errorf("%v != nil", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("update waited for admit")
+	}
+
+	close(clock.release)
+	if n := <-admitted; n != 1 {
+		t.Errorf("%v != 1", n)
+	}
+}
+
+func TestShardMapUpdateErrors(t *testing.T) {
+	t.Parallel()
+	m := &shardMap{}
+	if err := m.update([]HashKeyRange{{ShardID: "A", StartingHashKey: "foo", EndingHashKey: "1"}}); err == nil {
+		t.Error("err == nil")
+	}
+}
+
+// listingClient returns its pages of shards from ListShards, one per call.
+type listingClient struct {
+	mockBatchingClient
+	pages  [][]*kinesis.Shard
+	inputs []*kinesis.ListShardsInput
+	err    error
+}
+
+func (c *listingClient) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.inputs = append(c.inputs, input)
+	page := len(c.inputs) - 1
+	output := &kinesis.ListShardsOutput{Shards: c.pages[page]}
+	if page < len(c.pages)-1 {
+		output.NextToken = aws.String("next")
+	}
+	return output, nil
+}
+
+func newShard(r HashKeyRange, closed bool) *kinesis.Shard {
+	shard := &kinesis.Shard{
+		ShardId:             aws.String(r.ShardID),
+		HashKeyRange:        &kinesis.HashKeyRange{StartingHashKey: aws.String(r.StartingHashKey), EndingHashKey: aws.String(r.EndingHashKey)},
+		SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+	}
+	if closed {
+		shard.SequenceNumberRange.EndingSequenceNumber = aws.String("2")
+	}
+	return shard
+}
+
+func newListingClient() *listingClient {
+	return &listingClient{pages: [][]*kinesis.Shard{
+		{newShard(HashKeyRange{ShardID: "shardId-old", StartingHashKey: "0", EndingHashKey: twoShards[1].EndingHashKey}, true), newShard(twoShards[0], false)},
+		{newShard(twoShards[1], false)},
+	}}
+}
+
+func TestListShards(t *testing.T) {
+	t.Parallel()
+	client := newListingClient()
+	ranges, err := listShards(client, "foo", "")
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if len(ranges) != 2 || ranges[0] != twoShards[0] || ranges[1] != twoShards[1] {
+		t.Errorf("%v != %v", ranges, twoShards)
+	}
+	if len(client.inputs) != 2 {
+		t.Fatalf("%v != 2", len(client.inputs))
+	}
+	if aws.StringValue(client.inputs[0].StreamName) != "foo" {
+		t.Errorf("%v != foo", aws.StringValue(client.inputs[0].StreamName))
+	}
+	if client.inputs[1].StreamName != nil || aws.StringValue(client.inputs[1].NextToken) != "next" {
+		t.Errorf("%v, %v != nil, next", client.inputs[1].StreamName, aws.StringValue(client.inputs[1].NextToken))
+	}
+}
+
+func TestShardMapInterval(t *testing.T) {
+	t.Parallel()
+	config := Config{BufferSize: 10, BatchSize: 10, Logger: discardLogger, ShardMapInterval: time.Minute}
+	if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+		t.Error("err == nil")
+	}
+
+	client := newListingClient()
+	p, err := New(client, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := p.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b.shards.mu.Lock()
+	if len(b.shards.shards) != 2 {
+		t.Errorf("%v != 2", len(b.shards.shards))
+	}
+	b.shards.mu.Unlock()
+	b.Stop()
+
+	// Start fails if the shards can’t be listed
+	client.err = errors.New("Oh Noes!")
+	if err := b.Start(); err == nil {
+		t.Error("err == nil")
+	}
+}
@@ -0,0 +1,285 @@
+package batchproducer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// spillSegmentSize is the size beyond which a spillQueue starts a new segment file, so that the
+// disk space of records that have been read back can be reclaimed. It’s a var so that tests can
+// make it smaller.
+var spillSegmentSize int64 = 64 * 1024 * 1024
+
+// spillSuffix is the suffix of the names of segment files.
+const spillSuffix = ".spill"
+
+// spillQueue is the disk queue used by Config.SpillDir. Records are appended to segment files whose
+// names are numbers, and read back in the same order starting with the oldest segment, which is
+// deleted once it has been read completely and a newer one has been started. Each record is
+// written as:
+//
+//	8 bytes  its deadline, as nanoseconds since the Unix epoch, or 0 if it has none
+//	4 bytes  n, the length of its partition key
+//	n bytes  its partition key
+//	4 bytes  m, the length of its explicit hash key
+//	m bytes  its explicit hash key
+//	4 bytes  l, the length of its data
+//	l bytes  its data
+//
+// with the lengths big-endian. Segments left behind by an earlier process are read first, so
+// records spilled before a crash aren’t lost.
+type spillQueue struct {
+	dir string
+
+	// segments are the numbers of the segment files, oldest first. The last one is being written
+	// to, through w, and is wSize bytes long, unless w is nil because the queue has been closed.
+	// The first one is being read, through r, if r isn’t nil, and has been read up to rOffset, so
+	// that it can be opened there again once closed.
+	segments []int
+	w        *os.File
+	wSize    int64
+	r        *bufio.Reader
+	rFile    *os.File
+	rOffset  int64
+
+	// n is the number of records that have been written but not read yet. It is only modified
+	// while mu is held, but can be read atomically at any time.
+	n  int64
+	mu sync.Mutex
+}
+
+// openSpillQueue opens the spillQueue in dir, creating dir if need be.
+func openSpillQueue(dir string) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &spillQueue{dir: dir}
+	for _, name := range names {
+		segment, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), spillSuffix))
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		q.segments = append(q.segments, segment)
+	}
+	sort.Ints(q.segments)
+
+	for _, segment := range q.segments {
+		n, err := countSpilledRecords(q.path(segment))
+		if err != nil {
+			return nil, err
+		}
+		q.n += n
+	}
+
+	// Never append to an old segment, since it might end with a record that was only partly
+	// written before a crash.
+	next := 1
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1] + 1
+	}
+	if err := q.startSegment(next); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *spillQueue) path(segment int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%010d%v", segment, spillSuffix))
+}
+
+// startSegment starts writing to a new segment.
+func (q *spillQueue) startSegment(segment int) error {
+	w, err := os.OpenFile(q.path(segment), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if q.w != nil {
+		q.w.Close()
+	}
+	q.w, q.wSize = w, 0
+	q.segments = append(q.segments, segment)
+	return nil
+}
+
+// close closes the segment files, for when the Producer stops, so that one that is stopped for
+// good doesn’t keep them open. The queue can still be used afterwards, e.g. by Flush or if the
+// Producer is started again: push carries on in a new segment, as it would after the queue was
+// reopened, and pop opens the oldest one again where it left off.
+func (q *spillQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var err error
+	if q.w != nil {
+		err = q.w.Close()
+		q.w = nil
+	}
+	if q.rFile != nil {
+		if rerr := q.rFile.Close(); err == nil {
+			err = rerr
+		}
+		q.r, q.rFile = nil, nil
+	}
+	return err
+}
+
+// len returns the number of records waiting to be read. It is safe to call at any time.
+func (q *spillQueue) len() int {
+	return int(atomic.LoadInt64(&q.n))
+}
+
+// push appends record to the queue.
+func (q *spillQueue) push(record batchRecord) error {
+	buf := appendSpilledRecord(nil, record)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.w == nil || q.wSize >= spillSegmentSize {
+		if err := q.startSegment(q.segments[len(q.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+	// A single write, so that a record is never seen partly written by pop
+	n, err := q.w.Write(buf)
+	q.wSize += int64(n)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&q.n, 1)
+	return nil
+}
+
+// appendSpilledRecord appends record to buf in the format described at spillQueue.
+func appendSpilledRecord(buf []byte, record batchRecord) []byte {
+	var deadline int64
+	if !record.deadline.IsZero() {
+		deadline = record.deadline.UnixNano()
+	}
+	if buf == nil {
+		buf = make([]byte, 0, spilledSize(record))
+	}
+	buf = append(buf, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(deadline))
+	buf = appendSpillField(buf, []byte(record.partitionKey))
+	buf = appendSpillField(buf, []byte(record.explicitHashKey))
+	return appendSpillField(buf, record.data)
+}
+
+// spilledSize returns the number of bytes that record takes up in the format described at
+// spillQueue.
+func spilledSize(record batchRecord) int {
+	return 8 + 4 + len(record.partitionKey) + 4 + len(record.explicitHashKey) + 4 + len(record.data)
+}
+
+func appendSpillField(buf, field []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	return append(append(buf, length[:]...), field...)
+}
+
+// pop removes the oldest record from the queue and returns it. It returns false if the queue is
+// empty.
+func (q *spillQueue) pop() (batchRecord, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.n > 0 {
+		if q.r == nil {
+			f, err := os.Open(q.path(q.segments[0]))
+			if err != nil {
+				return batchRecord{}, false, err
+			}
+			if _, err := f.Seek(q.rOffset, io.SeekStart); err != nil {
+				f.Close()
+				return batchRecord{}, false, err
+			}
+			q.r, q.rFile = bufio.NewReader(f), f
+		}
+
+		record, err := readSpilledRecord(q.r)
+		if err == nil {
+			q.rOffset += int64(spilledSize(record))
+			atomic.AddInt64(&q.n, -1)
+			return record, true, nil
+		}
+		if len(q.segments) == 1 || (err != io.EOF && err != io.ErrUnexpectedEOF) {
+			return batchRecord{}, false, err
+		}
+
+		// We’ve read all of an old segment; a partial record at the end of it was written by a
+		// process that crashed, and wasn’t counted.
+		q.rFile.Close()
+		q.r, q.rFile, q.rOffset = nil, nil, 0
+		if err := os.Remove(q.path(q.segments[0])); err != nil {
+			return batchRecord{}, false, err
+		}
+		q.segments = q.segments[1:]
+	}
+	return batchRecord{}, false, nil
+}
+
+// readSpilledRecord reads a record written by push. It returns io.EOF if there are no more, or
+// io.ErrUnexpectedEOF if the last one is incomplete.
+func readSpilledRecord(r *bufio.Reader) (batchRecord, error) {
+	var deadline [8]byte
+	if _, err := io.ReadFull(r, deadline[:]); err != nil {
+		return batchRecord{}, err
+	}
+
+	var fields [3][]byte
+	for i := range fields {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return batchRecord{}, io.ErrUnexpectedEOF
+		}
+		fields[i] = make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(r, fields[i]); err != nil {
+			return batchRecord{}, io.ErrUnexpectedEOF
+		}
+	}
+
+	record := batchRecord{
+		partitionKey:    string(fields[0]),
+		explicitHashKey: string(fields[1]),
+		data:            fields[2],
+	}
+	if ns := int64(binary.BigEndian.Uint64(deadline[:])); ns != 0 {
+		record.deadline = time.Unix(0, ns)
+	}
+	return record, nil
+}
+
+// countSpilledRecords returns the number of complete records in the segment file name.
+func countSpilledRecords(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n int64
+	r := bufio.NewReader(f)
+	for {
+		if _, err := readSpilledRecord(r); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,277 @@
+package batchproducer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSpillDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "batchproducer")
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	return dir
+}
+
+func TestSpillQueue(t *testing.T) {
+	// Not parallel because it changes spillSegmentSize
+	defer func(size int64) { spillSegmentSize = size }(spillSegmentSize)
+	spillSegmentSize = 100
+
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := openSpillQueue(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	deadline := time.Unix(0, 1234567890)
+	for i := 0; i < 20; i++ {
+		record := batchRecord{data: []byte(fmt.Sprintf("record %v", i)), partitionKey: "foo"}
+		if i == 3 {
+			record.explicitHashKey = "42"
+			record.deadline = deadline
+		}
+		if err := q.push(record); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	if q.len() != 20 {
+		t.Errorf("%v != 20", q.len())
+	}
+	if len(q.segments) < 2 {
+		t.Errorf("%v < 2", len(q.segments))
+	}
+
+	for i := 0; i < 20; i++ {
+		record, ok, err := q.pop()
+		if !ok || err != nil {
+			t.Fatalf("%v, %v != true, nil", ok, err)
+		}
+		if expected := fmt.Sprintf("record %v", i); string(record.data) != expected {
+			t.Errorf("%q != %v", record.data, expected)
+		}
+		if i == 3 && (record.explicitHashKey != "42" || !record.deadline.Equal(deadline)) {
+			t.Errorf("%v, %v != 42, %v", record.explicitHashKey, record.deadline, deadline)
+		}
+		if i != 3 && !record.deadline.IsZero() {
+			t.Errorf("%v is not zero", record.deadline)
+		}
+	}
+	if _, ok, err := q.pop(); ok || err != nil {
+		t.Errorf("%v, %v != false, nil", ok, err)
+	}
+
+	// The segments that have been read have been deleted
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+	if len(names) != 1 {
+		t.Errorf("%v != 1", len(names))
+	}
+}
+
+func TestSpillQueueReopen(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := openSpillQueue(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	for _, data := range []string{"foo", "bar", "baz"} {
+		if err := q.push(batchRecord{data: []byte(data), partitionKey: "foo"}); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	if _, _, err := q.pop(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// Simulate a crash partway through writing a record
+	q.w.Write([]byte{0, 0, 0})
+	q.w.Close()
+
+	q, err = openSpillQueue(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	// The record that had been read is read again, since we can’t know whether it was sent
+	if q.len() != 3 {
+		t.Errorf("%v != 3", q.len())
+	}
+	if err := q.push(batchRecord{data: []byte("qux"), partitionKey: "foo"}); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	for _, expected := range []string{"foo", "bar", "baz", "qux"} {
+		record, ok, err := q.pop()
+		if !ok || err != nil {
+			t.Fatalf("%v, %v != true, nil", ok, err)
+		}
+		if string(record.data) != expected {
+			t.Errorf("%q != %v", record.data, expected)
+		}
+	}
+}
+
+func TestSpillQueueClose(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := openSpillQueue(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	for _, data := range []string{"foo", "bar", "baz"} {
+		if err := q.push(batchRecord{data: []byte(data), partitionKey: "foo"}); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	if _, _, err := q.pop(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if err := q.close(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if q.w != nil || q.rFile != nil {
+		t.Errorf("%v, %v != nil, nil", q.w, q.rFile)
+	}
+
+	// It carries on where it left off, writing to a new segment
+	if err := q.push(batchRecord{data: []byte("qux"), partitionKey: "foo"}); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if len(q.segments) != 2 {
+		t.Errorf("%v != 2", len(q.segments))
+	}
+	for _, expected := range []string{"bar", "baz", "qux"} {
+		record, ok, err := q.pop()
+		if !ok || err != nil {
+			t.Fatalf("%v, %v != true, nil", ok, err)
+		}
+		if string(record.data) != expected {
+			t.Errorf("%q != %v", record.data, expected)
+		}
+	}
+	q.close()
+}
+
+func TestSpillDirClosedOnStop(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultConfig()
+	config.Logger = discardLogger
+	config.SpillDir = dir
+	producer, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := producer.(*batchProducer)
+	b.Start()
+	b.Stop()
+
+	if b.spill.w != nil {
+		t.Errorf("%v != nil", b.spill.w)
+	}
+}
+
+func TestSpillDir(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultConfig()
+	config.BufferSize = 10
+	config.BatchSize = 10
+	config.Logger = discardLogger
+	config.SpillDir = dir
+	producer, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := producer.(*batchProducer)
+
+	// set running to true so Add will succeed
+	b.running = true
+	for i := 0; i < 50; i++ {
+		if err := b.Add([]byte(strconv.Itoa(i)), "foo"); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	if b.spill.len() != 40 {
+		t.Errorf("%v != 40", b.spill.len())
+	}
+	if b.bufferLen() != 50 {
+		t.Errorf("%v != 50", b.bufferLen())
+	}
+
+	// Records with callbacks are never spilled
+	if err := b.AddWithCallback([]byte("bar"), "foo", func(RecordResult) {}); err == nil {
+		t.Error("err == nil")
+	}
+	b.running = false
+
+	var i int
+	for b.bufferLen() > 0 {
+		for _, record := range b.takeRecordsFromBuffer(10) {
+			if string(record.data) != strconv.Itoa(i) {
+				t.Errorf("%q != %v", record.data, i)
+			}
+			i++
+		}
+	}
+	if i != 50 {
+		t.Errorf("%v != 50", i)
+	}
+}
+
+func TestTryAddWithSpillDir(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultConfig()
+	config.BufferSize = 10
+	config.BatchSize = 10
+	config.Logger = discardLogger
+	config.SpillDir = dir
+	producer, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := producer.(*batchProducer)
+
+	// set running to true so TryAdd will succeed
+	b.running = true
+	for i := 0; i < 20; i++ {
+		if !b.TryAdd([]byte(strconv.Itoa(i)), "foo") {
+			t.Fatalf("TryAdd failed with %v records buffered", b.bufferLen())
+		}
+	}
+	b.running = false
+
+	// The records that didn’t fit were spilled rather than rejected
+	if b.spill.len() != 10 {
+		t.Errorf("%v != 10", b.spill.len())
+	}
+	if b.bufferLen() != 20 {
+		t.Errorf("%v != 20", b.bufferLen())
+	}
+}
+
+func TestSpillDirRequiresBestEffortOrdering(t *testing.T) {
+	t.Parallel()
+	config := NewDefaultConfig()
+	config.SpillDir = "/nonexistent"
+	config.Ordering = OrderingPerPartitionKey
+	if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+		t.Error("err == nil")
+	}
+}
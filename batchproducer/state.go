@@ -0,0 +1,77 @@
+package batchproducer
+
+// ProducerState describes the overall state of a Producer; see Producer.State.
+type ProducerState int
+
+const (
+	// StateStopped means the Producer has not been started, or has been stopped.
+	StateStopped ProducerState = iota
+
+	// StateStarting means Start has been called but the Producer is not yet running.
+	StateStarting
+
+	// StateRunning means the Producer is running and healthy.
+	StateRunning
+
+	// StateDegraded means the Producer is running but the most recent request to Kinesis failed,
+	// or the buffer is full.
+	StateDegraded
+
+	// StateCircuitOpen means the Producer is running but has stopped sending batches for now
+	// because the circuit breaker is open. See Config.CircuitBreakerThreshold.
+	StateCircuitOpen
+
+	// StatePaused means the Producer is running but isn’t sending batches because Pause has been
+	// called.
+	StatePaused
+)
+
+func (s ProducerState) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateDegraded:
+		return "degraded"
+	case StateCircuitOpen:
+		return "circuit open"
+	case StatePaused:
+		return "paused"
+	default:
+		return "unknown"
+	}
+}
+
+// from/for interface Producer
+func (b *batchProducer) State() ProducerState {
+	b.stateMu.RLock()
+	defer b.stateMu.RUnlock()
+
+	switch {
+	case b.lifecycle != StateRunning:
+		return b.lifecycle
+	case b.isPaused():
+		return StatePaused
+	case b.circuit != circuitClosed:
+		return StateCircuitOpen
+	case b.consecutiveErrors > 0 || b.isBufferFull():
+		return StateDegraded
+	default:
+		return StateRunning
+	}
+}
+
+func (b *batchProducer) setLifecycle(state ProducerState) {
+	b.stateMu.Lock()
+	b.lifecycle = state
+	b.stateMu.Unlock()
+}
+
+func (b *batchProducer) setCircuit(state circuitState) {
+	b.stateMu.Lock()
+	b.circuit = state
+	b.stateMu.Unlock()
+}
@@ -0,0 +1,54 @@
+package batchproducer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	if b.State() != StateStopped {
+		t.Errorf("%v != %v", b.State(), StateStopped)
+	}
+
+	b.Start()
+	if b.State() != StateRunning {
+		t.Errorf("%v != %v", b.State(), StateRunning)
+	}
+
+	b.Stop()
+	if b.State() != StateStopped {
+		t.Errorf("%v != %v", b.State(), StateStopped)
+	}
+}
+
+func TestStateDegraded(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 10)
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(10, 0)
+	if !waitUntil(func() bool { return b.State() == StateDegraded }) {
+		t.Errorf("%v != %v", b.State(), StateDegraded)
+	}
+}
+
+func TestStateCircuitOpen(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 10)
+	b.clock = newFakeClock()
+	b.config.CircuitBreakerThreshold = 2
+	b.config.CircuitBreakerCooldown = 1 * time.Minute
+	b.Start()
+	defer b.Stop()
+
+	b.addRecordsAndWait(10, 0)
+	if !waitUntil(func() bool { return b.State() == StateCircuitOpen }) {
+		t.Errorf("%v != %v", b.State(), StateCircuitOpen)
+	}
+}
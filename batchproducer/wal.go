@@ -0,0 +1,258 @@
+package batchproducer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// walSegmentSize is the size beyond which a writeAheadLog starts a new segment file, so that old
+// segments can be deleted once all the records in them are complete. It’s a var so that tests can
+// make it smaller.
+var walSegmentSize int64 = 64 * 1024 * 1024
+
+// walSuffix is the suffix of the names of segment files.
+const walSuffix = ".wal"
+
+// The kinds of entry in a writeAheadLog.
+const (
+	walAdded    byte = 'A'
+	walComplete byte = 'C'
+)
+
+// writeAheadLog is the log used by Config.WALDir. Like a spillQueue it appends to segment files
+// whose names are numbers, each entry being:
+//
+//	1 byte   its kind, walAdded or walComplete
+//	8 bytes  the ID of the record, big-endian
+//
+// followed, for walAdded, by the record in the format described at spillQueue. Records are given
+// increasing IDs as they are added, and marked complete once they have been written or dropped.
+// A segment is deleted once every record added in it, and in all older segments, is complete; the
+// older ones have to go first since a segment may hold the walComplete entries of records added
+// in them.
+type writeAheadLog struct {
+	dir string
+
+	// segments are the numbers of the segment files, oldest first. The last one is being written
+	// to, through w, and is wSize bytes long, unless w is nil because the log has been closed.
+	segments []int
+	w        *os.File
+	wSize    int64
+
+	// incomplete is the number of records added in each segment that aren’t complete yet.
+	incomplete map[int]int
+	nextID     uint64
+
+	// replay holds the records left incomplete by an earlier process, oldest first, until they
+	// are taken by takeReplay.
+	replay []batchRecord
+
+	mu sync.Mutex
+}
+
+// openWriteAheadLog opens the writeAheadLog in dir, creating dir if need be, and reads the records
+// left incomplete by an earlier process.
+func openWriteAheadLog(dir string) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &writeAheadLog{dir: dir, incomplete: map[int]int{}, nextID: 1}
+	for _, name := range names {
+		segment, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), walSuffix))
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		l.segments = append(l.segments, segment)
+	}
+	sort.Ints(l.segments)
+
+	added := map[uint64]batchRecord{}
+	for _, segment := range l.segments {
+		if err := l.readSegment(segment, added); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range added {
+		l.replay = append(l.replay, record)
+		l.incomplete[record.walSegment]++
+	}
+	sort.Slice(l.replay, func(i, j int) bool { return l.replay[i].walID < l.replay[j].walID })
+
+	// Never append to an old segment, since it might end with an entry that was only partly
+	// written before a crash.
+	next := 1
+	if len(l.segments) > 0 {
+		next = l.segments[len(l.segments)-1] + 1
+	}
+	if err := l.startSegment(next); err != nil {
+		return nil, err
+	}
+	if err := l.deleteCompleteSegments(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// readSegment reads the entries in segment, adding the records added in it to added and removing
+// the ones completed in it.
+func (l *writeAheadLog) readSegment(segment int, added map[uint64]batchRecord) error {
+	f, err := os.Open(l.path(segment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var header [9]byte
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A partial entry at the end was written by a process that crashed
+			return nil
+		} else if err != nil {
+			return err
+		}
+		id := binary.BigEndian.Uint64(header[1:])
+		if id >= l.nextID {
+			l.nextID = id + 1
+		}
+
+		switch header[0] {
+		case walAdded:
+			record, err := readSpilledRecord(r)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			record.walSegment, record.walID = segment, id
+			added[id] = record
+		case walComplete:
+			delete(added, id)
+		default:
+			return fmt.Errorf("%v is corrupt", l.path(segment))
+		}
+	}
+}
+
+func (l *writeAheadLog) path(segment int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%010d%v", segment, walSuffix))
+}
+
+// startSegment starts writing to a new segment.
+func (l *writeAheadLog) startSegment(segment int) error {
+	w, err := os.OpenFile(l.path(segment), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if l.w != nil {
+		l.w.Close()
+	}
+	l.w, l.wSize = w, 0
+	l.segments = append(l.segments, segment)
+	return nil
+}
+
+// takeReplay returns the records left incomplete by an earlier process, the first time it is
+// called, and nil after that.
+func (l *writeAheadLog) takeReplay() []batchRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	replay := l.replay
+	l.replay = nil
+	return replay
+}
+
+// add logs record, setting its walSegment and walID. It must be called before record is buffered.
+func (l *writeAheadLog) add(record *batchRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil || l.wSize >= walSegmentSize {
+		if err := l.startSegment(l.segments[len(l.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 9, 9+spilledSize(*record))
+	buf[0] = walAdded
+	binary.BigEndian.PutUint64(buf[1:], l.nextID)
+	buf = appendSpilledRecord(buf, *record)
+	if err := l.write(buf); err != nil {
+		return err
+	}
+	record.walSegment, record.walID = l.segments[len(l.segments)-1], l.nextID
+	l.nextID++
+	l.incomplete[record.walSegment]++
+	return nil
+}
+
+// complete marks record, which must have been logged by add, as complete, and deletes any
+// segments that are no longer needed.
+func (l *writeAheadLog) complete(record batchRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf := make([]byte, 9)
+	buf[0] = walComplete
+	binary.BigEndian.PutUint64(buf[1:], record.walID)
+	if err := l.write(buf); err != nil {
+		return err
+	}
+	l.incomplete[record.walSegment]--
+	return l.deleteCompleteSegments()
+}
+
+// write appends buf to the current segment in a single write, so that an entry is only ever
+// partly written if the process crashes. If the log has been closed it starts a new segment first.
+func (l *writeAheadLog) write(buf []byte) error {
+	if l.w == nil {
+		if err := l.startSegment(l.segments[len(l.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(buf)
+	l.wSize += int64(n)
+	return err
+}
+
+// close syncs the current segment to disk and closes it, for when the Producer stops, so that the
+// entries written last are kept even if the machine goes down, and one that is stopped for good
+// doesn’t keep the file open. The log can still be used afterwards, e.g. by Flush or if the
+// Producer is started again; it carries on in a new segment, as it would after being reopened.
+func (l *writeAheadLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	err := l.w.Sync()
+	if cerr := l.w.Close(); err == nil {
+		err = cerr
+	}
+	l.w = nil
+	return err
+}
+
+// deleteCompleteSegments deletes the oldest segments, other than the current one, as long as all
+// the records added in them are complete.
+func (l *writeAheadLog) deleteCompleteSegments() error {
+	for len(l.segments) > 1 && l.incomplete[l.segments[0]] == 0 {
+		if err := os.Remove(l.path(l.segments[0])); err != nil {
+			return err
+		}
+		delete(l.incomplete, l.segments[0])
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
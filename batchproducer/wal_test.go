@@ -0,0 +1,265 @@
+package batchproducer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	// Not parallel because it changes walSegmentSize
+	defer func(size int64) { walSegmentSize = size }(walSegmentSize)
+	walSegmentSize = 100
+
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	deadline := time.Unix(0, 1234567890)
+	records := make([]batchRecord, 20)
+	for i := range records {
+		records[i] = batchRecord{data: []byte(fmt.Sprintf("record %v", i)), partitionKey: "foo"}
+		if i == 3 {
+			records[i].explicitHashKey = "42"
+			records[i].deadline = deadline
+		}
+		if err := l.add(&records[i]); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	if len(l.segments) < 3 {
+		t.Errorf("%v < 3", len(l.segments))
+	}
+
+	// Complete all but 3 and 15, as if they were still in the buffer when the process crashed
+	for i, record := range records {
+		if i != 3 && i != 15 {
+			if err := l.complete(record); err != nil {
+				t.Fatalf("%v != nil", err)
+			}
+		}
+	}
+	// Segments before the one record 3 was added in have been deleted
+	if l.segments[0] != records[3].walSegment {
+		t.Errorf("%v != %v", l.segments[0], records[3].walSegment)
+	}
+	l.w.Close()
+
+	l, err = openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	replay := l.takeReplay()
+	if len(replay) != 2 {
+		t.Fatalf("%v != 2", len(replay))
+	}
+	if string(replay[0].data) != "record 3" || replay[0].explicitHashKey != "42" || !replay[0].deadline.Equal(deadline) {
+		t.Errorf("%q, %v, %v != record 3, 42, %v", replay[0].data, replay[0].explicitHashKey, replay[0].deadline, deadline)
+	}
+	if string(replay[1].data) != "record 15" {
+		t.Errorf("%q != record 15", replay[1].data)
+	}
+	if replay := l.takeReplay(); replay != nil {
+		t.Errorf("%v != nil", replay)
+	}
+
+	// New records get new IDs, and once the replayed ones are complete only the current segment
+	// is left
+	record := batchRecord{data: []byte("new"), partitionKey: "foo"}
+	if err := l.add(&record); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if record.walID <= records[19].walID {
+		t.Errorf("%v <= %v", record.walID, records[19].walID)
+	}
+	for _, r := range append(replay, record) {
+		if err := l.complete(r); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if len(names) != 1 {
+		t.Errorf("%v != 1", len(names))
+	}
+}
+
+func TestWriteAheadLogPartialEntry(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	record := batchRecord{data: []byte("foo"), partitionKey: "foo"}
+	if err := l.add(&record); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	// Simulate a crash partway through writing an entry
+	l.w.Write([]byte{walAdded, 0, 0})
+	l.w.Close()
+
+	l, err = openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if replay := l.takeReplay(); len(replay) != 1 || string(replay[0].data) != "foo" {
+		t.Errorf("%v doesn’t hold just foo", replay)
+	}
+}
+
+func TestWALDir(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultConfig()
+	config.BufferSize = 100
+	config.BatchSize = 10
+	config.Logger = discardLogger
+	config.WALDir = dir
+	producer, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := producer.(*batchProducer)
+
+	// set running to true so Add will succeed, and never send anything, as if the process
+	// crashed with the records in the buffer
+	b.running = true
+	for i := 0; i < 15; i++ {
+		if err := b.Add([]byte(strconv.Itoa(i)), "foo"); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	b.running = false
+	b.wal.w.Close()
+
+	client := &mockBatchingClient{}
+	producer, err = New(client, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b = producer.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if err := b.Add([]byte("15"), "foo"); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if _, remaining, _ := b.Flush(time.Second, false); remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+
+	// Everything was written, so there’s nothing left to replay
+	l, err := openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if replay := l.takeReplay(); len(replay) != 0 {
+		t.Errorf("%v != 0", len(replay))
+	}
+}
+
+func TestTryAddWithWALDir(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultConfig()
+	config.BufferSize = 10
+	config.BatchSize = 10
+	config.Logger = discardLogger
+	config.WALDir = dir
+	producer, err := New(&mockBatchingClient{}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := producer.(*batchProducer)
+
+	// set running to true so TryAdd will succeed, and never send anything, as if the process
+	// crashed with the records in the buffer
+	b.running = true
+	for i := 0; i < 15; i++ {
+		if added := b.TryAdd([]byte(strconv.Itoa(i)), "foo"); added != (i < 10) {
+			t.Errorf("%v: %v != %v", i, added, i < 10)
+		}
+	}
+	b.running = false
+	b.wal.w.Close()
+
+	// Only the records that were added were logged
+	l, err := openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if replay := l.takeReplay(); len(replay) != 10 {
+		t.Errorf("%v != 10", len(replay))
+	}
+}
+
+func TestWALDirAfterStop(t *testing.T) {
+	t.Parallel()
+	dir := newSpillDir(t)
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultConfig()
+	config.BufferSize = 100
+	config.BatchSize = 10
+	config.Logger = discardLogger
+	config.WALDir = dir
+	// Nothing is written, so the records are all still in the buffer once it has stopped
+	producer, err := New(&mockBatchingClient{shouldErr: true}, "foo", config)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	b := producer.(*batchProducer)
+	if err := b.Start(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := b.Add([]byte(strconv.Itoa(i)), "foo"); err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+	}
+	if err := b.Stop(); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if b.wal.w != nil {
+		t.Errorf("%v != nil", b.wal.w)
+	}
+
+	// Another process can pick up where it left off
+	l, err := openWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	replay := l.takeReplay()
+	if len(replay) != 5 {
+		t.Fatalf("%v != 5", len(replay))
+	}
+	for i, record := range replay {
+		if string(record.data) != strconv.Itoa(i) {
+			t.Errorf("%q != %v", record.data, i)
+		}
+	}
+	l.close()
+}
+
+func TestWALDirCantBeUsedWithSpillDir(t *testing.T) {
+	t.Parallel()
+	config := NewDefaultConfig()
+	config.WALDir = "/nonexistent"
+	config.SpillDir = "/nonexistent"
+	if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+		t.Error("err == nil")
+	}
+}
@@ -0,0 +1,118 @@
+package batchproducer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// NewWriter returns a Writer that adds each line written to it to p as a separate record, which is
+// handy for sending the output of a log.Logger, for example, to Kinesis. partitionKeyFunc is called
+// with each line to determine its partition key. A line that hasn’t been terminated by a newline
+// yet is buffered until it is, or until Close is called. The newlines themselves are not included
+// in the records, and empty lines are skipped.
+//
+// If Add returns an error, Write returns that error along with the number of bytes that were
+// written before the line that couldn’t be added.
+func NewWriter(p Producer, partitionKeyFunc func(line []byte) string) io.WriteCloser {
+	return &writer{
+		producer:         p,
+		partitionKeyFunc: partitionKeyFunc,
+	}
+}
+
+type writer struct {
+	producer         Producer
+	partitionKeyFunc func(line []byte) string
+	partial          []byte
+	mu               sync.Mutex
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	written := 0
+	for {
+		i := bytes.IndexByte(p[written:], '\n')
+		if i < 0 {
+			break
+		}
+
+		// The line is copied (by append) because the Producer will hang on to it, whereas the
+		// caller is allowed to reuse p once Write returns.
+		line := append(w.partial, p[written:written+i]...)
+		if err := w.add(line); err != nil {
+			return written, err
+		}
+		w.partial = nil
+		written += i + 1
+	}
+
+	w.partial = append(w.partial, p[written:]...)
+	return len(p), nil
+}
+
+// Close adds the buffered partial line, if there is one. It does not stop the Producer.
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line := w.partial
+	w.partial = nil
+	return w.add(line)
+}
+
+func (w *writer) add(line []byte) error {
+	if len(line) == 0 {
+		return nil
+	}
+	return w.producer.Add(line, w.partitionKeyFunc(line))
+}
+
+// ProduceFrames reads length-delimited frames from r, each a 4-byte big-endian length followed by
+// that many bytes, and adds each one to p as a separate record, with the partition key returned by
+// partitionKeyFunc. It is the binary counterpart of NewWriter. Empty frames are skipped. It returns
+// nil once r is exhausted at the end of a frame, ctx.Err() if ctx is done (which is checked between
+// frames, so a Read that blocks isn’t interrupted), an error if r ends part way through a frame or
+// a frame is larger than MaxRecordSize, or the error returned by r or by Add.
+func ProduceFrames(ctx context.Context, p Producer, r io.Reader, partitionKeyFunc func(frame []byte) string) error {
+	var length [4]byte
+	for frames := 0; ; frames++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// io.ReadFull copes with readers that return less than was asked for
+		if n, err := io.ReadFull(r, length[:]); err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated length of frame %v: got %v of 4 bytes", frames, n)
+		} else if err != nil {
+			return err
+		}
+
+		size := binary.BigEndian.Uint32(length[:])
+		if size > MaxRecordSize {
+			return fmt.Errorf("frame %v is %v bytes, which is larger than MaxRecordSize", frames, size)
+		}
+		if size == 0 {
+			continue
+		}
+
+		// A new slice each time, since the Producer hangs on to it
+		frame := make([]byte, size)
+		if n, err := io.ReadFull(r, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated frame %v: got %v of %v bytes", frames, n, size)
+		} else if err != nil {
+			return err
+		}
+
+		if err := p.Add(frame, partitionKeyFunc(frame)); err != nil {
+			return err
+		}
+	}
+}
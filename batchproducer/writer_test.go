@@ -0,0 +1,191 @@
+package batchproducer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+
+	w := NewWriter(b, func(line []byte) string { return string(line[:1]) })
+
+	buf := []byte("alpha\nbra")
+	fmt.Fprintf(w, "%s", buf)
+	// Overwrite buf to make sure the records don’t share memory with it
+	copy(buf, "XXXXXXXXX")
+	fmt.Fprintf(w, "vo\n\ncharlie\ndel")
+
+	if b.records.len() != 3 {
+		t.Fatalf("%v != 3", b.records.len())
+	}
+
+	err := w.Close()
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	expected := []string{"alpha", "bravo", "charlie", "del"}
+	for _, line := range expected {
+		record, _ := b.records.pop()
+		if string(record.data) != line {
+			t.Errorf("%s != %s", record.data, line)
+		}
+		if record.partitionKey != line[:1] {
+			t.Errorf("%s != %s", record.partitionKey, line[:1])
+		}
+	}
+}
+
+func TestWriterWithLogger(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.running = true
+	defer func() { b.running = false }()
+
+	logger := log.New(NewWriter(b, func([]byte) string { return "foo" }), "", 0)
+	logger.Print("The cheese is old and moldy")
+	logger.Print("where is the bathroom?")
+
+	if b.records.len() != 2 {
+		t.Errorf("%v != 2", b.records.len())
+	}
+}
+
+func TestWriterWhenAddFails(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// b is not running so Add will fail
+	w := NewWriter(b, func([]byte) string { return "foo" })
+
+	n, err := w.Write([]byte("alpha\nbravo\n"))
+	if err == nil {
+		t.Errorf("%v == nil", err)
+	}
+	if n != 0 {
+		t.Errorf("%v != 0", n)
+	}
+}
+
+// frames returns data as length-delimited frames, as read by ProduceFrames.
+func frames(data ...string) []byte {
+	var buf bytes.Buffer
+	for _, d := range data {
+		binary.Write(&buf, binary.BigEndian, uint32(len(d)))
+		buf.WriteString(d)
+	}
+	return buf.Bytes()
+}
+
+func TestProduceFrames(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// set running to true so Add will succeed
+	b.running = true
+	defer func() { b.running = false }()
+
+	// Reading a byte at a time exercises partial reads
+	r := iotest.OneByteReader(bytes.NewReader(frames("alpha", "", "bravo\x00\n", "charlie")))
+	err := ProduceFrames(context.Background(), b, r, func(frame []byte) string { return string(frame[:1]) })
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	expected := []string{"alpha", "bravo\x00\n", "charlie"}
+	if b.records.len() != len(expected) {
+		t.Fatalf("%v != %v", b.records.len(), len(expected))
+	}
+	for _, frame := range expected {
+		record, _ := b.records.pop()
+		if string(record.data) != frame {
+			t.Errorf("%q != %q", record.data, frame)
+		}
+		if record.partitionKey != frame[:1] {
+			t.Errorf("%s != %s", record.partitionKey, frame[:1])
+		}
+	}
+}
+
+func TestProduceFramesTruncated(t *testing.T) {
+	t.Parallel()
+
+	whole := frames("alpha", "bravo")
+	for _, input := range [][]byte{
+		// Part way through the second length
+		whole[:11],
+		// Part way through the second frame
+		whole[:len(whole)-1],
+		// Just the second length
+		whole[:13],
+	} {
+		b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+		b.running = true
+		err := ProduceFrames(context.Background(), b, bytes.NewReader(input), func([]byte) string { return "foo" })
+		b.running = false
+		if err == nil {
+			t.Errorf("%v bytes: err == nil", len(input))
+		}
+		// The first frame was complete, so it was added
+		if b.records.len() != 1 {
+			t.Errorf("%v bytes: %v != 1", len(input), b.records.len())
+		}
+	}
+}
+
+func TestProduceFramesTooLarge(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.running = true
+	defer func() { b.running = false }()
+
+	input := []byte{0xff, 0xff, 0xff, 0xff}
+	if err := ProduceFrames(context.Background(), b, bytes.NewReader(input), func([]byte) string { return "foo" }); err == nil {
+		t.Error("err == nil")
+	}
+}
+
+func TestProduceFramesWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+	b.running = true
+	defer func() { b.running = false }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ProduceFrames(ctx, b, bytes.NewReader(frames("alpha")), func([]byte) string { return "foo" })
+	if err != context.Canceled {
+		t.Errorf("%v != %v", err, context.Canceled)
+	}
+	if b.records.len() != 0 {
+		t.Errorf("%v != 0", b.records.len())
+	}
+}
+
+func TestProduceFramesWhenAddFails(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 10)
+
+	// b is not running so Add will fail
+	if err := ProduceFrames(context.Background(), b, bytes.NewReader(frames("alpha")), func([]byte) string { return "foo" }); err == nil {
+		t.Error("err == nil")
+	}
+}
@@ -0,0 +1,72 @@
+// Package consumer provides helpers for reading from a Kinesis stream with an enhanced fan-out
+// consumer, which receives records pushed over HTTP/2 via SubscribeToShard rather than polling
+// with GetRecords. Each enhanced fan-out consumer gets its own 2 MiB/sec of read throughput per
+// shard and typically sees records within 70ms of them being written.
+package consumer
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Client is the subset of *kinesis.Kinesis used by this package, to ease mocking.
+type Client interface {
+	RegisterStreamConsumer(*kinesis.RegisterStreamConsumerInput) (*kinesis.RegisterStreamConsumerOutput, error)
+	DescribeStreamConsumer(*kinesis.DescribeStreamConsumerInput) (*kinesis.DescribeStreamConsumerOutput, error)
+	SubscribeToShardWithContext(aws.Context, *kinesis.SubscribeToShardInput, ...request.Option) (*kinesis.SubscribeToShardOutput, error)
+}
+
+// registrationPollInterval is how often RegisterConsumer checks whether a new consumer has become
+// active. Registration usually takes a few seconds.
+const registrationPollInterval = time.Second
+
+// RegisterConsumer registers an enhanced fan-out consumer named name with the stream identified by
+// streamARN, waits until it is active, and returns its ARN, which is needed to subscribe to shards.
+// If a consumer with that name is already registered with the stream, its ARN is returned instead.
+func RegisterConsumer(client Client, streamARN, name string) (string, error) {
+	return registerConsumer(client, streamARN, name, registrationPollInterval)
+}
+
+func registerConsumer(client Client, streamARN, name string, pollInterval time.Duration) (string, error) {
+	res, err := client.RegisterStreamConsumer(&kinesis.RegisterStreamConsumerInput{
+		StreamARN:    aws.String(streamARN),
+		ConsumerName: aws.String(name),
+	})
+
+	var consumerARN string
+	if err == nil {
+		consumerARN = aws.StringValue(res.Consumer.ConsumerARN)
+		if aws.StringValue(res.Consumer.ConsumerStatus) == kinesis.ConsumerStatusActive {
+			return consumerARN, nil
+		}
+	} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != kinesis.ErrCodeResourceInUseException {
+		return "", err
+	}
+
+	for {
+		input := &kinesis.DescribeStreamConsumerInput{ConsumerARN: aws.String(consumerARN)}
+		if consumerARN == "" {
+			// The consumer was already registered so we have to look it up by name
+			input = &kinesis.DescribeStreamConsumerInput{
+				StreamARN:    aws.String(streamARN),
+				ConsumerName: aws.String(name),
+			}
+		}
+
+		res, err := client.DescribeStreamConsumer(input)
+		if err != nil {
+			return "", err
+		}
+
+		consumerARN = aws.StringValue(res.ConsumerDescription.ConsumerARN)
+		if aws.StringValue(res.ConsumerDescription.ConsumerStatus) == kinesis.ConsumerStatusActive {
+			return consumerARN, nil
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,96 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type mockClient struct {
+	registerErr error
+	statuses    []string
+	describes   []*kinesis.DescribeStreamConsumerInput
+}
+
+func (m *mockClient) RegisterStreamConsumer(input *kinesis.RegisterStreamConsumerInput) (*kinesis.RegisterStreamConsumerOutput, error) {
+	if m.registerErr != nil {
+		return nil, m.registerErr
+	}
+	return &kinesis.RegisterStreamConsumerOutput{
+		Consumer: &kinesis.Consumer{
+			ConsumerARN:    aws.String("arn:consumer"),
+			ConsumerName:   input.ConsumerName,
+			ConsumerStatus: aws.String(kinesis.ConsumerStatusCreating),
+		},
+	}, nil
+}
+
+func (m *mockClient) DescribeStreamConsumer(input *kinesis.DescribeStreamConsumerInput) (*kinesis.DescribeStreamConsumerOutput, error) {
+	m.describes = append(m.describes, input)
+	status := m.statuses[0]
+	m.statuses = m.statuses[1:]
+	return &kinesis.DescribeStreamConsumerOutput{
+		ConsumerDescription: &kinesis.ConsumerDescription{
+			ConsumerARN:    aws.String("arn:consumer"),
+			ConsumerStatus: aws.String(status),
+		},
+	}, nil
+}
+
+func (m *mockClient) SubscribeToShardWithContext(aws.Context, *kinesis.SubscribeToShardInput, ...request.Option) (*kinesis.SubscribeToShardOutput, error) {
+	panic("not implemented")
+}
+
+func TestRegisterConsumerWaitsUntilActive(t *testing.T) {
+	t.Parallel()
+
+	c := &mockClient{statuses: []string{kinesis.ConsumerStatusCreating, kinesis.ConsumerStatusActive}}
+	arn, err := registerConsumer(c, "arn:stream", "foo", 0)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if arn != "arn:consumer" {
+		t.Errorf("%v != arn:consumer", arn)
+	}
+	if len(c.describes) != 2 {
+		t.Errorf("%v != 2", len(c.describes))
+	}
+	if aws.StringValue(c.describes[0].ConsumerARN) != "arn:consumer" {
+		t.Errorf("%v != arn:consumer", aws.StringValue(c.describes[0].ConsumerARN))
+	}
+}
+
+func TestRegisterConsumerAlreadyRegistered(t *testing.T) {
+	t.Parallel()
+
+	c := &mockClient{
+		registerErr: awserr.New(kinesis.ErrCodeResourceInUseException, "already exists", nil),
+		statuses:    []string{kinesis.ConsumerStatusActive},
+	}
+	arn, err := registerConsumer(c, "arn:stream", "foo", 0)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if arn != "arn:consumer" {
+		t.Errorf("%v != arn:consumer", arn)
+	}
+	if aws.StringValue(c.describes[0].ConsumerName) != "foo" {
+		t.Errorf("%v != foo", aws.StringValue(c.describes[0].ConsumerName))
+	}
+	if aws.StringValue(c.describes[0].StreamARN) != "arn:stream" {
+		t.Errorf("%v != arn:stream", aws.StringValue(c.describes[0].StreamARN))
+	}
+}
+
+func TestRegisterConsumerError(t *testing.T) {
+	t.Parallel()
+
+	c := &mockClient{registerErr: awserr.New(kinesis.ErrCodeLimitExceededException, "too many", nil)}
+	_, err := registerConsumer(c, "arn:stream", "foo", 0)
+	if err != c.registerErr {
+		t.Errorf("%v != %v", err, c.registerErr)
+	}
+}
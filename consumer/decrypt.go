@@ -0,0 +1,44 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Decrypter decrypts the data of records written by a batchproducer.Producer whose
+// Config.Encrypter encrypted it. It must be the inverse of that Encrypter.
+type Decrypter func(ciphertext []byte) (plaintext []byte, err error)
+
+// Decrypt receives records from in, e.g. those sent by Reader.Read, replaces the data of each with
+// its plaintext, and sends it to out, blocking until it is received. It returns nil once in is
+// closed, ctx.Err() if ctx is done, or an error if a record can’t be decrypted, in which case that
+// record isn’t sent.
+func (d Decrypter) Decrypt(ctx context.Context, in <-chan *kinesis.Record, out chan<- *kinesis.Record) error {
+	for {
+		var record *kinesis.Record
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-in:
+			if !ok {
+				return nil
+			}
+			record = r
+		}
+
+		plaintext, err := d(record.Data)
+		if err != nil {
+			return fmt.Errorf("could not decrypt record %v: %v", aws.StringValue(record.SequenceNumber), err)
+		}
+		record.Data = plaintext
+
+		select {
+		case out <- record:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package consumer
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// newAESGCM returns an encrypter and a matching Decrypter using AES-GCM with a random key, standing
+// in for a data key from KMS. The nonce is prepended to the ciphertext.
+func newAESGCM(t *testing.T) (func([]byte) ([]byte, error), Decrypter) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	encrypt := func(plaintext []byte) ([]byte, error) {
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	}
+	decrypt := func(ciphertext []byte) ([]byte, error) {
+		if len(ciphertext) < gcm.NonceSize() {
+			return nil, errors.New("ciphertext is too short")
+		}
+		nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+		return gcm.Open(nil, nonce, sealed, nil)
+	}
+	return encrypt, decrypt
+}
+
+func TestDecrypt(t *testing.T) {
+	t.Parallel()
+	encrypt, decrypt := newAESGCM(t)
+
+	in := make(chan *kinesis.Record, 2)
+	for i, data := range []string{"foo", "bar"} {
+		ciphertext, err := encrypt([]byte(data))
+		if err != nil {
+			t.Fatalf("%v != nil", err)
+		}
+		in <- &kinesis.Record{Data: ciphertext, SequenceNumber: aws.String(string(rune('1' + i)))}
+	}
+	close(in)
+
+	out := make(chan *kinesis.Record, 2)
+	if err := decrypt.Decrypt(context.Background(), in, out); err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	for _, expected := range []string{"foo", "bar"} {
+		if r := <-out; string(r.Data) != expected {
+			t.Errorf("%q != %v", r.Data, expected)
+		}
+	}
+}
+
+func TestDecryptFails(t *testing.T) {
+	t.Parallel()
+	_, decrypt := newAESGCM(t)
+
+	in := make(chan *kinesis.Record, 1)
+	in <- &kinesis.Record{Data: []byte("not encrypted at all"), SequenceNumber: aws.String("1")}
+	out := make(chan *kinesis.Record, 1)
+	if err := decrypt.Decrypt(context.Background(), in, out); err == nil {
+		t.Error("err == nil")
+	}
+	if len(out) != 0 {
+		t.Errorf("%v != 0", len(out))
+	}
+}
@@ -0,0 +1,110 @@
+package consumer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Reader reads the records of a single shard using an enhanced fan-out consumer.
+type Reader struct {
+	consumerARN string
+	shardID     string
+
+	// subscribe is a seam for tests; by default it calls SubscribeToShardWithContext on the client.
+	subscribe func(ctx context.Context, input *kinesis.SubscribeToShardInput) (eventStream, error)
+}
+
+// eventStream is the subset of *kinesis.SubscribeToShardEventStream used by a Reader.
+type eventStream interface {
+	Events() <-chan kinesis.SubscribeToShardEventStreamEvent
+	Close() error
+	Err() error
+}
+
+// NewReader returns a Reader for the shard shardID, using the consumer identified by consumerARN,
+// which you can get from RegisterConsumer.
+func NewReader(client Client, consumerARN, shardID string) *Reader {
+	return &Reader{
+		consumerARN: consumerARN,
+		shardID:     shardID,
+		subscribe: func(ctx context.Context, input *kinesis.SubscribeToShardInput) (eventStream, error) {
+			res, err := client.SubscribeToShardWithContext(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			return res.GetStream(), nil
+		},
+	}
+}
+
+// Read subscribes to the shard starting at position and sends each record it receives to records,
+// blocking until the record is received. A subscription only lasts for 5 minutes, so when one
+// expires Read resubscribes from just after the last record it received. Read returns nil once
+// the end of a closed shard (for example one that has been split or merged) has been reached,
+// ctx.Err() if ctx is done, or the error that ended a subscription. In the last case you can call
+// Read again, starting after the SequenceNumber of the last record received, to carry on.
+func (r *Reader) Read(ctx context.Context, position *kinesis.StartingPosition, records chan<- *kinesis.Record) error {
+	for {
+		continuation, err := r.readSubscription(ctx, position, records)
+		if err != nil {
+			return err
+		}
+		if continuation == nil {
+			return nil
+		}
+		if *continuation != "" {
+			position = &kinesis.StartingPosition{
+				Type:           aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+				SequenceNumber: continuation,
+			}
+		}
+	}
+}
+
+// readSubscription reads from a single subscription until it ends. It returns the continuation
+// sequence number of the last event received, which is nil if the shard has ended and empty if no
+// events were received at all.
+func (r *Reader) readSubscription(ctx context.Context, position *kinesis.StartingPosition, records chan<- *kinesis.Record) (*string, error) {
+	stream, err := r.subscribe(ctx, &kinesis.SubscribeToShardInput{
+		ConsumerARN:      aws.String(r.consumerARN),
+		ShardId:          aws.String(r.shardID),
+		StartingPosition: position,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	continuation := aws.String("")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case event, ok := <-stream.Events():
+			if !ok {
+				return continuation, stream.Err()
+			}
+
+			e, ok := event.(*kinesis.SubscribeToShardEvent)
+			if !ok {
+				continue
+			}
+
+			for _, record := range e.Records {
+				select {
+				case records <- record:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+
+			continuation = e.ContinuationSequenceNumber
+			if continuation == nil {
+				// The shard is closed and we’ve read all of it
+				return nil, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type fakeStream struct {
+	events chan kinesis.SubscribeToShardEventStreamEvent
+	err    error
+}
+
+func newFakeStream(err error, events ...*kinesis.SubscribeToShardEvent) *fakeStream {
+	s := &fakeStream{events: make(chan kinesis.SubscribeToShardEventStreamEvent, len(events)), err: err}
+	for _, e := range events {
+		s.events <- e
+	}
+	close(s.events)
+	return s
+}
+
+func (s *fakeStream) Events() <-chan kinesis.SubscribeToShardEventStreamEvent { return s.events }
+func (s *fakeStream) Close() error                                            { return nil }
+func (s *fakeStream) Err() error                                              { return s.err }
+
+func newTestReader(streams ...*fakeStream) (*Reader, *[]*kinesis.SubscribeToShardInput) {
+	var inputs []*kinesis.SubscribeToShardInput
+	r := NewReader(nil, "arn:consumer", "shardId-0")
+	r.subscribe = func(ctx context.Context, input *kinesis.SubscribeToShardInput) (eventStream, error) {
+		inputs = append(inputs, input)
+		s := streams[0]
+		streams = streams[1:]
+		return s, nil
+	}
+	return r, &inputs
+}
+
+func event(continuation *string, sequenceNumbers ...string) *kinesis.SubscribeToShardEvent {
+	e := &kinesis.SubscribeToShardEvent{ContinuationSequenceNumber: continuation}
+	for _, sn := range sequenceNumbers {
+		e.Records = append(e.Records, &kinesis.Record{SequenceNumber: aws.String(sn)})
+	}
+	return e
+}
+
+func TestReadResubscribesWhenSubscriptionExpires(t *testing.T) {
+	t.Parallel()
+
+	r, inputs := newTestReader(
+		newFakeStream(nil, event(aws.String("2"), "1", "2")),
+		newFakeStream(nil, event(aws.String("3"), "3"), event(nil)),
+	)
+
+	records := make(chan *kinesis.Record, 10)
+	position := &kinesis.StartingPosition{Type: aws.String(kinesis.ShardIteratorTypeTrimHorizon)}
+	err := r.Read(context.Background(), position, records)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	if len(records) != 3 {
+		t.Errorf("%v != 3", len(records))
+	}
+	if len(*inputs) != 2 {
+		t.Fatalf("%v != 2", len(*inputs))
+	}
+	if (*inputs)[0].StartingPosition != position {
+		t.Errorf("%v != %v", (*inputs)[0].StartingPosition, position)
+	}
+	second := (*inputs)[1].StartingPosition
+	if aws.StringValue(second.Type) != kinesis.ShardIteratorTypeAfterSequenceNumber {
+		t.Errorf("%v != %v", aws.StringValue(second.Type), kinesis.ShardIteratorTypeAfterSequenceNumber)
+	}
+	if aws.StringValue(second.SequenceNumber) != "2" {
+		t.Errorf("%v != 2", aws.StringValue(second.SequenceNumber))
+	}
+}
+
+func TestReadReturnsStreamError(t *testing.T) {
+	t.Parallel()
+
+	streamErr := errors.New("connection reset")
+	r, _ := newTestReader(newFakeStream(streamErr, event(aws.String("1"), "1")))
+
+	records := make(chan *kinesis.Record, 10)
+	err := r.Read(context.Background(), nil, records)
+	if err != streamErr {
+		t.Errorf("%v != %v", err, streamErr)
+	}
+	if len(records) != 1 {
+		t.Errorf("%v != 1", len(records))
+	}
+}
+
+func TestReadStopsWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	r, _ := newTestReader(newFakeStream(nil, event(aws.String("1"), "1")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nobody is receiving from records, so Read can only return because ctx is done
+	err := r.Read(ctx, nil, make(chan *kinesis.Record))
+	if err != context.Canceled {
+		t.Errorf("%v != %v", err, context.Canceled)
+	}
+}
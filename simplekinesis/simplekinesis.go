@@ -1,20 +1,123 @@
 package simplekinesis
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
+// Options configures the client created by NewWithOptions. Only Region is required.
+type Options struct {
+	Region string
+
+	// Endpoint, if set, is used for Kinesis instead of the standard AWS endpoint for Region. This
+	// is useful for testing against a local server such as LocalStack or kinesalite.
+	Endpoint string
+
+	// DisableSSL makes the client use HTTP rather than HTTPS, which local servers often require.
+	DisableSSL bool
+
+	// StaticCredentials, if set, are used instead of the default AWS credentials chain.
+	StaticCredentials *StaticCredentials
+
+	// MaxRetries is the maximum number of times the SDK will retry a failed request. If nil, the
+	// SDK’s default is used.
+	MaxRetries *int
+
+	// UserAgentSuffix, if set, is appended to the User-Agent of every request, so that requests
+	// made by this client can be told apart from other traffic in e.g. CloudTrail.
+	UserAgentSuffix string
+}
+
+// StaticCredentials are fixed AWS credentials. SessionToken is only needed for temporary
+// credentials.
+type StaticCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
 func New(region string) *kinesis.Kinesis {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
-	return kinesis.New(sess)
+	return must(NewWithOptions(Options{Region: region}))
 }
 
 func NewWithEndpoint(region, endpoint string) *kinesis.Kinesis {
+	return must(NewWithOptions(Options{Region: region, Endpoint: endpoint}))
+}
+
+// NewForStreamARN creates a Kinesis client for the region of the stream whose ARN is streamARN,
+// e.g. arn:aws:kinesis:eu-west-1:123456789012:stream/foo, so that a stream in another region can be
+// written to, e.g. with batchproducer.Config.StreamARN, knowing only its ARN. It returns an error
+// if streamARN isn’t the ARN of a Kinesis stream.
+func NewForStreamARN(streamARN string) (*kinesis.Kinesis, error) {
+	region, err := regionOfStreamARN(streamARN)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithOptions(Options{Region: region})
+}
+
+// regionOfStreamARN returns the region of the stream whose ARN is streamARN.
+func regionOfStreamARN(streamARN string) (string, error) {
+	parsed, err := arn.Parse(streamARN)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream ARN %q: %v", streamARN, err)
+	}
+	if parsed.Service != "kinesis" {
+		return "", fmt.Errorf("invalid stream ARN %q: service is %q rather than kinesis", streamARN, parsed.Service)
+	}
+	if parsed.Region == "" {
+		return "", fmt.Errorf("invalid stream ARN %q: no region", streamARN)
+	}
+	if !strings.HasPrefix(parsed.Resource, "stream/") || parsed.Resource == "stream/" {
+		return "", fmt.Errorf("invalid stream ARN %q: resource is %q rather than stream/<name>", streamARN, parsed.Resource)
+	}
+	return parsed.Region, nil
+}
+
+// NewWithOptions creates a Kinesis client configured by opts, without the need to build a
+// session.Session by hand.
+func NewWithOptions(opts Options) (*kinesis.Kinesis, error) {
+	config := &aws.Config{
+		Region: aws.String(opts.Region),
+	}
+	if opts.Endpoint != "" {
+		config.EndpointResolver = endpointResolver(opts.Endpoint)
+	}
+	if opts.DisableSSL {
+		config.DisableSSL = aws.Bool(true)
+	}
+	if opts.StaticCredentials != nil {
+		config.Credentials = credentials.NewStaticCredentials(
+			opts.StaticCredentials.AccessKeyID,
+			opts.StaticCredentials.SecretAccessKey,
+			opts.StaticCredentials.SessionToken,
+		)
+	}
+	if opts.MaxRetries != nil {
+		config.MaxRetries = aws.Int(*opts.MaxRetries)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	if opts.UserAgentSuffix != "" {
+		sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(opts.UserAgentSuffix))
+	}
+	return kinesis.New(sess), nil
+}
+
+// endpointResolver returns a resolver that uses endpoint for Kinesis and the default endpoints for
+// all other services.
+func endpointResolver(endpoint string) endpoints.ResolverFunc {
 	customResolver := func(service, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
 		if service == endpoints.KinesisServiceID {
 			return endpoints.ResolvedEndpoint{
@@ -25,9 +128,12 @@ func NewWithEndpoint(region, endpoint string) *kinesis.Kinesis {
 
 		return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
 	}
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region:           aws.String(region),
-		EndpointResolver: endpoints.ResolverFunc(customResolver),
-	}))
-	return kinesis.New(sess)
+	return endpoints.ResolverFunc(customResolver)
+}
+
+func must(client *kinesis.Kinesis, err error) *kinesis.Kinesis {
+	if err != nil {
+		panic(err)
+	}
+	return client
 }
@@ -0,0 +1,51 @@
+package simplekinesis
+
+import "testing"
+
+func TestRegionOfStreamARN(t *testing.T) {
+	t.Parallel()
+	region, err := regionOfStreamARN("arn:aws:kinesis:eu-west-1:123456789012:stream/foo")
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if region != "eu-west-1" {
+		t.Errorf("%v != eu-west-1", region)
+	}
+
+	// Other partitions work too
+	region, err = regionOfStreamARN("arn:aws-cn:kinesis:cn-north-1:123456789012:stream/foo")
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if region != "cn-north-1" {
+		t.Errorf("%v != cn-north-1", region)
+	}
+}
+
+func TestRegionOfStreamARNMalformed(t *testing.T) {
+	t.Parallel()
+	for _, streamARN := range []string{
+		"",
+		"foo",
+		"stream/foo",
+		"arn:aws:kinesis:eu-west-1",
+		"arn:aws:kinesis::123456789012:stream/foo",
+		"arn:aws:firehose:eu-west-1:123456789012:deliverystream/foo",
+		"arn:aws:kinesis:eu-west-1:123456789012:foo",
+		"arn:aws:kinesis:eu-west-1:123456789012:stream/",
+	} {
+		if region, err := regionOfStreamARN(streamARN); err == nil {
+			t.Errorf("%q: %v, nil != \"\", error", streamARN, region)
+		}
+	}
+}
+
+func TestNewForStreamARN(t *testing.T) {
+	t.Parallel()
+	if _, err := NewForStreamARN("arn:aws:kinesis:eu-west-1:123456789012:stream/foo"); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if _, err := NewForStreamARN("not an ARN"); err == nil {
+		t.Error("err == nil")
+	}
+}